@@ -27,7 +27,6 @@ import (
 	"io"
 	"net"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -60,6 +59,11 @@ type Archiver struct {
 	coalescer            *TransactionCoalescer
 	sshscs               *SSHConfigServer
 	enforceKeys          bool
+	retention            []*RetentionPolicy
+	fetchParallelism     int
+	history              *historyRecorder
+	schemas              []*TagSchema
+	flaggedcounter       *counter
 }
 
 // Creates a new Archiver instance:
@@ -85,6 +89,26 @@ func NewArchiver(c *Config) (a *Archiver) {
 	logging.SetBackend(logBackendLeveled)
 	logging.SetFormatter(logging.MustStringFormatter(format))
 
+	// Configure the capacity and expiry of the metadata store's caches
+	caches := make(map[string]CacheConfig)
+	for name, cache := range c.Cache {
+		var cc CacheConfig
+		if cache.Capacity != nil {
+			cc.Capacity = *cache.Capacity
+		}
+		if cache.TTL != nil {
+			ttl, err := parseIntoDuration(*cache.TTL)
+			if err != nil {
+				log.Fatal("Invalid TTL ", *cache.TTL, " for cache ", name, " (", err, ")")
+			}
+			cc.TTL = ttl
+		}
+		if cc.Capacity < 0 || cc.TTL < 0 {
+			log.Fatal("Capacity and TTL of cache ", name, " cannot be negative")
+		}
+		caches[name] = cc
+	}
+
 	// Configure Metadata store (+ object store)
 	var store MetadataStore
 	var manager APIKeyManager
@@ -96,12 +120,32 @@ func NewArchiver(c *Config) (a *Archiver) {
 		if err != nil {
 			log.Fatal("Error parsing Mongo address: %v", err)
 		}
-		mongostore := NewMongoStore(mongoaddr, *c.Mongo.UpdateInterval)
+		mongostore := NewMongoStore(mongoaddr, *c.Mongo.UpdateInterval, caches)
 		if mongostore == nil {
 			log.Fatal("Error connection to MongoDB instance")
 		}
 		store = mongostore
 		manager = mongostore
+		/** keep metadata in process, optionally saved to a local file */
+	case "embedded":
+		path := ""
+		if c.EmbeddedStore.Path != nil {
+			path = *c.EmbeddedStore.Path
+		}
+		embeddedstore := NewEmbeddedStore(path)
+		if embeddedstore == nil {
+			log.Fatal("Error opening embedded metadata store")
+		}
+		store = embeddedstore
+		manager = embeddedstore
+		/** metadata in PostgreSQL (or another database with a SQL dialect) */
+	case "sql":
+		sqlstore := NewSQLStore(*c.SQL.Driver, *c.SQL.DataSource)
+		if sqlstore == nil {
+			log.Fatal("Error connecting to SQL metadata store")
+		}
+		store = sqlstore
+		manager = sqlstore
 	case "venkman":
 		log.Fatal("No support for venkman yet")
 	default:
@@ -113,21 +157,46 @@ func NewArchiver(c *Config) (a *Archiver) {
 
 	// Configure Timeseries database
 	var tsdb TSDB
+	var keepAlive time.Duration
+	if c.Archiver.Keepalive != nil {
+		keepAlive = time.Duration(*c.Archiver.Keepalive) * time.Second
+	}
 	switch *c.Archiver.TSDB {
 	/** connect to ReadingDB */
 	case "readingdb":
-		log.Fatal("No current support for ReadingDB")
+		rdbaddr, err := net.ResolveTCPAddr("tcp4", *c.ReadingDB.Address+":"+*c.ReadingDB.Port)
+		if err != nil {
+			log.Fatal("Error parsing ReadingDB address: %v", err)
+		}
+		tsdb = NewReadingDB(rdbaddr, *c.Archiver.MaxConnections, keepAlive)
+		tsdb.AddStore(store)
 		/** connect to Quasar */
 	case "quasar":
 		qsraddr, err := net.ResolveTCPAddr("tcp4", *c.Quasar.Address+":"+*c.Quasar.Port)
 		if err != nil {
 			log.Fatal("Error parsing Quasar address: %v", err)
 		}
-		tsdb = NewQuasarDB(qsraddr, *c.Archiver.MaxConnections)
+		tsdb = NewQuasarDB(qsraddr, *c.Archiver.MaxConnections, keepAlive)
 		tsdb.AddStore(store)
 		if tsdb == nil {
 			log.Fatal("Error connecting to Quasar instance")
 		}
+		/** store in segment files on local disk */
+	case "file":
+		segmentSize := DEFAULT_SEGMENT_SIZE
+		if c.FileDB.SegmentSize != nil {
+			segmentSize = *c.FileDB.SegmentSize
+		}
+		filedb := NewFileDB(*c.FileDB.Path, segmentSize)
+		if filedb == nil {
+			log.Fatal("Error opening file timeseries database")
+		}
+		tsdb = filedb
+		tsdb.AddStore(store)
+		/** keep everything in process memory */
+	case "memory":
+		tsdb = NewMemoryDB()
+		tsdb.AddStore(store)
 	default:
 		log.Fatal(c.Archiver.TSDB, " is not a valid timeseries database")
 	}
@@ -147,10 +216,93 @@ func NewArchiver(c *Config) (a *Archiver) {
 		}
 		objstore = mongostore
 		objstore.AddStore(store)
+		/** content-addressed blobs on local disk */
+	case "file":
+		fileobjstore := NewFileObjectStore(*c.FileObjectStore.Path)
+		if fileobjstore == nil {
+			log.Fatal("Error opening file object store")
+		}
+		objstore = fileobjstore
+		objstore.AddStore(store)
 	default:
 		log.Fatal(*c.Archiver.Objects, " is not a recognized object store")
 	}
 
+	// Configure write-ahead log for buffered readings
+	var wal *WriteAheadLog
+	if c.WAL.Path != nil && *c.WAL.Path != "" {
+		segmentSize := DEFAULT_WAL_SEGMENT_SIZE
+		if c.WAL.SegmentSize != nil {
+			segmentSize = *c.WAL.SegmentSize
+		}
+		wal = NewWriteAheadLog(*c.WAL.Path, int64(segmentSize), c.WAL.Sync)
+		if wal == nil {
+			log.Fatal("Error opening write-ahead log")
+		}
+	}
+
+	// Configure retention policies
+	var retention []*RetentionPolicy
+	for name, rule := range c.Retention {
+		if rule.Where == nil || rule.KeepRaw == nil {
+			log.Fatal("Retention policy ", name, " needs a Where clause and KeepRaw")
+		}
+		rollup, function := "", ""
+		if rule.Rollup != nil {
+			rollup = *rule.Rollup
+		}
+		if rule.Function != nil {
+			function = *rule.Function
+		}
+		rp, err := NewRetentionPolicy(name, *rule.Where, *rule.KeepRaw, rollup, function)
+		if err != nil {
+			log.Fatal(err)
+		}
+		retention = append(retention, rp)
+	}
+
+	// Configure tag schemas
+	var schemas []*TagSchema
+	for name, schema := range c.Schema {
+		if schema.Tag == nil {
+			log.Fatal("Schema ", name, " needs a Tag")
+		}
+		kind, action := "", ""
+		if schema.Type != nil {
+			kind = *schema.Type
+		}
+		if schema.Action != nil {
+			action = *schema.Action
+		}
+		ts, err := NewTagSchema(name, *schema.Tag, kind, schema.Values, schema.Closed, action)
+		if err != nil {
+			log.Fatal(err)
+		}
+		schemas = append(schemas, ts)
+	}
+
+	// Configure the ingest budget
+	maxPending := DEFAULT_MAX_PENDING_WRITES
+	if c.Archiver.MaxPendingWrites != nil {
+		maxPending = *c.Archiver.MaxPendingWrites
+	}
+	if maxPending < 0 {
+		log.Fatal("MaxPendingWrites cannot be negative")
+	}
+	coalescer := NewTransactionCoalescer(&tsdb, &store, wal, uint64(maxPending))
+
+	// Configure how many streams a data query fetches at once
+	fetchParallelism := DEFAULT_FETCH_PARALLELISM
+	if c.Archiver.FetchParallelism != nil {
+		fetchParallelism = *c.Archiver.FetchParallelism
+	}
+
+	// Keep the history of metadata changes if the metadata store can
+	var history *historyRecorder
+	if mh, ok := store.(MetadataHistory); ok {
+		history = newHistoryRecorder(store, manager, mh)
+	}
+
 	// Configure SSH server
 	var sshscs *SSHConfigServer
 	if c.SSH.Enabled {
@@ -165,10 +317,15 @@ func NewArchiver(c *Config) (a *Archiver) {
 		objstore:             objstore,
 		manager:              manager,
 		incomingcounter:      newCounter(),
-		pendingwritescounter: newCounter(),
-		coalescer:            NewTransactionCoalescer(&tsdb, &store),
+		pendingwritescounter: coalescer.pending,
+		coalescer:            coalescer,
 		sshscs:               sshscs,
-		enforceKeys:          c.Archiver.EnforceKeys}
+		enforceKeys:          c.Archiver.EnforceKeys,
+		retention:            retention,
+		fetchParallelism:     fetchParallelism,
+		history:              history,
+		schemas:              schemas,
+		flaggedcounter:       newCounter()}
 
 	// Configure query processor
 	qp := NewQueryProcessor(a)
@@ -178,6 +335,18 @@ func NewArchiver(c *Config) (a *Archiver) {
 	republisher := NewRepublisher(a)
 	a.republisher = republisher
 	a.republisher2 = NewRepublisher(a)
+
+	// Roll up and remove old data in the background
+	if len(retention) > 0 {
+		interval := 3600
+		if c.Archiver.RetentionInterval != nil {
+			interval = *c.Archiver.RetentionInterval
+		}
+		for _, rp := range retention {
+			log.Notice("Applying retention policy %v every %v seconds", rp, interval)
+		}
+		go periodicCall(time.Duration(interval)*time.Second, a.applyRetention)
+	}
 	return
 }
 
@@ -185,7 +354,9 @@ func NewArchiver(c *Config) (a *Archiver) {
 // the underlying databases. First, checks that write permission is granted with the accompanied
 // apikey (generated with the gilescmd CLI tool), then saves the metadata, pushes the readings
 // out to any concerned republish clients, and commits the reading to the timeseries database.
-// Returns an error, which is nil if all went well
+// Returns an error, which is nil if all went well, a SchemaViolations if the tags do not follow
+// the configured schemas, and ErrOverloaded if too many readings are still waiting to be written
+// to the timeseries database
 func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) error {
 	var (
 		//pathMdErr error
@@ -202,10 +373,32 @@ func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) erro
 		}
 	}
 
+	if err := a.checkMessageSchemas(readings); err != nil {
+		return err
+	}
+
+	// reserve room for all of the readings before doing any work for them, so
+	// that if the timeseries database is falling behind the batch is refused
+	// as a whole and none of it is saved or republished
+	var reserved uint64
+	for _, msg := range readings {
+		reserved += uint64(len(msg.Readings))
+	}
+	if err := a.coalescer.ReserveReadings(reserved); err != nil {
+		return err
+	}
+	// whatever does not make it to the coalescer
+	defer func() {
+		a.coalescer.ReleaseReadings(reserved)
+	}()
+
 	tsMdErr = a.store.SaveTags(&readings)
 	if tsMdErr != nil {
 		return tsMdErr
 	}
+	if err := a.history.recordMessages(readings, apikey); err != nil {
+		log.Error("Error recording metadata history: %v", err)
+	}
 
 	// if any of these are NOT nil, then we signal the republisher
 	// that some metadata may have changed
@@ -222,8 +415,11 @@ func (a *Archiver) AddData(readings map[string]*SmapMessage, apikey string) erro
 			if err != nil {
 				return err
 			}
-		} else {
-			a.coalescer.AddSmapMessage(msg)
+			continue
+		}
+		reserved -= uint64(len(msg.Readings))
+		if err := a.coalescer.AddReservedSmapMessage(msg); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -249,17 +445,37 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 		return res, fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", lex.error.Error(), querystring, lex.lasttoken)
 	}
 	log.Debug("query %v", lex.query)
+	if lex.query.explain {
+		return a.Explain(lex)
+	}
 	switch lex.query.qtype {
 	case SELECT_TYPE:
+		if lex.query.count || lex.query.groupBy != "" {
+			res, err = selectGroups(lex.query, func(target bson.M) ([]interface{}, error) {
+				if !lex.query.asof.IsZero() {
+					return a.GetTagsAsOf(target, false, "", lex.query.where, Page{}, lex.query.asof)
+				}
+				return a.store.GetTags(target, false, "", lex.query.where, Page{})
+			})
+			if err != nil {
+				return res, err
+			}
+			break
+		}
 		target := lex.query.ContentsBson()
+		distinctKey := ""
 		if lex.query.distinct {
 			if len(target) != 1 {
 				return res, fmt.Errorf("Distinct query can only use one tag\n")
 			}
-			res, err = a.store.GetTags(target, true, lex.query.Contents[0], lex.query.WhereBson())
-		} else {
-			res, err = a.store.GetTags(target, false, "", lex.query.WhereBson())
+			distinctKey = lex.query.Contents[0]
 		}
+		res, err = selectPage(lex.query, func(page Page) ([]interface{}, error) {
+			if !lex.query.asof.IsZero() {
+				return a.GetTagsAsOf(target, lex.query.distinct, distinctKey, lex.query.where, page, lex.query.asof)
+			}
+			return a.store.GetTags(target, lex.query.distinct, distinctKey, lex.query.where, page)
+		})
 
 		if err != nil {
 			return res, err
@@ -268,10 +484,32 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 		var (
 			err error
 		)
+		if lex.query.data != nil { // DeleteData
+			dq := lex.query.data
+			uuids, err := a.GetUUIDs(lex.query.where)
+			if err != nil {
+				return res, err
+			}
+			start := uint64(dq.start.UnixNano())
+			end := uint64(dq.end.UnixNano())
+			if end < start {
+				start, end = end, start
+			}
+			res, err = a.DeleteData(uuids, start, end, UOT_NS, apikey)
+			log.Info("results %v", res)
+			if err != nil {
+				return res, err
+			}
+			break
+		}
 		if len(lex.query.Contents) > 0 { // RemoveTags
-			res, err = a.store.RemoveTags(lex.query.ContentsBson(), apikey, lex.query.WhereBson())
+			res, err = a.changeTags(HISTORY_REMOVE, apikey, lex.query.where, func() (bson.M, error) {
+				return a.store.RemoveTags(lex.query.ContentsBson(), apikey, lex.query.where)
+			})
 		} else { // RemoveDocs
-			res, err = a.store.RemoveDocs(apikey, lex.query.WhereBson())
+			res, err = a.changeTags(HISTORY_DELETE, apikey, lex.query.where, func() (bson.M, error) {
+				return a.store.RemoveDocs(apikey, lex.query.where)
+			})
 		}
 		a.republisher2.RepublishKeyChanges(lex.keys)
 		log.Info("results %v", res)
@@ -279,7 +517,12 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 			return res, err
 		}
 	case SET_TYPE:
-		res, err = a.store.UpdateTags(lex.query.SetBson(), apikey, lex.query.WhereBson())
+		if err = a.checkUpdateSchemas(lex.query.SetBson(), lex.query.where); err != nil {
+			return res, err
+		}
+		res, err = a.changeTags(HISTORY_SET, apikey, lex.query.where, func() (bson.M, error) {
+			return a.store.UpdateTags(lex.query.SetBson(), apikey, lex.query.where)
+		})
 		if err != nil {
 			return res, err
 		}
@@ -289,7 +532,7 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 		dq := lex.query.data
 
 		// fetch all possible UUIDs that match the query
-		uuids, err := a.GetUUIDs(lex.query.WhereBson())
+		uuids, err := a.GetUUIDs(lex.query.where)
 		if err != nil {
 			return res, err
 		}
@@ -316,6 +559,16 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 			log.Debug("Data after time %v", start)
 			res, err = a.NextData(uuids, start, int32(dq.limit.limit), UOT_NS, dq.timeconv)
 		}
+		if err = logStreamErrors(err); err != nil {
+			return res, err
+		}
+		if dq.fill != nil {
+			fn := newFillNode(dq)
+			fn.a = a
+			if res, err = fn.fillResponses(res.([]interface{})); err != nil {
+				return res, err
+			}
+		}
 		log.Debug("response %v uuids %v", res, uuids)
 	}
 	return res, nil
@@ -323,44 +576,93 @@ func (a *Archiver) HandleQuery(querystring, apikey string) (interface{}, error)
 
 func (a *Archiver) Query2(querystring string, apikey string, w io.Writer) error {
 	log.Info(querystring)
-	wherestring := strings.Split(querystring, "where")[1]
-	fmt.Printf(wherestring + "\n")
 	lex := a.qp.Parse(querystring)
 	if lex.error != nil {
 		return fmt.Errorf("Error (%v) in query \"%v\" (error at %v)\n", lex.error.Error(), querystring, lex.lasttoken)
 	}
 	log.Debug("query %v", lex.query)
+	if lex.query.explain {
+		return a.writeExplanation(lex, w)
+	}
 	// create root node from WHERE clause of tree
 	done := make(chan struct{})
+	nodes, err := a.buildGraph(lex.query, done)
+	if err != nil {
+		return err
+	}
+	wn, last := nodes[0], nodes[len(nodes)-1]
+	echoClient := NewEchoNode(done, w)
+	last.AddChild(echoClient)
+	wait := make(chan struct{})
+	nop := NewNopNode(done, wait)
+	echoClient.AddChild(nop)
+	wn.In <- struct{}{}
+	<-wait
+	return nil
+}
 
+// Builds the graph of nodes that evaluates the apply query @q: the where
+// clause, the selection of the data, the group by clause and the operators in
+// the order they are applied. Returns the connected nodes starting with the
+// where node, along with the nodes built so far if an operator is unknown or
+// cannot take the output of the node before it. Grouped min, max, mean and
+// count combine the readings of a group that have the same timestamp, so they
+// need a window or fill to line the streams up first
+func (a *Archiver) buildGraph(q *query, done chan struct{}) ([]*Node, error) {
 	// evalutes where clause
-	wn := NewWhereNode(done, lex.query.WhereBson(), a.store)
-
-	// add the selector node to the tree
-	sn := NewSelectDataNode(done, a, lex.query.data)
-	wn.AddChild(sn)
+	wn := NewWhereNode(done, q.where, a.store)
 
 	// run through the operators and build up the tree
 	var (
-		last    *Node = sn
-		newNode *Node
+		last      *Node
+		newNode   *Node
+		operators = q.operators
+		aligned   = q.data.fill != nil
 	)
-	for _, op := range lex.query.operators {
-		newNode = a.qp.GetNodeFromOp(op, lex.query)
+	if len(operators) > 0 && operators[0].Operator == "window" && q.data.dtype == IN_TYPE {
+		// the window node takes the uuids directly so that the timeseries
+		// database can compute the windows instead of returning all the data
+		last = a.qp.GetNodeFromOp(operators[0], q, done)
+		operators = operators[1:]
+		aligned = true
+	} else {
+		// add the selector node to the tree
+		last = NewSelectDataNode(done, a, q.data)
+	}
+	wn.AddChild(last)
+	nodes := []*Node{wn, last}
+	if q.data.fill != nil {
+		newNode = NewFillNode(done, q.data, a)
 		if !a.qp.CheckOutToIn(last, newNode) {
-			return fmt.Errorf("Node types do not match!")
+			return nodes, fmt.Errorf("Cannot fill the output of %v", nodeName(last))
 		}
 		last.AddChild(newNode)
 		last = newNode
+		nodes = append(nodes, last)
 	}
-	echoClient := NewEchoNode(done, w)
-	last.AddChild(echoClient)
-	wait := make(chan struct{})
-	nop := NewNopNode(done, wait)
-	echoClient.AddChild(nop)
-	wn.In <- struct{}{}
-	<-wait
-	return nil
+	if q.groupBy != "" {
+		newNode = NewGroupNode(done, q.groupBy, a.store)
+		last.AddChild(newNode)
+		last = newNode
+		nodes = append(nodes, last)
+	}
+
+	for _, op := range operators {
+		if _, found := opFuncChooser[op.Operator]; found && q.groupBy != "" && !aligned {
+			return nodes, fmt.Errorf("Grouped %v needs a window or fill to line up the streams first", op.Operator)
+		}
+		aligned = aligned || op.Operator == "window"
+		if newNode = a.qp.GetNodeFromOp(op, q, done); newNode == nil {
+			return nodes, fmt.Errorf("Unknown operator %v", op.Operator)
+		}
+		if !a.qp.CheckOutToIn(last, newNode) {
+			return nodes, fmt.Errorf("Node types do not match! %v outputs %v %v but %v takes %v %v", nodeName(last), last.Tags["out:structure"], last.Tags["out:datatype"], nodeName(newNode), newNode.Tags["in:structure"], newNode.Tags["in:datatype"])
+		}
+		last.AddChild(newNode)
+		last = newNode
+		nodes = append(nodes, last)
+	}
+	return nodes, nil
 }
 
 func (a *Archiver) StreamingQuery(querystring, apikey string, sendback Subscriber) error {
@@ -381,8 +683,13 @@ func (a *Archiver) StreamingQuery(querystring, apikey string, sendback Subscribe
 		last    *Node = sn
 		newNode *Node
 	)
+	if lex.query.groupBy != "" {
+		newNode = NewGroupNode(done, lex.query.groupBy, a.store)
+		last.AddChild(newNode)
+		last = newNode
+	}
 	for _, op := range lex.query.operators {
-		newNode = a.qp.GetNodeFromOp(op, lex.query)
+		newNode = a.qp.GetNodeFromOp(op, lex.query, done)
 		if !a.qp.CheckOutToIn(last, newNode) {
 			return fmt.Errorf("Node types do not match!")
 		}
@@ -415,47 +722,80 @@ func (a *Archiver) StreamingQuery(querystring, apikey string, sendback Subscribe
 // it needs (most of these will query the metadata store for the unit of time for the
 // data stream it is accessing)
 func (a *Archiver) GetData(streamids []string, start, end uint64, query_uot, to_uot UnitOfTime) (interface{}, error) {
-	var err error
-	ret := make([]interface{}, len(streamids))
+	return a.fetchStreams(streamids, to_uot, func(uuids []string) ([]SmapNumbersResponse, error) {
+		return a.tsdb.GetData(uuids, start, end, query_uot)
+	}, func(streamid string) (SmapObjectResponse, error) {
+		return a.objstore.GetObjects(streamid, start, end, query_uot)
+	})
+}
+
+// For each of the streamids, has the timeseries database summarize the data between start and end
+// (where start < end) into windows of the given size, all in units of query_uot. Object streams have no
+// statistics and get an empty response. Returns ErrStatisticsUnsupported if the timeseries database
+// cannot compute them, in which case the caller should use GetData and windowStatistics instead
+func (a *Archiver) GetStatistics(streamids []string, start, end, window uint64, query_uot, to_uot UnitOfTime) ([]StatisticalNumbersResponse, error) {
+	ret := make([]StatisticalNumbersResponse, len(streamids))
 	for idx, streamid := range streamids {
+		ret[idx].UUID = streamid
+		if a.store.GetStreamType(streamid) != NUMERIC_STREAM {
+			continue
+		}
+		res, err := a.tsdb.GetStatistics(streamids[idx:idx+1], start, end, window, query_uot)
+		if err != nil {
+			return ret, err
+		}
+		ret[idx] = res[0]
 		stream_uot := a.store.GetUnitOfTime(streamid)
+		for _, stat := range ret[idx].Readings {
+			stat.Time = convertTime(stat.Time, stream_uot, to_uot)
+		}
+	}
+	return ret, nil
+}
+
+// For each of the streamids, removes all data between start and end (where start < end) in units of
+// query_uot, from the timeseries database or the object store depending on the type of the stream.
+// Like MetadataStore.RemoveDocs, the key @apikey must be valid for all of the streams before anything
+// is removed
+func (a *Archiver) DeleteData(streamids []string, start, end uint64, query_uot UnitOfTime, apikey string) (bson.M, error) {
+	var res bson.M
+	messages := make(map[string]*SmapMessage, len(streamids))
+	for _, streamid := range streamids {
+		messages[streamid] = &SmapMessage{UUID: streamid}
+	}
+	ok, err := a.store.CheckKey(apikey, messages)
+	if err != nil {
+		log.Error("Error checking API key %v: %v", apikey, err)
+		return res, err
+	}
+	if !ok {
+		return res, errors.New("Unauthorized api key " + apikey)
+	}
+	var numeric []string
+	for _, streamid := range streamids {
 		if a.store.GetStreamType(streamid) == NUMERIC_STREAM {
-			res, _ := a.tsdb.GetData(streamids[idx:idx+1], start, end, query_uot)
-			ret[idx] = res[0]
-			for _, reading := range ret[idx].(SmapNumbersResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
-		} else {
-			ret[idx], _ = a.objstore.GetObjects(streamid, start, end, query_uot)
-			for _, reading := range ret[idx].(SmapObjectResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
+			numeric = append(numeric, streamid)
+		} else if err = a.objstore.DeleteObjects(streamid, start, end, query_uot); err != nil {
+			return res, err
+		}
+	}
+	if len(numeric) > 0 {
+		if err = a.tsdb.DeleteData(numeric, start, end, query_uot); err != nil {
+			return res, err
 		}
 	}
-	return ret, err
+	log.Info("Removed data from %v streams", len(streamids))
+	return bson.M{"Streams": len(streamids)}, nil
 }
 
 // For each of the streamids, fetches data before the start time. If limit is < 0, fetches all data.
 // If limit >= 0, fetches only that number of points. See Archiver.GetData for explanation of query_uot
 func (a *Archiver) PrevData(streamids []string, start uint64, limit int32, query_uot, to_uot UnitOfTime) (interface{}, error) {
-	var err error
-	ret := make([]interface{}, len(streamids))
-	for idx, streamid := range streamids {
-		stream_uot := a.store.GetUnitOfTime(streamid)
-		if a.store.GetStreamType(streamid) == NUMERIC_STREAM {
-			res, _ := a.tsdb.Prev(streamids[idx:idx+1], start, limit, query_uot)
-			ret[idx] = res[0]
-			for _, reading := range ret[idx].(SmapNumbersResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
-		} else {
-			ret[idx], _ = a.objstore.PrevObject(streamid, start, query_uot)
-			for _, reading := range ret[idx].(SmapObjectResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
-		}
-	}
-	return ret, err
+	return a.fetchStreams(streamids, to_uot, func(uuids []string) ([]SmapNumbersResponse, error) {
+		return a.tsdb.Prev(uuids, start, limit, query_uot)
+	}, func(streamid string) (SmapObjectResponse, error) {
+		return a.objstore.PrevObject(streamid, start, query_uot)
+	})
 }
 
 // How do we handle getting data from 2 databases where we don't know which database each UUID is in?
@@ -467,40 +807,26 @@ func (a *Archiver) PrevData(streamids []string, start uint64, limit int32, query
 // For each of the streamids, fetches data after the start time. If limit is < 0, fetches all data.
 // If limit >= 0, fetches only that number of points. See Archiver.GetData for explanation of query_uot
 func (a *Archiver) NextData(streamids []string, start uint64, limit int32, query_uot, to_uot UnitOfTime) (interface{}, error) {
-	var err error
-	ret := make([]interface{}, len(streamids))
-	for idx, streamid := range streamids {
-		stream_uot := a.store.GetUnitOfTime(streamid)
-		if a.store.GetStreamType(streamid) == NUMERIC_STREAM {
-			res, _ := a.tsdb.Next(streamids[idx:idx+1], start, limit, query_uot)
-			ret[idx] = res[0]
-			for _, reading := range ret[idx].(SmapNumbersResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
-		} else {
-			ret[idx], _ = a.objstore.NextObject(streamid, start, query_uot)
-			for _, reading := range ret[idx].(SmapObjectResponse).Readings {
-				reading.Time = convertTime(reading.Time, stream_uot, to_uot)
-			}
-		}
-	}
-	return ret, err
+	return a.fetchStreams(streamids, to_uot, func(uuids []string) ([]SmapNumbersResponse, error) {
+		return a.tsdb.Next(uuids, start, limit, query_uot)
+	}, func(streamid string) (SmapObjectResponse, error) {
+		return a.objstore.NextObject(streamid, start, query_uot)
+	})
 }
 
 // For all streams that match the provided where clause in where_tags, returns the values of the requested
-// tags. where_tags is a bson.M object that follows the same syntax as a MongoDB query. select_tags is
+// tags. where_tags is a Predicate as produced by the query parser. select_tags is
 // a map[string]int corresponding to which tags we wish returned. A value of 1 means the tag will be
 // returned (and ignores all other tags), and a value of 0 means the tag will NOT be returned (and all
 // other tags will be).
-func (a *Archiver) GetTags(select_tags, where_tags bson.M) ([]interface{}, error) {
-	return a.store.GetTags(select_tags, false, "", where_tags)
+func (a *Archiver) GetTags(select_tags bson.M, where_tags Predicate) ([]interface{}, error) {
+	return a.store.GetTags(select_tags, false, "", where_tags, Page{})
 }
 
-// Returns a list of UUIDs for all streams that match the provided 'where' clause. where_tags is a bson.M
-// object that follows the same syntax as a MongoDB query. This query is executed against the underlying
-// metadata store. As we move into supporting multiple possible metadata storage solutions, this interface
-// may change.
-func (a *Archiver) GetUUIDs(where_tags bson.M) ([]string, error) {
+// Returns a list of UUIDs for all streams that match the provided 'where' clause. where_tags is a Predicate
+// as produced by the query parser. This query is executed against the underlying metadata store, which
+// compiles it into whatever its backend understands.
+func (a *Archiver) GetUUIDs(where_tags Predicate) ([]string, error) {
 	return a.store.GetUUIDs(where_tags)
 }
 
@@ -534,8 +860,13 @@ func (a *Archiver) HandleMetadataSubscriber(s Subscriber, query, apikey string)
 
 // For all streams that match the provided where clause in where_tags, sets the key-value
 // pairs specified in update_tags.
-func (a *Archiver) SetTags(update_tags, where_tags map[string]interface{}, apikey string) (int, error) {
-	res, err := a.store.UpdateTags(update_tags, apikey, where_tags)
+func (a *Archiver) SetTags(update_tags map[string]interface{}, where_tags Predicate, apikey string) (int, error) {
+	if err := a.checkUpdateSchemas(update_tags, where_tags); err != nil {
+		return 0, err
+	}
+	res, err := a.changeTags(HISTORY_SET, apikey, where_tags, func() (bson.M, error) {
+		return a.store.UpdateTags(update_tags, apikey, where_tags)
+	})
 	return res["Updated"].(int), err
 }
 
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	UUID "github.com/pborman/uuid"
 	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 )
@@ -16,8 +19,8 @@ var SmapMsgPool1Path = &sync.Pool{
 	New: func() interface{} {
 		return map[string]*SmapMessage{
 			"/sensor1": &SmapMessage{
-				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+				Readings: []Reading{
+					&SmapNumberReading{Time: 100, Value: 1},
 				},
 				Metadata: bson.M{},
 			},
@@ -31,8 +34,8 @@ var SmapMsgPool10Path = &sync.Pool{
 		for i := 0; i < 10; i++ {
 			ret[fmt.Sprintf("/sensor%s", i)] = &SmapMessage{
 				UUID: UUID.New(),
-				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+				Readings: []Reading{
+					&SmapNumberReading{Time: 100, Value: 1},
 				},
 				Metadata: bson.M{},
 			}
@@ -47,8 +50,8 @@ var SmapMsgPool10PathMetadata = &sync.Pool{
 		for i := 0; i < 10; i++ {
 			ret[fmt.Sprintf("/sensor%s", i)] = &SmapMessage{
 				UUID: UUID.New(),
-				Readings: [][]interface{}{
-					[]interface{}{uint64(100), float64(1)},
+				Readings: []Reading{
+					&SmapNumberReading{Time: 100, Value: 1},
 				},
 				Metadata: bson.M{"key1": "val1", "key2": "val2"},
 			}
@@ -130,3 +133,42 @@ func BenchmarkArchiverAddData10WithMetadata(b *testing.B) {
 		SmapMsgPool10PathMetadata.Put(msgs)
 	}
 }
+
+func TestHandleQueryDeleteData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deletedata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	es := newTestEmbeddedStore(filepath.Join(dir, "metadata.bson"))
+	key, err := es.NewKey("test", "test@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.EnforceKeys(true)
+	if ok, err := es.CanWrite(key, "ddd"); !ok || err != nil {
+		t.Fatal("Key should be able to claim new uuid: ", err)
+	}
+	es.SaveTags(&map[string]*SmapMessage{"/building/temp2": &SmapMessage{Path: "/building/temp2", UUID: "ddd",
+		Properties: bson.M{"UnitofTime": "s"}}})
+	mem := NewMemoryDB()
+	mem.AddStore(es)
+	mem.Add(newTestStreamBuf("ddd", UOT_S, 1, 2, 3))
+	fos := NewFileObjectStore(filepath.Join(dir, "objects"))
+	fos.AddStore(es)
+	tst := &Archiver{store: es, tsdb: mem, objstore: fos}
+	tst.qp = NewQueryProcessor(tst)
+
+	// aaa is not owned by the key
+	if _, err := tst.HandleQuery(`delete data in (0, 10) where uuid = "aaa"`, key); err == nil {
+		t.Error("Key should not be able to delete data it does not own")
+	}
+	if _, err := tst.HandleQuery(`delete data in (2, 3) where uuid = "ddd"`, key); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := mem.GetData([]string{"ddd"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 3}) {
+		t.Error("Got ", times, " should be [1 3]")
+	}
+}
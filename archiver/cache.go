@@ -0,0 +1,164 @@
+package archiver
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache is a least-recently-used cache of a fixed capacity whose entries can
+// also expire after a time-to-live. It counts its hits, misses, evictions (of
+// the least recently used entry to make room for a new one) and expirations
+// so that we can tell from the status whether it is big enough.
+
+// number of entries kept by a cache that has not been configured
+const DEFAULT_CACHE_CAPACITY = 1000
+
+// The capacity and time-to-live of a cache. A TTL of 0 never expires entries
+type CacheConfig struct {
+	Capacity int
+	TTL      time.Duration
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+type Cache struct {
+	sync.Mutex
+	name     string
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	// most recently used at the front
+	order       *list.List
+	hits        *counter
+	misses      *counter
+	evictions   *counter
+	expirations *counter
+}
+
+// Creates a cache called @name (as it appears in the stats) that holds up to
+// @capacity entries, each for at most @ttl (or forever if @ttl is 0)
+func NewCache(name string, capacity int, ttl time.Duration) *Cache {
+	if capacity <= 0 {
+		capacity = DEFAULT_CACHE_CAPACITY
+	}
+	return &Cache{name: name,
+		capacity:    capacity,
+		ttl:         ttl,
+		entries:     make(map[string]*list.Element, capacity),
+		order:       list.New(),
+		hits:        newCounter(),
+		misses:      newCounter(),
+		evictions:   newCounter(),
+		expirations: newCounter()}
+}
+
+// Returns the value for @key and marks it as the most recently used. Expired
+// entries are removed and count as misses
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	elem, found := c.entries[key]
+	if !found {
+		c.misses.Mark()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.expired(entry) {
+		c.remove(elem)
+		c.expirations.Mark()
+		c.misses.Mark()
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	c.hits.Mark()
+	return entry.value, true
+}
+
+// Adds or replaces the value for @key, evicting the least recently used
+// entry if the cache is full
+func (c *Cache) Set(key string, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	var expires time.Time
+	if c.ttl > 0 {
+		expires = time.Now().Add(c.ttl)
+	}
+	if elem, found := c.entries[key]; found {
+		entry := elem.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if len(c.entries) >= c.capacity {
+		oldest := c.order.Back()
+		if c.expired(oldest.Value.(*cacheEntry)) {
+			c.expirations.Mark()
+		} else {
+			c.evictions.Mark()
+		}
+		c.remove(oldest)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+}
+
+// Removes the value identified by key, if it is in the cache
+func (c *Cache) Remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+}
+
+// Returns the number of entries in the cache, including expired ones that
+// have not been removed yet
+func (c *Cache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.entries)
+}
+
+// Returns the size and counters of the cache
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{
+		Name:        c.name,
+		Size:        c.Len(),
+		Capacity:    c.capacity,
+		Hits:        c.hits.Value(),
+		Misses:      c.misses.Value(),
+		Evictions:   c.evictions.Value(),
+		Expirations: c.expirations.Value(),
+	}
+}
+
+// must be called with the lock held
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *Cache) expired(entry *cacheEntry) bool {
+	return !entry.expires.IsZero() && time.Now().After(entry.expires)
+}
+
+// Counters of a cache since it was created
+type CacheStats struct {
+	Name        string
+	Size        int
+	Capacity    int
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+func (cs CacheStats) String() string {
+	return fmt.Sprintf("%v %d/%d hit:%d miss:%d evict:%d expire:%d", cs.Name, cs.Size, cs.Capacity, cs.Hits, cs.Misses, cs.Evictions, cs.Expirations)
+}
@@ -0,0 +1,241 @@
+package archiver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	var cache *Cache = NewCache("test", 8, 0)
+
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprintf("testkey%d", i), i)
+		cache.Get(fmt.Sprintf("testkey%d", i))
+	}
+	// Cache should have values 2,3,4,5,6,7,8,9
+
+	// Verify
+	for i := 2; i < 10; i++ {
+		val, success := cache.Get(fmt.Sprintf("testkey%d", i))
+		if val != i || !success {
+			t.Errorf("value %d should be in cache, but is not", i)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, success := cache.Get(fmt.Sprintf("testkey%d", i))
+		if success {
+			t.Errorf("Value %d should not be in cache", i)
+		}
+	}
+}
+
+// Returns the values in the cache from the most to the least recently used
+func cacheValues(cache *Cache) []interface{} {
+	var values []interface{}
+	for elem := cache.order.Front(); elem != nil; elem = elem.Next() {
+		values = append(values, elem.Value.(*cacheEntry).value)
+	}
+	return values
+}
+
+func TestCacheOrder(t *testing.T) {
+	var cache *Cache = NewCache("test", 8, 0)
+	for i := 0; i < 8; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	if values := cacheValues(cache); !valuesEqual(values, []interface{}{7, 6, 5, 4, 3, 2, 1, 0}) {
+		t.Error("Got ", values, " should be [7 6 5 4 3 2 1 0]")
+	}
+	cache.Get("3")
+	cache.Set("5", 50)
+	if values := cacheValues(cache); !valuesEqual(values, []interface{}{50, 3, 7, 6, 4, 2, 1, 0}) {
+		t.Error("Got ", values, " should be [50 3 7 6 4 2 1 0]")
+	}
+}
+
+func TestCacheFirstEviction(t *testing.T) {
+	var cache *Cache = NewCache("test", 8, 0)
+	for i := 0; i < 9; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	if values := cacheValues(cache); !valuesEqual(values, []interface{}{8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Error("Got ", values, " should be [8 7 6 5 4 3 2 1]")
+	}
+	if len(cache.entries) != 8 {
+		t.Error("Got ", len(cache.entries), " entries should be 8")
+	}
+}
+
+func TestGet(t *testing.T) {
+	lru := NewCache("test", 4, 0)
+
+	val, ok := lru.Get("asdf")
+	if ok != false {
+		t.Error("ok should be false but is", ok)
+	}
+	lru.Set("asdf", "asdfvalue")
+	val, ok = lru.Get("asdf")
+	if val != "asdfvalue" {
+		t.Error("LRU.Get does not return correct value", val)
+	}
+
+	if lru.entries["asdf"].Value.(*cacheEntry).value.(string) != "asdfvalue" {
+		t.Error("LRU.cache does not contain key/value after Get")
+	}
+
+}
+
+func TestEviction(t *testing.T) {
+	lru := NewCache("test", 2, 0)
+	val1, ok := lru.Get("a")
+	if ok != false {
+		t.Error("ok should be false")
+	}
+	lru.Set("a", "avalue")
+	val1, ok = lru.Get("a")
+	if ok != true {
+		t.Error("ok should be true")
+	}
+	if val1 != "avalue" {
+		t.Error("lru.Get: val1 should be avalue but is", val1)
+	}
+
+	lru.Set("b", "bvalue")
+	lru.Set("c", "cvalue")
+
+	if lru.Len() != 2 {
+		t.Error("lru.Cache size should be 2 but is", lru.Len())
+	}
+
+	val1, ok = lru.Get("a")
+	if ok == true {
+		t.Error("a should have been evicted")
+	}
+
+	val1, ok = lru.Get("b")
+	if ok != true {
+		t.Error("b should have been retained")
+	}
+
+	val1, ok = lru.Get("c")
+	if ok != true {
+		t.Error("c should have been retained")
+	}
+}
+
+/**
+ * Should do the following benchmarks:
+ * Insert with no Reuse (no repeats)
+ * Insert with Resue (with repeats -- moving LRU item to top)
+ * Parallel versions of the above, to test the effect of the Lock
+ * Insert with LRU size = 1
+ * Insert+Get with LRU size = 1
+ * Get with LRU size = 1
+**/
+
+func BenchmarkSetSize1NoReuse(b *testing.B) {
+	l := NewCache("test", 3, 0)
+	for i := 0; i < b.N; i++ {
+		l.Set(fmt.Sprintf("%d", i), i)
+	}
+}
+
+func BenchmarkSetSize1000Reuse(b *testing.B) {
+	l := NewCache("test", 1000, 0)
+	for i := 0; i < b.N; i++ {
+		l.Set(fmt.Sprintf("%d", i), i)
+	}
+}
+
+func BenchmarkSetSize1Reuse(b *testing.B) {
+	l := NewCache("test", 1, 0)
+	l.Set("1", 1)
+	for i := 0; i < b.N; i++ {
+		l.Set("1", 1)
+	}
+}
+
+func BenchmarkGetSize1(b *testing.B) {
+	l := NewCache("test", 1, 0)
+	l.Set("1", 1)
+	for i := 0; i < b.N; i++ {
+		l.Get("1")
+	}
+}
+
+func TestCacheRemove(t *testing.T) {
+	var cache *Cache = NewCache("test", 4, 0)
+	for i := 0; i < 4; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	// remove the tail, the head and one in between
+	for _, key := range []string{"0", "3", "1"} {
+		cache.Remove(key)
+		if _, found := cache.Get(key); found {
+			t.Errorf("Key %v should have been removed", key)
+		}
+	}
+	cache.Remove("unknown")
+	if val, found := cache.Get("2"); !found || val != 2 {
+		t.Errorf("Key 2 should still be in the cache")
+	}
+	if cache.order.Front() != cache.entries["2"] {
+		t.Errorf("Key 2 should be the most recently used")
+	}
+	// the cache fills up again
+	for i := 4; i < 8; i++ {
+		cache.Set(fmt.Sprintf("%d", i), i)
+	}
+	if cache.Len() != 4 {
+		t.Errorf("Cache has %v values, should have 4", cache.Len())
+	}
+	for i := 5; i < 8; i++ {
+		if val, found := cache.Get(fmt.Sprintf("%d", i)); !found || val != i {
+			t.Errorf("Value %d should be in cache, but is not", i)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	cache := NewCache("test", 2, 50*time.Millisecond)
+	cache.Set("a", 1)
+	if val, found := cache.Get("a"); !found || val != 1 {
+		t.Error("Got ", val, " should be 1 before it expires")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, found := cache.Get("a"); found {
+		t.Error("a should have expired")
+	}
+	if cache.Len() != 0 {
+		t.Error("Got ", cache.Len(), " entries, the expired one should be removed")
+	}
+	// setting again restarts the TTL
+	cache.Set("b", 2)
+	time.Sleep(30 * time.Millisecond)
+	cache.Set("b", 3)
+	time.Sleep(30 * time.Millisecond)
+	if val, found := cache.Get("b"); !found || val != 3 {
+		t.Error("Got ", val, " should be 3")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	cache := NewCache("uot", 2, 0)
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	cache.Get("a")
+	cache.Get("a")
+	cache.Get("c")
+	cache.Set("c", 3) // evicts b
+	cache.Get("b")
+	stats := cache.Stats()
+	expected := CacheStats{Name: "uot", Size: 2, Capacity: 2, Hits: 2, Misses: 2, Evictions: 1}
+	if stats != expected {
+		t.Error("Got ", stats, " should be ", expected)
+	}
+	if NewCache("default", 0, 0).Stats().Capacity != DEFAULT_CACHE_CAPACITY {
+		t.Error("A cache without a capacity should have the default one")
+	}
+}
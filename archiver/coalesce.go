@@ -1,6 +1,8 @@
 package archiver
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,8 +11,16 @@ import (
 const (
 	COALESCE_TIMEOUT = 1000  // milliseconds
 	COALESCE_MAX     = 16384 // num readings
+	// readings accepted but not yet written to the timeseries database,
+	// across all streams
+	DEFAULT_MAX_PENDING_WRITES = 1 << 20
 )
 
+// Returned when accepting more readings would put more than the allowed
+// number of readings in flight to the timeseries database. Clients should
+// back off and send the readings again later
+var ErrOverloaded = errors.New("Overloaded, retry later")
+
 type StreamMap map[string](*StreamBuf)
 type StreamLockMap map[string](*sync.Mutex)
 
@@ -21,10 +31,11 @@ type StreamBuf struct {
 	readings   []*SmapNumberReading
 	txc        *TransactionCoalescer
 	closed     atomic.Value
-	timeout    <-chan time.Time
-	abort      chan bool
+	timer      *time.Timer
 	num        int64
 	idx        int
+	// write-ahead log segment of each message added to the buffer
+	walSegments []uint64
 	sync.Mutex
 }
 
@@ -34,35 +45,31 @@ func NewStreamBuf(uuid string, uot UnitOfTime, txc *TransactionCoalescer) *Strea
 		num:      0,
 		idx:      0,
 		txc:      txc,
-		readings: txc.bufpool.Get().([]*SmapNumberReading),
-		abort:    make(chan bool, 1),
-		timeout:  time.After(time.Duration(COALESCE_TIMEOUT) * time.Millisecond)}
+		readings: txc.bufpool.Get().([]*SmapNumberReading)}
 	sb.closed.Store(false)
-	go sb.watch()
+	sb.timer = time.AfterFunc(time.Duration(COALESCE_TIMEOUT)*time.Millisecond, sb.commit)
 	return sb
 }
 
-func (sb *StreamBuf) watch() {
-	select {
-	case <-sb.timeout:
-		sb.commit()
-	case <-sb.abort:
-	}
-}
-
 func (sb *StreamBuf) isClosed() bool {
 	return sb.closed.Load().(bool)
 }
 
 // Returns true if successfully added SmapMessage to the buffer,
-// and false if the buffer is already closed
-func (sb *StreamBuf) add(sm *SmapMessage) bool {
+// and false if the buffer is already closed. @walSegment is the write-ahead
+// log segment holding the message, if there is a write-ahead log
+func (sb *StreamBuf) add(sm *SmapMessage, walSegment uint64) bool {
 	// if no longer accepting readings, return false
 	if sb.isClosed() {
 		return false
 	}
 
 	sb.Lock()
+	// the buffer may have been committed while we waited for the lock
+	if sb.isClosed() {
+		sb.Unlock()
+		return false
+	}
 	// if we are short some readings, append the space to the end
 	if diff := (len(sm.Readings) + sb.idx) - COALESCE_MAX; diff > 0 {
 		sb.readings = append(sb.readings, make([]*SmapNumberReading, diff)...)
@@ -73,9 +80,12 @@ func (sb *StreamBuf) add(sm *SmapMessage) bool {
 	}
 	// advance our pointer
 	sb.idx += len(sm.Readings)
+	if sb.txc.wal != nil {
+		sb.walSegments = append(sb.walSegments, walSegment)
+	}
 
-	if sb.idx >= COALESCE_MAX {
-		sb.abort <- true // cancels the timeout
+	// if the timer already fired, its commit is waiting for the lock
+	if sb.idx >= COALESCE_MAX && sb.timer.Stop() {
 		sb.Unlock()
 		sb.commit()
 		return true
@@ -98,11 +108,19 @@ type TransactionCoalescer struct {
 	streamLocks atomic.Value
 	bufpool     sync.Pool
 	chanpool    sync.Pool
+	wal         *WriteAheadLog
+	// readings accepted but not yet written to the timeseries database
+	pending    *counter
+	maxPending uint64
 	sync.Mutex
 }
 
-func NewTransactionCoalescer(tsdb *TSDB, store *MetadataStore) *TransactionCoalescer {
-	txc := &TransactionCoalescer{tsdb: tsdb, store: store}
+// If @wal is not nil, readings are recorded in the write-ahead log before they
+// are buffered, and any readings left in it by a previous run are written to
+// the timeseries database first. At most @maxPending readings are accepted
+// before they have been written (0 means no limit)
+func NewTransactionCoalescer(tsdb *TSDB, store *MetadataStore, wal *WriteAheadLog, maxPending uint64) *TransactionCoalescer {
+	txc := &TransactionCoalescer{tsdb: tsdb, store: store, wal: wal, pending: newCounter(), maxPending: maxPending}
 	txc.streams.Store(make(StreamMap))
 	txc.streamLocks.Store(make(StreamLockMap))
 	txc.bufpool = sync.Pool{
@@ -115,21 +133,124 @@ func NewTransactionCoalescer(tsdb *TSDB, store *MetadataStore) *TransactionCoale
 			return make(chan *SmapMessage, COALESCE_MAX)
 		},
 	}
+	if wal != nil {
+		if err := txc.replay(); err != nil {
+			log.Error("Could not replay write-ahead log, will try again on restart (%v)", err)
+		}
+	}
 	return txc
 }
 
+// Writes the readings left in the write-ahead log by a previous run to the
+// timeseries database. The old segments are removed once all of them are written
+func (txc *TransactionCoalescer) replay() error {
+	seqs, err := txc.wal.segments()
+	if err != nil || len(seqs) == 0 {
+		return err
+	}
+	records, err := txc.wal.read(seqs)
+	if err != nil {
+		return err
+	}
+	var (
+		bufs  = make(map[string]*StreamBuf)
+		order []string
+		count int
+	)
+	for _, rec := range records {
+		sb, found := bufs[rec.uuid]
+		if !found {
+			sb = &StreamBuf{uuid: rec.uuid, unitOfTime: rec.uot}
+			bufs[rec.uuid] = sb
+			order = append(order, rec.uuid)
+		}
+		for _, rdg := range rec.readings {
+			rdg.Time = convertTime(rdg.Time, rec.uot, sb.unitOfTime)
+			sb.readings = append(sb.readings, rdg)
+		}
+		sb.idx = len(sb.readings)
+		count += len(rec.readings)
+	}
+	failed := 0
+	for _, uuid := range order {
+		if !(*txc.tsdb).Add(bufs[uuid]) {
+			failed += 1
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Could not write %v streams to the timeseries database", failed)
+	}
+	txc.wal.remove(seqs)
+	log.Notice("Replayed %v readings for %v streams from the write-ahead log", count, len(order))
+	return nil
+}
+
 // Called to add an incoming SmapMessage to the underlying timeseries database. A SmapMessage contains
 // an array of Readings and the UUID for the stream the readings belong to. The Readings must be added to
 // a StreamBuffer for coalescing. This StreamBuffer is either a) pre-existing and still open, b) pre-existing and committing or
 // c) not existing. In the
-func (txc *TransactionCoalescer) AddSmapMessage(sm *SmapMessage) {
+// If there is a write-ahead log, the readings are recorded there first, and an error means that they were
+// not accepted. If too many readings are already waiting to be written, the message is rejected with ErrOverloaded.
+func (txc *TransactionCoalescer) AddSmapMessage(sm *SmapMessage) error {
+	if err := txc.ReserveReadings(uint64(len(sm.Readings))); err != nil {
+		return err
+	}
+	return txc.AddReservedSmapMessage(sm)
+}
+
+// Like AddSmapMessage for a message whose readings were already counted with
+// ReserveReadings. If the message is not accepted, its readings are released
+func (txc *TransactionCoalescer) AddReservedSmapMessage(sm *SmapMessage) error {
+	count := uint64(len(sm.Readings))
+	var walSegment uint64
+	if txc.wal != nil && count > 0 {
+		var err error
+		uot := (*txc.store).GetUnitOfTime(sm.UUID)
+		if walSegment, err = txc.wal.append(sm, uot); err != nil {
+			log.Error("Could not write to write-ahead log (%v)", err)
+			txc.pending.Sub(count)
+			return err
+		}
+	}
+	txc.buffer(sm, walSegment)
+	return nil
+}
+
+// Counts @count more readings as pending, unless that goes over the limit, in
+// which case it returns ErrOverloaded. Readings are always accepted when
+// nothing is pending, so that a batch larger than the limit still gets
+// through. Each reserved reading must be added with AddReservedSmapMessage or
+// given back with ReleaseReadings
+func (txc *TransactionCoalescer) ReserveReadings(count uint64) error {
+	total := txc.pending.Add(count)
+	if txc.maxPending > 0 && total > txc.maxPending && total != count {
+		txc.pending.Sub(count)
+		return ErrOverloaded
+	}
+	return nil
+}
+
+// Gives back @count readings reserved with ReserveReadings that will not be added
+func (txc *TransactionCoalescer) ReleaseReadings(count uint64) {
+	if count > 0 {
+		txc.pending.Sub(count)
+	}
+}
+
+// Returns true if no more readings can be accepted until some of the pending
+// ones have been written to the timeseries database
+func (txc *TransactionCoalescer) Overloaded() bool {
+	return txc.maxPending > 0 && txc.pending.Value() >= txc.maxPending
+}
+
+func (txc *TransactionCoalescer) buffer(sm *SmapMessage, walSegment uint64) {
 	var sb *StreamBuf
 
 	// if we find the stream buffer and it is still accepting data, we write to that
 	// stream and then return
 	streams := txc.streams.Load().(StreamMap)
 	if sb, found := streams[sm.UUID]; found && sb != nil {
-		if sb.add(sm) {
+		if sb.add(sm, walSegment) {
 			return
 		}
 	}
@@ -138,7 +259,7 @@ func (txc *TransactionCoalescer) AddSmapMessage(sm *SmapMessage) {
 	streams = txc.streams.Load().(StreamMap)
 	// check again
 	if sb, found := streams[sm.UUID]; found && sb != nil {
-		if sb.add(sm) {
+		if sb.add(sm, walSegment) {
 			txc.Unlock()
 			return
 		}
@@ -152,7 +273,7 @@ func (txc *TransactionCoalescer) AddSmapMessage(sm *SmapMessage) {
 	newStreams[sm.UUID] = sb
 	txc.streams.Store(newStreams)
 	txc.Unlock()
-	txc.AddSmapMessage(sm)
+	txc.buffer(sm, walSegment)
 }
 
 func (txc *TransactionCoalescer) Commit(sb *StreamBuf) {
@@ -168,7 +289,15 @@ func (txc *TransactionCoalescer) Commit(sb *StreamBuf) {
 		txc.Unlock()
 	}
 	sb.Lock()
-	(*txc.tsdb).Add(sb)
+	ok := (*txc.tsdb).Add(sb)
+	if txc.wal != nil {
+		if ok || sb.idx == 0 {
+			txc.wal.commit(sb.walSegments)
+		} else {
+			log.Error("Could not write %v readings for %v, they will be replayed from the write-ahead log on restart", sb.idx, sb.uuid)
+		}
+	}
+	txc.pending.Sub(uint64(sb.idx))
 	txc.bufpool.Put(sb.readings)
 	txc.chanpool.Put(sb.incoming)
 	sb.Unlock()
@@ -0,0 +1,76 @@
+package archiver
+
+import (
+	"testing"
+)
+
+func TestTransactionCoalescerOverloaded(t *testing.T) {
+	var store MetadataStore = uotStore{uot: UOT_S}
+	mem := NewMemoryDB()
+	mem.AddStore(store)
+	var tsdb TSDB = mem
+	txc := NewTransactionCoalescer(&tsdb, &store, nil, 3)
+
+	// a message larger than the budget still gets through when nothing is pending
+	if err := txc.AddSmapMessage(walMessage("aaa", 1, 2, 3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if !txc.Overloaded() {
+		t.Error("Coalescer with 4 of 3 readings pending should be overloaded")
+	}
+	if err := txc.AddSmapMessage(walMessage("bbb", 5)); err != ErrOverloaded {
+		t.Error("Got ", err, " should be ", ErrOverloaded)
+	}
+
+	// writing the buffered readings frees up the budget
+	sb := txc.streams.Load().(StreamMap)["aaa"]
+	if !sb.timer.Stop() {
+		t.Fatal("Buffer for aaa was committed too early")
+	}
+	sb.commit()
+	if pending := txc.pending.Value(); pending != 0 {
+		t.Error("Got ", pending, " pending readings should be 0")
+	}
+	if err := txc.AddSmapMessage(walMessage("bbb", 5)); err != nil {
+		t.Error("Got ", err, " should be accepted")
+	}
+	res, _ := mem.GetData([]string{"aaa"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 2, 3, 4}) {
+		t.Error("Got ", times, " should be [1 2 3 4]")
+	}
+}
+
+func TestTransactionCoalescerReserve(t *testing.T) {
+	var store MetadataStore = uotStore{uot: UOT_S}
+	mem := NewMemoryDB()
+	mem.AddStore(store)
+	var tsdb TSDB = mem
+	txc := NewTransactionCoalescer(&tsdb, &store, nil, 4)
+
+	// a batch of several streams is reserved as a whole
+	if err := txc.ReserveReadings(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := txc.ReserveReadings(2); err != ErrOverloaded {
+		t.Error("Got ", err, " a batch that does not fit should be refused")
+	}
+	if pending := txc.pending.Value(); pending != 3 {
+		t.Error("Got ", pending, " pending readings, a refused batch should not be counted")
+	}
+	for _, msg := range []*SmapMessage{walMessage("aaa", 1, 2), walMessage("bbb", 3)} {
+		if err := txc.AddReservedSmapMessage(msg); err != nil {
+			t.Error("Got ", err, " reserved readings should be accepted")
+		}
+	}
+	if pending := txc.pending.Value(); pending != 3 {
+		t.Error("Got ", pending, " pending readings, adding reserved readings should not count them again")
+	}
+	txc.ReleaseReadings(0)
+	if err := txc.ReserveReadings(1); err != nil {
+		t.Error("Got ", err, " should fit")
+	}
+	txc.ReleaseReadings(1)
+	if pending := txc.pending.Value(); pending != 3 {
+		t.Error("Got ", pending, " pending readings, released readings should not be counted")
+	}
+}
@@ -14,6 +14,36 @@ type Config struct {
 		EnforceKeys    bool
 		LogLevel       *string
 		MaxConnections *int
+		// readings accepted but not yet written to the timeseries database
+		// before new readings are refused
+		MaxPendingWrites *int
+		// number of streams fetched from the databases at once by a data query
+		FetchParallelism *int
+		// seconds between applications of the retention policies
+		RetentionInterval *int
+	}
+
+	// one [Retention "name"] section per policy
+	Retention map[string]*struct {
+		Where    *string
+		KeepRaw  *string
+		Rollup   *string
+		Function *string
+	}
+
+	// one [Schema "name"] section per tag or namespace of tags
+	Schema map[string]*struct {
+		Tag    *string
+		Type   *string
+		Values []string
+		Closed bool
+		Action *string
+	}
+
+	// one [Cache "name"] section per cache of the metadata store
+	Cache map[string]*struct {
+		Capacity *int
+		TTL      *string
 	}
 
 	ReadingDB struct {
@@ -26,12 +56,36 @@ type Config struct {
 		Address *string
 	}
 
+	FileDB struct {
+		Path        *string
+		SegmentSize *int
+	}
+
 	Mongo struct {
 		Port           *string
 		Address        *string
 		UpdateInterval *int
 	}
 
+	EmbeddedStore struct {
+		Path *string
+	}
+
+	FileObjectStore struct {
+		Path *string
+	}
+
+	WAL struct {
+		Path        *string
+		SegmentSize *int
+		Sync        bool
+	}
+
+	SQL struct {
+		Driver     *string
+		DataSource *string
+	}
+
 	Venkman struct {
 		Port    *string
 		Address *string
@@ -94,15 +148,48 @@ func LoadConfig(filename string) *Config {
 
 func PrintConfig(c *Config) {
 	fmt.Println("Giles Configuration")
-	fmt.Println("Connecting to Mongo at", *c.Mongo.Address, ":", *c.Mongo.Port, "with update interval", *c.Mongo.UpdateInterval, "seconds")
+	switch *c.Archiver.Metadata {
+	case "mongo":
+		fmt.Println("Connecting to Mongo at", *c.Mongo.Address, ":", *c.Mongo.Port, "with update interval", *c.Mongo.UpdateInterval, "seconds")
+	case "sql":
+		fmt.Println("Using", *c.SQL.Driver, "for metadata")
+	case "embedded":
+		if c.EmbeddedStore.Path != nil && *c.EmbeddedStore.Path != "" {
+			fmt.Println("Using embedded metadata store at", *c.EmbeddedStore.Path)
+		} else {
+			fmt.Println("Using in-memory metadata store (not persisted)")
+		}
+	}
 	fmt.Println("Using Timeseries DB", *c.Archiver.TSDB)
 	switch *c.Archiver.TSDB {
 	case "readingdb":
 		fmt.Println("	at address", *c.ReadingDB.Address, ":", *c.ReadingDB.Port)
 	case "quasar":
 		fmt.Println("	at address", *c.Quasar.Address, ":", *c.Quasar.Port)
+	case "file":
+		fmt.Println("	at path", *c.FileDB.Path)
+	case "memory":
+		fmt.Println("	in process memory (not persisted)")
 	}
 	fmt.Println("	with keepalive", *c.Archiver.Keepalive)
+	fmt.Println("Using object store", *c.Archiver.Objects)
+	if *c.Archiver.Objects == "file" {
+		fmt.Println("	at path", *c.FileObjectStore.Path)
+	}
+	if c.WAL.Path != nil && *c.WAL.Path != "" {
+		fmt.Println("Using write-ahead log at", *c.WAL.Path, "with sync", c.WAL.Sync)
+	}
+	for name, rule := range c.Retention {
+		fmt.Println("Retention policy", name, "keeps raw data for", *rule.KeepRaw, "where", *rule.Where)
+	}
+	for name, schema := range c.Schema {
+		fmt.Println("Schema", name, "for", *schema.Tag)
+	}
+	for name, cache := range c.Cache {
+		if cache.Capacity != nil {
+			fmt.Println("Cache", name, "holds", *cache.Capacity, "entries")
+		}
+	}
 
 	if c.Profile.Enabled {
 		fmt.Println("Profiling enabled for", *c.Profile.BenchmarkTimer, "seconds!")
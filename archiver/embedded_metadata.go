@@ -0,0 +1,817 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// EmbeddedStore implements MetadataStore and APIKeyManager without an
+// external database. Documents are kept in memory in the same shape MongoStore
+// keeps them in Mongo (nested bson.M with Metadata, Properties, Actuator, Path,
+// uuid and _api keys), and where-clauses are evaluated with matchPredicate.
+//
+// If a path is given, the store is loaded from a snapshot in that file and a
+// log of the changes made since (the same path with .log appended) on
+// startup. Each change appends the documents it touched to the log, and once
+// the log outgrows the snapshot the whole store is written to a new snapshot
+// and the log starts over. With an empty path nothing is persisted, which is
+// what tests and CI want.
+type EmbeddedStore struct {
+	path string
+	// generation of the snapshot. Log entries of older generations were
+	// compacted into it
+	generation uint64
+	// sizes in bytes of the snapshot and the log
+	snapshotSize int64
+	logSize      int64
+	// the log is compacted once it is larger than the snapshot and than this
+	minCompaction int64
+	// uuid -> document
+	metadata map[string]bson.M
+	// path -> document of path metadata
+	pathmetadata map[string]bson.M
+	apikeys      []bson.M
+	// uuid -> readingdb stream id
+	streamids map[string]uint32
+	maxsid    uint32
+	// changes to the metadata, oldest first
+	history     []*MetadataChange
+	enforceKeys bool
+	sync.RWMutex
+}
+
+func NewEmbeddedStore(path string) *EmbeddedStore {
+	es := &EmbeddedStore{
+		path:          path,
+		metadata:      make(map[string]bson.M),
+		pathmetadata:  make(map[string]bson.M),
+		apikeys:       []bson.M{},
+		streamids:     make(map[string]uint32),
+		maxsid:        1,
+		enforceKeys:   true,
+		minCompaction: EMBEDDED_MIN_COMPACTION,
+	}
+	if path == "" {
+		log.Notice("Using in-memory metadata store")
+		return es
+	}
+	log.Notice("Using embedded metadata store at %v", path)
+	if err := es.load(); err != nil {
+		log.Critical("Could not load metadata from %v: %v", path, err)
+		return nil
+	}
+	return es
+}
+
+// smallest log, in bytes, that is compacted into the snapshot
+const EMBEDDED_MIN_COMPACTION = 1 << 20
+
+// the on-disk format mirrors the Mongo collections
+type embeddedSnapshot struct {
+	Generation   uint64            `bson:"generation"`
+	Metadata     []bson.M          `bson:"metadata"`
+	PathMetadata []bson.M          `bson:"pathmetadata"`
+	APIKeys      []bson.M          `bson:"apikeys"`
+	Streams      []bson.M          `bson:"streams"`
+	History      []*MetadataChange `bson:"history"`
+}
+
+// A change to the store as it is appended to the log: the documents it wrote
+// whole and the ones it removed
+type embeddedLogEntry struct {
+	Generation   uint64            `bson:"generation"`
+	Metadata     []bson.M          `bson:"metadata,omitempty"`
+	Removed      []string          `bson:"removed,omitempty"`
+	PathMetadata []bson.M          `bson:"pathmetadata,omitempty"`
+	Streams      []bson.M          `bson:"streams,omitempty"`
+	History      []*MetadataChange `bson:"history,omitempty"`
+	// the API keys are few, so a change to them writes all of them
+	SetAPIKeys bool     `bson:"setapikeys,omitempty"`
+	APIKeys    []bson.M `bson:"apikeys,omitempty"`
+}
+
+func (es *EmbeddedStore) logPath() string {
+	return es.path + ".log"
+}
+
+func (es *EmbeddedStore) load() error {
+	var snapshot embeddedSnapshot
+	bytes, err := ioutil.ReadFile(es.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if err = bson.Unmarshal(bytes, &snapshot); err != nil {
+			return err
+		}
+	}
+	es.generation = snapshot.Generation
+	es.snapshotSize = int64(len(bytes))
+	es.apply(&embeddedLogEntry{
+		Metadata:     snapshot.Metadata,
+		PathMetadata: snapshot.PathMetadata,
+		Streams:      snapshot.Streams,
+		History:      snapshot.History,
+		SetAPIKeys:   true,
+		APIKeys:      snapshot.APIKeys,
+	})
+	return es.replayLog()
+}
+
+// Applies the entries of the log of the current generation. A torn entry at
+// the end, from a crash while appending it, is truncated away
+func (es *EmbeddedStore) replayLog() error {
+	contents, err := ioutil.ReadFile(es.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	offset := 0
+	for offset+4 <= len(contents) {
+		// a BSON document starts with its length
+		length := int(binary.LittleEndian.Uint32(contents[offset : offset+4]))
+		if length < 5 || offset+length > len(contents) {
+			break
+		}
+		var entry embeddedLogEntry
+		if err := bson.Unmarshal(contents[offset:offset+length], &entry); err != nil {
+			break
+		}
+		if entry.Generation == es.generation {
+			es.apply(&entry)
+		}
+		offset += length
+	}
+	es.logSize = int64(offset)
+	if offset < len(contents) {
+		log.Warning("Truncating %v bytes of partial writes from %v", len(contents)-offset, es.logPath())
+		return os.Truncate(es.logPath(), int64(offset))
+	}
+	return nil
+}
+
+func (es *EmbeddedStore) apply(entry *embeddedLogEntry) {
+	for _, doc := range entry.Metadata {
+		if uuid, ok := doc["uuid"].(string); ok {
+			es.metadata[uuid] = doc
+		}
+	}
+	for _, uuid := range entry.Removed {
+		delete(es.metadata, uuid)
+	}
+	for _, doc := range entry.PathMetadata {
+		if path, ok := doc["Path"].(string); ok {
+			es.pathmetadata[path] = doc
+		}
+	}
+	for _, doc := range entry.Streams {
+		uuid, _ := doc["uuid"].(string)
+		streamid, _ := asFloat(doc["streamid"])
+		es.streamids[uuid] = uint32(streamid)
+		if uint32(streamid) >= es.maxsid {
+			es.maxsid = uint32(streamid) + 1
+		}
+	}
+	es.history = append(es.history, entry.History...)
+	if entry.SetAPIKeys {
+		es.apikeys = append([]bson.M{}, entry.APIKeys...)
+	}
+}
+
+// Appends @entry to the log, and compacts the log into a new snapshot once it
+// is larger than the snapshot. Must be called with the lock held
+func (es *EmbeddedStore) record(entry *embeddedLogEntry) error {
+	if es.path == "" {
+		return nil
+	}
+	entry.Generation = es.generation
+	bytes, err := bson.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(es.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(bytes); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	es.logSize += int64(len(bytes))
+	if es.logSize > es.snapshotSize && es.logSize > es.minCompaction {
+		return es.compact()
+	}
+	return nil
+}
+
+// the documents in @docs
+func logDocuments(docs ...bson.M) *embeddedLogEntry {
+	return &embeddedLogEntry{Metadata: docs}
+}
+
+// Writes out the whole store as the snapshot of the next generation, which
+// makes the entries in the log obsolete, then empties the log. Must be called
+// with the lock held
+func (es *EmbeddedStore) compact() error {
+	snapshot := embeddedSnapshot{
+		Generation:   es.generation + 1,
+		Metadata:     make([]bson.M, 0, len(es.metadata)),
+		PathMetadata: make([]bson.M, 0, len(es.pathmetadata)),
+		APIKeys:      es.apikeys,
+		Streams:      make([]bson.M, 0, len(es.streamids)),
+		History:      es.history,
+	}
+	for _, doc := range es.metadata {
+		snapshot.Metadata = append(snapshot.Metadata, doc)
+	}
+	for _, doc := range es.pathmetadata {
+		snapshot.PathMetadata = append(snapshot.PathMetadata, doc)
+	}
+	for uuid, streamid := range es.streamids {
+		snapshot.Streams = append(snapshot.Streams, bson.M{"uuid": uuid, "streamid": int64(streamid)})
+	}
+	bytes, err := bson.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename so a crash never leaves us with
+	// a partial snapshot
+	tmp := es.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(bytes); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, es.path); err != nil {
+		return err
+	}
+	es.generation += 1
+	es.snapshotSize = int64(len(bytes))
+	// a crash before this leaves entries of the old generation, which are
+	// skipped on startup
+	es.logSize = 0
+	return os.Truncate(es.logPath(), 0)
+}
+
+// returns the documents matching @where, in order of UUID. Must be called
+// with the lock held
+func (es *EmbeddedStore) find(where Predicate) ([]bson.M, error) {
+	var ret []bson.M
+	uuids := make([]string, 0, len(es.metadata))
+	for uuid := range es.metadata {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		doc := es.metadata[uuid]
+		match, err := matchPredicate(doc, where)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			ret = append(ret, doc)
+		}
+	}
+	return ret, nil
+}
+
+// returns the distinct values of @key over @docs. Array values are unwound
+func distinctValues(docs []bson.M, key string) []interface{} {
+	var ret = []interface{}{}
+	add := func(value interface{}) {
+		for _, seen := range ret {
+			if valuesEqual(seen, value) {
+				return
+			}
+		}
+		ret = append(ret, copyValue(value))
+	}
+	for _, doc := range docs {
+		value, found := getPath(doc, key)
+		if !found {
+			continue
+		}
+		if list, ok := value.([]interface{}); ok {
+			for _, elem := range list {
+				add(elem)
+			}
+		} else {
+			add(value)
+		}
+	}
+	return ret
+}
+
+/* MetadataStore interface implementation*/
+
+func (es *EmbeddedStore) EnforceKeys(enforce bool) {
+	es.enforceKeys = enforce
+}
+
+func (es *EmbeddedStore) Find(where Predicate, selectClause bson.M) (interface{}, error) {
+	var result []interface{}
+	es.RLock()
+	defer es.RUnlock()
+	docs, err := es.find(where)
+	for _, doc := range docs {
+		result = append(result, projectDocument(doc, selectClause))
+	}
+	return result, err
+}
+
+func (es *EmbeddedStore) FindDistinct(where Predicate, distinctKey string) (interface{}, error) {
+	es.RLock()
+	defer es.RUnlock()
+	docs, err := es.find(where)
+	if err != nil {
+		return nil, err
+	}
+	return distinctValues(docs, distinctKey), nil
+}
+
+func (es *EmbeddedStore) CheckKey(apikey string, messages map[string]*SmapMessage) (bool, error) {
+	for _, msg := range messages {
+		if msg.UUID == "" {
+			continue
+		} // no API key for path metadata
+		ok, err := es.CanWrite(apikey, msg.UUID)
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Same rules as MongoStore.CanWrite: the first valid key to write to a UUID
+// owns it
+func (es *EmbeddedStore) CanWrite(apikey, uuid string) (bool, error) {
+	if !es.enforceKeys {
+		return true, nil
+	}
+	es.Lock()
+	defer es.Unlock()
+	if doc, found := es.metadata[uuid]; found {
+		if doc["_api"] != apikey {
+			return false, errors.New("API key " + apikey + " is invalid for UUID " + uuid)
+		}
+		return true, nil
+	}
+	exists, err := es.apiKeyExists(apikey)
+	if !exists || err != nil {
+		return false, err
+	}
+	if uuid == "" {
+		return false, err
+	}
+	es.metadata[uuid] = bson.M{"uuid": uuid, "_api": apikey}
+	return true, es.record(logDocuments(es.metadata[uuid]))
+}
+
+// sets each of the dotted keys of @values in @doc. Returns true if this
+// changed the document
+func setPaths(doc bson.M, values bson.M) bool {
+	changed := false
+	for k, v := range values {
+		changed = setPath(doc, k, v) || changed
+	}
+	return changed
+}
+
+// merges the metadata, properties and actuator of @msg into @doc as dotted
+// keys. Returns true if this changed the document
+func mergeSmapMessage(doc bson.M, msg *SmapMessage) bool {
+	changed := false
+	for k, v := range msg.Metadata {
+		changed = setPath(doc, "Metadata."+k, v) || changed
+	}
+	for k, v := range msg.Properties {
+		changed = setPath(doc, "Properties."+k, v) || changed
+	}
+	for k, v := range msg.Actuator {
+		changed = setPath(doc, "Actuator."+k, v) || changed
+	}
+	return changed
+}
+
+func (es *EmbeddedStore) SavePathMetadata(messages map[string]*SmapMessage) error {
+	var changed []bson.M
+	es.Lock()
+	defer es.Unlock()
+	for path, msg := range messages {
+		// check if we have anything to do
+		if msg.Path == "" || (msg.Metadata == nil && msg.Properties == nil && msg.Actuator == nil) {
+			continue
+		}
+		doc, found := es.pathmetadata[path]
+		if !found {
+			doc = bson.M{"Path": path}
+			es.pathmetadata[path] = doc
+		}
+		if mergeSmapMessage(doc, msg) || !found {
+			changed = append(changed, doc)
+		}
+	}
+	if len(changed) > 0 {
+		return es.record(&embeddedLogEntry{PathMetadata: changed})
+	}
+	return nil
+}
+
+// Inherits the metadata of each of the prefixes of the timeseries path before
+// applying the timeseries-specific metadata, like MongoStore
+func (es *EmbeddedStore) SaveTimeseriesMetadata(messages map[string]*SmapMessage) error {
+	var changed []bson.M
+	es.Lock()
+	defer es.Unlock()
+	for path, msg := range messages {
+		if msg.UUID == "" { // not a timeseries path
+			continue
+		}
+		toWrite := bson.M{"Path": path, "uuid": msg.UUID}
+		for _, prefix := range getPrefixes(path) {
+			if prefixDoc, found := es.pathmetadata[prefix]; found {
+				for k, v := range projectDocument(prefixDoc, bson.M{"Path": 0}) {
+					toWrite[k] = v
+				}
+			}
+		}
+		mergeSmapMessage(toWrite, msg)
+		if len(toWrite) <= 2 {
+			continue
+		}
+		doc, found := es.metadata[msg.UUID]
+		if !found {
+			doc = bson.M{}
+			es.metadata[msg.UUID] = doc
+		}
+		if setPaths(doc, toWrite) {
+			changed = append(changed, doc)
+		}
+	}
+	if len(changed) > 0 {
+		return es.record(logDocuments(changed...))
+	}
+	return nil
+}
+
+func (es *EmbeddedStore) SaveTags(messages *map[string]*SmapMessage) error {
+	var changed []bson.M
+	tsm := TieredSmapMessage(*messages)
+	tsm.CollapseToTimeseries()
+	es.Lock()
+	defer es.Unlock()
+	for _, bsonMsg := range tsm.ToBson() {
+		uuid := bsonMsg["uuid"].(string)
+		doc, found := es.metadata[uuid]
+		if !found {
+			doc = bson.M{}
+			es.metadata[uuid] = doc
+		}
+		if setPaths(doc, bsonMsg) || !found {
+			changed = append(changed, doc)
+		}
+	}
+	if len(changed) > 0 {
+		return es.record(logDocuments(changed...))
+	}
+	return nil
+}
+
+func (es *EmbeddedStore) GetTags(target bson.M, is_distinct bool, distinct_key string, where Predicate, page Page) ([]interface{}, error) {
+	var res = []interface{}{}
+	es.RLock()
+	defer es.RUnlock()
+	docs, err := es.find(where)
+	if err != nil {
+		return res, err
+	}
+	if is_distinct {
+		return distinctValues(docs, distinct_key), nil
+	}
+	sel := tagSelection(target)
+	for _, doc := range pageDocuments(docs, page) {
+		res = append(res, projectDocument(doc, sel))
+	}
+	return res, nil
+}
+
+// checks @apikey against all documents matching @where, and returns them.
+// Must be called with the lock held
+func (es *EmbeddedStore) findWritable(apikey string, where Predicate) ([]bson.M, error) {
+	docs, err := es.find(where)
+	if err != nil || !es.enforceKeys {
+		return docs, err
+	}
+	exists, err := es.apiKeyExists(apikey)
+	if !exists || err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if doc["_api"] != apikey {
+			return nil, errors.New("API key " + apikey + " is invalid for UUID " + fmt.Sprintf("%v", doc["uuid"]))
+		}
+	}
+	return docs, nil
+}
+
+func (es *EmbeddedStore) UpdateTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	es.Lock()
+	defer es.Unlock()
+	docs, err := es.findWritable(apikey, where)
+	if err != nil {
+		return res, err
+	}
+	var changed []bson.M
+	for _, doc := range docs {
+		if setPaths(doc, updates) {
+			changed = append(changed, doc)
+		}
+	}
+	log.Info("Updated %v records", len(changed))
+	if len(changed) == 0 {
+		return bson.M{"Updated": 0}, nil
+	}
+	return bson.M{"Updated": len(changed)}, es.record(logDocuments(changed...))
+}
+
+func (es *EmbeddedStore) RemoveDocs(apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	es.Lock()
+	defer es.Unlock()
+	docs, err := es.findWritable(apikey, where)
+	if err != nil {
+		return res, err
+	}
+	removed := make([]string, len(docs))
+	for i, doc := range docs {
+		removed[i] = doc["uuid"].(string)
+		delete(es.metadata, removed[i])
+	}
+	log.Info("Removed %v records", len(docs))
+	return bson.M{"Removed": len(docs)}, es.record(&embeddedLogEntry{Removed: removed})
+}
+
+func (es *EmbeddedStore) RemoveTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	es.Lock()
+	defer es.Unlock()
+	docs, err := es.findWritable(apikey, where)
+	if err != nil {
+		return res, err
+	}
+	var changed []bson.M
+	for _, doc := range docs {
+		unset := false
+		for k := range updates {
+			unset = unsetPath(doc, k) || unset
+		}
+		if unset {
+			changed = append(changed, doc)
+		}
+	}
+	log.Info("Updated %v records", len(changed))
+	if len(changed) == 0 {
+		return bson.M{"Updated": 0}, nil
+	}
+	return bson.M{"Updated": len(changed)}, es.record(logDocuments(changed...))
+}
+
+func (es *EmbeddedStore) UUIDTags(uuid string) (bson.M, error) {
+	es.RLock()
+	defer es.RUnlock()
+	doc, found := es.metadata[uuid]
+	if !found {
+		return bson.M{}, mgo.ErrNotFound
+	}
+	return projectDocument(doc, bson.M{"_api": 0}), nil
+}
+
+func (es *EmbeddedStore) GetUUIDs(where Predicate) ([]string, error) {
+	var res = []string{}
+	es.RLock()
+	defer es.RUnlock()
+	docs, err := es.find(where)
+	if err != nil {
+		return res, err
+	}
+	for _, doc := range docs {
+		res = append(res, doc["uuid"].(string))
+	}
+	return res, nil
+}
+
+// defaults to ms, like MongoStore
+func (es *EmbeddedStore) GetUnitOfTime(uuid string) UnitOfTime {
+	es.RLock()
+	defer es.RUnlock()
+	if doc, found := es.metadata[uuid]; found {
+		if units, found := getPath(doc, "Properties.UnitofTime"); found {
+			if s, ok := units.(string); ok {
+				if uot, err := parseUOT(s); err == nil {
+					return uot
+				}
+			}
+		}
+	}
+	return UOT_MS
+}
+
+func (es *EmbeddedStore) GetStreamType(uuid string) StreamType {
+	es.RLock()
+	defer es.RUnlock()
+	if doc, found := es.metadata[uuid]; found {
+		if st, found := getPath(doc, "Properties.StreamType"); found && st == "object" {
+			return OBJECT_STREAM
+		}
+	}
+	return NUMERIC_STREAM
+}
+
+func (es *EmbeddedStore) GetStreamId(uuid string) uint32 {
+	es.Lock()
+	defer es.Unlock()
+	if streamid, found := es.streamids[uuid]; found {
+		return streamid
+	}
+	streamid := es.maxsid
+	es.maxsid += 1
+	es.streamids[uuid] = streamid
+	if err := es.record(&embeddedLogEntry{Streams: []bson.M{{"uuid": uuid, "streamid": int64(streamid)}}}); err != nil {
+		log.Error("Error saving streamid %v", err)
+	}
+	log.Notice("Creating StreamId %v for uuid %v", streamid, uuid)
+	return streamid
+}
+
+/* MetadataHistory interface implementation */
+
+func (es *EmbeddedStore) AddMetadataChanges(changes []*MetadataChange) error {
+	es.Lock()
+	defer es.Unlock()
+	es.history = append(es.history, changes...)
+	return es.record(&embeddedLogEntry{History: changes})
+}
+
+func (es *EmbeddedStore) GetMetadataHistory(uuid string) ([]*MetadataChange, error) {
+	var ret []*MetadataChange
+	es.RLock()
+	defer es.RUnlock()
+	for _, change := range es.history {
+		if change.UUID == uuid {
+			ret = append(ret, change)
+		}
+	}
+	return ret, nil
+}
+
+func (es *EmbeddedStore) GetMetadataAsOf(when int64) ([]*MetadataChange, error) {
+	latest := make(map[string]*MetadataChange)
+	es.RLock()
+	for _, change := range es.history {
+		if change.Time <= when {
+			latest[change.UUID] = change
+		}
+	}
+	es.RUnlock()
+	ret := make([]*MetadataChange, 0, len(latest))
+	for _, change := range latest {
+		ret = append(ret, change)
+	}
+	sort.Sort(changesByUUID(ret))
+	return ret, nil
+}
+
+/** Implementing the APIKeyManager interface **/
+
+// Must be called with the lock held
+func (es *EmbeddedStore) apiKeyExists(apikey string) (bool, error) {
+	count := 0
+	for _, key := range es.apikeys {
+		if key["key"] == apikey {
+			count += 1
+		}
+	}
+	if count > 1 {
+		return false, errors.New("More than 1 API key with value " + apikey)
+	}
+	if count < 1 {
+		return false, errors.New("No API key with value " + apikey)
+	}
+	return true, nil
+}
+
+func (es *EmbeddedStore) ApiKeyExists(apikey string) (bool, error) {
+	es.RLock()
+	defer es.RUnlock()
+	return es.apiKeyExists(apikey)
+}
+
+func (es *EmbeddedStore) NewKey(name, email string, public bool) (string, error) {
+	apikey, err := generateAPIKey()
+	if err != nil {
+		return apikey, err
+	}
+	es.Lock()
+	defer es.Unlock()
+	for _, key := range es.apikeys {
+		if key["name"] == name && key["email"] == email {
+			return "", errors.New(fmt.Sprintf("could not save new apikey for %v %v (key with that name already exists)", name, email))
+		}
+	}
+	es.apikeys = append(es.apikeys, bson.M{"key": apikey, "name": name, "email": email, "public": public})
+	if err = es.record(es.logAPIKeys()); err != nil {
+		return apikey, errors.New(fmt.Sprintf("could not save new apikey for %v %v (%v)", name, email, err))
+	}
+	return apikey, nil
+}
+
+func (es *EmbeddedStore) GetKey(name, email string) (string, error) {
+	es.RLock()
+	defer es.RUnlock()
+	for _, key := range es.apikeys {
+		if key["name"] == name && key["email"] == email {
+			return key["key"].(string), nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("Could not retrieve apikey for %v %v (%v)", name, email, mgo.ErrNotFound))
+}
+
+func (es *EmbeddedStore) ListKeys(email string) ([]map[string]interface{}, error) {
+	var res []map[string]interface{}
+	es.RLock()
+	defer es.RUnlock()
+	for _, key := range es.apikeys {
+		if key["email"] == email {
+			res = append(res, map[string]interface{}(copyValue(key).(bson.M)))
+		}
+	}
+	return res, nil
+}
+
+// all of the API keys, as a change to the store
+func (es *EmbeddedStore) logAPIKeys() *embeddedLogEntry {
+	return &embeddedLogEntry{SetAPIKeys: true, APIKeys: es.apikeys}
+}
+
+// removes all keys for which @match returns true, and returns how many were
+// removed. Must be called with the lock held
+func (es *EmbeddedStore) removeKeys(match func(key bson.M) bool) int {
+	kept := es.apikeys[:0]
+	for _, key := range es.apikeys {
+		if !match(key) {
+			kept = append(kept, key)
+		}
+	}
+	removed := len(es.apikeys) - len(kept)
+	es.apikeys = kept
+	return removed
+}
+
+func (es *EmbeddedStore) DeleteKeyByName(name, email string) (string, error) {
+	es.Lock()
+	defer es.Unlock()
+	removed := es.removeKeys(func(key bson.M) bool {
+		return key["name"] == name && key["email"] == email
+	})
+	if err := es.record(es.logAPIKeys()); err != nil {
+		return "", errors.New(fmt.Sprintf("Could not delete keys for %v %v (%v)", name, email, err))
+	}
+	return fmt.Sprintf("Removed %v records", removed), nil
+}
+
+func (es *EmbeddedStore) DeleteKeyByValue(key string) (string, error) {
+	es.Lock()
+	defer es.Unlock()
+	if es.removeKeys(func(k bson.M) bool { return k["key"] == key }) == 0 {
+		return fmt.Sprintf("Removed key"), mgo.ErrNotFound
+	}
+	return fmt.Sprintf("Removed key"), es.record(es.logAPIKeys())
+}
+
+func (es *EmbeddedStore) Owner(key string) (map[string]interface{}, error) {
+	es.RLock()
+	defer es.RUnlock()
+	for _, k := range es.apikeys {
+		if k["key"] == key {
+			return map[string]interface{}{"name": k["name"], "email": k["email"]}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Could not find owners for key %v (%v)", key, mgo.ErrNotFound))
+}
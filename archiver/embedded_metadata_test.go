@@ -0,0 +1,271 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestEmbeddedStore(path string) *EmbeddedStore {
+	es := NewEmbeddedStore(path)
+	populateTestStore(es)
+	return es
+}
+
+// saves a small building worth of metadata to @store, with key enforcement
+// turned off
+func populateTestStore(store MetadataStore) {
+	store.EnforceKeys(false)
+	msgs := map[string]*SmapMessage{
+		"/building": &SmapMessage{Path: "/building", Metadata: bson.M{"Site": "soda"}},
+		"/building/temp": &SmapMessage{Path: "/building/temp", UUID: "aaa",
+			Metadata:   bson.M{"Type": "Sensor", "Location": bson.M{"Room": "410"}},
+			Properties: bson.M{"UnitofTime": "s", "ReadRate": 30}},
+		"/building/hum": &SmapMessage{Path: "/building/hum", UUID: "bbb",
+			Metadata:   bson.M{"Type": "Sensor", "Location": bson.M{"Room": "420"}, "Floor": 4},
+			Properties: bson.M{"ReadRate": "60"}},
+		"/building/setpoint": &SmapMessage{Path: "/building/setpoint", UUID: "ccc",
+			Metadata:   bson.M{"Type": "Setpoint", "Tags": []interface{}{"hvac", "zone"}},
+			Properties: bson.M{"StreamType": "object", "ReadRate": []interface{}{10, 90.5}}},
+	}
+	store.SaveTags(&msgs)
+}
+
+// parses the where clause of a select query
+func parseWhere(t *testing.T, where string) Predicate {
+	l := NewSQLex("select * where " + where + ";")
+	SQParse(l)
+	if l.error != nil {
+		t.Fatal("Could not parse ", where, ": ", l.error)
+	}
+	return l.query.where
+}
+
+var whereTests = []struct {
+	where string
+	uuids []string
+}{
+	{`Metadata/Type = "Sensor"`, []string{"aaa", "bbb"}},
+	{`Metadata/Site = "soda"`, []string{"aaa", "bbb", "ccc"}},
+	{`Metadata/Type != "Sensor"`, []string{"ccc"}},
+	{`Metadata/Location/Room like "4.0"`, []string{"aaa", "bbb"}},
+	{`Metadata/Location/Room like "^41"`, []string{"aaa"}},
+	{`has Metadata/Floor`, []string{"bbb"}},
+	{`not has Metadata/Floor`, []string{"aaa", "ccc"}},
+	{`not Metadata/Type like "Sens"`, []string{"ccc"}},
+	{`Metadata/Type = "Sensor" and Metadata/Location/Room = "420"`, []string{"bbb"}},
+	{`Metadata/Type = "Setpoint" or Metadata/Location/Room = "420"`, []string{"bbb", "ccc"}},
+	{`["410", "420"] in Metadata/Location/Room`, []string{"aaa", "bbb"}},
+	{`["410", "420"] not in Metadata/Location/Room`, []string{"ccc"}},
+	{`Metadata/Tags = "zone"`, []string{"ccc"}},
+	{`Metadata/Location = "410"`, []string{}},
+	{`uuid = "bbb"`, []string{"bbb"}},
+	{`Metadata/Floor = 4`, []string{"bbb"}},
+	{`Metadata/Floor >= 3`, []string{"bbb"}},
+	{`Metadata/Floor > 4`, []string{}},
+	{`Properties/ReadRate = 30`, []string{"aaa"}},
+	{`Properties/ReadRate != 30`, []string{"bbb", "ccc"}},
+	{`Properties/ReadRate < 30`, []string{"ccc"}},
+	{`Properties/ReadRate <= 30.0`, []string{"aaa", "ccc"}},
+	{`Properties/ReadRate > 90`, []string{"ccc"}},
+	{`Properties/ReadRate >= 90.6`, []string{}},
+	// strings of digits are not numbers
+	{`Properties/ReadRate >= 50`, []string{"ccc"}},
+	{`not Properties/ReadRate < 60`, []string{"bbb"}},
+	{`Metadata/Floor >= 3 or Properties/ReadRate < 60`, []string{"aaa", "bbb", "ccc"}},
+}
+
+// runs all of whereTests against a store populated by populateTestStore
+func testWhere(t *testing.T, store MetadataStore) {
+	for _, test := range whereTests {
+		uuids, err := store.GetUUIDs(parseWhere(t, test.where))
+		if err != nil {
+			t.Error(test.where, ": ", err)
+		}
+		if !isStringSliceEqual(uuids, test.uuids) {
+			t.Error(test.where, ": got ", uuids, " should be ", test.uuids)
+		}
+	}
+
+	if _, err := store.GetUUIDs(Like{Key: "Metadata.Type", Pattern: "(Sens"}); err == nil {
+		t.Error("Expected error for invalid regular expression")
+	}
+}
+
+func TestEmbeddedStoreWhere(t *testing.T) {
+	testWhere(t, newTestEmbeddedStore(""))
+}
+
+func TestEmbeddedStoreTags(t *testing.T) {
+	testTags(t, newTestEmbeddedStore(""))
+}
+
+// exercises tag retrieval and updates against a store populated by
+// populateTestStore
+func testTags(t *testing.T, es MetadataStore) {
+	if uot := es.GetUnitOfTime("aaa"); uot != UOT_S {
+		t.Error("Got ", uot, " should be ", UOT_S)
+	}
+	if uot := es.GetUnitOfTime("bbb"); uot != UOT_MS {
+		t.Error("Got ", uot, " should be ", UOT_MS)
+	}
+	if st := es.GetStreamType("ccc"); st != OBJECT_STREAM {
+		t.Error("Got ", st, " should be ", OBJECT_STREAM)
+	}
+
+	res, _ := es.GetTags(bson.M{"Metadata.Location.Room": 1}, false, "", Eq{Key: "uuid", Value: "aaa"}, Page{})
+	if len(res) != 1 || !valuesEqual(res[0], bson.M{"Metadata": bson.M{"Location": bson.M{"Room": "410"}}}) {
+		t.Error("Got ", res, " should be only Metadata.Location.Room")
+	}
+	res, _ = es.GetTags(bson.M{}, true, "Metadata.Type", nil, Page{})
+	if !valuesEqual(res, []interface{}{"Sensor", "Setpoint"}) {
+		t.Error("Got ", res, " should be [Sensor Setpoint]")
+	}
+
+	updated, err := es.UpdateTags(bson.M{"Metadata.Location.Building": "Soda"}, "", Eq{Key: "Metadata.Type", Value: "Sensor"})
+	if err != nil || updated["Updated"] != 2 {
+		t.Error("Got ", updated, err, " should have updated 2 records")
+	}
+	doc, _ := es.UUIDTags("bbb")
+	if room, _ := getPath(doc, "Metadata.Location.Room"); room != "420" {
+		t.Error("Got ", room, " should be 420; update replaced the subdocument")
+	}
+
+	es.RemoveTags(bson.M{"Metadata.Location": 1}, "", Eq{Key: "uuid", Value: "bbb"})
+	doc, _ = es.UUIDTags("bbb")
+	if _, found := getPath(doc, "Metadata.Location"); found {
+		t.Error("Metadata.Location should have been removed from ", doc)
+	}
+
+	removed, _ := es.RemoveDocs("", Eq{Key: "Metadata.Type", Value: "Setpoint"})
+	if removed["Removed"] != 1 {
+		t.Error("Got ", removed, " should have removed 1 record")
+	}
+	if _, err := es.UUIDTags("ccc"); err == nil {
+		t.Error("ccc should have been removed")
+	}
+}
+
+func TestEmbeddedStoreKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.bson")
+
+	es := newTestEmbeddedStore(path)
+	es.EnforceKeys(true)
+	key, err := es.NewKey("test", "test@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.NewKey("test", "test@example.com", false); err == nil {
+		t.Error("Should not be able to create a second key with the same name")
+	}
+	if ok, err := es.CanWrite(key, "ddd"); !ok || err != nil {
+		t.Error("Key should be able to claim new uuid: ", err)
+	}
+	if ok, _ := es.CanWrite("badkey", "ddd"); ok {
+		t.Error("Other keys should not be able to write to ddd")
+	}
+	if _, err := es.RemoveDocs(key, Eq{Key: "uuid", Value: "aaa"}); err == nil {
+		t.Error("Key should not be able to remove a document it does not own")
+	}
+	streamid := es.GetStreamId("ddd")
+
+	// everything should come back after reopening the store
+	es = NewEmbeddedStore(path)
+	if found, err := es.GetKey("test", "test@example.com"); found != key || err != nil {
+		t.Error("Got ", found, " should be ", key, " (", err, ")")
+	}
+	if owner, _ := es.Owner(key); owner["email"] != "test@example.com" {
+		t.Error("Got ", owner, " should be owned by test@example.com")
+	}
+	if ok, err := es.CanWrite(key, "ddd"); !ok || err != nil {
+		t.Error("Key should still own ddd: ", err)
+	}
+	if sid := es.GetStreamId("ddd"); sid != streamid {
+		t.Error("Got ", sid, " should be ", streamid)
+	}
+	if sid := es.GetStreamId("eee"); sid == streamid {
+		t.Error("New uuid got existing stream id ", sid)
+	}
+	if uuids, _ := es.GetUUIDs(Eq{Key: "Metadata.Type", Value: "Sensor"}); len(uuids) != 2 {
+		t.Error("Got ", uuids, " should be [aaa bbb]")
+	}
+
+	es.DeleteKeyByName("test", "test@example.com")
+	if keys, _ := es.ListKeys("test@example.com"); len(keys) != 0 {
+		t.Error("Got ", keys, " should have no keys")
+	}
+}
+
+func TestEmbeddedStoreLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.bson")
+
+	es := newTestEmbeddedStore(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("The changes should only be in the log until it is compacted")
+	}
+	es.UpdateTags(bson.M{"Metadata.Floor": 5}, "", Eq{Key: "uuid", Value: "aaa"})
+	es.RemoveDocs("", Eq{Key: "uuid", Value: "ccc"})
+	es.GetStreamId("aaa")
+	info, _ := os.Stat(es.logPath())
+	logSize := info.Size()
+
+	// an unchanged document is not logged again
+	es.UpdateTags(bson.M{"Metadata.Floor": 5}, "", Eq{Key: "uuid", Value: "aaa"})
+	if info, _ = os.Stat(es.logPath()); info.Size() != logSize {
+		t.Error("Got a log of ", info.Size(), " bytes, should still be ", logSize)
+	}
+
+	// simulate an append torn by a crash
+	f, err := os.OpenFile(es.logPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+
+	check := func(es *EmbeddedStore, when string) {
+		if doc, _ := es.UUIDTags("aaa"); !valuesEqual(doc["Metadata"].(bson.M)["Floor"], 5) {
+			t.Error(when, ": got ", doc, " should be on floor 5")
+		}
+		if _, err := es.UUIDTags("ccc"); err == nil {
+			t.Error(when, ": ccc should have been removed")
+		}
+		if uuids, _ := es.GetUUIDs(Eq{Key: "Metadata.Type", Value: "Sensor"}); len(uuids) != 2 {
+			t.Error(when, ": got ", uuids, " should be [aaa bbb]")
+		}
+	}
+	es = NewEmbeddedStore(path)
+	check(es, "replayed")
+	if info, _ = os.Stat(es.logPath()); info.Size() != logSize {
+		t.Error("Got a log of ", info.Size(), " bytes, the torn entry should be truncated to ", logSize)
+	}
+	streamid := es.GetStreamId("aaa")
+
+	// the next change compacts the log into the snapshot
+	es.minCompaction = 0
+	es.EnforceKeys(false)
+	es.UpdateTags(bson.M{"Metadata.Site": "cory"}, "", Eq{Key: "uuid", Value: "bbb"})
+	if info, _ = os.Stat(es.logPath()); info.Size() != 0 {
+		t.Error("Got a log of ", info.Size(), " bytes, should be empty after compaction")
+	}
+	es = NewEmbeddedStore(path)
+	check(es, "compacted")
+	if sid := es.GetStreamId("aaa"); sid != streamid {
+		t.Error("Got ", sid, " should be ", streamid)
+	}
+	if uuids, _ := es.GetUUIDs(Eq{Key: "Metadata.Site", Value: "cory"}); len(uuids) != 1 {
+		t.Error("Got ", uuids, " should be [bbb]")
+	}
+}
@@ -0,0 +1,199 @@
+package archiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gtfierro/msgpack"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strings"
+)
+
+// Any query can be prefixed with explain to see how Giles understands it
+// without running it:
+//
+//    explain apply mean() < window(size="5min") to data in (now -1h, now) where Metadata/Type = "Sensor";
+//
+// returns the parsed query, the where clause as the metadata store runs it,
+// the number of streams it matches and, for apply queries, the graph of nodes
+// that would evaluate it, so that a query that matches nothing or whose
+// operators do not fit together can be debugged.
+
+// The answer to an explain query
+type Explanation struct {
+	// the parts of the parsed query
+	Query map[string]interface{}
+	// the where clause compiled into the query language of the metadata
+	// store, for stores that compile it
+	CompiledWhere interface{} `json:",omitempty"`
+	// number of streams matched by the where clause, as of the time of an as
+	// of clause
+	UUIDs int
+	// for apply queries, the nodes that evaluate the query in the order the
+	// data goes through them
+	Graph []ExplainedNode `json:",omitempty"`
+	// why the query cannot run, if it cannot
+	Error string `json:",omitempty"`
+}
+
+// A node of the graph of an apply query, with the structure and data type
+// of its input and output
+type ExplainedNode struct {
+	Name string
+	// the operator of the query that made the node, if any
+	Operator     string `json:",omitempty"`
+	InStructure  string `json:",omitempty"`
+	InDatatype   string `json:",omitempty"`
+	OutStructure string `json:",omitempty"`
+	OutDatatype  string `json:",omitempty"`
+}
+
+var unitOfTimeNames = map[UnitOfTime]string{UOT_NS: "ns", UOT_US: "us", UOT_MS: "ms", UOT_S: "s"}
+
+// Describes how the query parsed into @lex would run, without running it
+func (a *Archiver) Explain(lex *SQLex) (*Explanation, error) {
+	q := lex.query
+	exp := &Explanation{Query: q.ast()}
+	if we, ok := a.store.(WhereExplainer); ok {
+		compiled, err := we.ExplainWhere(q.where)
+		if err != nil {
+			exp.Error = err.Error()
+			return exp, nil
+		}
+		exp.CompiledWhere = compiled
+	}
+	count, err := a.countMatches(q)
+	if err != nil {
+		return nil, err
+	}
+	exp.UUIDs = count
+	if q.qtype == APPLY_TYPE {
+		// the nodes are never run, so they are stopped once described
+		done := make(chan struct{})
+		defer close(done)
+		nodes, err := a.buildGraph(q, done)
+		for _, n := range nodes {
+			exp.Graph = append(exp.Graph, explainNode(n))
+		}
+		if err != nil {
+			exp.Error = err.Error()
+		}
+	}
+	return exp, nil
+}
+
+// Writes the explanation of the query parsed into @lex to @w as msgpack, like
+// the results of Query2
+func (a *Archiver) writeExplanation(lex *SQLex, w io.Writer) error {
+	exp, err := a.Explain(lex)
+	if err != nil {
+		return err
+	}
+	// msgpack does not encode structs, so turn it into maps through JSON
+	bytes, err := json.Marshal(exp)
+	if err != nil {
+		return err
+	}
+	var mpfriendly interface{}
+	if err = json.Unmarshal(bytes, &mpfriendly); err != nil {
+		return err
+	}
+	var mybytes = make([]byte, 1024)
+	length := msgpack.Encode(mpfriendly, &mybytes)
+	_, err = w.Write(mybytes[:length])
+	return err
+}
+
+// the number of streams matched by the where clause of @q
+func (a *Archiver) countMatches(q *query) (int, error) {
+	if !q.asof.IsZero() {
+		docs, err := a.GetTagsAsOf(bson.M{"uuid": 1}, false, "", q.where, Page{}, q.asof)
+		return len(docs), err
+	}
+	uuids, err := a.GetUUIDs(q.where)
+	return len(uuids), err
+}
+
+func explainNode(n *Node) ExplainedNode {
+	en := ExplainedNode{Name: nodeName(n)}
+	en.Operator, _ = n.Tags["operator"].(string)
+	if structure, found := n.Tags["in:structure"]; found {
+		en.InStructure = fmt.Sprintf("%v", structure)
+	}
+	if datatype, found := n.Tags["in:datatype"]; found {
+		en.InDatatype = fmt.Sprintf("%v", datatype)
+	}
+	if structure, found := n.Tags["out:structure"]; found {
+		en.OutStructure = fmt.Sprintf("%v", structure)
+	}
+	if datatype, found := n.Tags["out:datatype"]; found {
+		en.OutDatatype = fmt.Sprintf("%v", datatype)
+	}
+	return en
+}
+
+// the type of the operator of @n, e.g. SelectDataNode
+func nodeName(n *Node) string {
+	name := fmt.Sprintf("%T", n.Op)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// The parts of the parsed query that it has, keyed by what they are
+func (q *query) ast() map[string]interface{} {
+	ast := map[string]interface{}{"Type": q.qtype.String()}
+	if len(q.Contents) > 0 {
+		ast["Contents"] = q.Contents
+	}
+	if q.distinct {
+		ast["Distinct"] = true
+	}
+	if q.count {
+		ast["Count"] = true
+	}
+	if len(q.set) > 0 {
+		ast["Set"] = q.set
+	}
+	if q.data != nil && !q.data.start.IsZero() {
+		data := map[string]interface{}{"Type": q.data.dtype.String(), "Start": q.data.start}
+		if !q.data.end.IsZero() {
+			data["End"] = q.data.end
+		}
+		if q.data.limit.limit > 0 {
+			data["Limit"] = q.data.limit.limit
+		}
+		if q.data.limit.streamlimit > 0 {
+			data["StreamLimit"] = q.data.limit.streamlimit
+		}
+		if unit, found := unitOfTimeNames[q.data.timeconv]; found {
+			data["UnitOfTime"] = unit
+		}
+		if q.data.fill != nil {
+			fill := map[string]interface{}{"Method": q.data.fill.method, "Every": q.data.fill.every.String()}
+			if q.data.fill.method == FILL_CONSTANT {
+				fill["Value"] = q.data.fill.value
+			}
+			data["Fill"] = fill
+		}
+		ast["Data"] = data
+	}
+	if len(q.operators) > 0 {
+		// in the order they are applied
+		ast["Operators"] = q.operators
+	}
+	if q.where != nil {
+		ast["Where"] = q.where.String()
+	}
+	if !q.asof.IsZero() {
+		ast["AsOf"] = q.asof
+	}
+	if q.groupBy != "" {
+		ast["GroupBy"] = q.groupBy
+	}
+	if !q.page.IsZero() {
+		ast["Page"] = q.page
+	}
+	if q.cursor != "" {
+		ast["Cursor"] = q.cursor
+	}
+	return ast
+}
@@ -0,0 +1,105 @@
+package archiver
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExplainArchiver(store MetadataStore) *Archiver {
+	a := &Archiver{store: store}
+	a.qp = NewQueryProcessor(a)
+	return a
+}
+
+func explain(t *testing.T, a *Archiver, q string) *Explanation {
+	l := a.qp.Parse(q)
+	if l.error != nil {
+		t.Fatal("Could not parse ", q, ": ", l.error)
+	}
+	if !l.query.explain {
+		t.Fatal(q, " should be explained")
+	}
+	exp, err := a.Explain(l)
+	if err != nil {
+		t.Fatal(q, ": ", err)
+	}
+	return exp
+}
+
+func graphNames(exp *Explanation) []string {
+	var names []string
+	for _, node := range exp.Graph {
+		names = append(names, node.Name)
+	}
+	return names
+}
+
+func TestExplainSelect(t *testing.T) {
+	a := newTestExplainArchiver(newTestEmbeddedStore(""))
+	exp := explain(t, a, `explain select uuid where Metadata/Type = "Sensor" order by Properties/ReadRate limit 1;`)
+	if exp.UUIDs != 2 || exp.Query["Type"] != "select" || exp.Query["Where"] != `Metadata/Type = "Sensor"` || exp.Error != "" {
+		t.Error("Got ", exp, " should match the 2 sensors")
+	}
+	if page, _ := exp.Query["Page"].(Page); page.OrderBy != "Properties.ReadRate" || page.Limit != 1 {
+		t.Error("Got page ", exp.Query["Page"], " should be ordered and limited")
+	}
+	// the embedded store runs the parsed where clause itself
+	if exp.CompiledWhere != nil || len(exp.Graph) != 0 {
+		t.Error("Got ", exp.CompiledWhere, exp.Graph, " should have no compiled where clause or graph")
+	}
+	if exp = explain(t, a, `explain select * where Metadata/Type = "Nothing";`); exp.UUIDs != 0 {
+		t.Error("Got ", exp.UUIDs, " should match nothing")
+	}
+}
+
+func TestExplainSQLWhere(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	exp := explain(t, newTestExplainArchiver(ss), `explain set Metadata/Floor = 5 where Metadata/Location/Room = "410";`)
+	compiled, ok := asMap(exp.CompiledWhere)
+	if !ok || !strings.HasPrefix(compiled["Query"].(string), "SELECT doc FROM metadata WHERE ") || exp.UUIDs != 1 {
+		t.Error("Got ", exp.CompiledWhere, " and ", exp.UUIDs, " should be the SQL matching aaa")
+	}
+	if exp.Query["Type"] != "set" {
+		t.Error("Got ", exp.Query["Type"], " should be set")
+	}
+}
+
+func TestExplainApply(t *testing.T) {
+	a := newTestExplainArchiver(newTestEmbeddedStore(""))
+	exp := explain(t, a, `explain apply mean() < edge() < window() to data in (now -1h, now) where has uuid group by Metadata/Type;`)
+	if names := graphNames(exp); !isStringSliceEqual(names, []string{"WhereNode", "WindowNode", "GroupNode", "EdgeNode", "MeanNode"}) || exp.Error != "" {
+		t.Error("Got ", names, exp.Error, " should be the nodes in order")
+	}
+	if last := exp.Graph[len(exp.Graph)-1]; last.Operator != "mean" || last.InStructure != "TIMESERIES|GROUPED" || last.OutStructure != "LIST|GROUPED" {
+		t.Error("Got ", last, " should be the mean node")
+	}
+	if exp.UUIDs != 3 || exp.Query["GroupBy"] != "Metadata.Type" {
+		t.Error("Got ", exp.UUIDs, exp.Query, " should match all streams")
+	}
+
+	if exp = explain(t, a, `explain apply median() to data in (now -1h, now) where has uuid;`); exp.Error != "Unknown operator median" {
+		t.Error("Got ", exp.Error, " median is not an operator")
+	}
+	// readings of different streams rarely share a timestamp
+	exp = explain(t, a, `explain apply mean() < edge() to data in (now -1h, now) where has uuid group by Metadata/Type;`)
+	if exp.Error != "Grouped mean needs a window or fill to line up the streams first" {
+		t.Error("Got ", exp.Error, " grouped mean of unaligned streams should be refused")
+	}
+}
+
+func TestExplainStopsNodes(t *testing.T) {
+	a := newTestExplainArchiver(newTestEmbeddedStore(""))
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		explain(t, a, `explain apply mean() < window() to data in (now -1h, now) where has uuid;`)
+	}
+	for wait := 0; runtime.NumGoroutine() > before && wait < 100; wait++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if running := runtime.NumGoroutine(); running > before {
+		t.Error("Got ", running, " goroutines should be ", before)
+	}
+}
@@ -0,0 +1,122 @@
+package archiver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the number of streams GetData, PrevData and NextData fetch at the same time
+// unless configured otherwise
+const DEFAULT_FETCH_PARALLELISM = 16
+
+// The errors for the streams of a multi-stream fetch that could not be
+// fetched, by uuid. The streams that were fetched are still returned.
+type StreamErrors map[string]error
+
+func (se StreamErrors) Error() string {
+	uuids := make([]string, 0, len(se))
+	for uuid := range se {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	msgs := make([]string, len(uuids))
+	for i, uuid := range uuids {
+		msgs[i] = uuid + ": " + se[uuid].Error()
+	}
+	return fmt.Sprintf("Could not fetch %v streams (%v)", len(se), strings.Join(msgs, "; "))
+}
+
+// Logs the error for each stream if @err is a StreamErrors, in which case the
+// rest of the streams can still be used and nil is returned. Any other error
+// is returned as is
+func logStreamErrors(err error) error {
+	streamErrors, ok := err.(StreamErrors)
+	if !ok {
+		return err
+	}
+	for uuid, streamErr := range streamErrors {
+		log.Error("Error fetching data for %v (%v)", uuid, streamErr)
+	}
+	return nil
+}
+
+// Fetches each of the streamids with @numbers (one uuid at a time) or
+// @objects, depending on the type of stream, and converts the timestamps from
+// the unit of time of the stream to @to_uot. Up to a.fetchParallelism streams
+// are fetched at once, each over its own connection to the database. The
+// responses are in the order of @streamids; a stream that could not be
+// fetched gets an empty response with STATUS_ERROR, and its error is also
+// returned in a StreamErrors
+func (a *Archiver) fetchStreams(streamids []string, to_uot UnitOfTime,
+	numbers func([]string) ([]SmapNumbersResponse, error),
+	objects func(string) (SmapObjectResponse, error)) ([]interface{}, error) {
+	ret := make([]interface{}, len(streamids))
+	errs := make([]error, len(streamids))
+	parallelism := a.fetchParallelism
+	if parallelism <= 0 {
+		parallelism = DEFAULT_FETCH_PARALLELISM
+	}
+	slots := make(chan bool, parallelism)
+	var wg sync.WaitGroup
+	for idx, streamid := range streamids {
+		slots <- true
+		wg.Add(1)
+		go func(idx int, streamid string) {
+			defer wg.Done()
+			ret[idx], errs[idx] = a.fetchStream(streamid, to_uot, numbers, objects)
+			<-slots
+		}(idx, streamid)
+	}
+	wg.Wait()
+
+	var streamErrors = make(StreamErrors)
+	for idx, err := range errs {
+		if err != nil {
+			streamErrors[streamids[idx]] = err
+		}
+	}
+	if len(streamErrors) > 0 {
+		return ret, streamErrors
+	}
+	return ret, nil
+}
+
+func (a *Archiver) fetchStream(streamid string, to_uot UnitOfTime,
+	numbers func([]string) ([]SmapNumbersResponse, error),
+	objects func(string) (SmapObjectResponse, error)) (interface{}, error) {
+	stream_uot := a.store.GetUnitOfTime(streamid)
+	if a.store.GetStreamType(streamid) != NUMERIC_STREAM {
+		res, err := objects(streamid)
+		if err != nil {
+			return SmapObjectResponse{UUID: streamid, Status: STATUS_ERROR, Error: err.Error()}, err
+		}
+		for _, reading := range res.Readings {
+			reading.Time = convertTime(reading.Time, stream_uot, to_uot)
+		}
+		res.UUID = streamid
+		res.Status = readingsStatus(len(res.Readings))
+		return res, nil
+	}
+	res, err := numbers([]string{streamid})
+	if err == nil && len(res) == 0 {
+		err = fmt.Errorf("No response for %v from the timeseries database", streamid)
+	}
+	if err != nil {
+		return SmapNumbersResponse{UUID: streamid, Status: STATUS_ERROR, Error: err.Error()}, err
+	}
+	for _, reading := range res[0].Readings {
+		reading.Time = convertTime(reading.Time, stream_uot, to_uot)
+	}
+	res[0].UUID = streamid
+	res[0].Status = readingsStatus(len(res[0].Readings))
+	return res[0], nil
+}
+
+func readingsStatus(count int) string {
+	if count == 0 {
+		return STATUS_NODATA
+	}
+	return STATUS_OK
+}
@@ -0,0 +1,106 @@
+package archiver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// timeseries database that fails for one of its streams
+type flakyTSDB struct {
+	TSDB
+	bad string
+}
+
+func (f flakyTSDB) GetData(uuids []string, start, end uint64, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	if uuids[0] == f.bad {
+		return nil, errors.New("backend error")
+	}
+	return f.TSDB.GetData(uuids, start, end, uot)
+}
+
+func TestGetDataParallel(t *testing.T) {
+	es := newTestEmbeddedStore("")
+	mem := NewMemoryDB()
+	mem.AddStore(es)
+	var uuids []string
+	for i := 0; i < 20; i++ {
+		uuid := fmt.Sprintf("stream%02d", i)
+		uuids = append(uuids, uuid)
+		// stream i has i+1 readings (in ms, the default unit of time)
+		var times []uint64
+		for j := 0; j <= i; j++ {
+			times = append(times, uint64(j))
+		}
+		mem.Add(newTestStreamBuf(uuid, UOT_MS, times...))
+	}
+	a := &Archiver{store: es, tsdb: flakyTSDB{TSDB: mem, bad: "stream07"}, fetchParallelism: 3}
+
+	res, err := a.GetData(uuids, 0, 100, UOT_MS, UOT_MS)
+	streamErrors, ok := err.(StreamErrors)
+	if !ok || len(streamErrors) != 1 || streamErrors["stream07"] == nil {
+		t.Fatal("Got ", err, " should be an error for stream07 only")
+	}
+	for i, resp := range res.([]interface{}) {
+		snr := resp.(SmapNumbersResponse)
+		if snr.UUID != uuids[i] {
+			t.Error("Got ", snr.UUID, " at ", i, " should be ", uuids[i])
+		}
+		if i == 7 {
+			if len(snr.Readings) != 0 || snr.Status != STATUS_ERROR || snr.Error != "backend error" {
+				t.Error("Got ", snr, " for stream07 should be an error response")
+			}
+		} else if len(snr.Readings) != i+1 || snr.Status != STATUS_OK {
+			t.Error("Got ", len(snr.Readings), " readings for ", snr.UUID, " should be ", i+1)
+		}
+	}
+
+	// a stream without data in the range is not an error
+	res, err = a.GetData([]string{"stream00", "unknown"}, 50, 100, UOT_MS, UOT_MS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resp := range res.([]interface{}) {
+		if snr := resp.(SmapNumbersResponse); snr.Status != STATUS_NODATA || snr.Error != "" {
+			t.Error("Got ", snr, " should have status ", STATUS_NODATA)
+		}
+	}
+}
+
+func TestFetchEmptyObjectStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Archiver{store: newTestEmbeddedStore(""), objstore: newTestFileObjectStore(t, dir)}
+
+	// ccc is an object stream without any objects
+	for _, fetch := range []func() (interface{}, error){
+		func() (interface{}, error) { return a.PrevData([]string{"ccc"}, 100, 1, UOT_S, UOT_S) },
+		func() (interface{}, error) { return a.NextData([]string{"ccc"}, 100, 1, UOT_S, UOT_S) },
+	} {
+		res, err := fetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sor := res.([]interface{})[0].(SmapObjectResponse); sor.UUID != "ccc" || sor.Status != STATUS_NODATA || sor.Error != "" {
+			t.Error("Got ", sor, " should have status ", STATUS_NODATA)
+		}
+	}
+}
+
+func TestTransformSmapNumRespStatus(t *testing.T) {
+	res := transformSmapNumResp([]SmapNumbersResponse{
+		{UUID: "a", Status: STATUS_ERROR, Error: "backend error"},
+		{UUID: "b"},
+	})
+	if res[0]["Status"] != STATUS_ERROR || res[0]["Error"] != "backend error" {
+		t.Error("Got ", res[0], " should have status and error")
+	}
+	if _, found := res[1]["Status"]; found {
+		t.Error("Got ", res[1], " should not have a status")
+	}
+}
@@ -0,0 +1,368 @@
+package archiver
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileObjectStore is an ObjectStore that keeps objects on local disk, with
+// no limit on the size of an object.
+//
+// Values are BSON encoded and stored content-addressed under
+// blobs/<first 2 hex digits>/<sha256>, so a value that is archived many times
+// (e.g. an unchanged camera thumbnail) is only stored once. Each stream has an
+// append-only index file under streams/<uuid> of fixed-size records of
+// (time in nanoseconds, sha256, crc32) that is read into memory the first
+// time the stream is used. A blob is always written before the index record
+// that refers to it, so a crash can at worst leave an unreferenced blob or a
+// torn record at the end of an index, which is truncated on load.
+type FileObjectStore struct {
+	root    string
+	store   MetadataStore
+	streams map[string]*objectStream
+	sync.Mutex
+}
+
+const (
+	objectRecordSize = 44 // uint64 time, sha256, uint32 crc
+	objectBlobDir    = "blobs"
+	objectStreamDir  = "streams"
+)
+
+type objectEntry struct {
+	time uint64
+	hash [sha256.Size]byte
+}
+
+type objectStream struct {
+	filename string
+	// sorted by time, one entry per timestamp
+	entries []objectEntry
+	sync.RWMutex
+}
+
+func NewFileObjectStore(root string) *FileObjectStore {
+	log.Notice("Using file-backed object store at %v", root)
+	for _, dir := range []string{objectBlobDir, objectStreamDir} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			log.Critical("Could not create object store directory %v (%v)", root, err)
+			return nil
+		}
+	}
+	return &FileObjectStore{root: root, streams: make(map[string]*objectStream)}
+}
+
+func (fos *FileObjectStore) AddStore(store MetadataStore) {
+	fos.store = store
+}
+
+// Returns the stream for the given uuid, loading its index from disk the
+// first time it is used.
+func (fos *FileObjectStore) getStream(uuid string) (*objectStream, error) {
+	if uuid == "" || uuid == "." || uuid == ".." || strings.ContainsAny(uuid, "/\\") {
+		return nil, fmt.Errorf("Invalid uuid for file storage: %v", uuid)
+	}
+	fos.Lock()
+	defer fos.Unlock()
+	if stream, found := fos.streams[uuid]; found {
+		return stream, nil
+	}
+	stream := &objectStream{filename: filepath.Join(fos.root, objectStreamDir, uuid)}
+	if err := stream.load(); err != nil {
+		return nil, err
+	}
+	fos.streams[uuid] = stream
+	return stream, nil
+}
+
+func (fos *FileObjectStore) blobPath(hash [sha256.Size]byte) string {
+	name := hex.EncodeToString(hash[:])
+	return filepath.Join(fos.root, objectBlobDir, name[:2], name)
+}
+
+// Encodes @value and writes it to its blob file if it is not already there.
+// Returns the hash that addresses it
+func (fos *FileObjectStore) writeBlob(value interface{}) ([sha256.Size]byte, error) {
+	encoded, err := bson.Marshal(bson.M{"value": value})
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	hash := sha256.Sum256(encoded)
+	filename := fos.blobPath(hash)
+	if _, err = os.Stat(filename); err == nil {
+		return hash, nil
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return hash, err
+	}
+	// concurrent writers of the same value each get their own temp file
+	f, err := ioutil.TempFile(filepath.Dir(filename), "tmp")
+	if err != nil {
+		return hash, err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(encoded); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return hash, err
+	}
+	return hash, os.Rename(tmp, filename)
+}
+
+func (fos *FileObjectStore) readBlob(hash [sha256.Size]byte) (interface{}, error) {
+	var doc bson.M
+	encoded, err := ioutil.ReadFile(fos.blobPath(hash))
+	if err != nil {
+		return nil, err
+	}
+	if err = bson.Unmarshal(encoded, &doc); err != nil {
+		return nil, err
+	}
+	return doc["value"], nil
+}
+
+func encodeObjectRecord(buf []byte, entry objectEntry) {
+	binary.BigEndian.PutUint64(buf[0:8], entry.time)
+	copy(buf[8:40], entry.hash[:])
+	binary.BigEndian.PutUint32(buf[40:44], crc32.ChecksumIEEE(buf[0:40]))
+}
+
+// Reads the index of the stream. Anything after the last valid record (e.g. a
+// write torn by a crash) is truncated away.
+func (stream *objectStream) load() error {
+	contents, err := ioutil.ReadFile(stream.filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	offset := 0
+	for ; offset+objectRecordSize <= len(contents); offset += objectRecordSize {
+		rec := contents[offset : offset+objectRecordSize]
+		if binary.BigEndian.Uint32(rec[40:44]) != crc32.ChecksumIEEE(rec[0:40]) {
+			break
+		}
+		entry := objectEntry{time: binary.BigEndian.Uint64(rec[0:8])}
+		copy(entry.hash[:], rec[8:40])
+		stream.insert(entry)
+	}
+	if offset < len(contents) {
+		log.Warning("Truncating %v bytes of partial writes from %v", len(contents)-offset, stream.filename)
+		return os.Truncate(stream.filename, int64(offset))
+	}
+	return nil
+}
+
+// Adds @entry to the sorted entries. If there is already an entry at that
+// time it is replaced, so the latest write wins
+func (stream *objectStream) insert(entry objectEntry) {
+	idx := sort.Search(len(stream.entries), func(i int) bool { return stream.entries[i].time >= entry.time })
+	if idx < len(stream.entries) && stream.entries[idx].time == entry.time {
+		stream.entries[idx] = entry
+		return
+	}
+	stream.entries = append(stream.entries, objectEntry{})
+	copy(stream.entries[idx+1:], stream.entries[idx:])
+	stream.entries[idx] = entry
+}
+
+// Appends the entries to the index file
+func (stream *objectStream) append(entries []objectEntry) error {
+	stream.Lock()
+	defer stream.Unlock()
+	buf := make([]byte, objectRecordSize*len(entries))
+	for i, entry := range entries {
+		encodeObjectRecord(buf[i*objectRecordSize:], entry)
+	}
+	f, err := os.OpenFile(stream.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		// drop whatever part of the batch made it to disk
+		stream.entries = nil
+		if loadErr := stream.load(); loadErr != nil {
+			log.Error("Could not reload object index after failed write (%v)", loadErr)
+		}
+		return err
+	}
+	for _, entry := range entries {
+		stream.insert(entry)
+	}
+	return nil
+}
+
+// Rewrites the index file without the entries in [start, end) (nanoseconds)
+// and atomically replaces it
+func (stream *objectStream) remove(start, end uint64) error {
+	stream.Lock()
+	defer stream.Unlock()
+	var kept []objectEntry
+	for _, entry := range stream.entries {
+		if entry.time < start || entry.time >= end {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == len(stream.entries) {
+		return nil
+	}
+	buf := make([]byte, objectRecordSize*len(kept))
+	for i, entry := range kept {
+		encodeObjectRecord(buf[i*objectRecordSize:], entry)
+	}
+	tmp := stream.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, stream.filename); err != nil {
+		return err
+	}
+	stream.entries = kept
+	return nil
+}
+
+// Returns the entries for which @pick returns a [from, to) range of indexes
+func (stream *objectStream) slice(pick func(entries []objectEntry) (int, int)) []objectEntry {
+	stream.RLock()
+	defer stream.RUnlock()
+	from, to := pick(stream.entries)
+	ret := make([]objectEntry, to-from)
+	copy(ret, stream.entries[from:to])
+	return ret
+}
+
+func (fos *FileObjectStore) AddObject(msg *SmapMessage) (bool, error) {
+	if msg.Readings == nil || len(msg.Readings) == 0 {
+		return false, errors.New("No readings in sMAP message")
+	} // return early
+	if len(msg.UUID) == 0 {
+		return false, errors.New("Reading has no UUID")
+	}
+	stream, err := fos.getStream(msg.UUID)
+	if err != nil {
+		return false, err
+	}
+	uot := fos.store.GetUnitOfTime(msg.UUID)
+	entries := make([]objectEntry, len(msg.Readings))
+	for i, rdg := range msg.Readings {
+		entries[i].time = convertTime(rdg.GetTime(), uot, UOT_NS)
+		if entries[i].hash, err = fos.writeBlob(rdg.GetValue()); err != nil {
+			return false, err
+		}
+	}
+	if err = stream.append(entries); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Reads the blobs for @entries into a response for @uuid, converting the
+// timestamps to the stream's unit of time
+func (fos *FileObjectStore) response(uuid string, entries []objectEntry) (SmapObjectResponse, error) {
+	uot := fos.store.GetUnitOfTime(uuid)
+	ret := SmapObjectResponse{Readings: make([]*SmapObjectReading, len(entries)), UUID: uuid}
+	for i, entry := range entries {
+		value, err := fos.readBlob(entry.hash)
+		if err != nil {
+			return ret, err
+		}
+		ret.Readings[i] = &SmapObjectReading{Time: convertTime(entry.time, UOT_NS, uot), Value: value}
+	}
+	return ret, nil
+}
+
+func (fos *FileObjectStore) PrevObject(uuid string, time uint64, uot UnitOfTime) (SmapObjectResponse, error) {
+	var ret SmapObjectResponse
+	stream, err := fos.getStream(uuid)
+	if err != nil {
+		return ret, err
+	}
+	time_ns := convertTime(time, uot, UOT_NS)
+	entries := stream.slice(func(entries []objectEntry) (int, int) {
+		idx := sort.Search(len(entries), func(i int) bool { return entries[i].time > time_ns })
+		if idx == 0 {
+			return 0, 0
+		}
+		return idx - 1, idx
+	})
+	if len(entries) == 0 {
+		return SmapObjectResponse{UUID: uuid}, nil
+	}
+	return fos.response(uuid, entries)
+}
+
+func (fos *FileObjectStore) NextObject(uuid string, time uint64, uot UnitOfTime) (SmapObjectResponse, error) {
+	var ret SmapObjectResponse
+	stream, err := fos.getStream(uuid)
+	if err != nil {
+		return ret, err
+	}
+	time_ns := convertTime(time, uot, UOT_NS)
+	entries := stream.slice(func(entries []objectEntry) (int, int) {
+		idx := sort.Search(len(entries), func(i int) bool { return entries[i].time >= time_ns })
+		if idx == len(entries) {
+			return idx, idx
+		}
+		return idx, idx + 1
+	})
+	if len(entries) == 0 {
+		return SmapObjectResponse{UUID: uuid}, nil
+	}
+	return fos.response(uuid, entries)
+}
+
+func (fos *FileObjectStore) GetObjects(uuid string, start uint64, end uint64, uot UnitOfTime) (SmapObjectResponse, error) {
+	var ret SmapObjectResponse
+	stream, err := fos.getStream(uuid)
+	if err != nil {
+		return ret, err
+	}
+	start_time_ns := convertTime(start, uot, UOT_NS)
+	end_time_ns := convertTime(end, uot, UOT_NS)
+	entries := stream.slice(func(entries []objectEntry) (int, int) {
+		from := sort.Search(len(entries), func(i int) bool { return entries[i].time >= start_time_ns })
+		to := sort.Search(len(entries), func(i int) bool { return entries[i].time > end_time_ns })
+		if to < from {
+			to = from
+		}
+		return from, to
+	})
+	return fos.response(uuid, entries)
+}
+
+// Removes the objects in [start, end) from the stream's index. The blobs are
+// left in place because other streams (or other times) may refer to them.
+func (fos *FileObjectStore) DeleteObjects(uuid string, start uint64, end uint64, uot UnitOfTime) error {
+	stream, err := fos.getStream(uuid)
+	if err != nil {
+		return err
+	}
+	return stream.remove(convertTime(start, uot, UOT_NS), convertTime(end, uot, UOT_NS))
+}
@@ -0,0 +1,118 @@
+package archiver
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFileObjectStore(t *testing.T, dir string) *FileObjectStore {
+	fos := NewFileObjectStore(dir)
+	if fos == nil {
+		t.Fatal("Could not create FileObjectStore in ", dir)
+	}
+	fos.AddStore(uotStore{uot: UOT_S})
+	return fos
+}
+
+func TestFileObjectStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileobjects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// much larger than the 1000 bytes the Mongo object store allows
+	thumbnail := bytes.Repeat([]byte{0xff, 0xd8}, 50000)
+	fos := newTestFileObjectStore(t, dir)
+	msg := &SmapMessage{UUID: "a", Readings: []Reading{
+		&SmapObjectReading{Time: 3, Value: thumbnail},
+		&SmapObjectReading{Time: 1, Value: bson.M{"status": "ok"}},
+		&SmapObjectReading{Time: 2, Value: thumbnail},
+	}}
+	if ok, err := fos.AddObject(msg); !ok || err != nil {
+		t.Fatal("Could not add objects: ", err)
+	}
+	// the thumbnail is stored once
+	blobs, _ := filepath.Glob(filepath.Join(dir, objectBlobDir, "*", "*"))
+	if len(blobs) != 2 {
+		t.Error("Got ", len(blobs), " blobs should be 2")
+	}
+
+	// reopen to read everything back from disk
+	fos = newTestFileObjectStore(t, dir)
+	res, err := fos.GetObjects("a", 1, 2, UOT_S)
+	if err != nil || len(res.Readings) != 2 {
+		t.Fatal("Got ", res, " (", err, ") should have 2 readings")
+	}
+	if status, _ := getPath(res.Readings[0].Value.(bson.M), "status"); status != "ok" {
+		t.Error("Got ", res.Readings[0].Value, " should be {status: ok}")
+	}
+	if value, ok := res.Readings[1].Value.([]byte); !ok || !bytes.Equal(value, thumbnail) {
+		t.Error("Large object did not round trip")
+	}
+	if res, err := fos.PrevObject("a", 2500, UOT_MS); err != nil || res.Readings[0].Time != 2 {
+		t.Error("Got ", res, " (", err, ") should be the reading at 2")
+	}
+	if res, err := fos.NextObject("a", 2500, UOT_MS); err != nil || res.Readings[0].Time != 3 {
+		t.Error("Got ", res, " (", err, ") should be the reading at 3")
+	}
+	if res, err := fos.NextObject("a", 4, UOT_S); err != nil || res.UUID != "a" || len(res.Readings) != 0 {
+		t.Error("Got ", res, " (", err, ") there should be no object after 4")
+	}
+
+	// later writes to the same timestamp win
+	fos.AddObject(&SmapMessage{UUID: "a", Readings: []Reading{&SmapObjectReading{Time: 1, Value: "replaced"}}})
+	if res, _ := fos.PrevObject("a", 1, UOT_S); len(res.Readings) != 1 || res.Readings[0].Value != "replaced" {
+		t.Error("Got ", res, " should be replaced")
+	}
+}
+
+func TestFileObjectStoreTornIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileobjects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fos := newTestFileObjectStore(t, dir)
+	fos.AddObject(&SmapMessage{UUID: "a", Readings: []Reading{&SmapObjectReading{Time: 1, Value: "x"}}})
+	index := filepath.Join(dir, objectStreamDir, "a")
+	f, _ := os.OpenFile(index, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	fos = newTestFileObjectStore(t, dir)
+	if res, err := fos.GetObjects("a", 0, 10, UOT_S); err != nil || len(res.Readings) != 1 {
+		t.Error("Got ", res, " (", err, ") should have 1 reading")
+	}
+	if info, _ := os.Stat(index); info.Size() != objectRecordSize {
+		t.Error("Got index of ", info.Size(), " bytes should be ", objectRecordSize)
+	}
+}
+
+func TestFileObjectStoreDeleteObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileobjects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fos := newTestFileObjectStore(t, dir)
+	fos.AddObject(&SmapMessage{UUID: "a", Readings: []Reading{
+		&SmapObjectReading{Time: 1, Value: "x"},
+		&SmapObjectReading{Time: 2, Value: "y"},
+		&SmapObjectReading{Time: 3, Value: "z"},
+	}})
+	if err := fos.DeleteObjects("a", 2, 3, UOT_S); err != nil {
+		t.Fatal(err)
+	}
+	fos = newTestFileObjectStore(t, dir)
+	res, err := fos.GetObjects("a", 0, 10, UOT_S)
+	if err != nil || len(res.Readings) != 2 || res.Readings[0].Value != "x" || res.Readings[1].Value != "z" {
+		t.Error("Got ", res, " (", err, ") should be x and z")
+	}
+}
@@ -0,0 +1,139 @@
+package archiver
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+)
+
+// Metadata selects and data queries can be grouped by the value of a tag:
+//
+//    select count where Metadata/Type = "Sensor" group by Metadata/Location/Building;
+//    apply mean() to data in (now -1h, now) where Metadata/Type = "Sensor" group by Metadata/HVACZone;
+//
+// A stream whose tag is a list is in the group of each of its elements, and
+// the streams without the tag are in a group whose value is nil. Groups are
+// ordered by their value the same way `order by` orders documents.
+
+// One group of a metadata select with a group by clause
+type TagGroup struct {
+	// the value of the group by tag shared by the streams of the group
+	Value interface{}
+	// number of streams in the group
+	Count int
+	// the selected tags of each stream, which include the group by tag. Left
+	// out by select count
+	Results []interface{} `json:",omitempty"`
+}
+
+// Runs the metadata select @q, which counts streams or has a group by
+// clause, through @get, which returns the @target tags of the documents
+// matching the where clause. Counting without a group by returns a single
+// group with a nil Value
+func selectGroups(q *query, get func(target bson.M) ([]interface{}, error)) ([]TagGroup, error) {
+	if q.distinct {
+		return nil, errors.New("Distinct queries cannot be grouped")
+	}
+	if !q.page.IsZero() || q.cursor != "" {
+		return nil, errors.New("Grouped queries cannot be ordered or limited")
+	}
+	var target bson.M
+	if q.count {
+		target = bson.M{"uuid": 1}
+	} else {
+		target = q.ContentsBson()
+	}
+	if q.groupBy != "" && len(target) > 0 {
+		target[q.groupBy] = 1
+	}
+	docs, err := get(target)
+	if err != nil {
+		return nil, err
+	}
+	values, members := groupIndexes(len(docs), func(i int) []interface{} {
+		doc, _ := asMap(docs[i])
+		return groupValues(doc, q.groupBy)
+	})
+	groups := make([]TagGroup, len(values))
+	for i, value := range values {
+		groups[i] = TagGroup{Value: value, Count: len(members[i])}
+		if q.count {
+			continue
+		}
+		groups[i].Results = make([]interface{}, len(members[i]))
+		for j, member := range members[i] {
+			groups[i].Results[j] = docs[member]
+		}
+	}
+	return groups, nil
+}
+
+// The values of @key in @doc that it is grouped by: each element if the value
+// is a list, or nil if @doc does not have it. Everything is in the nil group
+// if @key is empty
+func groupValues(doc bson.M, key string) []interface{} {
+	if key == "" {
+		return []interface{}{nil}
+	}
+	value, found := getPath(doc, key)
+	if !found {
+		return []interface{}{nil}
+	}
+	list, ok := asList(value)
+	if !ok {
+		return []interface{}{value}
+	}
+	var ret []interface{}
+	for _, elem := range list {
+		if !containsValue(ret, elem) {
+			ret = append(ret, elem)
+		}
+	}
+	if len(ret) == 0 {
+		return []interface{}{nil}
+	}
+	return ret
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if valuesEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type valueGroups struct {
+	values  []interface{}
+	members [][]int
+}
+
+func (g valueGroups) Len() int { return len(g.values) }
+func (g valueGroups) Swap(i, j int) {
+	g.values[i], g.values[j] = g.values[j], g.values[i]
+	g.members[i], g.members[j] = g.members[j], g.members[i]
+}
+func (g valueGroups) Less(i, j int) bool { return compareSortValues(g.values[i], g.values[j]) < 0 }
+
+// Groups the @n items 0..n-1 by the values that @valuesOf returns for each.
+// Returns the values of the groups in sort order, and the indexes of the items
+// in each group in the order they were given
+func groupIndexes(n int, valuesOf func(i int) []interface{}) ([]interface{}, [][]int) {
+	groups := valueGroups{values: []interface{}{}, members: [][]int{}}
+	for i := 0; i < n; i++ {
+	values:
+		for _, value := range valuesOf(i) {
+			for g, seen := range groups.values {
+				if valuesEqual(seen, value) {
+					groups.members[g] = append(groups.members[g], i)
+					continue values
+				}
+			}
+			groups.values = append(groups.values, value)
+			groups.members = append(groups.members, []int{i})
+		}
+	}
+	sort.Sort(groups)
+	return groups.values, groups.members
+}
@@ -0,0 +1,206 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestParseGroupBy(t *testing.T) {
+	for _, test := range []struct {
+		query   string
+		count   bool
+		groupBy string
+	}{
+		{`select count where has uuid;`, true, ""},
+		{`select count where Metadata/Type = "Sensor" group by Metadata/Location/Building;`, true, "Metadata.Location.Building"},
+		{`select * group by Metadata/Type;`, false, "Metadata.Type"},
+		{`select uuid where has uuid as of "2026-01-01" group by Metadata/Type;`, false, "Metadata.Type"},
+		{`apply mean() to data in (now -1h, now) where has uuid group by Metadata/HVACZone;`, false, "Metadata.HVACZone"},
+	} {
+		q := parseQuery(t, test.query)
+		if q.count != test.count || q.groupBy != test.groupBy {
+			t.Error(test.query, ": got ", q.count, " ", q.groupBy, " should be ", test.count, " ", test.groupBy)
+		}
+	}
+	// count is still an operator
+	q := parseQuery(t, `apply count() < edge() to data in (now -1h, now) where has uuid;`)
+	if len(q.operators) != 2 || q.operators[1].Operator != "count" {
+		t.Error("Got ", q.operators, " should apply count")
+	}
+}
+
+// runs the grouped select @q against @store
+func runGroups(t *testing.T, store MetadataStore, q string) []TagGroup {
+	query := parseQuery(t, q)
+	groups, err := selectGroups(query, func(target bson.M) ([]interface{}, error) {
+		return store.GetTags(target, false, "", query.where, Page{})
+	})
+	if err != nil {
+		t.Fatal(q, ": ", err)
+	}
+	return groups
+}
+
+func TestSelectGroups(t *testing.T) {
+	store := newTestEmbeddedStore("")
+	for _, test := range []struct {
+		query  string
+		values []interface{}
+		counts []int
+	}{
+		{`select count where has uuid;`, []interface{}{nil}, []int{3}},
+		{`select count group by Metadata/Type;`, []interface{}{"Sensor", "Setpoint"}, []int{2, 1}},
+		// the streams without a floor are in the nil group, which sorts first
+		{`select count where has uuid group by Metadata/Floor;`, []interface{}{nil, 4}, []int{2, 1}},
+		// ccc is in the group of each of its tags
+		{`select count group by Metadata/Tags;`, []interface{}{nil, "hvac", "zone"}, []int{2, 1, 1}},
+		{`select count where Metadata/Type = "Sensor" group by Metadata/Location/Room;`, []interface{}{"410", "420"}, []int{1, 1}},
+	} {
+		groups := runGroups(t, store, test.query)
+		if len(groups) != len(test.values) {
+			t.Error(test.query, ": got ", groups, " should have ", len(test.values), " groups")
+			continue
+		}
+		for i, group := range groups {
+			if !valuesEqual(group.Value, test.values[i]) || group.Count != test.counts[i] || group.Results != nil {
+				t.Error(test.query, ": got ", group, " should be ", test.values[i], " with ", test.counts[i])
+			}
+		}
+	}
+
+	groups := runGroups(t, store, `select uuid group by Metadata/Type;`)
+	if len(groups) != 2 || !isStringSliceEqual(resultUUIDs(groups[0].Results), []string{"aaa", "bbb"}) {
+		t.Error("Got ", groups, " should have the sensors first")
+	}
+	if doc, _ := asMap(groups[1].Results[0]); doc["uuid"] != "ccc" || doc["Metadata"] == nil {
+		t.Error("Got ", doc, " should have the uuid and type of ccc")
+	}
+
+	for _, bad := range []string{`select distinct Metadata/Type group by Metadata/Type;`, `select count group by Metadata/Type limit 1;`} {
+		if _, err := selectGroups(parseQuery(t, bad), nil); err == nil {
+			t.Error(bad, " should not be allowed")
+		}
+	}
+}
+
+func testStream(uuid string, readings ...float64) SmapNumbersResponse {
+	snr := SmapNumbersResponse{UUID: uuid}
+	for i, value := range readings {
+		snr.Readings = append(snr.Readings, &SmapNumberReading{Time: uint64(i + 1), Value: value})
+	}
+	return snr
+}
+
+func streamUUIDs(streams []SmapNumbersResponse) []string {
+	var uuids []string
+	for _, stream := range streams {
+		uuids = append(uuids, stream.UUID)
+	}
+	return uuids
+}
+
+func TestGroupNode(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	node := NewGroupNode(done, "Metadata.Type", newTestEmbeddedStore(""))
+	res, err := node.Op.Run([]SmapNumbersResponse{testStream("ccc"), testStream("bbb"), testStream("aaa"), testStream("ddd")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := res.([]TimeseriesGroup)
+	if len(groups) != 3 {
+		t.Fatal("Got ", groups, " should be 3 groups")
+	}
+	for i, test := range []struct {
+		value interface{}
+		uuids []string
+	}{
+		{nil, []string{"ddd"}},
+		{"Sensor", []string{"bbb", "aaa"}},
+		{"Setpoint", []string{"ccc"}},
+	} {
+		if groups[i].Value != test.value || !isStringSliceEqual(streamUUIDs(groups[i].Streams), test.uuids) {
+			t.Error("Got ", groups[i].Value, streamUUIDs(groups[i].Streams), " should be ", test.value, test.uuids)
+		}
+	}
+}
+
+func TestAggregateGroups(t *testing.T) {
+	groups := []TimeseriesGroup{
+		{Value: "a", Streams: []SmapNumbersResponse{testStream("aaa", 1, 2), testStream("bbb", 3, 4, 5)}},
+		{Value: "b", Streams: []SmapNumbersResponse{testStream("ccc")}},
+	}
+	for _, test := range []struct {
+		stat   string
+		values []float64
+	}{
+		{"mean", []float64{2, 3, 5}},
+		{"min", []float64{1, 2, 5}},
+		{"max", []float64{3, 4, 5}},
+		{"count", []float64{2, 2, 1}},
+	} {
+		res := aggregateGroups(groups, test.stat)
+		if len(res) != 2 || len(res[0].Streams) != 1 || len(res[1].Streams) != 1 || len(res[1].Streams[0].Readings) != 0 {
+			t.Error(test.stat, ": got ", res, " should be one series per group")
+			continue
+		}
+		var values []float64
+		for i, reading := range res[0].Streams[0].Readings {
+			if reading.Time != uint64(i+1) {
+				t.Error(test.stat, ": got time ", reading.Time, " should be ", i+1)
+			}
+			values = append(values, reading.Value)
+		}
+		if len(values) != len(test.values) {
+			t.Error(test.stat, ": got ", values, " should be ", test.values)
+			continue
+		}
+		for i := range values {
+			if values[i] != test.values[i] {
+				t.Error(test.stat, ": got ", values, " should be ", test.values)
+				break
+			}
+		}
+	}
+}
+
+func TestNodeRunsOnGroups(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	groups := []TimeseriesGroup{
+		{Value: "a", Streams: []SmapNumbersResponse{testStream("aaa", 1, 3), testStream("bbb", 2, 6)}},
+		{Value: "b", Streams: []SmapNumbersResponse{testStream("ccc", 5, 4)}},
+	}
+
+	qp := &QueryProcessor{}
+	mean, edge := NewMeanNode(done), NewEdgeNode(done)
+	if !qp.CheckOutToIn(NewGroupNode(done, "Metadata.Type", newTestEmbeddedStore("")), mean) || !qp.CheckOutToIn(mean, edge) {
+		t.Error("Groups should go to the mean node, and its output to the edge node")
+	}
+	if qp.CheckOutToIn(NewWhereNode(done, nil, newTestEmbeddedStore("")), edge) {
+		t.Error("A list of uuids should not go to the edge node")
+	}
+
+	// the edge node does not take groups, so it runs on each of them
+	res, err := edge.run(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edges := res.([]TimeseriesGroup)
+	if len(edges) != 2 || edges[1].Value != "b" || !isStringSliceEqual(streamUUIDs(edges[0].Streams), []string{"aaa", "bbb"}) {
+		t.Fatal("Got ", edges, " should be the groups of edges")
+	}
+	if rdg := edges[1].Streams[0].Readings[0]; rdg.Value != -1 {
+		t.Error("Got ", rdg.Value, " should be -1")
+	}
+
+	// the mean node aggregates each group
+	res, err = mean.run(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	means := res.([]TimeseriesGroup)
+	if rdg := means[0].Streams[0].Readings[1]; len(means) != 2 || rdg.Value != 4.5 {
+		t.Error("Got ", means, " should be the mean of each group")
+	}
+}
@@ -0,0 +1,314 @@
+package archiver
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The metadata history is an append-only log of the changes made to the tags
+// of each stream. After every write to the metadata store (incoming messages
+// with Metadata, Properties or Actuator, and set/delete queries), the current
+// document of each affected stream is compared with the last one recorded,
+// and if anything changed we append a MetadataChange with the tags that
+// changed and the whole new document. The documents let us answer
+// `select ... as of <time>` queries by evaluating the where clause against
+// the latest recorded document of each stream at that time.
+//
+// Streams only have history from the first time their tags change after the
+// history was enabled.
+
+// what made a change to the metadata
+const (
+	HISTORY_ADD    = "add"    // tags in an incoming message
+	HISTORY_SET    = "set"    // set query
+	HISTORY_REMOVE = "remove" // delete query for some tags
+	HISTORY_DELETE = "delete" // delete query for whole documents
+)
+
+var errNoHistory = errors.New("The metadata store does not keep history")
+
+type MetadataChange struct {
+	UUID string `bson:"uuid"`
+	// unix nanoseconds
+	Time   int64  `bson:"time"`
+	Action string `bson:"action"`
+	ApiKey string `bson:"apikey"`
+	// name and email of the owner of ApiKey, if known
+	Owner bson.M `bson:"owner,omitempty"`
+	// the tags that changed, keyed by path as in queries (Metadata/Site),
+	// with their new values. Removed tags have a nil value
+	Changes bson.M `bson:"changes"`
+	// the document after the change, or nil if the document was removed
+	Document bson.M `bson:"document"`
+}
+
+type changesByUUID []*MetadataChange
+
+func (c changesByUUID) Len() int           { return len(c) }
+func (c changesByUUID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c changesByUUID) Less(i, j int) bool { return c[i].UUID < c[j].UUID }
+
+// records the changes to the tags of streams. Keeps the last recorded
+// document of each stream in memory to work out what changed
+type historyRecorder struct {
+	store   MetadataStore
+	manager APIKeyManager
+	history MetadataHistory
+	// uuid -> flattened document as of its last recorded change
+	last map[string]bson.M
+	sync.Mutex
+}
+
+func newHistoryRecorder(store MetadataStore, manager APIKeyManager, history MetadataHistory) *historyRecorder {
+	return &historyRecorder{store: store, manager: manager, history: history, last: make(map[string]bson.M)}
+}
+
+// Appends a MetadataChange for each of the streams in @uuids whose document
+// has changed since it was last recorded. Does nothing if the recorder is nil
+func (hr *historyRecorder) record(uuids []string, apikey, action string) error {
+	if hr == nil || len(uuids) == 0 {
+		return nil
+	}
+	var owner bson.M
+	if apikey != "" && hr.manager != nil {
+		if o, err := hr.manager.Owner(apikey); err == nil {
+			owner = bson.M(o)
+		}
+	}
+	now := time.Now().UnixNano()
+	hr.Lock()
+	defer hr.Unlock()
+	var changes []*MetadataChange
+	for _, uuid := range uuids {
+		previous, err := hr.previous(uuid)
+		if err != nil {
+			return err
+		}
+		doc, err := hr.store.UUIDTags(uuid)
+		if err == mgo.ErrNotFound {
+			doc = nil
+		} else if err != nil {
+			return err
+		}
+		current := flattenDocument(doc)
+		diff := diffDocuments(previous, current)
+		if len(diff) == 0 {
+			continue
+		}
+		changes = append(changes, &MetadataChange{
+			UUID:     uuid,
+			Time:     now,
+			Action:   action,
+			ApiKey:   apikey,
+			Owner:    owner,
+			Changes:  diff,
+			Document: doc,
+		})
+		hr.last[uuid] = current
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return hr.history.AddMetadataChanges(changes)
+}
+
+// Like record for the streams whose tags may have been changed by @readings,
+// an incoming batch. Most messages repeat the tags they were sent with
+// before, so a stream whose own tags all have the values they had at its last
+// recorded change is skipped without fetching its document. This does not
+// apply when tags are inherited from the paths above the streams
+func (hr *historyRecorder) recordMessages(readings map[string]*SmapMessage, apikey string) error {
+	if hr == nil {
+		return nil
+	}
+	uuids := taggedStreams(readings)
+	if inheritsTags(readings) {
+		return hr.record(uuids, apikey, HISTORY_ADD)
+	}
+	messages := make(map[string]*SmapMessage, len(readings))
+	for _, msg := range readings {
+		if msg.UUID != "" {
+			messages[msg.UUID] = msg
+		}
+	}
+	hr.Lock()
+	changed := uuids[:0]
+	for _, uuid := range uuids {
+		if !hr.repeats(messages[uuid]) {
+			changed = append(changed, uuid)
+		}
+	}
+	hr.Unlock()
+	return hr.record(changed, apikey, HISTORY_ADD)
+}
+
+// true if all of the tags of @msg have the values they had at the last
+// recorded change to its stream. Must be called with the lock held
+func (hr *historyRecorder) repeats(msg *SmapMessage) bool {
+	last, found := hr.last[msg.UUID]
+	if !found {
+		return false
+	}
+	tags := bson.M{}
+	for name, values := range map[string]bson.M{"Metadata": msg.Metadata, "Properties": msg.Properties, "Actuator": msg.Actuator} {
+		if values != nil {
+			tags[name] = values
+		}
+	}
+	for k, v := range flattenDocument(tags) {
+		if old, found := last[k]; !found || !valuesEqual(old, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the flattened document from the last change to @uuid, looking it up
+// in the history if we have not seen the stream yet. Must be called with the
+// lock held
+func (hr *historyRecorder) previous(uuid string) (bson.M, error) {
+	if doc, found := hr.last[uuid]; found {
+		return doc, nil
+	}
+	changes, err := hr.history.GetMetadataHistory(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return bson.M{}, nil
+	}
+	return flattenDocument(changes[len(changes)-1].Document), nil
+}
+
+// Returns the leaves of @doc keyed by their paths, written with slashes like
+// the tags in queries so they can be stored as Mongo keys
+func flattenDocument(doc bson.M) bson.M {
+	ret := bson.M{}
+	var flatten func(prefix string, m bson.M)
+	flatten = func(prefix string, m bson.M) {
+		for k, v := range m {
+			if sub, ok := asMap(v); ok && len(sub) > 0 {
+				flatten(prefix+k+"/", sub)
+			} else {
+				ret[prefix+k] = v
+			}
+		}
+	}
+	flatten("", doc)
+	return ret
+}
+
+// Returns the keys of the flattened document @to that are new or different
+// from @from with their values, and the keys that are only in @from with nil
+func diffDocuments(from, to bson.M) bson.M {
+	ret := bson.M{}
+	for k, v := range to {
+		if old, found := from[k]; !found || !valuesEqual(old, v) {
+			ret[k] = v
+		}
+	}
+	for k := range from {
+		if _, found := to[k]; !found {
+			ret[k] = nil
+		}
+	}
+	return ret
+}
+
+// Returns the uuids of the streams whose tags may have been changed by
+// @readings: the streams with tags of their own, and all of them if any of the
+// non-timeseries paths have tags for their children to inherit
+func taggedStreams(readings map[string]*SmapMessage) []string {
+	inherited := inheritsTags(readings)
+	var uuids []string
+	for _, msg := range readings {
+		if msg.UUID != "" && (inherited || hasTags(msg)) {
+			uuids = append(uuids, msg.UUID)
+		}
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func hasTags(msg *SmapMessage) bool {
+	return msg.Metadata != nil || msg.Properties != nil || msg.Actuator != nil
+}
+
+// true if any of the non-timeseries paths of @readings have tags for their
+// children to inherit
+func inheritsTags(readings map[string]*SmapMessage) bool {
+	for _, msg := range readings {
+		if msg.UUID == "" && hasTags(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies @change, a set or delete of the tags of the streams matching @where,
+// and records the changes it made in the metadata history. The streams are
+// resolved first because the change may stop them from matching
+func (a *Archiver) changeTags(action, apikey string, where Predicate, change func() (bson.M, error)) (bson.M, error) {
+	var uuids []string
+	if a.history != nil {
+		var err error
+		if uuids, err = a.store.GetUUIDs(where); err != nil {
+			return bson.M{}, err
+		}
+	}
+	res, err := change()
+	if err != nil {
+		return res, err
+	}
+	if err := a.history.record(uuids, apikey, action); err != nil {
+		log.Error("Error recording metadata history: %v", err)
+	}
+	return res, nil
+}
+
+// Returns the changes made to the tags of the stream with the given UUID,
+// oldest first
+func (a *Archiver) MetadataHistory(uuid string) ([]*MetadataChange, error) {
+	if a.history == nil {
+		return nil, errNoHistory
+	}
+	return a.history.history.GetMetadataHistory(uuid)
+}
+
+// Like GetTags, but evaluates the where clause against the documents as they
+// were at @when, as reconstructed from the metadata history
+func (a *Archiver) GetTagsAsOf(target bson.M, is_distinct bool, distinct_key string, where Predicate, page Page, when time.Time) ([]interface{}, error) {
+	var res = []interface{}{}
+	if a.history == nil {
+		return res, errNoHistory
+	}
+	changes, err := a.history.history.GetMetadataAsOf(when.UnixNano())
+	if err != nil {
+		return res, err
+	}
+	var docs []bson.M
+	for _, change := range changes {
+		if change.Document == nil { // removed by then
+			continue
+		}
+		match, err := matchPredicate(change.Document, where)
+		if err != nil {
+			return res, err
+		}
+		if match {
+			docs = append(docs, change.Document)
+		}
+	}
+	if is_distinct {
+		return distinctValues(docs, distinct_key), nil
+	}
+	sel := tagSelection(target)
+	for _, doc := range pageDocuments(docs, page) {
+		res = append(res, projectDocument(doc, sel))
+	}
+	return res, nil
+}
@@ -0,0 +1,163 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestParseAsOf(t *testing.T) {
+	l := NewSQLex(`select * where uuid = "aaa" as of "2026-01-01";`)
+	SQParse(l)
+	if l.error != nil {
+		t.Fatal(l.error)
+	}
+	if asof := l.query.asof; !asof.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Got ", asof, " should be 2026-01-01")
+	}
+	if l.query.where == nil || l.query.qtype != SELECT_TYPE {
+		t.Error("Got ", l.query.where, " should be a select with a where clause")
+	}
+}
+
+func TestDiffDocuments(t *testing.T) {
+	from := flattenDocument(bson.M{"uuid": "aaa", "Metadata": bson.M{"Site": "soda", "Floor": 4}})
+	to := flattenDocument(bson.M{"uuid": "aaa", "Metadata": bson.M{"Site": "cory", "Floor": int64(4), "Room": "410"}})
+	diff := diffDocuments(from, to)
+	if !valuesEqual(diff, bson.M{"Metadata/Site": "cory", "Metadata/Room": "410"}) {
+		t.Error("Got ", diff, " should have the new Site and Room")
+	}
+	diff = diffDocuments(to, flattenDocument(nil))
+	if len(diff) != 4 || diff["uuid"] != nil {
+		t.Error("Got ", diff, " should remove all 4 tags")
+	}
+}
+
+func TestEmbeddedStoreHistory(t *testing.T) {
+	testHistory(t, newTestEmbeddedStore(""))
+}
+
+func TestSQLStoreHistory(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	testHistory(t, ss)
+}
+
+func testHistory(t *testing.T, store MetadataStore) {
+	history := store.(MetadataHistory)
+	manager := store.(APIKeyManager)
+	a := &Archiver{store: store, history: newHistoryRecorder(store, manager, history)}
+	apikey, err := manager.NewKey("ops", "ops@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test store was populated before the recorder existed
+	uuids := []string{"aaa", "bbb", "ccc"}
+	if err := a.history.record(uuids, "", HISTORY_ADD); err != nil {
+		t.Fatal(err)
+	}
+	// nothing has changed since
+	if err := a.history.record(uuids, "", HISTORY_ADD); err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+
+	_, err = a.changeTags(HISTORY_SET, apikey, parseWhere(t, `uuid = "aaa"`), func() (bson.M, error) {
+		return store.UpdateTags(bson.M{"Metadata.Location.Room": "510"}, apikey, parseWhere(t, `uuid = "aaa"`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.changeTags(HISTORY_DELETE, apikey, parseWhere(t, `uuid = "ccc"`), func() (bson.M, error) {
+		return store.RemoveDocs(apikey, parseWhere(t, `uuid = "ccc"`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := a.MetadataHistory("aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatal("Got ", len(changes), " changes to aaa should be 2")
+	}
+	last := changes[1]
+	if last.Action != HISTORY_SET || last.ApiKey != apikey || last.Owner["email"] != "ops@example.com" {
+		t.Error("Got ", last, " should be a set by ops")
+	}
+	if !valuesEqual(last.Changes, bson.M{"Metadata/Location/Room": "510"}) {
+		t.Error("Got ", last.Changes, " should only change the room")
+	}
+	if changes, _ = a.MetadataHistory("ccc"); len(changes) != 2 || changes[1].Document != nil {
+		t.Error("Got ", changes, " should end with ccc being removed")
+	}
+
+	where := parseWhere(t, `Metadata/Location/Room = "410"`)
+	if res, _ := a.GetTagsAsOf(bson.M{}, false, "", where, Page{}, before); len(res) != 1 {
+		t.Error("Got ", res, " should be aaa in room 410")
+	}
+	if res, _ := a.GetTagsAsOf(bson.M{}, false, "", where, Page{}, time.Now()); len(res) != 0 {
+		t.Error("Got ", res, " should be nothing in room 410 now")
+	}
+	if res, _ := a.GetTagsAsOf(bson.M{}, true, "uuid", nil, Page{}, before); !valuesEqual(res, []interface{}{"aaa", "bbb", "ccc"}) {
+		t.Error("Got ", res, " should be [aaa bbb ccc]")
+	}
+	if res, _ := a.GetTagsAsOf(bson.M{}, true, "uuid", nil, Page{}, time.Now()); !valuesEqual(res, []interface{}{"aaa", "bbb"}) {
+		t.Error("Got ", res, " should be [aaa bbb]")
+	}
+	if res, _ := a.GetTagsAsOf(bson.M{}, false, "", nil, Page{}, before.Add(-time.Hour)); len(res) != 0 {
+		t.Error("Got ", res, " should be nothing before the history began")
+	}
+}
+
+// counts the documents fetched from the store
+type countingStore struct {
+	MetadataStore
+	fetched int
+}
+
+func (cs *countingStore) UUIDTags(uuid string) (bson.M, error) {
+	cs.fetched += 1
+	return cs.MetadataStore.UUIDTags(uuid)
+}
+
+func TestHistoryRecordMessages(t *testing.T) {
+	es := newTestEmbeddedStore("")
+	store := &countingStore{MetadataStore: es}
+	hr := newHistoryRecorder(store, es, es)
+	add := func(msgs map[string]*SmapMessage) {
+		if err := es.SaveTags(&msgs); err != nil {
+			t.Fatal(err)
+		}
+		if err := hr.recordMessages(msgs, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	temp := func(room string) map[string]*SmapMessage {
+		return map[string]*SmapMessage{"/building/temp": &SmapMessage{Path: "/building/temp", UUID: "aaa",
+			Metadata: bson.M{"Location": bson.M{"Room": room}}, Properties: bson.M{"ReadRate": 30}}}
+	}
+
+	add(temp("410"))
+	if store.fetched != 1 {
+		t.Error("Fetched ", store.fetched, " documents, should fetch the first one")
+	}
+	// the same tags again do not need the document
+	add(temp("410"))
+	if store.fetched != 1 {
+		t.Error("Fetched ", store.fetched, " documents, should not fetch repeated tags")
+	}
+	add(temp("411"))
+	if changes, _ := es.GetMetadataHistory("aaa"); store.fetched != 2 || len(changes) != 2 || !valuesEqual(changes[1].Changes, bson.M{"Metadata/Location/Room": "411"}) {
+		t.Error("Got ", changes, " after ", store.fetched, " fetches, should record the new room")
+	}
+	// tags inherited from a path can change the stream
+	inherited := temp("411")
+	inherited["/building"] = &SmapMessage{Path: "/building", Metadata: bson.M{"Site": "cory"}}
+	add(inherited)
+	if store.fetched != 3 {
+		t.Error("Fetched ", store.fetched, " documents, should fetch with inherited tags")
+	}
+}
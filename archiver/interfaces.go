@@ -24,10 +24,17 @@ type TSDB interface {
 	Next([]string, uint64, int32, UnitOfTime) ([]SmapNumbersResponse, error)
 	// uuids, start time, end time, unit of time
 	GetData([]string, uint64, uint64, UnitOfTime) ([]SmapNumbersResponse, error)
+	// uuids, start time, end time, window size, unit of time
+	// retrieve the min/mean/max/count of each window of data, returning
+	// ErrStatisticsUnsupported if the database cannot compute them
+	GetStatistics([]string, uint64, uint64, uint64, UnitOfTime) ([]StatisticalNumbersResponse, error)
+	// uuids, start time, end time, unit of time
+	// remove all data in [start, end)
+	DeleteData([]string, uint64, uint64, UnitOfTime) error
 	// get a new connection to the timeseries database
 	GetConnection() (net.Conn, error)
-	// return the number of live connections
-	LiveConnections() int
+	// return the number of live, idle and failed connections
+	LiveConnections() ConnectionStats
 	// Adds a pointer to metadata store for streamid/uuid conversion and the like
 	AddStore(MetadataStore)
 }
@@ -37,12 +44,16 @@ type TSDB interface {
 type ObjectStore interface {
 	// archive the given SmapMessage that contains non-numerical Readings
 	AddObject(*SmapMessage) (bool, error)
-	// retrieve blob closest before the reference time for the given UUID
+	// retrieve blob closest before the reference time for the given UUID, or
+	// an empty response if there is none
 	PrevObject(string, uint64, UnitOfTime) (SmapObjectResponse, error)
-	// retrieve blob closest after the reference time for the given UUIDs
+	// retrieve blob closest after the reference time for the given UUIDs, or
+	// an empty response if there is none
 	NextObject(string, uint64, UnitOfTime) (SmapObjectResponse, error)
 	// retrieves all blobs between the start/end times for the given UUIDs
 	GetObjects(string, uint64, uint64, UnitOfTime) (SmapObjectResponse, error)
+	// removes all blobs in [start, end) for the given UUID
+	DeleteObjects(string, uint64, uint64, UnitOfTime) error
 	// Adds a pointer to metadata store for streamid/uuid conversion and the like
 	AddStore(MetadataStore)
 }
@@ -67,8 +78,9 @@ type MetadataStore interface {
 
 	// Retrieves the tags indicated by @target for documents that match the
 	// @where clause. If @is_distinct is true, then it will return a list of
-	// distinct values for the tag @distinct_key
-	GetTags(target bson.M, is_distinct bool, distinct_key string, where bson.M) ([]interface{}, error)
+	// distinct values for the tag @distinct_key. The documents are ordered
+	// and limited by @page, which is ignored for distinct queries
+	GetTags(target bson.M, is_distinct bool, distinct_key string, where Predicate, page Page) ([]interface{}, error)
 
 	// Normal metadata save method
 	SaveTags(messages *map[string]*SmapMessage) error
@@ -76,21 +88,21 @@ type MetadataStore interface {
 	// For all documents that match the where clause @where, apply the updates
 	// contained in @updates, provided that the key @apikey is valid for all of
 	// them
-	UpdateTags(updates bson.M, apikey string, where bson.M) (bson.M, error)
+	UpdateTags(updates bson.M, apikey string, where Predicate) (bson.M, error)
 
 	// Removes all documents that match the where clause @where, provided that the
 	// key @apikey is valid for them
-	RemoveDocs(apikey string, where bson.M) (bson.M, error)
+	RemoveDocs(apikey string, where Predicate) (bson.M, error)
 
 	// Unapplies all tags in the list @target for all documents that match the
 	// where clause @where, after checking the API key
-	RemoveTags(target bson.M, apikey string, where bson.M) (bson.M, error)
+	RemoveTags(target bson.M, apikey string, where Predicate) (bson.M, error)
 
 	// Returns all metadata for a given UUID
 	UUIDTags(uuid string) (bson.M, error)
 
 	// Resolve a where clause to a slice of UUIDs
-	GetUUIDs(where bson.M) ([]string, error)
+	GetUUIDs(where Predicate) ([]string, error)
 
 	// Returns the unit of time for the stream identified by the given UUID.
 	GetUnitOfTime(uuid string) UnitOfTime
@@ -99,10 +111,37 @@ type MetadataStore interface {
 	GetStreamType(uuid string) StreamType
 
 	// General purpose metadata Find
-	Find(findclause, selectClause bson.M) (interface{}, error)
+	Find(where Predicate, selectClause bson.M) (interface{}, error)
 
 	// General purpose metadata Find
-	FindDistinct(findClause bson.M, distinctKey string) (interface{}, error)
+	FindDistinct(where Predicate, distinctKey string) (interface{}, error)
+}
+
+// Metadata stores that can keep the history of the changes made to the tags
+// of each stream implement this (see history.go)
+type MetadataHistory interface {
+	// Appends the given changes to the history
+	AddMetadataChanges(changes []*MetadataChange) error
+
+	// Returns all changes to the stream identified by the given UUID, oldest
+	// first
+	GetMetadataHistory(uuid string) ([]*MetadataChange, error)
+
+	// Returns the latest change to each stream made at or before @when (unix
+	// nanoseconds), in order of UUID
+	GetMetadataAsOf(when int64) ([]*MetadataChange, error)
+}
+
+// Metadata stores that cache lookups (like the unit of time of a stream)
+// implement this so the caches show up in the status
+type CacheReporter interface {
+	CacheStats() []CacheStats
+}
+
+// Metadata stores that compile where clauses into their own query language
+// implement this so that explain queries can show the compiled clause
+type WhereExplainer interface {
+	ExplainWhere(where Predicate) (interface{}, error)
 }
 
 type APIKeyManager interface {
@@ -131,6 +170,15 @@ type APIKeyManager interface {
 	Owner(key string) (map[string]interface{}, error)
 }
 
+// Timeseries databases like ReadingDB identify streams by a numerical id
+// instead of a UUID. Metadata stores that can allocate these ids should
+// implement this interface
+type StreamIdStore interface {
+	// Returns the stream id for the given UUID, allocating a new one if
+	// the UUID has not been seen before
+	GetStreamId(uuid string) uint32
+}
+
 type Operator interface {
 	Run(input interface{}) (interface{}, error)
 }
@@ -0,0 +1,341 @@
+package archiver
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Evaluates where-clause predicates against documents held in memory,
+// following the semantics MongoDB gives to the same clause. Keys are dotted
+// paths into nested documents (Metadata.Location.City)
+
+// Returns true if @doc satisfies the predicate @where. A nil predicate
+// matches every document
+func matchPredicate(doc bson.M, where Predicate) (bool, error) {
+	switch p := where.(type) {
+	case nil:
+		return true, nil
+	case And:
+		for _, term := range p {
+			if match, err := matchPredicate(doc, term); !match || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case Or:
+		for _, term := range p {
+			if match, err := matchPredicate(doc, term); match || err != nil {
+				return match, err
+			}
+		}
+		return false, nil
+	case Not:
+		match, err := matchPredicate(doc, p.Predicate)
+		return !match && err == nil, err
+	case Eq:
+		value, found := getPath(doc, p.Key)
+		return found && valueMatches(value, p.Value), nil
+	case Compare:
+		compare, found := compareOperators[p.Op]
+		if !found {
+			return false, fmt.Errorf("Unknown comparison %v", p.Op)
+		}
+		value, found := getPath(doc, p.Key)
+		return found && numberMatches(value, p.Value, compare), nil
+	case Like:
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return false, err
+		}
+		value, found := getPath(doc, p.Key)
+		return found && regexMatches(value, re), nil
+	case Has:
+		_, found := getPath(doc, p.Key)
+		return found, nil
+	case In:
+		value, found := getPath(doc, p.Key)
+		if !found {
+			return false, nil
+		}
+		for _, candidate := range p.Values {
+			if valueMatches(value, candidate) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Unsupported predicate %v", where)
+}
+
+// Like MongoDB, a literal matches an array if it matches any of its elements
+func valueMatches(value, target interface{}) bool {
+	if valuesEqual(value, target) {
+		return true
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, elem := range list {
+			if valuesEqual(elem, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Like MongoDB, only numbers compare with numbers, and an array matches if
+// any of its elements do
+func numberMatches(value interface{}, target float64, compare func(a, b float64) bool) bool {
+	if f, ok := asFloat(value); ok {
+		return compare(f, target)
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, elem := range list {
+			if f, ok := asFloat(elem); ok && compare(f, target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func regexMatches(value interface{}, re *regexp.Regexp) bool {
+	switch v := value.(type) {
+	case string:
+		return re.MatchString(v)
+	case []interface{}:
+		for _, elem := range v {
+			if s, ok := elem.(string); ok && re.MatchString(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compares two values, treating all numeric types as equivalent
+func valuesEqual(a, b interface{}) bool {
+	if fa, ok := asFloat(a); ok {
+		fb, ok := asFloat(b)
+		return ok && fa == fb
+	}
+	if ma, ok := asMap(a); ok {
+		mb, ok := asMap(b)
+		if !ok || len(ma) != len(mb) {
+			return false
+		}
+		for k, va := range ma {
+			if vb, found := mb[k]; !found || !valuesEqual(va, vb) {
+				return false
+			}
+		}
+		return true
+	}
+	if la, ok := asList(a); ok {
+		lb, ok := asList(b)
+		if !ok || len(la) != len(lb) {
+			return false
+		}
+		for i := range la {
+			if !valuesEqual(la[i], lb[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// The grammar builds clauses out of Dict and List, JSON decoding gives
+// map[string]interface{} and the bson package gives bson.M; these helpers
+// let us treat them all the same
+func asMap(v interface{}) (bson.M, bool) {
+	switch m := v.(type) {
+	case bson.M:
+		return m, true
+	case Dict:
+		return bson.M(m), true
+	case map[string]interface{}:
+		return bson.M(m), true
+	}
+	return nil, false
+}
+
+func asList(v interface{}) ([]interface{}, bool) {
+	switch l := v.(type) {
+	case []interface{}:
+		return l, true
+	case List:
+		return stringsToList(l), true
+	case []string:
+		return stringsToList(l), true
+	case []Dict:
+		ret := make([]interface{}, len(l))
+		for i, d := range l {
+			ret[i] = d
+		}
+		return ret, true
+	case []bson.M:
+		ret := make([]interface{}, len(l))
+		for i, d := range l {
+			ret[i] = d
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+func stringsToList(l []string) []interface{} {
+	ret := make([]interface{}, len(l))
+	for i, s := range l {
+		ret[i] = s
+	}
+	return ret
+}
+
+func asFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// Returns the value at the dotted path @path in @doc
+func getPath(doc bson.M, path string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := asMap(cur)
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// Sets the value at the dotted path @path in @doc, creating intermediate
+// documents as needed. Returns true if this changed the document
+func setPath(doc bson.M, path string, value interface{}) bool {
+	keys := strings.Split(path, ".")
+	cur := doc
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asMap(cur[key])
+		if !ok {
+			next = bson.M{}
+			cur[key] = next
+		}
+		cur = next
+	}
+	last := keys[len(keys)-1]
+	if old, found := cur[last]; found && valuesEqual(old, value) {
+		return false
+	}
+	cur[last] = copyValue(value)
+	return true
+}
+
+// Removes the value at the dotted path @path from @doc. Returns true if there
+// was anything to remove
+func unsetPath(doc bson.M, path string) bool {
+	keys := strings.Split(path, ".")
+	cur := doc
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asMap(cur[key])
+		if !ok {
+			return false
+		}
+		cur = next
+	}
+	last := keys[len(keys)-1]
+	if _, found := cur[last]; !found {
+		return false
+	}
+	delete(cur, last)
+	return true
+}
+
+// Applies a MongoDB-style projection to @doc. If any of the keys in @sel are
+// included (value of 1 or true), only those keys are returned. Otherwise the
+// keys in @sel are excluded. _id is ignored because we do not have one
+func projectDocument(doc bson.M, sel bson.M) bson.M {
+	include := false
+	for k, v := range sel {
+		if k == "_id" {
+			continue
+		}
+		if f, ok := asFloat(v); (ok && f != 0) || v == true {
+			include = true
+			break
+		}
+	}
+	if !include {
+		ret := copyValue(doc).(bson.M)
+		for k := range sel {
+			unsetPath(ret, k)
+		}
+		return ret
+	}
+	ret := bson.M{}
+	for k, v := range sel {
+		if f, ok := asFloat(v); (ok && f == 0) || v == false {
+			continue
+		}
+		if value, found := getPath(doc, k); found {
+			setPath(ret, k, value)
+		}
+	}
+	return ret
+}
+
+// Returns the projection for a select of the tags in @target: everything but
+// _api for an empty target. Like MongoStore, _api is only excluded if the
+// target is not including anything
+func tagSelection(target bson.M) bson.M {
+	if len(target) == 0 {
+		return bson.M{"_api": 0}
+	}
+	for _, include := range target {
+		if include == 1 {
+			return target
+		}
+	}
+	target["_api"] = 0
+	return target
+}
+
+// deep copies documents and lists so that stored documents are never shared
+// with callers
+func copyValue(v interface{}) interface{} {
+	if m, ok := asMap(v); ok {
+		ret := make(bson.M, len(m))
+		for k, vv := range m {
+			ret[k] = copyValue(vv)
+		}
+		return ret
+	}
+	if l, ok := v.([]interface{}); ok {
+		ret := make([]interface{}, len(l))
+		for i, vv := range l {
+			ret[i] = copyValue(vv)
+		}
+		return ret
+	}
+	return v
+}
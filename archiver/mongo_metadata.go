@@ -1,13 +1,11 @@
 package archiver
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"net"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,6 +14,18 @@ import (
 // default select clause to ignore internal variables
 var ignoreDefault = bson.M{"_id": 0, "_api": 0}
 
+// size in bytes of the capped collection of cache invalidations
+const CACHE_INVALIDATIONS_SIZE = 1 << 20
+
+// Every Giles process running against the same Mongo keeps its own caches of
+// the unit of time, stream type and API key of each stream. When the metadata
+// of a stream changes, its uuid is written to the capped cache_invalidations
+// collection, which each process tails to drop the stream from its caches.
+type cacheInvalidation struct {
+	Id    bson.ObjectId `bson:"_id"`
+	UUIDs []string      `bson:"uuids"`
+}
+
 //TODO: copy the session for a transaction -- this is faster
 type MongoStore struct {
 	session        *mgo.Session
@@ -24,6 +34,8 @@ type MongoStore struct {
 	metadata       *mgo.Collection
 	pathmetadata   *mgo.Collection
 	apikeys        *mgo.Collection
+	history        *mgo.Collection
+	invalidations  *mgo.Collection
 	apikeylock     sync.Mutex
 	maxsid         *uint32
 	streamlock     sync.Mutex
@@ -50,7 +62,23 @@ type rdbStreamId struct {
 	UUID     string
 }
 
-func NewMongoStore(address *net.TCPAddr, interval int) *MongoStore {
+// names of the caches of the MongoStore, as in the [Cache "name"] sections of
+// the configuration
+var mongoCaches = []string{"uuid", "apikey", "unitoftime", "streamtype"}
+
+// Connects to the MongoDB at @address. @caches gives the capacity and TTL of
+// the caches named in mongoCaches; the ones not in it hold
+// DEFAULT_CACHE_CAPACITY entries that do not expire
+func NewMongoStore(address *net.TCPAddr, interval int, caches map[string]CacheConfig) *MongoStore {
+	for name := range caches {
+		known := false
+		for _, cache := range mongoCaches {
+			known = known || name == cache
+		}
+		if !known {
+			log.Warning("Unknown cache %v, should be one of %v", name, mongoCaches)
+		}
+	}
 	log.Notice("Connecting to MongoDB at %v...", address.String())
 	session, err := mgo.Dial(address.String())
 	if err != nil {
@@ -64,6 +92,12 @@ func NewMongoStore(address *net.TCPAddr, interval int) *MongoStore {
 	metadata := db.C("metadata")
 	pathmetadata := db.C("pathmetadata")
 	apikeys := db.C("apikeys")
+	history := db.C("metadata_history")
+	invalidations := db.C("cache_invalidations")
+	err = invalidations.Create(&mgo.CollectionInfo{Capped: true, MaxBytes: CACHE_INVALIDATIONS_SIZE})
+	if qerr, ok := err.(*mgo.QueryError); err != nil && !(ok && qerr.Code == 48) { // 48: already exists
+		log.Fatalf("Could not create cache_invalidations collection (%v)", err)
+	}
 	// create indexes
 	index := mgo.Index{
 		Key:        []string{"uuid"},
@@ -115,6 +149,13 @@ func NewMongoStore(address *net.TCPAddr, interval int) *MongoStore {
 		log.Fatalf("Could not create index on apikeys (%v)", err)
 	}
 
+	index.Unique = false
+	index.Key = []string{"uuid", "time"}
+	err = history.EnsureIndex(index)
+	if err != nil {
+		log.Fatalf("Could not create index on metadata_history (%v)", err)
+	}
+
 	maxstreamid := &rdbStreamId{}
 	streams.Find(bson.M{}).Sort("-streamid").One(&maxstreamid)
 	var maxsid uint32 = 1
@@ -129,20 +170,33 @@ func NewMongoStore(address *net.TCPAddr, interval int) *MongoStore {
 		metadata:       metadata,
 		pathmetadata:   pathmetadata,
 		apikeys:        apikeys,
+		history:        history,
+		invalidations:  invalidations,
 		maxsid:         &maxsid,
-		uuidcache:      NewCache(1000),
-		apikcache:      NewCache(1000),
-		uotcache:       NewCache(1000),
-		streamtype:     NewCache(1000),
+		uuidcache:      newMongoCache("uuid", caches),
+		apikcache:      newMongoCache("apikey", caches),
+		uotcache:       newMongoCache("unitoftime", caches),
+		streamtype:     newMongoCache("streamtype", caches),
 		updateTicker:   ticker,
 		updateTrigger:  make(chan bool, 1000),
 		updateInterval: time.Duration(interval),
 		UUIDS:          make(map[string]struct{}),
 		enforceKeys:    true}
 	ms.StartUpdateCacheLoop()
+	go ms.tailInvalidations()
 	return ms
 }
 
+func newMongoCache(name string, caches map[string]CacheConfig) *Cache {
+	cc := caches[name]
+	return NewCache(name, cc.Capacity, cc.TTL)
+}
+
+// Returns the stats of the uuid, apikey, unitoftime and streamtype caches
+func (ms *MongoStore) CacheStats() []CacheStats {
+	return []CacheStats{ms.uuidcache.Stats(), ms.apikcache.Stats(), ms.uotcache.Stats(), ms.streamtype.Stats()}
+}
+
 /* MetadataStore interface implementation*/
 
 func (ms *MongoStore) EnforceKeys(enforce bool) {
@@ -177,19 +231,130 @@ func (ms *MongoStore) StartUpdateCacheLoop() {
 	}()
 }
 
-func (ms *MongoStore) Find(findClause, selectClause bson.M) (interface{}, error) {
+// Drops the given streams from the caches of this process
+func (ms *MongoStore) invalidate(uuids []string) {
+	ms.streamtypelock.Lock()
+	defer ms.streamtypelock.Unlock()
+	for _, uuid := range uuids {
+		ms.uotcache.Remove(uuid)
+		ms.streamtype.Remove(uuid)
+		ms.apikcache.Remove(uuid)
+	}
+}
+
+// Drops the given streams from the caches of this and every other process
+// using this Mongo
+func (ms *MongoStore) notifyChanged(uuids []string) {
+	if len(uuids) == 0 {
+		return
+	}
+	ms.invalidate(uuids)
+	if err := ms.invalidations.Insert(cacheInvalidation{Id: bson.NewObjectId(), UUIDs: uuids}); err != nil {
+		log.Error("Could not notify other instances of changes to %v (%v)", uuids, err)
+	}
+}
+
+// Follows the cache_invalidations collection, invalidating the streams in
+// each new entry. Starts from the beginning of the collection, which only
+// drops entries that cannot be in the fresh caches anyway
+func (ms *MongoStore) tailInvalidations() {
+	session := ms.session.Copy()
+	defer session.Close()
+	invalidations := ms.invalidations.With(session)
+	var (
+		inv    cacheInvalidation
+		lastId bson.ObjectId
+		query  = bson.M{}
+	)
+	for {
+		iter := invalidations.Find(query).Sort("$natural").Tail(5 * time.Second)
+		for {
+			for iter.Next(&inv) {
+				ms.invalidate(inv.UUIDs)
+				lastId = inv.Id
+			}
+			if iter.Err() != nil || !iter.Timeout() {
+				break
+			}
+		}
+		if err := iter.Close(); err != nil {
+			log.Error("Error following cache invalidations (%v)", err)
+			session.Refresh()
+		}
+		// the cursor dies if the collection is empty or we fell behind
+		// by more than its size, so wait a bit and pick up where we were
+		if lastId != "" {
+			query = bson.M{"_id": bson.M{"$gt": lastId}}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func (ms *MongoStore) Find(where Predicate, selectClause bson.M) (interface{}, error) {
 	var result []interface{}
-	staged := ms.metadata.Find(findClause).Select(selectClause)
+	staged := ms.metadata.Find(compileMongo(where)).Select(selectClause)
 	err := staged.All(&result)
 	return result, err
 }
 
-func (ms *MongoStore) FindDistinct(findClause bson.M, distinctKey string) (interface{}, error) {
+func (ms *MongoStore) FindDistinct(where Predicate, distinctKey string) (interface{}, error) {
 	var result []interface{}
-	err := ms.metadata.Find(findClause).Distinct(distinctKey, &result)
+	err := ms.metadata.Find(compileMongo(where)).Distinct(distinctKey, &result)
 	return result, err
 }
 
+// the Mongo operators for the comparisons of Compare
+var mongoCompareOperators = map[string]string{"<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+
+// Compiles a where-clause predicate into a Mongo query document. A nil
+// predicate becomes the empty document, which matches everything
+func compileMongo(where Predicate) bson.M {
+	switch p := where.(type) {
+	case And:
+		return bson.M{"$and": compileMongoList(p)}
+	case Or:
+		return bson.M{"$or": compileMongoList(p)}
+	case Not:
+		switch inner := p.Predicate.(type) {
+		case Eq:
+			return bson.M{inner.Key: bson.M{"$ne": inner.Value}}
+		case Like:
+			// $not takes a regular expression object rather than $regex
+			return bson.M{inner.Key: bson.M{"$not": bson.RegEx{Pattern: inner.Pattern}}}
+		case Has, In, Compare:
+			// single-field operator documents can be negated in place
+			for key, cond := range compileMongo(inner) {
+				return bson.M{key: bson.M{"$not": cond}}
+			}
+		}
+		return bson.M{"$nor": []bson.M{compileMongo(p.Predicate)}}
+	case Eq:
+		return bson.M{p.Key: p.Value}
+	case Like:
+		return bson.M{p.Key: bson.M{"$regex": p.Pattern}}
+	case Compare:
+		return bson.M{p.Key: bson.M{mongoCompareOperators[p.Op]: p.Value}}
+	case Has:
+		return bson.M{p.Key: bson.M{"$exists": true}}
+	case In:
+		return bson.M{p.Key: bson.M{"$in": p.Values}}
+	}
+	return bson.M{}
+}
+
+// Returns the Mongo query document of @where
+func (ms *MongoStore) ExplainWhere(where Predicate) (interface{}, error) {
+	return compileMongo(where), nil
+}
+
+func compileMongoList(preds []Predicate) []bson.M {
+	ret := make([]bson.M, len(preds))
+	for i, pred := range preds {
+		ret[i] = compileMongo(pred)
+	}
+	return ret
+}
+
 func (ms *MongoStore) CheckKey(apikey string, messages map[string]*SmapMessage) (bool, error) {
 	for _, msg := range messages {
 		if msg.UUID == "" {
@@ -381,37 +546,52 @@ func (ms *MongoStore) SaveTags(messages *map[string]*SmapMessage) error {
 		err       error
 		updateAny = false
 	)
+	var changed []string
 	tsm := TieredSmapMessage(*messages)
 	tsm.CollapseToTimeseries()
 	ms.CacheLock.RLock()
 	for _, bsonMsg := range tsm.ToBson() {
-		if _, found := ms.UUIDS[bsonMsg["uuid"].(string)]; !found || len(bsonMsg) > 2 {
+		uuid := bsonMsg["uuid"].(string)
+		// compared before the upsert, while the caches and the store still
+		// hold the old values
+		if ms.changesCachedTags(uuid, bsonMsg) {
+			changed = append(changed, uuid)
+		}
+		if _, found := ms.UUIDS[uuid]; !found || len(bsonMsg) > 2 {
 			updateAny = true
 			_, err = ms.metadata.Upsert(bson.M{"uuid": bsonMsg["uuid"]}, bson.M{"$set": bsonMsg})
 		}
 	}
 	ms.CacheLock.RUnlock()
+	ms.notifyChanged(changed)
 	if updateAny {
 		ms.updateTrigger <- true
 	}
 	return err
 }
 
+// Returns true if the flattened tags @doc give the stream @uuid another unit
+// of time or stream type than the ones cached (or stored) for it
+func (ms *MongoStore) changesCachedTags(uuid string, doc bson.M) bool {
+	if uot, found := doc["Properties.UnitofTime"]; found && mongoUnitOfTime(uot) != ms.GetUnitOfTime(uuid) {
+		return true
+	}
+	if st, found := doc["Properties.StreamType"]; found && mongoStreamType(st) != ms.GetStreamType(uuid) {
+		return true
+	}
+	return false
+}
+
 // Retrieves the tags indicated by `target` for documents that match the `where` clause. If `is_distinct` is true,
-// then it will return a list of distinct values for the tag `distinct_key`
-func (ms *MongoStore) GetTags(target bson.M, is_distinct bool, distinct_key string, where bson.M) ([]interface{}, error) {
+// then it will return a list of distinct values for the tag `distinct_key`. Otherwise the documents are
+// sorted, skipped and limited in Mongo as `page` says
+func (ms *MongoStore) GetTags(target bson.M, is_distinct bool, distinct_key string, where Predicate, page Page) ([]interface{}, error) {
 	var res []interface{}
 	var err error
 	var staged *mgo.Query
-	uuids, uuidErr := ms.GetUUIDs(where)
-	if uuidErr != nil {
-		return res, uuidErr
-	}
-	staged = ms.metadata.Find(bson.M{"uuid": bson.M{"$in": uuids}}).Select(bson.M{"_id": 0, "_api": 0})
-	err = staged.All(&res)
 
 	if len(target) == 0 {
-		staged = ms.metadata.Find(where).Select(bson.M{"_id": 0, "_api": 0})
+		staged = ms.metadata.Find(compileMongo(where)).Select(bson.M{"_id": 0, "_api": 0})
 	} else {
 		// because we can't have both inclusion and exclusion, we check if the
 		// target is including anything. If we get a "1", then we don't add
@@ -427,19 +607,29 @@ func (ms *MongoStore) GetTags(target bson.M, is_distinct bool, distinct_key stri
 		if doExclude {
 			target["_api"] = 0
 		}
-		staged = ms.metadata.Find(where).Select(target)
+		staged = ms.metadata.Find(compileMongo(where)).Select(target)
 	}
 	if is_distinct {
 		var res2 []interface{}
 		err = staged.Distinct(distinct_key, &res2)
 		return res2, err
-	} else {
-		err = staged.All(&res)
-		return res, err
 	}
+	if !page.IsZero() {
+		// ties are broken by uuid, so pages do not overlap
+		order := []string{"uuid"}
+		if page.OrderBy != "" {
+			order = []string{page.OrderBy, "uuid"}
+		}
+		if page.Descending {
+			order[0] = "-" + order[0]
+		}
+		staged = staged.Sort(order...).Skip(page.Offset).Limit(page.Limit)
+	}
+	err = staged.All(&res)
+	return res, err
 }
 
-func (ms *MongoStore) UpdateTags(updates bson.M, apikey string, where bson.M) (bson.M, error) {
+func (ms *MongoStore) UpdateTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
 	var res bson.M
 	uuids, err := ms.GetUUIDs(where)
 	if err != nil {
@@ -451,15 +641,16 @@ func (ms *MongoStore) UpdateTags(updates bson.M, apikey string, where bson.M) (b
 			return res, err
 		}
 	}
-	info, err2 := ms.metadata.UpdateAll(where, bson.M{"$set": updates})
+	info, err2 := ms.metadata.UpdateAll(compileMongo(where), bson.M{"$set": updates})
 	if err2 != nil {
 		return res, err2
 	}
+	ms.notifyChanged(uuids)
 	log.Info("Updated %v records", info.Updated)
 	return bson.M{"Updated": info.Updated}, nil
 }
 
-func (ms *MongoStore) RemoveDocs(apikey string, where bson.M) (bson.M, error) {
+func (ms *MongoStore) RemoveDocs(apikey string, where Predicate) (bson.M, error) {
 	var res bson.M
 	uuids, err := ms.GetUUIDs(where)
 	if err != nil {
@@ -471,12 +662,13 @@ func (ms *MongoStore) RemoveDocs(apikey string, where bson.M) (bson.M, error) {
 			return res, canWriteErr
 		}
 	}
-	ci, removeErr := ms.metadata.RemoveAll(where)
+	ci, removeErr := ms.metadata.RemoveAll(compileMongo(where))
+	ms.notifyChanged(uuids)
 	log.Info("Removed %v records", ci.Removed)
 	return bson.M{"Removed": ci.Removed}, removeErr
 }
 
-func (ms *MongoStore) RemoveTags(updates bson.M, apikey string, where bson.M) (bson.M, error) {
+func (ms *MongoStore) RemoveTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
 	var res bson.M
 	uuids, err := ms.GetUUIDs(where)
 	if err != nil {
@@ -488,7 +680,8 @@ func (ms *MongoStore) RemoveTags(updates bson.M, apikey string, where bson.M) (b
 			return res, canWriteErr
 		}
 	}
-	info, updateErr := ms.metadata.UpdateAll(where, bson.M{"$unset": updates})
+	info, updateErr := ms.metadata.UpdateAll(compileMongo(where), bson.M{"$unset": updates})
+	ms.notifyChanged(uuids)
 	log.Info("Updated %v records", info.Updated)
 	return bson.M{"Updated": info.Updated}, updateErr
 }
@@ -502,10 +695,10 @@ func (ms *MongoStore) UUIDTags(uuid string) (bson.M, error) {
 }
 
 // Resolve a query to a slice of UUIDs
-func (ms *MongoStore) GetUUIDs(where bson.M) ([]string, error) {
+func (ms *MongoStore) GetUUIDs(where Predicate) ([]string, error) {
 	var tmp []bson.M
 	var res = []string{}
-	err := ms.metadata.Find(where).Select(bson.M{"uuid": 1}).All(&tmp)
+	err := ms.metadata.Find(compileMongo(where)).Select(bson.M{"uuid": 1}).All(&tmp)
 	if err != nil {
 		return res, err
 	}
@@ -529,26 +722,27 @@ func (ms *MongoStore) GetUnitOfTime(uuid string) UnitOfTime {
 	}
 	if prop, found := res["Properties"]; found {
 		if uot, found := prop.(bson.M)["UnitofTime"]; found {
-			switch uot.(string) {
-			case "ns":
-				ms.uotcache.Set(uuid, UOT_NS)
-				return UOT_NS
-			case "us":
-				ms.uotcache.Set(uuid, UOT_US)
-				return UOT_US
-			case "ms":
-				ms.uotcache.Set(uuid, UOT_MS)
-				return UOT_MS
-			case "s":
-				ms.uotcache.Set(uuid, UOT_S)
-				return UOT_S
-			}
+			ms.uotcache.Set(uuid, mongoUnitOfTime(uot))
+			return mongoUnitOfTime(uot)
 		}
 	}
 	ms.uotcache.Set(uuid, UOT_MS)
 	return UOT_MS
 }
 
+// The unit of time of a stream with the UnitofTime tag @uot; defaults to ms
+func mongoUnitOfTime(uot interface{}) UnitOfTime {
+	switch uot {
+	case "ns":
+		return UOT_NS
+	case "us":
+		return UOT_US
+	case "s":
+		return UOT_S
+	}
+	return UOT_MS
+}
+
 func (ms *MongoStore) GetStreamType(uuid string) StreamType {
 	ms.streamtypelock.RLock()
 	if st, found := ms.streamtype.Get(uuid); found {
@@ -564,15 +758,9 @@ func (ms *MongoStore) GetStreamType(uuid string) StreamType {
 	}
 	if prop, found := res["Properties"]; found {
 		if st, found := prop.(bson.M)["StreamType"]; found {
-			if st.(string) == "object" {
-				ms.streamtype.Set(uuid, OBJECT_STREAM)
-				ms.streamtypelock.Unlock()
-				return OBJECT_STREAM
-			} else {
-				ms.streamtype.Set(uuid, NUMERIC_STREAM)
-				ms.streamtypelock.Unlock()
-				return NUMERIC_STREAM
-			}
+			ms.streamtype.Set(uuid, mongoStreamType(st))
+			ms.streamtypelock.Unlock()
+			return mongoStreamType(st)
 		}
 	}
 	ms.streamtype.Set(uuid, NUMERIC_STREAM)
@@ -580,6 +768,49 @@ func (ms *MongoStore) GetStreamType(uuid string) StreamType {
 	return NUMERIC_STREAM
 }
 
+// The type of a stream with the StreamType tag @st; defaults to numeric
+func mongoStreamType(st interface{}) StreamType {
+	if st == "object" {
+		return OBJECT_STREAM
+	}
+	return NUMERIC_STREAM
+}
+
+/* MetadataHistory interface implementation */
+
+func (ms *MongoStore) AddMetadataChanges(changes []*MetadataChange) error {
+	docs := make([]interface{}, len(changes))
+	for i, change := range changes {
+		docs[i] = change
+	}
+	return ms.history.Insert(docs...)
+}
+
+func (ms *MongoStore) GetMetadataHistory(uuid string) ([]*MetadataChange, error) {
+	var res []*MetadataChange
+	err := ms.history.Find(bson.M{"uuid": uuid}).Sort("time").Select(bson.M{"_id": 0}).All(&res)
+	return res, err
+}
+
+func (ms *MongoStore) GetMetadataAsOf(when int64) ([]*MetadataChange, error) {
+	var (
+		latest []struct {
+			Change *MetadataChange `bson:"change"`
+		}
+		res []*MetadataChange
+	)
+	err := ms.history.Pipe([]bson.M{
+		{"$match": bson.M{"time": bson.M{"$lte": when}}},
+		{"$sort": bson.D{{Name: "uuid", Value: 1}, {Name: "time", Value: 1}}},
+		{"$group": bson.M{"_id": "$uuid", "change": bson.M{"$last": "$$ROOT"}}},
+		{"$sort": bson.M{"_id": 1}},
+	}).AllowDiskUse().All(&latest)
+	for _, l := range latest {
+		res = append(res, l.Change)
+	}
+	return res, err
+}
+
 /** Implementing the APIKeyManager interface **/
 
 func (ms *MongoStore) GetStreamId(uuid string) uint32 {
@@ -622,21 +853,10 @@ func (ms *MongoStore) ApiKeyExists(apikey string) (bool, error) {
 }
 
 func (ms *MongoStore) NewKey(name, email string, public bool) (string, error) {
-	var apikey string
-	var err error
-	urandom, err := os.Open("/dev/urandom")
+	apikey, err := generateAPIKey()
 	if err != nil {
-		return apikey, errors.New(fmt.Sprintf("Could not open /dev/urandom (%v)", err))
-	}
-	randbytes := make([]byte, 64)
-	n, err := urandom.Read(randbytes)
-	if err != nil {
-		return apikey, errors.New(fmt.Sprintf("Could not read /dev/urandom (%v)", err))
-	}
-	if n != 64 {
-		return apikey, errors.New(fmt.Sprintf("Could not read 64 bytes from /dev/urandom %v", n))
+		return apikey, err
 	}
-	apikey = base64.URLEncoding.EncodeToString(randbytes)
 	err = ms.apikeys.Insert(bson.M{"key": apikey, "name": name, "email": email, "public": public})
 	if err != nil {
 		return apikey, errors.New(fmt.Sprintf("could not save new apikey for %v %v to Mongo (%v)", name, email, err))
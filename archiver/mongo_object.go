@@ -91,7 +91,9 @@ func (ms *MongoObjectStore) PrevObject(uuid string, time uint64, uot UnitOfTime)
 	var ret SmapObjectResponse
 	time_ns := convertTime(time, uot, UOT_NS)
 	err := ms.objects.Find(bson.M{"uuid": uuid, "timestamp": bson.M{"$lte": time_ns}}).Sort("-timestamp").One(&res)
-	if err != nil {
+	if err == mgo.ErrNotFound {
+		return SmapObjectResponse{UUID: uuid}, nil
+	} else if err != nil {
 		log.Error("got an err %v", err)
 		return ret, err
 	}
@@ -108,7 +110,9 @@ func (ms *MongoObjectStore) NextObject(uuid string, time uint64, uot UnitOfTime)
 	var ret SmapObjectResponse
 	time_ns := convertTime(time, uot, UOT_NS)
 	err := ms.objects.Find(bson.M{"uuid": uuid, "timestamp": bson.M{"$gte": time_ns}}).Sort("+timestamp").One(&res)
-	if err != nil {
+	if err == mgo.ErrNotFound {
+		return SmapObjectResponse{UUID: uuid}, nil
+	} else if err != nil {
 		log.Error("got an err %v", err)
 		return ret, err
 	}
@@ -144,6 +148,20 @@ func (ms *MongoObjectStore) GetObjects(uuid string, start uint64, end uint64, uo
 	return ret, nil
 }
 
+func (ms *MongoObjectStore) DeleteObjects(uuid string, start uint64, end uint64, uot UnitOfTime) error {
+	start_time_ns := convertTime(start, uot, UOT_NS)
+	end_time_ns := convertTime(end, uot, UOT_NS)
+	info, err := ms.objects.RemoveAll(bson.M{"uuid": uuid,
+		"$and": []bson.M{bson.M{"timestamp": bson.M{"$gte": start_time_ns}}, bson.M{"timestamp": bson.M{"$lt": end_time_ns}}},
+	})
+	if err != nil {
+		log.Error("got an err %v", err)
+		return err
+	}
+	log.Info("Removed %v objects for %v", info.Removed, uuid)
+	return nil
+}
+
 func (ms *MongoObjectStore) AddStore(store MetadataStore) {
 	ms.store = store
 }
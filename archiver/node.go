@@ -1,5 +1,9 @@
 package archiver
 
+import (
+	"fmt"
+)
+
 type Node struct {
 	Id       string
 	Tags     map[string]interface{}
@@ -20,7 +24,7 @@ func NewNode(operation Operator, done <-chan struct{}) (n *Node) {
 		for {
 			select {
 			case input := <-n.In:
-				res, err := n.Op.Run(input)
+				res, err := n.run(input)
 				if err != nil {
 					log.Error("NODE ERROR %v", err)
 					continue
@@ -29,13 +33,37 @@ func NewNode(operation Operator, done <-chan struct{}) (n *Node) {
 					c.In <- res
 				}
 			case <-done:
-				close(n.In)
+				return
 			}
 		}
 	}(n)
 	return
 }
 
+// Runs the operator on @input. A node that takes timeseries but not groups of
+// them is run on the streams of each group in turn, and outputs the groups of
+// its results
+func (n *Node) run(input interface{}) (interface{}, error) {
+	groups, ok := input.([]TimeseriesGroup)
+	structure, _ := n.Tags["in:structure"].(StructureType)
+	if !ok || structure&GROUPED != 0 || structure&TIMESERIES == 0 {
+		return n.Op.Run(input)
+	}
+	result := make([]TimeseriesGroup, len(groups))
+	for idx, group := range groups {
+		res, err := n.Op.Run(group.Streams)
+		if err != nil {
+			return nil, err
+		}
+		streams, ok := res.([]SmapNumbersResponse)
+		if !ok {
+			return nil, fmt.Errorf("Operator on groups must output []SmapNumbersResponse, not %T", res)
+		}
+		result[idx] = TimeseriesGroup{Value: group.Value, Streams: streams}
+	}
+	return result, nil
+}
+
 func (n *Node) AddChild(child *Node) bool {
 	var found bool
 	if _, found = n.Children[child.Id]; !found {
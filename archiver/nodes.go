@@ -19,8 +19,15 @@ type StructureType uint
 const (
 	LIST StructureType = 1 << iota
 	TIMESERIES
+	// a list of TIMESERIES split into groups by a group by clause, as
+	// []TimeseriesGroup
+	GROUPED
 )
 
+func (st StructureType) String() string {
+	return flagNames(uint(st), []string{"LIST", "TIMESERIES", "GROUPED"})
+}
+
 type DataType uint
 
 const (
@@ -28,6 +35,21 @@ const (
 	OBJECT
 )
 
+func (dt DataType) String() string {
+	return flagNames(uint(dt), []string{"SCALAR", "OBJECT"})
+}
+
+// joins the names of the bits set in @flags, where names[i] is the name of 1 << i
+func flagNames(flags uint, names []string) string {
+	var set []string
+	for i, name := range names {
+		if flags&(1<<uint(i)) != 0 {
+			set = append(set, name)
+		}
+	}
+	return strings.Join(set, "|")
+}
+
 type OperationType uint
 
 const (
@@ -70,21 +92,23 @@ func init() {
 	opFuncChooser["mean"] = opFuncMean
 	opFuncChooser["max"] = opFuncMax
 	opFuncChooser["min"] = opFuncMin
+	opFuncChooser["count"] = opFuncCount
 }
 
 /** Where Node **/
 // A WhereNode takes a where clause in its constructor.
 type WhereNode struct {
-	where bson.M
+	where Predicate
 	store MetadataStore
 }
 
 // First argument are the k/v tags for this node, second are the arguments to the constructor
-// arg0: BSON where clause, most likely from a parsed query
+// arg0: where clause Predicate, most likely from a parsed query (nil matches all)
 // arg1: pointer to a metadata store
 func NewWhereNode(done <-chan struct{}, args ...interface{}) (n *Node) {
+	where, _ := args[0].(Predicate)
 	wn := &WhereNode{
-		where: args[0].(bson.M),
+		where: where,
 		store: args[1].(MetadataStore),
 	}
 	n = NewNode(wn, done)
@@ -100,6 +124,69 @@ func (wn *WhereNode) Run(input interface{}) (interface{}, error) {
 	return wn.store.GetUUIDs(wn.where)
 }
 
+/** Group Node **/
+// The streams of a data query with a group by clause that share a value of
+// the group by tag
+type TimeseriesGroup struct {
+	// nil for the streams without the tag
+	Value   interface{}
+	Streams []SmapNumbersResponse
+}
+
+// A GroupNode splits a list of timeseries into groups by the value of a tag
+type GroupNode struct {
+	key   string
+	store MetadataStore
+}
+
+// arg0: dotted key of the tag to group by
+// arg1: pointer to a metadata store
+func NewGroupNode(done <-chan struct{}, args ...interface{}) (n *Node) {
+	gn := &GroupNode{
+		key:   args[0].(string),
+		store: args[1].(MetadataStore),
+	}
+	n = NewNode(gn, done)
+	n.Tags["in:structure"] = TIMESERIES
+	n.Tags["in:datatype"] = SCALAR | OBJECT
+	n.Tags["out:structure"] = GROUPED
+	n.Tags["out:datatype"] = SCALAR | OBJECT
+	return
+}
+
+// Looks up the group by tag of the streams and groups them by its value
+func (gn *GroupNode) Run(input interface{}) (interface{}, error) {
+	streams, ok := input.([]SmapNumbersResponse)
+	if !ok {
+		return nil, fmt.Errorf("Arg0 to GroupNode must be []SmapNumbersResponse")
+	}
+	uuids := make([]string, len(streams))
+	for idx, stream := range streams {
+		uuids[idx] = stream.UUID
+	}
+	docs, err := gn.store.GetTags(bson.M{"uuid": 1, gn.key: 1}, false, "", In{Key: "uuid", Values: uuids}, Page{})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]bson.M, len(docs))
+	for _, doc := range docs {
+		if m, ok := asMap(doc); ok {
+			tags[fmt.Sprintf("%v", m["uuid"])] = m
+		}
+	}
+	values, members := groupIndexes(len(streams), func(i int) []interface{} {
+		return groupValues(tags[streams[i].UUID], gn.key)
+	})
+	groups := make([]TimeseriesGroup, len(values))
+	for i, value := range values {
+		groups[i] = TimeseriesGroup{Value: value, Streams: make([]SmapNumbersResponse, len(members[i]))}
+		for j, member := range members[i] {
+			groups[i].Streams[j] = streams[member]
+		}
+	}
+	return groups, nil
+}
+
 /** Select Tags Node **/
 type SelectTagsNode struct {
 }
@@ -155,6 +242,9 @@ func (sn *SelectDataNode) Run(input interface{}) (interface{}, error) {
 		log.Debug("Data after time %v", start)
 		response, err = sn.a.NextData(uuids, start, int32(sn.dq.limit.limit), UOT_NS, sn.dq.timeconv)
 	}
+	if err = logStreamErrors(err); err != nil {
+		return nil, err
+	}
 	//TODO: make this work for objects too
 	var toreturn = make([]SmapNumbersResponse, len(response.([]interface{})))
 	for idx, resp := range response.([]interface{}) {
@@ -180,9 +270,9 @@ func NewEchoNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 		mybytes: make([]byte, 1024),
 	}
 	n = NewNode(en, done)
-	n.Tags["in:structure"] = LIST | TIMESERIES
+	n.Tags["in:structure"] = LIST | TIMESERIES | GROUPED
 	n.Tags["in:datatype"] = SCALAR | OBJECT
-	n.Tags["out:structure"] = LIST | TIMESERIES
+	n.Tags["out:structure"] = LIST | TIMESERIES | GROUPED
 	n.Tags["out:datatype"] = SCALAR | OBJECT
 	return
 }
@@ -199,6 +289,10 @@ func (en *EchoNode) Run(input interface{}) (interface{}, error) {
 		mpfriendly := transformSmapItem(input.([]*SmapItem))
 		length := msgpack.Encode(mpfriendly, &en.mybytes)
 		en.data = bytes.NewBuffer(en.mybytes[:length])
+	case []TimeseriesGroup:
+		mpfriendly := transformTimeseriesGroups(input.([]TimeseriesGroup))
+		length := msgpack.Encode(mpfriendly, &en.mybytes)
+		en.data = bytes.NewBuffer(en.mybytes[:length])
 	default:
 		length := msgpack.Encode(input, &en.mybytes)
 		en.data = bytes.NewBuffer(en.mybytes[:length])
@@ -217,9 +311,9 @@ func NewStreamingEchoNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 		send: args[0].(Subscriber),
 	}
 	n = NewNode(sen, done)
-	n.Tags["in:structure"] = LIST | TIMESERIES
+	n.Tags["in:structure"] = LIST | TIMESERIES | GROUPED
 	n.Tags["in:datatype"] = SCALAR | OBJECT
-	n.Tags["out:structure"] = LIST | TIMESERIES
+	n.Tags["out:structure"] = LIST | TIMESERIES | GROUPED
 	n.Tags["out:datatype"] = SCALAR | OBJECT
 	return
 }
@@ -320,7 +414,7 @@ func NewChunkedStreamingDataNode(done <-chan struct{}, args ...interface{}) (n *
 		a: args[0].(*Archiver),
 		q: args[1].(*query),
 	}
-	csn.uuids, _ = csn.a.GetUUIDs(csn.q.WhereBson())
+	csn.uuids, _ = csn.a.GetUUIDs(csn.q.where)
 	go csn.grabChunks()
 	n = NewNode(csn, done)
 	n.Tags["in:structure"] = LIST
@@ -395,9 +489,9 @@ func NewNetworkNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 
 	n = NewNode(nn, done)
 	n.Tags["out:datatype"] = SCALAR | OBJECT
-	n.Tags["out:structure"] = TIMESERIES | LIST
+	n.Tags["out:structure"] = TIMESERIES | LIST | GROUPED
 	n.Tags["in:datatype"] = SCALAR | OBJECT
-	n.Tags["in:structure"] = TIMESERIES | LIST
+	n.Tags["in:structure"] = TIMESERIES | LIST | GROUPED
 	return
 }
 
@@ -413,6 +507,10 @@ func (nn *NetworkNode) Run(input interface{}) (interface{}, error) {
 		mpfriendly := transformSmapItem(input.([]*SmapItem))
 		length := msgpack.Encode(mpfriendly, &mybytes)
 		buf = bytes.NewBuffer(mybytes[:length])
+	case []TimeseriesGroup:
+		mpfriendly := transformTimeseriesGroups(input.([]TimeseriesGroup))
+		length := msgpack.Encode(mpfriendly, &mybytes)
+		buf = bytes.NewBuffer(mybytes[:length])
 	default:
 		length := msgpack.Encode(input, &mybytes)
 		buf = bytes.NewBuffer(mybytes[:length])
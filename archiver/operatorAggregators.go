@@ -72,3 +72,7 @@ func opFuncMin(data [][]interface{}) float64 {
 	}
 	return datamin
 }
+
+func opFuncCount(data [][]interface{}) float64 {
+	return float64(len(data))
+}
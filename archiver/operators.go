@@ -2,6 +2,8 @@ package archiver
 
 import (
 	"fmt"
+	"math"
+	"time"
 )
 
 // The Edge operator essentially takes the 1st order derivative of a stream
@@ -56,14 +58,19 @@ func (en *EdgeNode) Run(input interface{}) (interface{}, error) {
 }
 
 type WindowNode struct {
-	data         []SmapNumbersResponse
+	a            *Archiver
+	dq           *dataquery
 	window       uint64
-	aggFunc      func([][]interface{}) float64
+	stat         string
 	start        uint64
 	end          uint64
 	fromTimeUnit UnitOfTime
 }
 
+// arg0: Dict of operator arguments: size (e.g. 5min) and func (min, mean, max or count)
+// arg1: query.y dataquery struct
+// arg2: archiver reference. If given, the node can take the list of uuids from
+// a where clause and ask the timeseries database to compute the windows
 func NewWindowNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	wn := &WindowNode{}
 	n = NewNode(wn, done)
@@ -71,27 +78,36 @@ func NewWindowNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	var windowSize interface{}
 	if args[0] != nil {
 		kv := args[0].(Dict)
-		fmt.Printf("kv %v\n", kv)
 		windowSize = kv["size"]
-		wn.aggFunc = opFuncChooser[kv["func"].(string)]
+		if stat, ok := kv["func"].(string); ok {
+			wn.stat = stat
+		}
 	}
 
 	if windowSize == nil {
 		windowSize = "5min"
 	}
 
-	if wn.aggFunc == nil {
-		wn.aggFunc = opFuncMean
+	switch wn.stat {
+	case "min", "mean", "max", "count":
+	case "":
+		wn.stat = "mean"
+	default:
+		log.Error("Unknown window function %v, using mean", wn.stat)
+		wn.stat = "mean"
 	}
 
-	dq := args[1].(*dataquery)
+	wn.dq = args[1].(*dataquery)
+	if len(args) > 2 {
+		wn.a, _ = args[2].(*Archiver)
+	}
 
-	wn.start = uint64(dq.start.UnixNano())
-	wn.end = uint64(dq.end.UnixNano())
+	wn.start = uint64(wn.dq.start.UnixNano())
+	wn.end = uint64(wn.dq.end.UnixNano())
 	if wn.end < wn.start {
 		wn.start, wn.end = wn.end, wn.start
 	}
-	wn.fromTimeUnit = dq.timeconv
+	wn.fromTimeUnit = wn.dq.timeconv
 
 	// evaluate windowSize
 	parsed, err := parseIntoDuration(windowSize.(string))
@@ -104,74 +120,315 @@ func NewWindowNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	log.Debug("time: %v", parsed)
 	log.Debug("start: %v end %v", wn.start, wn.end)
 
-	// evaluate aggFunc
-	//TODO
-
 	n.Tags["out:datatype"] = SCALAR
 	n.Tags["out:structure"] = TIMESERIES
 	n.Tags["in:datatype"] = SCALAR
 	n.Tags["in:structure"] = TIMESERIES
+	if wn.a != nil {
+		n.Tags["in:structure"] = LIST | TIMESERIES
+	}
 	return n
 }
 
-//TODO: do we assume that data is sorted?
+// Takes either a list of uuids, in which case the windows are computed by the
+// timeseries database if it can, or the timeseries themselves. Outputs one
+// reading per window holding the chosen statistic; windows without readings
+// are left out.
 func (wn *WindowNode) Run(input interface{}) (interface{}, error) {
 	var (
-		ok  bool
-		err error
+		stats []StatisticalNumbersResponse
+		err   error
 	)
-	wn.data, ok = input.([]SmapNumbersResponse)
-	if !ok {
-		err = fmt.Errorf("Arg0 to EdgeNode must be []SmapNumbersResponse")
+	switch data := input.(type) {
+	case []string:
+		if wn.a == nil {
+			return nil, fmt.Errorf("WindowNode needs an archiver to fetch data for uuids")
+		}
+		stats, err = wn.fetchStatistics(data)
+	case []SmapNumbersResponse:
+		stats = make([]StatisticalNumbersResponse, len(data))
+		for idx, stream := range data {
+			stats[idx] = wn.summarize(stream, wn.fromTimeUnit)
+		}
+	default:
+		return nil, fmt.Errorf("Arg0 to WindowNode must be []string or []SmapNumbersResponse")
+	}
+	if err != nil {
+		return nil, err
 	}
-	if len(wn.data) == 0 {
+	if len(stats) == 0 {
 		return nil, fmt.Errorf("No data to compute window")
 	}
-	var result = make([]SmapNumbersResponse, len(wn.data))
-	for idx, stream := range wn.data {
-		item := SmapNumbersResponse{UUID: stream.UUID, Readings: []*SmapNumberReading{}}
-		if len(stream.Readings) == 0 {
-			result[idx] = item
-			continue
+	var result = make([]SmapNumbersResponse, len(stats))
+	for idx, stream := range stats {
+		item := SmapNumbersResponse{UUID: stream.UUID, Readings: make([]*SmapNumberReading, len(stream.Readings))}
+		for i, stat := range stream.Readings {
+			item.Readings[i] = &SmapNumberReading{Time: stat.Time, Value: wn.pick(stat)}
 		}
+		result[idx] = item
+	}
+	return result, nil
+}
 
-		upperBound := wn.start
-		lowerBound := wn.start
-		lastIdx := 0
-		upperBound += min64(wn.window, wn.end)
-		for upperBound < wn.end {
-			window := [][]interface{}{}
-			for lastIdx < len(stream.Readings) {
-				time := stream.Readings[lastIdx].Time
-				time = convertTime(time, wn.fromTimeUnit, UOT_NS)
-				if time >= lowerBound && time < upperBound {
-					window = append(window, []interface{}{time, stream.Readings[lastIdx].Value})
-					lastIdx += 1
-				} else {
-					fmt.Printf("fail: %v %v %v\n", lowerBound, time, upperBound)
-					break
-				}
-			}
-			lowerBound += wn.window
-			upperBound += min64(wn.window, wn.end)
-			fmt.Printf("got window %v out of total %v\n", len(window), len(stream.Readings))
-			newTime := convertTime(lowerBound, UOT_NS, wn.fromTimeUnit)
-			item.Readings = append(item.Readings, &SmapNumberReading{Time: newTime, Value: wn.aggFunc(window)})
+// Asks the timeseries database for the windows, falling back to fetching the
+// readings and computing them here
+func (wn *WindowNode) fetchStatistics(uuids []string) ([]StatisticalNumbersResponse, error) {
+	// limit number of streams
+	if wn.dq.limit.streamlimit > 0 && int64(len(uuids)) > wn.dq.limit.streamlimit {
+		uuids = uuids[:wn.dq.limit.streamlimit]
+	}
+	stats, err := wn.a.GetStatistics(uuids, wn.start, wn.end, wn.window, UOT_NS, wn.fromTimeUnit)
+	if err != ErrStatisticsUnsupported {
+		return stats, err
+	}
+	log.Debug("Computing windows from raw data (%v)", err)
+	response, err := wn.a.GetData(uuids, wn.start, wn.end, UOT_NS, UOT_NS)
+	if err = logStreamErrors(err); err != nil {
+		return nil, err
+	}
+	stats = make([]StatisticalNumbersResponse, len(uuids))
+	for idx, resp := range response.([]interface{}) {
+		stats[idx].UUID = uuids[idx]
+		if snr, ok := resp.(SmapNumbersResponse); ok {
+			stats[idx] = wn.summarize(snr, UOT_NS)
 		}
-		lastIdx += 1
-		if lastIdx < len(stream.Readings) {
-			lowerBound += wn.window
-			newTime := convertTime(lowerBound, UOT_NS, wn.fromTimeUnit)
-			window := make([][]interface{}, len(stream.Readings[lastIdx:]))
-			for i, val := range stream.Readings[lastIdx:] {
-				time := val.Time
-				time = convertTime(time, wn.fromTimeUnit, UOT_NS)
-				window[i] = []interface{}{time, val.Value}
-			}
-			item.Readings = append(item.Readings, &SmapNumberReading{Time: newTime, Value: opFuncMean(window)})
+	}
+	return stats, nil
+}
+
+// Computes the windows over @stream, whose timestamps are in @uot. The
+// windows are timestamped in the unit of time of the query
+func (wn *WindowNode) summarize(stream SmapNumbersResponse, uot UnitOfTime) StatisticalNumbersResponse {
+	readings := make([]*SmapNumberReading, len(stream.Readings))
+	for i, rdg := range stream.Readings {
+		readings[i] = &SmapNumberReading{Time: convertTime(rdg.Time, uot, UOT_NS), Value: rdg.Value}
+	}
+	stats := windowStatistics(readings, wn.start, wn.end, wn.window)
+	for _, stat := range stats {
+		stat.Time = convertTime(stat.Time, UOT_NS, wn.fromTimeUnit)
+	}
+	return StatisticalNumbersResponse{UUID: stream.UUID, Readings: stats}
+}
+
+func (wn *WindowNode) pick(stat *StatisticalNumberReading) float64 {
+	switch wn.stat {
+	case "min":
+		return stat.Min
+	case "max":
+		return stat.Max
+	case "count":
+		return float64(stat.Count)
+	}
+	return stat.Mean
+}
+
+/** Fill Node **/
+
+// How the gaps between the readings of a data query are filled
+const (
+	// the value of the last reading
+	FILL_PREVIOUS = "previous"
+	// interpolated between the readings on either side
+	FILL_LINEAR = "linear"
+	// null, which is NaN in the reading
+	FILL_NULL = "null"
+	// a number given in the query
+	FILL_CONSTANT = "constant"
+)
+
+// most readings a fill may make per stream
+const MAX_FILL_READINGS = 100000
+
+// The fill clause of a data query: fill previous|linear|null|<constant> every <duration>
+type dataFill struct {
+	method string
+	// the number of FILL_CONSTANT
+	value float64
+	every time.Duration
+}
+
+// A FillNode resamples timeseries to one reading every interval over the time
+// range of the data query. The reading at each time is the latest one no
+// older than the interval; the times without one are filled in. Filling with
+// the previous value starts from the last reading before the range, if the
+// node has an archiver to fetch it from; times before any reading are left
+// out. Interpolation leaves out the times before the first reading and after
+// the last one
+type FillNode struct {
+	fill *dataFill
+	// times of the readings to make, in the unit of time of the query
+	start uint64
+	end   uint64
+	every uint64
+	// start of the range in nanoseconds, and the unit of time of the query
+	startNs uint64
+	uot     UnitOfTime
+	// fetches the readings before the range
+	a *Archiver
+}
+
+// arg0: query.y dataquery struct, which has a fill
+// arg1: optional archiver reference, to fill previous values from before the
+// time range
+func NewFillNode(done <-chan struct{}, args ...interface{}) (n *Node) {
+	fn := newFillNode(args[0].(*dataquery))
+	if len(args) > 1 {
+		fn.a, _ = args[1].(*Archiver)
+	}
+	n = NewNode(fn, done)
+	n.Tags["out:datatype"] = SCALAR
+	n.Tags["out:structure"] = TIMESERIES
+	n.Tags["in:datatype"] = SCALAR
+	n.Tags["in:structure"] = TIMESERIES
+	return n
+}
+
+func newFillNode(dq *dataquery) *FillNode {
+	fn := &FillNode{
+		fill:    dq.fill,
+		start:   convertTime(uint64(dq.start.UnixNano()), UOT_NS, dq.timeconv),
+		end:     convertTime(uint64(dq.end.UnixNano()), UOT_NS, dq.timeconv),
+		every:   convertTime(uint64(dq.fill.every.Nanoseconds()), UOT_NS, dq.timeconv),
+		startNs: uint64(dq.start.UnixNano()),
+		uot:     dq.timeconv,
+	}
+	if fn.end < fn.start {
+		fn.start, fn.end = fn.end, fn.start
+		fn.startNs = uint64(dq.end.UnixNano())
+	}
+	if fn.every == 0 {
+		// shorter than the unit of time of the readings
+		fn.every = 1
+	}
+	return fn
+}
+
+// arg0: list of SmapNumbersResponse to fill. The readings must be in order of time
+func (fn *FillNode) Run(input interface{}) (interface{}, error) {
+	data, ok := input.([]SmapNumbersResponse)
+	if !ok {
+		return nil, fmt.Errorf("Arg0 to FillNode must be []SmapNumbersResponse")
+	}
+	if err := fn.check(); err != nil {
+		return nil, err
+	}
+	earlier, err := fn.earlierReadings(data)
+	if err != nil {
+		return nil, err
+	}
+	var result = make([]SmapNumbersResponse, len(data))
+	for idx, stream := range data {
+		result[idx] = fn.fillStream(withEarlier(stream, earlier))
+	}
+	return result, nil
+}
+
+// Fills the numeric streams of @responses, the results of Archiver.GetData.
+// Object streams are left as they are
+func (fn *FillNode) fillResponses(responses []interface{}) ([]interface{}, error) {
+	if err := fn.check(); err != nil {
+		return nil, err
+	}
+	var streams []SmapNumbersResponse
+	for _, resp := range responses {
+		if snr, ok := resp.(SmapNumbersResponse); ok {
+			streams = append(streams, snr)
 		}
-		result[idx] = item
 	}
+	earlier, err := fn.earlierReadings(streams)
+	if err != nil {
+		return nil, err
+	}
+	var result = make([]interface{}, len(responses))
+	for idx, resp := range responses {
+		if snr, ok := resp.(SmapNumbersResponse); ok {
+			result[idx] = fn.fillStream(withEarlier(snr, earlier))
+		} else {
+			result[idx] = resp
+		}
+	}
+	return result, nil
+}
 
-	return result, err
+// Returns the last reading before the time range of each of @streams that
+// has no reading at its start, keyed by uuid, when filling with the previous
+// value
+func (fn *FillNode) earlierReadings(streams []SmapNumbersResponse) (map[string]*SmapNumberReading, error) {
+	var earlier = make(map[string]*SmapNumberReading)
+	if fn.fill.method != FILL_PREVIOUS || fn.a == nil {
+		return earlier, nil
+	}
+	var uuids []string
+	for _, stream := range streams {
+		if len(stream.Readings) == 0 || stream.Readings[0].Time > fn.start {
+			uuids = append(uuids, stream.UUID)
+		}
+	}
+	if len(uuids) == 0 {
+		return earlier, nil
+	}
+	res, err := fn.a.PrevData(uuids, fn.startNs, 1, UOT_NS, fn.uot)
+	if err = logStreamErrors(err); err != nil {
+		return nil, err
+	}
+	for _, resp := range res.([]interface{}) {
+		if snr, ok := resp.(SmapNumbersResponse); ok && len(snr.Readings) > 0 {
+			earlier[snr.UUID] = snr.Readings[len(snr.Readings)-1]
+		}
+	}
+	return earlier, nil
+}
+
+// @stream with the reading in @earlier for it before its own readings
+func withEarlier(stream SmapNumbersResponse, earlier map[string]*SmapNumberReading) SmapNumbersResponse {
+	if reading, found := earlier[stream.UUID]; found {
+		stream.Readings = append([]*SmapNumberReading{reading}, stream.Readings...)
+	}
+	return stream
+}
+
+// Refuses fills that would make too many readings
+func (fn *FillNode) check() error {
+	if count := (fn.end-fn.start)/fn.every + 1; count > MAX_FILL_READINGS {
+		return fmt.Errorf("Filling every %v makes %v readings per stream, more than %v", fn.fill.every, count, MAX_FILL_READINGS)
+	}
+	return nil
+}
+
+func (fn *FillNode) fillStream(stream SmapNumbersResponse) SmapNumbersResponse {
+	filled := SmapNumbersResponse{UUID: stream.UUID, Status: stream.Status, Error: stream.Error, Readings: []*SmapNumberReading{}}
+	readings := stream.Readings
+	// readings[next] is the first reading after the current time
+	next := 0
+	for ts := fn.start; ts <= fn.end; ts += fn.every {
+		for next < len(readings) && readings[next].Time <= ts {
+			next++
+		}
+		var prev *SmapNumberReading
+		if next > 0 {
+			prev = readings[next-1]
+		}
+		reading := &SmapNumberReading{Time: ts}
+		switch {
+		case fn.fill.method == FILL_LINEAR:
+			if prev == nil || (prev.Time < ts && next == len(readings)) {
+				continue
+			}
+			reading.Value = prev.Value
+			if prev.Time < ts {
+				after := readings[next]
+				reading.Value += (after.Value - prev.Value) * float64(ts-prev.Time) / float64(after.Time-prev.Time)
+			}
+		case prev != nil && (fn.fill.method == FILL_PREVIOUS || ts-prev.Time < fn.every):
+			reading.Value = prev.Value
+		case fn.fill.method == FILL_PREVIOUS:
+			continue
+		case fn.fill.method == FILL_NULL:
+			reading.Value = math.NaN()
+		default:
+			reading.Value = fn.fill.value
+		}
+		filled.Readings = append(filled.Readings, reading)
+	}
+	return filled
 }
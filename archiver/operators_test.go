@@ -0,0 +1,159 @@
+package archiver
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseFill(t *testing.T) {
+	for _, test := range []struct {
+		query  string
+		method string
+		value  float64
+		every  time.Duration
+	}{
+		{`select data in (now -1h, now) fill previous every 5min where has uuid;`, FILL_PREVIOUS, 0, 5 * time.Minute},
+		{`select data in now -1d, now as s fill linear every 1 h where has uuid;`, FILL_LINEAR, 0, time.Hour},
+		{`select data in (now -1h, now) limit 10 fill null every 30s where has uuid;`, FILL_NULL, 0, 30 * time.Second},
+		{`apply mean() to data in (now -1h, now) fill -1.5 every 1min where has uuid;`, FILL_CONSTANT, -1.5, time.Minute},
+	} {
+		q := parseQuery(t, test.query)
+		if fill := q.data.fill; fill == nil || fill.method != test.method || fill.value != test.value || fill.every != test.every {
+			t.Error(test.query, ": got ", fill, " should be ", test.method, " ", test.value, " every ", test.every)
+		}
+	}
+	if q := parseQuery(t, `select data in (now -1h, now) where has uuid;`); q.data.fill != nil {
+		t.Error("Got ", q.data.fill, " should not fill")
+	}
+	for _, bad := range []string{
+		`select data in (now -1h, now) fill nearest every 1min where has uuid;`,
+		`select data in (now -1h, now) fill previous every 0s where has uuid;`,
+		`select data in (now -1h, now) fill previous every 1 fortnight where has uuid;`,
+		`select data before now fill previous every 1min where has uuid;`,
+	} {
+		l := NewSQLex(bad)
+		if SQParse(l); l.error == nil {
+			t.Error(bad, " should not parse")
+		}
+	}
+}
+
+// a FillNode for the data query of @q
+func parseFill(t *testing.T, q string) *FillNode {
+	return newFillNode(parseQuery(t, q).data)
+}
+
+func TestFillStream(t *testing.T) {
+	nan := math.NaN()
+	stream := SmapNumbersResponse{UUID: "aaa", Readings: []*SmapNumberReading{
+		{Time: 1, Value: 10}, {Time: 4, Value: 40}, {Time: 5, Value: 50},
+	}}
+	for _, test := range []struct {
+		fill   string
+		times  []uint64
+		values []float64
+	}{
+		{"previous every 1s", []uint64{1, 2, 3, 4, 5, 6}, []float64{10, 10, 10, 40, 50, 50}},
+		{"linear every 1s", []uint64{1, 2, 3, 4, 5}, []float64{10, 20, 30, 40, 50}},
+		{"null every 1s", []uint64{0, 1, 2, 3, 4, 5, 6}, []float64{nan, 10, nan, nan, 40, 50, nan}},
+		{"-1 every 1s", []uint64{0, 1, 2, 3, 4, 5, 6}, []float64{-1, 10, -1, -1, 40, 50, -1}},
+		// a reading within the interval before a time is used for it
+		{"null every 2s", []uint64{0, 2, 4, 6}, []float64{nan, 10, 40, 50}},
+		{"linear every 3s", []uint64{3}, []float64{30}},
+	} {
+		q := `select data in (0, 6) as s fill ` + test.fill + ` where has uuid;`
+		filled := parseFill(t, q).fillStream(stream)
+		if filled.UUID != "aaa" || len(filled.Readings) != len(test.values) {
+			t.Error(test.fill, ": got ", filled, " should have ", len(test.values), " readings")
+			continue
+		}
+		for i, reading := range filled.Readings {
+			same := reading.Value == test.values[i] || (math.IsNaN(reading.Value) && math.IsNaN(test.values[i]))
+			if reading.Time != test.times[i] || !same {
+				t.Error(test.fill, ": got ", reading.Time, " ", reading.Value, " should be ", test.times[i], " ", test.values[i])
+			}
+		}
+	}
+
+	// the query is in milliseconds unless it says otherwise
+	fn := parseFill(t, `select data in (0, 2) fill previous every 500ms where has uuid;`)
+	if fn.start != 0 || fn.end != 2000 || fn.every != 500 {
+		t.Error("Got ", fn.start, " ", fn.end, " ", fn.every, " should be 0 2000 500")
+	}
+}
+
+func TestFillPreviousFromEarlierReading(t *testing.T) {
+	es := newTestEmbeddedStore("")
+	a := &Archiver{store: es, tsdb: newTestMemoryDB(UOT_S, "aaa", 1, 5, 7)}
+	q := `select data in (4, 8) as s fill previous every 1s where uuid = "aaa";`
+	check := func(how string, stream SmapNumbersResponse) {
+		var values []uint64
+		for _, reading := range stream.Readings {
+			values = append(values, uint64(reading.Value))
+		}
+		if times := readingTimes(stream); !isUint64SliceEqual(times, []uint64{4, 5, 6, 7, 8}) || !isUint64SliceEqual(values, []uint64{1, 5, 5, 7, 7}) {
+			t.Error(how, ": got ", times, values, " should start with the reading at 1")
+		}
+	}
+
+	fn := parseFill(t, q)
+	fn.a = a
+	data, err := a.GetData([]string{"aaa"}, 4, 8, UOT_S, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := fn.Run([]SmapNumbersResponse{data.([]interface{})[0].(SmapNumbersResponse)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("node", res.([]SmapNumbersResponse)[0])
+
+	queried, err := a.HandleQuery(q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("query", queried.([]interface{})[0].(SmapNumbersResponse))
+}
+
+func TestFillTooManyReadings(t *testing.T) {
+	fn := parseFill(t, `select data in (now -1d, now) as ns fill previous every 1ms where has uuid;`)
+	if _, err := fn.Run([]SmapNumbersResponse{testStream("aaa", 1)}); err == nil {
+		t.Error("Filling a day every millisecond should be refused")
+	}
+	if _, err := fn.fillResponses([]interface{}{testStream("aaa", 1)}); err == nil {
+		t.Error("Filling a day every millisecond should be refused")
+	}
+}
+
+func TestFillResponses(t *testing.T) {
+	fn := parseFill(t, `select data in (1, 3) as s fill null every 1s where has uuid;`)
+	objects := SmapObjectResponse{UUID: "bbb"}
+	res, err := fn.fillResponses([]interface{}{testStream("aaa", 1), objects})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[1].(SmapObjectResponse).UUID != "bbb" {
+		t.Error("Got ", res[1], " should leave the objects as they are")
+	}
+	bytes, err := json.Marshal(res[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bytes) != `{"Readings":[[1,1],[2,null],[3,null]],"uuid":"aaa"}` {
+		t.Error("Got ", string(bytes), " the gaps should be null")
+	}
+}
+
+func TestFillNodeInGraph(t *testing.T) {
+	a := newTestExplainArchiver(newTestEmbeddedStore(""))
+	exp := explain(t, a, `explain apply mean() to data in (now -1h, now) fill linear every 1min where has uuid group by Metadata/Type;`)
+	if names := graphNames(exp); !isStringSliceEqual(names, []string{"WhereNode", "SelectDataNode", "FillNode", "GroupNode", "MeanNode"}) || exp.Error != "" {
+		t.Error("Got ", names, exp.Error, " should fill before grouping")
+	}
+	fill, _ := exp.Query["Data"].(map[string]interface{})["Fill"].(map[string]interface{})
+	if fill["Method"] != FILL_LINEAR || fill["Every"] != "1m0s" {
+		t.Error("Got ", fill, " should be the fill of the query")
+	}
+}
@@ -0,0 +1,247 @@
+package archiver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Metadata selects can be ordered by a tag and split into pages:
+//
+//    select * where Metadata/Type = "Sensor" order by Metadata/Location/Floor desc limit 100 offset 200;
+//
+// A select with a limit returns a SelectPage, whose Cursor continues the same
+// query from where the page ended:
+//
+//    select * where Metadata/Type = "Sensor" order by Metadata/Location/Floor desc limit 100 cursor "...";
+//
+// Documents are ordered the way MongoDB sorts them, with ties broken by uuid
+// so that pages do not overlap.
+
+var errBadCursor = errors.New("Invalid cursor, or cursor for a different query")
+
+// Orders and limits the documents returned by a metadata select. The zero
+// Page returns all documents in no particular order
+type Page struct {
+	// dotted key to order by. Pages with a Limit or Offset but no OrderBy are
+	// ordered by uuid
+	OrderBy    string
+	Descending bool
+	// return at most this many documents, or all of them if 0
+	Limit int
+	// skip this many documents first
+	Offset int
+}
+
+// Returns true if the page returns all documents in no particular order
+func (p Page) IsZero() bool {
+	return p == Page{}
+}
+
+// the key to order by, which is uuid if none was given
+func (p Page) orderKey() string {
+	if p.OrderBy == "" {
+		return "uuid"
+	}
+	return p.OrderBy
+}
+
+// A page of the results of a select with a limit
+type SelectPage struct {
+	Results []interface{}
+	// pass to `limit N cursor "..."` in the same query to get the next page.
+	// Empty if this is the last page
+	Cursor string
+}
+
+type pageCursor struct {
+	Offset int    `json:"offset"`
+	Query  uint32 `json:"query"`
+}
+
+// identifies the select @q, leaving out the limit and offset, so that a cursor
+// is only used with the query it came from
+func queryFingerprint(q *query) uint32 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%v|%v|%v|%v|%v|%v", strings.Join(q.Contents, ","), q.distinct, q.where, q.asof.UnixNano(), q.page.OrderBy, q.page.Descending)
+	return h.Sum32()
+}
+
+func encodeCursor(q *query, offset int) string {
+	bytes, _ := json.Marshal(pageCursor{Offset: offset, Query: queryFingerprint(q)})
+	return base64.URLEncoding.EncodeToString(bytes)
+}
+
+// Returns the offset that @cursor continues @q from
+func decodeCursor(q *query, cursor string) (int, error) {
+	var pc pageCursor
+	bytes, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errBadCursor
+	}
+	if err = json.Unmarshal(bytes, &pc); err != nil || pc.Offset < 0 || pc.Query != queryFingerprint(q) {
+		return 0, errBadCursor
+	}
+	return pc.Offset, nil
+}
+
+// Runs the select @q through @get, which returns the documents in a page. If
+// the query has a limit, one more document than the limit is asked for to
+// tell whether there is a next page, and the result is a SelectPage
+func selectPage(q *query, get func(Page) ([]interface{}, error)) (interface{}, error) {
+	page := q.page
+	if q.distinct && !page.IsZero() {
+		return nil, errors.New("Distinct queries cannot be ordered or limited")
+	}
+	if q.cursor != "" {
+		var err error
+		if page.Offset, err = decodeCursor(q, q.cursor); err != nil {
+			return nil, err
+		}
+	}
+	if page.Limit == 0 {
+		return get(page)
+	}
+	ask := page
+	ask.Limit += 1
+	res, err := get(ask)
+	if err != nil {
+		return nil, err
+	}
+	ret := SelectPage{Results: res}
+	if len(res) > page.Limit {
+		ret.Results = res[:page.Limit]
+		ret.Cursor = encodeCursor(q, page.Offset+page.Limit)
+	}
+	return ret, nil
+}
+
+type documentOrder struct {
+	docs []bson.M
+	keys []interface{}
+	desc bool
+}
+
+func (o documentOrder) Len() int { return len(o.docs) }
+func (o documentOrder) Swap(i, j int) {
+	o.docs[i], o.docs[j] = o.docs[j], o.docs[i]
+	o.keys[i], o.keys[j] = o.keys[j], o.keys[i]
+}
+func (o documentOrder) Less(i, j int) bool {
+	c := compareSortValues(o.keys[i], o.keys[j])
+	if o.desc {
+		c = -c
+	}
+	if c == 0 {
+		return fmt.Sprintf("%v", o.docs[i]["uuid"]) < fmt.Sprintf("%v", o.docs[j]["uuid"])
+	}
+	return c < 0
+}
+
+// Orders @docs as @page says and returns the ones in its window, for metadata
+// stores that select documents in memory. Does nothing for the zero Page
+func pageDocuments(docs []bson.M, page Page) []bson.M {
+	if page.IsZero() {
+		return docs
+	}
+	order := documentOrder{docs: docs, keys: make([]interface{}, len(docs)), desc: page.Descending}
+	for i, doc := range docs {
+		value, _ := getPath(doc, page.orderKey())
+		order.keys[i] = sortValue(value, page.Descending)
+	}
+	sort.Sort(order)
+	if page.Offset >= len(docs) {
+		return []bson.M{}
+	}
+	docs = docs[page.Offset:]
+	if page.Limit > 0 && page.Limit < len(docs) {
+		docs = docs[:page.Limit]
+	}
+	return docs
+}
+
+// Like MongoDB, a list sorts by its smallest element in ascending order and
+// by its largest in descending order
+func sortValue(value interface{}, desc bool) interface{} {
+	list, ok := asList(value)
+	if !ok {
+		return value
+	}
+	var ret interface{}
+	for i, elem := range list {
+		c := compareSortValues(elem, ret)
+		if i == 0 || (desc && c > 0) || (!desc && c < 0) {
+			ret = elem
+		}
+	}
+	return ret
+}
+
+// missing values, then numbers, then strings, then documents, then booleans,
+// then anything else
+func sortRank(value interface{}) int {
+	if value == nil {
+		return 0
+	}
+	if _, ok := asFloat(value); ok {
+		return 1
+	}
+	if _, ok := asMap(value); ok {
+		return 3
+	}
+	switch value.(type) {
+	case string:
+		return 2
+	case bool:
+		return 4
+	}
+	return 5
+}
+
+// Returns -1, 0 or 1 as @a sorts before, with or after @b
+func compareSortValues(a, b interface{}) int {
+	ra, rb := sortRank(a), sortRank(b)
+	switch {
+	case ra != rb:
+		return compareInts(ra, rb)
+	case ra == 1:
+		fa, _ := asFloat(a)
+		fb, _ := asFloat(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	case ra == 4:
+		return compareInts(boolRank(a.(bool)), boolRank(b.(bool)))
+	}
+	sa, sb := fmt.Sprintf("%v", a), fmt.Sprintf("%v", b)
+	if sa < sb {
+		return -1
+	} else if sa > sb {
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package archiver
+
+import (
+	"testing"
+)
+
+// parses a whole query
+func parseQuery(t *testing.T, q string) *query {
+	l := NewSQLex(q)
+	SQParse(l)
+	if l.error != nil {
+		t.Fatal("Could not parse ", q, ": ", l.error)
+	}
+	return l.query
+}
+
+func TestParsePage(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		page  Page
+	}{
+		{`select * where has uuid;`, Page{}},
+		{`select * order by Metadata/Location/Floor;`, Page{OrderBy: "Metadata.Location.Floor"}},
+		{`select * where has uuid order by Metadata/Location/Floor asc limit 10;`, Page{OrderBy: "Metadata.Location.Floor", Limit: 10}},
+		{`select uuid where has uuid order by Properties/ReadRate desc limit 10 offset 20;`, Page{OrderBy: "Properties.ReadRate", Descending: true, Limit: 10, Offset: 20}},
+		{`select * where has uuid as of "2026-01-01" limit 5;`, Page{Limit: 5}},
+	} {
+		if q := parseQuery(t, test.query); q.page != test.page {
+			t.Error(test.query, ": got ", q.page, " should be ", test.page)
+		}
+	}
+	if q := parseQuery(t, `select * where has uuid limit 10 cursor "abc";`); q.cursor != "abc" {
+		t.Error("Got cursor ", q.cursor, " should be abc")
+	}
+	for _, bad := range []string{`select * limit 0;`, `select * limit 10 offset -1;`, `select * limit 2.5;`} {
+		l := NewSQLex(bad)
+		SQParse(l)
+		if l.error == nil {
+			t.Error(bad, " should not parse")
+		}
+	}
+}
+
+func TestEmbeddedStorePage(t *testing.T) {
+	testPage(t, newTestEmbeddedStore(""))
+}
+
+func TestSQLStorePage(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	testPage(t, ss)
+}
+
+// runs the select @q against @store and returns its result
+func runSelect(t *testing.T, store MetadataStore, q string) interface{} {
+	query := parseQuery(t, q)
+	res, err := selectPage(query, func(page Page) ([]interface{}, error) {
+		return store.GetTags(query.ContentsBson(), false, "", query.where, page)
+	})
+	if err != nil {
+		t.Fatal(q, ": ", err)
+	}
+	return res
+}
+
+func resultUUIDs(res []interface{}) []string {
+	var uuids []string
+	for _, doc := range res {
+		m, _ := asMap(doc)
+		uuids = append(uuids, m["uuid"].(string))
+	}
+	return uuids
+}
+
+// runs paged selects against a store populated by populateTestStore
+func testPage(t *testing.T, store MetadataStore) {
+	for _, test := range []struct {
+		query string
+		uuids []string
+	}{
+		// bbb has the only Floor, the others are missing and sort first
+		{`select * order by Metadata/Floor;`, []string{"aaa", "ccc", "bbb"}},
+		{`select * order by Metadata/Floor desc;`, []string{"bbb", "aaa", "ccc"}},
+		// ccc's list sorts by 10 ascending and 90.5 descending, and bbb's
+		// string sorts after the numbers
+		{`select * order by Properties/ReadRate;`, []string{"ccc", "aaa", "bbb"}},
+		{`select * order by Properties/ReadRate desc;`, []string{"bbb", "ccc", "aaa"}},
+		{`select uuid where has Properties/ReadRate order by Properties/ReadRate desc;`, []string{"bbb", "ccc", "aaa"}},
+	} {
+		res := runSelect(t, store, test.query).([]interface{})
+		if uuids := resultUUIDs(res); !isStringSliceEqual(uuids, test.uuids) {
+			t.Error(test.query, ": got ", uuids, " should be ", test.uuids)
+		}
+	}
+
+	res := runSelect(t, store, `select * limit 1 offset 1;`).(SelectPage)
+	if uuids := resultUUIDs(res.Results); !isStringSliceEqual(uuids, []string{"bbb"}) || res.Cursor == "" {
+		t.Error("Got ", uuids, " and cursor ", res.Cursor, ", should be bbb with a cursor")
+	}
+
+	// walk the pages with the cursor
+	var uuids []string
+	q := `select uuid where has uuid order by Properties/ReadRate desc limit 2`
+	res = runSelect(t, store, q+";").(SelectPage)
+	for pages := 1; ; pages++ {
+		uuids = append(uuids, resultUUIDs(res.Results)...)
+		if res.Cursor == "" {
+			if pages != 2 {
+				t.Error("Got ", pages, " pages should be 2")
+			}
+			break
+		}
+		res = runSelect(t, store, q+` cursor "`+res.Cursor+`";`).(SelectPage)
+	}
+	if !isStringSliceEqual(uuids, []string{"bbb", "ccc", "aaa"}) {
+		t.Error("Got ", uuids, " should be [bbb ccc aaa]")
+	}
+
+	first := runSelect(t, store, q+";").(SelectPage)
+	other := parseQuery(t, `select uuid where has uuid order by Properties/ReadRate limit 2 cursor "`+first.Cursor+`";`)
+	if _, err := selectPage(other, nil); err != errBadCursor {
+		t.Error("Got ", err, " cursor of another query should be refused")
+	}
+	distinct := parseQuery(t, `select distinct Metadata/Type limit 2;`)
+	if _, err := selectPage(distinct, nil); err == nil {
+		t.Error("Distinct queries should not be limited")
+	}
+}
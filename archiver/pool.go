@@ -1,8 +1,10 @@
 package archiver
 
 import (
+	"fmt"
 	"net"
 	"sync/atomic"
+	"time"
 )
 
 // For handling connections to the TSDB, we want to have a pool of long-lived
@@ -13,10 +15,32 @@ import (
 // connection from the channel, and when it is finished, it can return it to
 // the channel. Buffered channels give us a way to place a maximum number of
 // connections as well, which is nice.
+//
+// Connections that were closed after an error are dropped when they are
+// returned to the pool, and idle connections are checked before they are
+// handed out again, so the TSDB going away and coming back only costs a
+// reconnect. Idle connections are closed once they have not been used for
+// longer than the keepalive.
+
+const (
+	// how many times Get tries to dial the TSDB before giving up
+	POOL_DIAL_ATTEMPTS = 5
+	// wait before the first redial; doubles with every failed attempt
+	POOL_INITIAL_BACKOFF = 50 * time.Millisecond
+	POOL_MAX_BACKOFF     = 5 * time.Second
+	// idle connections are probed before reuse if they have been idle this long
+	POOL_PROBE_IDLE = 1 * time.Second
+)
 
 type TSDBConn struct {
 	conn   net.Conn
 	closed bool
+	// when the connection was last returned to the pool
+	lastUsed time.Time
+}
+
+func NewTSDBConn(conn net.Conn) *TSDBConn {
+	return &TSDBConn{conn: conn, lastUsed: time.Now()}
 }
 
 func (c *TSDBConn) Read(b []byte) (int, error) {
@@ -36,28 +60,108 @@ func (c *TSDBConn) IsClosed() bool {
 	return c.closed
 }
 
+// Returns false if the other end has hung up on an idle connection. Nothing
+// should be waiting to be read on an idle connection, so anything other than
+// a timeout on a short read means it cannot be used
+func (c *TSDBConn) probe() bool {
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.conn.SetReadDeadline(time.Time{})
+	var b [1]byte
+	_, err := c.conn.Read(b[:])
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return true
+	}
+	return false
+}
+
+// Counts of the connections to the TSDB. Live is the number of open
+// connections, in use or idle in the pool. Failed is the number of times
+// connecting has failed or a pooled connection was found to be broken.
+type ConnectionStats struct {
+	Live   int64
+	Idle   int64
+	Failed int64
+}
+
+func (cs ConnectionStats) String() string {
+	return fmt.Sprintf("%d live, %d idle, %d failed", cs.Live, cs.Idle, cs.Failed)
+}
+
 type ConnectionPool struct {
 	pool chan *TSDBConn
 	// ConnectionPool will call this function when it needs a new connection
-	newConn func() *TSDBConn
-	count   int64
+	newConn   func() (*TSDBConn, error)
+	keepAlive time.Duration
+	count     int64
+	failed    int64
 }
 
-func NewConnectionPool(newConn func() *TSDBConn, maxConnections int) *ConnectionPool {
-	pool := &ConnectionPool{newConn: newConn, pool: make(chan *TSDBConn, maxConnections), count: 0}
+// Creates a pool that keeps up to @maxConnections idle connections around.
+// Connections idle for longer than @keepAlive are closed (0 keeps them open)
+func NewConnectionPool(newConn func() (*TSDBConn, error), maxConnections int, keepAlive time.Duration) *ConnectionPool {
+	pool := &ConnectionPool{newConn: newConn, pool: make(chan *TSDBConn, maxConnections), keepAlive: keepAlive, count: 0}
+	if keepAlive > 0 {
+		go periodicCall(keepAlive, pool.closeIdle)
+	}
 	return pool
 }
 
-func (pool *ConnectionPool) Get() *TSDBConn {
-	var c *TSDBConn
-	select {
-	case c = <-pool.pool:
+// Returns a connection from the pool, or a new one if there are no usable
+// idle connections. Dialing is retried with exponential backoff, and an error
+// is returned if the TSDB still cannot be reached.
+func (pool *ConnectionPool) Get() (*TSDBConn, error) {
+	for {
+		var c *TSDBConn
+		select {
+		case c = <-pool.pool:
+		default:
+		}
+		if c == nil {
+			break
+		}
+		if pool.usable(c) {
+			return c, nil
+		}
+	}
+	backoff := POOL_INITIAL_BACKOFF
+	var err error
+	for attempt := 1; attempt <= POOL_DIAL_ATTEMPTS; attempt++ {
+		var c *TSDBConn
+		if c, err = pool.newConn(); err == nil {
+			atomic.AddInt64(&pool.count, 1)
+			log.Info("Creating new connection in pool, now %v", atomic.LoadInt64(&pool.count))
+			return c, nil
+		}
+		atomic.AddInt64(&pool.failed, 1)
+		if attempt == POOL_DIAL_ATTEMPTS {
+			break
+		}
+		log.Warning("Could not connect to TSDB (%v), retrying in %v", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > POOL_MAX_BACKOFF {
+			backoff = POOL_MAX_BACKOFF
+		}
+	}
+	return nil, fmt.Errorf("Could not connect to TSDB after %v attempts (%v)", POOL_DIAL_ATTEMPTS, err)
+}
+
+// Checks an idle connection taken out of the pool, closing it if it has been
+// closed, has expired or is broken
+func (pool *ConnectionPool) usable(c *TSDBConn) bool {
+	idle := time.Since(c.lastUsed)
+	switch {
+	case c.IsClosed():
+	case pool.keepAlive > 0 && idle > pool.keepAlive:
+		c.Close()
+	case idle > POOL_PROBE_IDLE && !c.probe():
+		c.Close()
+		atomic.AddInt64(&pool.failed, 1)
+		log.Warning("Dropping broken connection to TSDB")
 	default:
-		c = pool.newConn()
-		atomic.AddInt64(&pool.count, 1)
-		log.Info("Creating new connection in pool %v, %v", &c.conn, pool.count)
+		return true
 	}
-	return c
+	atomic.AddInt64(&pool.count, -1)
+	return false
 }
 
 func (pool *ConnectionPool) Put(c *TSDBConn) {
@@ -65,11 +169,41 @@ func (pool *ConnectionPool) Put(c *TSDBConn) {
 		atomic.AddInt64(&pool.count, -1)
 		return
 	}
+	c.lastUsed = time.Now()
 	select {
 	case pool.pool <- c:
 	default:
 		c.Close()
 		atomic.AddInt64(&pool.count, -1)
-		log.Info("Releasing connection in pool, now %v", pool.count)
+		log.Info("Releasing connection in pool, now %v", atomic.LoadInt64(&pool.count))
+	}
+}
+
+// Closes the idle connections that have outlived the keepalive (or broken)
+func (pool *ConnectionPool) closeIdle() {
+	for i := len(pool.pool); i > 0; i-- {
+		var c *TSDBConn
+		select {
+		case c = <-pool.pool:
+		default:
+			return
+		}
+		if !pool.usable(c) {
+			continue
+		}
+		select {
+		case pool.pool <- c:
+		default:
+			c.Close()
+			atomic.AddInt64(&pool.count, -1)
+		}
+	}
+}
+
+func (pool *ConnectionPool) Stats() ConnectionStats {
+	return ConnectionStats{
+		Live:   atomic.LoadInt64(&pool.count),
+		Idle:   int64(len(pool.pool)),
+		Failed: atomic.LoadInt64(&pool.failed),
 	}
 }
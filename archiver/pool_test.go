@@ -0,0 +1,121 @@
+package archiver
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pool of connections to a local listener. Returns the pool and the server
+// side of every connection it has made so far
+func newTestPool(t *testing.T, keepAlive time.Duration) (*ConnectionPool, chan net.Conn, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	pool := NewConnectionPool(func() (*TSDBConn, error) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return NewTSDBConn(conn), nil
+	}, 2, keepAlive)
+	return pool, accepted, listener
+}
+
+func TestConnectionPoolReuse(t *testing.T) {
+	pool, _, listener := newTestPool(t, 0)
+	defer listener.Close()
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(c)
+	if stats := pool.Stats(); stats.Live != 1 || stats.Idle != 1 {
+		t.Error("Got ", stats, " should be 1 live, 1 idle")
+	}
+	if c2, _ := pool.Get(); c2 != c {
+		t.Error("Idle connection should have been reused")
+	}
+	// connections closed after an error are not put back
+	c.Close()
+	pool.Put(c)
+	if stats := pool.Stats(); stats.Live != 0 || stats.Idle != 0 {
+		t.Error("Got ", stats, " should be 0 live, 0 idle")
+	}
+}
+
+func TestConnectionPoolDropsBrokenConnections(t *testing.T) {
+	pool, accepted, listener := newTestPool(t, 0)
+	defer listener.Close()
+
+	c, _ := pool.Get()
+	pool.Put(c)
+	// the TSDB hangs up on the idle connection
+	(<-accepted).Close()
+	c.lastUsed = time.Now().Add(-2 * POOL_PROBE_IDLE)
+
+	c2, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 == c || !c.IsClosed() {
+		t.Error("Broken connection should have been closed and replaced")
+	}
+	if stats := pool.Stats(); stats.Live != 1 || stats.Failed != 1 {
+		t.Error("Got ", stats, " should be 1 live, 1 failed")
+	}
+}
+
+func TestConnectionPoolKeepAlive(t *testing.T) {
+	pool, _, listener := newTestPool(t, time.Hour)
+	defer listener.Close()
+
+	c, _ := pool.Get()
+	pool.Put(c)
+	c.lastUsed = time.Now().Add(-2 * time.Hour)
+	pool.closeIdle()
+	if !c.IsClosed() {
+		t.Error("Connection idle for longer than the keepalive should be closed")
+	}
+	if stats := pool.Stats(); stats.Live != 0 || stats.Idle != 0 {
+		t.Error("Got ", stats, " should be 0 live, 0 idle")
+	}
+}
+
+func TestConnectionPoolBackoff(t *testing.T) {
+	attempts := 0
+	pool := NewConnectionPool(func() (*TSDBConn, error) {
+		attempts += 1
+		if attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		client, _ := net.Pipe()
+		return NewTSDBConn(client), nil
+	}, 2, 0)
+	if _, err := pool.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats(); stats.Live != 1 || stats.Failed != 2 {
+		t.Error("Got ", stats, " should be 1 live, 2 failed")
+	}
+
+	pool = NewConnectionPool(func() (*TSDBConn, error) {
+		return nil, errors.New("connection refused")
+	}, 2, 0)
+	if c, err := pool.Get(); err == nil || c != nil {
+		t.Error("Got ", c, " should fail after ", POOL_DIAL_ATTEMPTS, " attempts")
+	}
+}
@@ -0,0 +1,148 @@
+package archiver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Predicate is a node of the where-clause tree built by the query parser.
+// Metadata stores compile the tree into whatever their backend understands
+// (see compileMongo, matchPredicate and sqlDialect.compileWhere). A nil
+// Predicate (no where clause) matches everything.
+//
+// Keys are dotted paths into the stream document, e.g. Metadata.Location.City
+type Predicate interface {
+	// Returns the predicate in the syntax of the query language
+	String() string
+}
+
+// All of the predicates must match
+type And []Predicate
+
+// At least one of the predicates must match
+type Or []Predicate
+
+// Negates the predicate
+type Not struct {
+	Predicate Predicate
+}
+
+// The value at Key equals Value. If the stored value is a list, it matches if
+// any of its elements equal Value
+type Eq struct {
+	Key   string
+	Value interface{}
+}
+
+// The value at Key is a number that compares to Value with Op, one of <, <=,
+// > or >=. Values that are not numbers (including strings of digits) never
+// match. If the stored value is a list, it matches if any of its elements do
+type Compare struct {
+	Key   string
+	Op    string
+	Value float64
+}
+
+// The value at Key matches the regular expression Pattern
+type Like struct {
+	Key     string
+	Pattern string
+}
+
+// The document has a value at Key
+type Has struct {
+	Key string
+}
+
+// The value at Key equals one of Values
+type In struct {
+	Key    string
+	Values []string
+}
+
+// the operators of Compare
+var compareOperators = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
+
+// Returns the NUMBER literal @num of a query as an int64, or as a float64 if
+// it has a fractional part (or does not fit)
+func parseNumber(num string) interface{} {
+	if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return i
+	}
+	f, _ := strconv.ParseFloat(num, 64)
+	return f
+}
+
+// Builds the Compare for `@key @op @num` in a where clause
+func newCompare(key, op, num string) Compare {
+	value, _ := strconv.ParseFloat(num, 64)
+	return Compare{Key: key, Op: op, Value: value}
+}
+
+// turns a dotted key back into the tag path used in queries
+func predicateKey(key string) string {
+	return strings.Replace(key, ".", "/", -1)
+}
+
+func predicateValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func joinPredicates(preds []Predicate, sep string) string {
+	terms := make([]string, len(preds))
+	for i, p := range preds {
+		terms[i] = p.String()
+	}
+	return "(" + strings.Join(terms, sep) + ")"
+}
+
+func (p And) String() string {
+	return joinPredicates(p, " and ")
+}
+
+func (p Or) String() string {
+	return joinPredicates(p, " or ")
+}
+
+func (p Not) String() string {
+	switch inner := p.Predicate.(type) {
+	case Eq:
+		return predicateKey(inner.Key) + " != " + predicateValue(inner.Value)
+	case In:
+		return strings.TrimSuffix(inner.String(), " in "+predicateKey(inner.Key)) + " not in " + predicateKey(inner.Key)
+	}
+	return "not " + p.Predicate.String()
+}
+
+func (p Eq) String() string {
+	return predicateKey(p.Key) + " = " + predicateValue(p.Value)
+}
+
+func (p Compare) String() string {
+	return predicateKey(p.Key) + " " + p.Op + " " + predicateValue(p.Value)
+}
+
+func (p Like) String() string {
+	return predicateKey(p.Key) + " like " + strconv.Quote(p.Pattern)
+}
+
+func (p Has) String() string {
+	return "has " + predicateKey(p.Key)
+}
+
+func (p In) String() string {
+	values := make([]string, len(p.Values))
+	for i, v := range p.Values {
+		values[i] = strconv.Quote(v)
+	}
+	return "[" + strings.Join(values, ", ") + "] in " + predicateKey(p.Key)
+}
@@ -0,0 +1,76 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestParsePredicate(t *testing.T) {
+	for _, test := range []struct {
+		where     string
+		predicate Predicate
+	}{
+		{`Metadata/Type = "Sensor"`, Eq{Key: "Metadata.Type", Value: "Sensor"}},
+		{`Metadata/Type != "Sensor"`, Not{Eq{Key: "Metadata.Type", Value: "Sensor"}}},
+		{`Path like "temp"`, Like{Key: "Path", Pattern: "temp"}},
+		{`has Metadata/Floor`, Has{Key: "Metadata.Floor"}},
+		{`["a", "b"] in uuid`, In{Key: "uuid", Values: []string{"a", "b"}}},
+		{`["a"] not in uuid`, Not{In{Key: "uuid", Values: []string{"a"}}}},
+		{`Metadata/Floor = 4`, Eq{Key: "Metadata.Floor", Value: int64(4)}},
+		{`Metadata/Floor != 4.5`, Not{Eq{Key: "Metadata.Floor", Value: 4.5}}},
+		{`Metadata/Floor < 4`, Compare{Key: "Metadata.Floor", Op: "<", Value: 4}},
+		{`Metadata/Floor <= -1`, Compare{Key: "Metadata.Floor", Op: "<=", Value: -1}},
+		{`Properties/ReadRate > 0.5`, Compare{Key: "Properties.ReadRate", Op: ">", Value: 0.5}},
+		{`Properties/ReadRate >= 60`, Compare{Key: "Properties.ReadRate", Op: ">=", Value: 60}},
+		{`has Path and (uuid = "a" or not has Metadata)`,
+			And{Has{Key: "Path"}, Or{Eq{Key: "uuid", Value: "a"}, Not{Has{Key: "Metadata"}}}}},
+	} {
+		predicate := parseWhere(t, test.where)
+		if !valuesEqual(compileMongo(predicate), compileMongo(test.predicate)) || predicate.String() != test.predicate.String() {
+			t.Error("Got ", predicate, " should be ", test.predicate)
+		}
+		// printed predicates parse back to the same tree
+		if again := parseWhere(t, predicate.String()); again.String() != predicate.String() {
+			t.Error("Got ", again, " should be ", predicate)
+		}
+	}
+}
+
+func TestCompileMongo(t *testing.T) {
+	for _, test := range []struct {
+		where string
+		bson  bson.M
+	}{
+		{`Metadata/Type = "Sensor"`, bson.M{"Metadata.Type": "Sensor"}},
+		{`Metadata/Type != "Sensor"`, bson.M{"Metadata.Type": bson.M{"$ne": "Sensor"}}},
+		{`Path like "temp"`, bson.M{"Path": bson.M{"$regex": "temp"}}},
+		{`not has Metadata/Floor`, bson.M{"Metadata.Floor": bson.M{"$not": bson.M{"$exists": true}}}},
+		{`["a", "b"] not in uuid`, bson.M{"uuid": bson.M{"$not": bson.M{"$in": []interface{}{"a", "b"}}}}},
+		{`Metadata/Floor = 4`, bson.M{"Metadata.Floor": 4}},
+		{`Metadata/Floor >= 3`, bson.M{"Metadata.Floor": bson.M{"$gte": 3}}},
+		{`not Properties/ReadRate < 60`, bson.M{"Properties.ReadRate": bson.M{"$not": bson.M{"$lt": 60}}}},
+		{`has Path and uuid = "a"`, bson.M{"$and": []interface{}{
+			bson.M{"Path": bson.M{"$exists": true}}, bson.M{"uuid": "a"}}}},
+		{`not (has Path or uuid = "a")`, bson.M{"$nor": []interface{}{bson.M{"$or": []interface{}{
+			bson.M{"Path": bson.M{"$exists": true}}, bson.M{"uuid": "a"}}}}}},
+	} {
+		if compiled := compileMongo(parseWhere(t, test.where)); !valuesEqual(compiled, test.bson) {
+			t.Error(test.where, ": got ", compiled, " should be ", test.bson)
+		}
+	}
+	if compiled := compileMongo(nil); len(compiled) != 0 {
+		t.Error("Got ", compiled, " should be empty")
+	}
+}
+
+func TestParseSetNumbers(t *testing.T) {
+	l := NewSQLex(`set Metadata/Floor = 4, Properties/ReadRate = 0.5, Metadata/Room = "410" where uuid = "aaa";`)
+	SQParse(l)
+	if l.error != nil {
+		t.Fatal(l.error)
+	}
+	set := l.query.set
+	if set["Metadata.Floor"] != int64(4) || set["Properties.ReadRate"] != 0.5 || set["Metadata.Room"] != "410" {
+		t.Error("Got ", set, " should have typed numbers")
+	}
+}
@@ -22,6 +22,7 @@ type SQSymType struct {
 	yys      int
 	str      string
 	dict     Dict
+	pred     Predicate
 	oplist   []*OpNode
 	op       *OpNode
 	data     *dataquery
@@ -29,7 +30,10 @@ type SQSymType struct {
 	timeconv UnitOfTime
 	list     List
 	time     _time.Time
-	timediff _time.Duration
+	tref     timeRef
+	offset   timeOffset
+	loc      *_time.Location
+	fill     *dataFill
 }
 
 const SELECT = 57346
@@ -37,37 +41,57 @@ const DISTINCT = 57347
 const DELETE = 57348
 const SET = 57349
 const APPLY = 57350
-const WHERE = 57351
-const DATA = 57352
-const BEFORE = 57353
-const AFTER = 57354
-const LIMIT = 57355
-const STREAMLIMIT = 57356
-const NOW = 57357
-const LVALUE = 57358
-const QSTRING = 57359
-const OPERATOR = 57360
-const EQ = 57361
-const NEQ = 57362
-const COMMA = 57363
-const ALL = 57364
-const LEFTPIPE = 57365
-const LIKE = 57366
-const AS = 57367
-const AND = 57368
-const OR = 57369
-const HAS = 57370
-const NOT = 57371
-const IN = 57372
-const TO = 57373
-const LPAREN = 57374
-const RPAREN = 57375
-const LBRACK = 57376
-const RBRACK = 57377
-const NUMBER = 57378
-const SEMICOLON = 57379
-const NEWLINE = 57380
-const TIMEUNIT = 57381
+const EXPLAIN = 57351
+const WHERE = 57352
+const DATA = 57353
+const BEFORE = 57354
+const AFTER = 57355
+const LIMIT = 57356
+const STREAMLIMIT = 57357
+const NOW = 57358
+const LVALUE = 57359
+const QSTRING = 57360
+const OPERATOR = 57361
+const EQ = 57362
+const NEQ = 57363
+const COMMA = 57364
+const ALL = 57365
+const LEFTPIPE = 57366
+const LTE = 57367
+const GT = 57368
+const GTE = 57369
+const LIKE = 57370
+const AS = 57371
+const OF = 57372
+const AT = 57373
+const TIMEZONE = 57374
+const TODAY = 57375
+const YESTERDAY = 57376
+const START = 57377
+const ORDER = 57378
+const BY = 57379
+const ASC = 57380
+const DESC = 57381
+const OFFSET = 57382
+const CURSOR = 57383
+const GROUP = 57384
+const STREAMCOUNT = 57385
+const FILL = 57386
+const EVERY = 57387
+const AND = 57388
+const OR = 57389
+const HAS = 57390
+const NOT = 57391
+const IN = 57392
+const TO = 57393
+const LPAREN = 57394
+const RPAREN = 57395
+const LBRACK = 57396
+const RBRACK = 57397
+const NUMBER = 57398
+const SEMICOLON = 57399
+const NEWLINE = 57400
+const TIMEUNIT = 57401
 
 var SQToknames = []string{
 	"SELECT",
@@ -75,6 +99,7 @@ var SQToknames = []string{
 	"DELETE",
 	"SET",
 	"APPLY",
+	"EXPLAIN",
 	"WHERE",
 	"DATA",
 	"BEFORE",
@@ -90,8 +115,27 @@ var SQToknames = []string{
 	"COMMA",
 	"ALL",
 	"LEFTPIPE",
+	"LTE",
+	"GT",
+	"GTE",
 	"LIKE",
 	"AS",
+	"OF",
+	"AT",
+	"TIMEZONE",
+	"TODAY",
+	"YESTERDAY",
+	"START",
+	"ORDER",
+	"BY",
+	"ASC",
+	"DESC",
+	"OFFSET",
+	"CURSOR",
+	"GROUP",
+	"STREAMCOUNT",
+	"FILL",
+	"EVERY",
 	"AND",
 	"OR",
 	"HAS",
@@ -113,7 +157,7 @@ const SQEofCode = 1
 const SQErrCode = 2
 const SQMaxDepth = 200
 
-//line query.y:437
+//line query.y:614
 const eof = 0
 
 var supported_formats = []string{"1/2/2006",
@@ -122,7 +166,11 @@ var supported_formats = []string{"1/2/2006",
 	"1-2-2006 03:04:05 PM MST",
 	"1/2/2006 15:04:05 MST",
 	"1-2-2006 15:04:05 MST",
-	"2006-1-2 15:04:05 MST"}
+	"2006-1-2 15:04:05 MST",
+	"2006-1-2 15:04:05",
+	"2006-1-2",
+	_time.RFC3339,
+	"2006-01-02T15:04:05"}
 
 type Dict map[string]interface{}
 type List []string
@@ -151,6 +199,8 @@ func (qt queryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case APPLY_TYPE:
+		ret = "apply"
 	}
 	return ret
 }
@@ -163,18 +213,30 @@ type query struct {
 	// key-value pairs to add
 	set Dict
 	// where clause for query
-	where Dict
+	where Predicate
 	// are we querying distinct values?
 	distinct bool
 	// list of tags to target for deletion, selection
 	Contents []string
+	// select the metadata as it was at this time, if set
+	asof _time.Time
+	// order and limit of the documents returned by a select
+	page Page
+	// continues the select from where an earlier page ended
+	cursor string
+	// are we counting the streams instead of selecting their tags?
+	count bool
+	// dotted key of the tag whose values group the results
+	groupBy string
+	// describe how the query would run instead of running it
+	explain bool
 	// formed operator tree
 	operators []*OpNode
 }
 
 func (q *query) Print() {
 	fmt.Printf("Type: %v\n", q.qtype.String())
-	if q.qtype == DATA_TYPE {
+	if q.data != nil {
 		fmt.Printf("Data Query Type: %v\n", q.data.dtype.String())
 		fmt.Printf("Start: %v\n", q.data.start)
 		fmt.Printf("End: %v\n", q.data.end)
@@ -184,6 +246,21 @@ func (q *query) Print() {
 	fmt.Printf("Contents: %v\n", q.Contents)
 	fmt.Printf("Distinct? %v\n", q.distinct)
 	fmt.Printf("where: %v\n", q.where)
+	if !q.asof.IsZero() {
+		fmt.Printf("As of: %v\n", q.asof)
+	}
+	if q.page.OrderBy != "" {
+		fmt.Printf("Order by: %v (descending? %v)\n", q.page.OrderBy, q.page.Descending)
+	}
+	if q.page.Limit > 0 {
+		fmt.Printf("Limit: %v offset %v cursor %v\n", q.page.Limit, q.page.Offset, q.cursor)
+	}
+	if q.count {
+		fmt.Printf("Count? %v\n", q.count)
+	}
+	if q.groupBy != "" {
+		fmt.Printf("Group by: %v\n", q.groupBy)
+	}
 }
 
 func (q *query) ContentsBson() bson.M {
@@ -194,10 +271,6 @@ func (q *query) ContentsBson() bson.M {
 	return ret
 }
 
-func (q *query) WhereBson() bson.M {
-	return bson.M(q.where)
-}
-
 func (q *query) SetBson() bson.M {
 	return bson.M(q.set)
 }
@@ -229,6 +302,8 @@ type dataquery struct {
 	end      _time.Time
 	limit    datalimit
 	timeconv UnitOfTime
+	// nil unless the readings are filled in
+	fill *dataFill
 }
 
 type datalimit struct {
@@ -248,12 +323,25 @@ type SQLex struct {
 	keys  []string
 }
 
+// Words that are lexed as LVALUE and then turned into their token, so that
+// tags starting with them (like atrium or start_time) are still tags. "to" is
+// here so that it does not take the start of "today"
+var reservedWords = map[string]int{
+	"to":        TO,
+	"at":        AT,
+	"timezone":  TIMEZONE,
+	"today":     TODAY,
+	"yesterday": YESTERDAY,
+	"start":     START,
+}
+
 func NewSQLex(s string) *SQLex {
 	scanner := toki.NewScanner(
 		[]toki.Def{
 			{Token: WHERE, Pattern: "where"},
 			{Token: SELECT, Pattern: "select"},
 			{Token: APPLY, Pattern: "apply"},
+			{Token: EXPLAIN, Pattern: "explain"},
 			{Token: DELETE, Pattern: "delete"},
 			{Token: DISTINCT, Pattern: "distinct"},
 			{Token: LIMIT, Pattern: "limit"},
@@ -265,16 +353,29 @@ func NewSQLex(s string) *SQLex {
 			{Token: AFTER, Pattern: "after"},
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
+			{Token: ASC, Pattern: "asc"},
 			{Token: AS, Pattern: "as"},
-			{Token: TO, Pattern: "to"},
+			{Token: OFFSET, Pattern: "offset"},
+			{Token: OF, Pattern: "of"},
+			{Token: BY, Pattern: "by"},
+			{Token: DESC, Pattern: "desc"},
+			{Token: CURSOR, Pattern: "cursor"},
+			{Token: STREAMCOUNT, Pattern: "count"},
+			{Token: GROUP, Pattern: "group"},
+			{Token: FILL, Pattern: "fill"},
+			{Token: EVERY, Pattern: "every"},
 			{Token: DATA, Pattern: "data"},
+			{Token: ORDER, Pattern: "order"},
 			{Token: OR, Pattern: "or"},
 			{Token: IN, Pattern: "in"},
 			{Token: HAS, Pattern: "has"},
 			{Token: NOT, Pattern: "not"},
 			{Token: NEQ, Pattern: "!="},
 			{Token: EQ, Pattern: "="},
+			{Token: LTE, Pattern: "<="},
+			{Token: GTE, Pattern: ">="},
 			{Token: LEFTPIPE, Pattern: "<"},
+			{Token: GT, Pattern: ">"},
 			{Token: LPAREN, Pattern: "\\("},
 			{Token: RPAREN, Pattern: "\\)"},
 			{Token: LBRACK, Pattern: "\\["},
@@ -299,6 +400,9 @@ func (sq *SQLex) Lex(lval *SQSymType) int {
 	}
 	lval.str = string(r.Value)
 	sq.tokens = append(sq.tokens, lval.str)
+	if token, found := reservedWords[lval.str]; found && int(r.Token) == LVALUE {
+		return token
+	}
 	return int(r.Token)
 }
 
@@ -306,6 +410,26 @@ func (sq *SQLex) Error(s string) {
 	sq.error = fmt.Errorf(s)
 }
 
+// Parses @num, the number of a limit or offset, which must be at least @min
+func (sq *SQLex) pageNumber(num string, min int) int {
+	n, err := strconv.Atoi(num)
+	if err != nil || n < min {
+		sq.Error(fmt.Sprintf("Expected a whole number of at least %v, not \"%v\"", min, num))
+	}
+	return n
+}
+
+// Parses the interval "@num @units" of a fill, which must be positive
+func (sq *SQLex) fillInterval(num, units string) _time.Duration {
+	every, err := parseReltime(num, units)
+	if err != nil {
+		sq.Error(fmt.Sprintf("Error parsing fill interval \"%v %v\" (%v)", num, units, err.Error()))
+	} else if every <= 0 {
+		sq.Error(fmt.Sprintf("Fill interval \"%v %v\" must be positive", num, units))
+	}
+	return every
+}
+
 func readline(fi *bufio.Reader) (string, bool) {
 	fmt.Printf("smap> ")
 	s, err := fi.ReadString('\n')
@@ -324,109 +448,153 @@ var SQExca = []int{
 	-2, 0,
 }
 
-const SQNprod = 65
+const SQNprod = 98
 const SQPrivate = 57344
 
 var SQTokenNames []string
 var SQStates []string
 
-const SQLast = 159
+const SQLast = 269
 
 var SQAct = []int{
 
-	109, 85, 39, 82, 78, 12, 15, 12, 52, 14,
-	73, 17, 19, 25, 54, 35, 49, 7, 22, 24,
-	18, 53, 119, 54, 62, 53, 30, 54, 33, 58,
-	54, 42, 12, 60, 131, 54, 18, 47, 48, 46,
-	34, 59, 51, 70, 55, 56, 51, 101, 31, 120,
-	13, 74, 65, 66, 97, 83, 112, 76, 88, 111,
-	45, 75, 40, 36, 23, 80, 37, 79, 42, 129,
-	104, 41, 27, 28, 99, 43, 95, 96, 98, 92,
-	93, 63, 64, 100, 77, 8, 108, 103, 94, 113,
-	16, 26, 15, 15, 15, 72, 71, 110, 107, 114,
-	115, 116, 128, 117, 61, 63, 64, 44, 127, 123,
-	106, 74, 124, 118, 121, 57, 68, 69, 79, 102,
-	91, 67, 90, 122, 130, 10, 89, 81, 29, 105,
-	11, 134, 132, 133, 32, 135, 13, 18, 54, 125,
-	13, 84, 9, 21, 13, 86, 87, 126, 2, 11,
-	4, 3, 5, 1, 18, 50, 20, 6, 38,
+	214, 21, 186, 161, 122, 104, 69, 66, 110, 118,
+	99, 28, 33, 18, 59, 70, 220, 74, 45, 212,
+	39, 70, 42, 74, 70, 29, 74, 23, 218, 197,
+	194, 182, 71, 72, 73, 176, 152, 74, 71, 72,
+	73, 71, 72, 73, 75, 76, 82, 74, 79, 74,
+	74, 83, 84, 78, 57, 68, 61, 65, 17, 100,
+	64, 68, 107, 49, 68, 87, 88, 219, 16, 19,
+	16, 115, 108, 116, 40, 174, 113, 34, 43, 225,
+	224, 124, 210, 52, 109, 80, 198, 137, 135, 50,
+	46, 128, 189, 47, 188, 52, 133, 134, 136, 119,
+	153, 141, 16, 146, 130, 131, 140, 139, 138, 144,
+	105, 85, 86, 105, 96, 24, 204, 150, 132, 10,
+	156, 200, 155, 149, 151, 158, 114, 147, 165, 56,
+	55, 98, 97, 223, 53, 143, 44, 170, 215, 166,
+	167, 168, 36, 37, 85, 86, 106, 222, 26, 103,
+	31, 32, 100, 178, 179, 175, 172, 112, 51, 60,
+	177, 142, 62, 184, 31, 183, 23, 164, 191, 185,
+	102, 190, 173, 101, 27, 193, 154, 192, 180, 181,
+	35, 13, 123, 159, 121, 32, 199, 15, 201, 19,
+	19, 19, 63, 17, 187, 205, 11, 54, 31, 12,
+	81, 206, 207, 20, 209, 208, 196, 171, 30, 211,
+	195, 169, 213, 216, 157, 145, 217, 129, 221, 14,
+	90, 91, 148, 127, 92, 93, 94, 95, 89, 126,
+	125, 117, 38, 41, 74, 77, 227, 58, 23, 22,
+	226, 105, 202, 17, 160, 17, 120, 162, 163, 203,
+	111, 4, 15, 6, 5, 7, 3, 4, 23, 6,
+	5, 7, 2, 1, 67, 25, 8, 9, 48,
 }
 var SQPact = []int{
 
-	144, -1000, 120, 124, 128, 127, 27, 145, -1000, -1000,
-	124, 61, 107, -1000, 11, 115, 145, 3, 34, 44,
-	84, 28, 2, -1000, 0, -1000, 6, 10, 10, 124,
-	-8, -1000, -3, -13, -1000, 79, 34, 34, -1000, 97,
-	124, 66, 121, 139, 127, 51, -1000, -1000, 10, 106,
-	19, 125, -1000, -1000, -1000, 132, 132, -1000, -1000, 105,
-	101, 99, -1000, 34, 34, 79, 55, 121, 18, 121,
-	-1000, 124, 53, 12, 98, 145, -1000, -1000, 37, 110,
-	89, 10, -1000, 124, -1000, 72, 23, 20, 72, 124,
-	124, 124, 79, 79, -1000, -1000, -1000, -1000, -1000, -1000,
-	124, -1000, 121, -15, -1000, 13, 10, 132, 19, -1000,
-	123, 133, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	87, 81, 36, 72, -1000, -1000, -2, 102, 102, 132,
-	-1000, -1000, -1000, -1000, 72, -1000,
+	247, -1000, -1000, 253, 176, 226, 228, 131, -1000, 156,
+	248, -1000, -1000, 226, -1000, 130, 210, -1000, 17, 213,
+	248, 21, 86, 41, 83, 173, 78, 77, 122, 123,
+	108, 125, 162, 3, -1000, 5, 8, 8, 226, -4,
+	-1000, 29, -11, -1000, -1, 98, 41, 41, -1000, 200,
+	226, 82, 216, 241, 131, 96, 93, 123, 108, 236,
+	120, 123, 226, 8, -1000, 8, 209, 43, 229, -1000,
+	-1000, -1000, -1000, 154, -1000, 151, 151, -1000, -1000, 208,
+	207, 201, -1000, 8, 195, 41, 41, 98, 65, 216,
+	32, 31, 52, 51, 50, 45, -1000, 226, 85, 54,
+	193, 248, -1000, -1000, 74, 202, -1000, 70, 236, 123,
+	-21, 44, 226, 236, -1000, 151, 192, 8, -1000, 226,
+	-1000, 227, 233, 135, 233, 226, 226, 226, 189, 8,
+	98, 98, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, 226, -1000, 216, 108, -1000, 19, -1000,
+	-22, 236, -1000, 113, 140, -26, -1000, 8, 151, 43,
+	-1000, 165, 38, 36, 216, 165, -1000, -1000, -1000, 8,
+	151, -1000, -1000, -27, 188, 184, -1000, -28, 30, 216,
+	-1000, -1000, -1000, 68, 233, -1000, -1000, 225, 234, -1000,
+	-1000, -1000, 63, 248, -1000, 224, 224, -1000, -1000, -1000,
+	151, 165, -1000, 26, 151, -38, -1000, -1000, 233, 94,
+	-1000, 248, -1000, 165, -1000, 11, -41, 94, 102, 88,
+	-1000, -1000, 24, 23, 223, 219, -1000, -1000,
 }
 var SQPgo = []int{
 
-	0, 15, 158, 11, 9, 4, 157, 85, 10, 71,
-	12, 156, 17, 16, 155, 3, 1, 0, 8, 2,
-	153,
+	0, 18, 268, 1, 13, 5, 267, 196, 10, 158,
+	115, 265, 119, 208, 7, 264, 9, 4, 0, 3,
+	2, 6, 63, 263, 262, 25, 14, 8,
 }
 var SQR1 = []int{
 
-	0, 20, 20, 20, 20, 20, 20, 20, 20, 7,
-	7, 9, 8, 8, 4, 4, 4, 4, 4, 4,
-	6, 6, 6, 6, 12, 12, 12, 12, 13, 13,
-	14, 14, 14, 14, 15, 15, 16, 16, 16, 16,
-	17, 17, 3, 2, 2, 2, 2, 2, 2, 2,
-	18, 19, 1, 1, 1, 1, 1, 10, 10, 11,
-	11, 5, 5, 5, 5,
+	0, 23, 23, 24, 24, 24, 24, 24, 24, 24,
+	24, 24, 24, 24, 24, 7, 7, 9, 8, 8,
+	4, 4, 4, 4, 4, 4, 6, 6, 6, 6,
+	6, 12, 12, 12, 12, 18, 18, 18, 25, 25,
+	26, 26, 26, 26, 27, 27, 27, 27, 13, 17,
+	17, 14, 14, 15, 15, 15, 15, 15, 15, 15,
+	16, 16, 19, 19, 19, 19, 20, 20, 3, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 21, 22, 1, 1, 1, 1, 1, 10, 10,
+	11, 11, 11, 11, 5, 5, 5, 5,
 }
 var SQR2 = []int{
 
-	0, 4, 3, 4, 4, 3, 4, 3, 6, 1,
-	3, 3, 1, 3, 3, 3, 3, 5, 5, 5,
-	1, 1, 2, 1, 9, 7, 5, 5, 1, 2,
-	2, 1, 1, 1, 2, 3, 0, 2, 2, 4,
-	0, 2, 2, 3, 3, 3, 3, 2, 3, 4,
-	1, 1, 3, 3, 2, 3, 1, 1, 3, 3,
-	4, 3, 3, 5, 5,
+	0, 1, 2, 7, 6, 8, 7, 4, 4, 3,
+	4, 3, 11, 9, 7, 1, 3, 3, 1, 3,
+	3, 3, 3, 5, 5, 5, 1, 1, 2, 1,
+	1, 11, 9, 6, 6, 0, 5, 5, 0, 3,
+	0, 3, 4, 4, 0, 2, 4, 4, 4, 0,
+	3, 1, 2, 2, 1, 1, 1, 1, 1, 3,
+	2, 3, 0, 2, 2, 4, 0, 2, 2, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 2, 3,
+	4, 1, 1, 3, 3, 2, 3, 1, 1, 3,
+	3, 4, 3, 4, 3, 3, 5, 5,
 }
 var SQChk = []int{
 
-	-1000, -20, 4, 7, 6, 8, -6, -12, -7, 22,
-	5, 10, -19, 16, -4, -19, -7, -3, 9, -10,
-	-11, 16, -3, 37, -3, -19, 30, 11, 12, 21,
-	-3, 37, 19, -3, 37, -1, 29, 32, -2, -19,
-	28, -9, 34, 31, 23, 32, 37, 37, 32, -13,
-	-14, 36, -18, 15, 17, -13, -13, -7, 37, -18,
-	36, -9, 37, 26, 27, -1, -1, 24, 19, 20,
-	-19, 30, 29, -8, -18, -12, -10, 33, -5, 16,
-	-13, 21, -15, 36, 16, -16, 13, 14, -16, 21,
-	21, 21, -1, -1, 33, -18, -18, 36, -18, -19,
-	30, 35, 21, -3, 33, 19, 21, -13, -19, -17,
-	25, 36, 36, -17, -4, -4, -4, -19, -8, 37,
-	36, -18, -13, -16, -15, 16, 14, 21, 21, 33,
-	-17, 36, -5, -5, -16, -17,
+	-1000, -23, -24, 9, 4, 7, 6, 8, -24, -6,
+	-12, -7, 23, 5, 43, 11, -22, 17, -4, -22,
+	-7, -3, 11, 10, -10, -11, 17, 43, -3, -25,
+	-13, 42, 29, -3, -22, 50, 12, 13, 22, -3,
+	57, 20, -3, 57, 50, -1, 49, 52, -2, -22,
+	48, -9, 54, 51, 24, 52, 52, -25, -13, -26,
+	36, -25, 37, 30, 57, 52, -14, -15, 56, -21,
+	16, 33, 34, 35, 18, -14, -14, -7, 57, -21,
+	56, -9, 57, 52, -14, 46, 47, -1, -1, 28,
+	20, 21, 24, 25, 26, 27, -22, 50, 49, -8,
+	-21, -12, -10, 53, -5, 17, 53, -5, -26, -25,
+	-27, 14, 37, -26, -22, -14, -14, 22, -16, 56,
+	17, 30, -17, 31, -17, 22, 22, 22, -14, 22,
+	-1, -1, 53, -21, -21, 56, -21, 56, 56, 56,
+	56, 56, -22, 50, 55, 22, -3, 53, 20, 53,
+	-27, -26, 57, 56, -22, -27, -17, 22, -14, -22,
+	17, -19, 14, 15, 32, -19, -4, -4, -4, 22,
+	-14, -22, -8, -25, 56, -21, 57, -27, 40, 41,
+	38, 39, 57, -14, -17, -16, -20, 29, 56, 56,
+	-21, -20, -14, -17, 57, 22, 22, 57, 56, -21,
+	53, -19, 17, 15, 53, -3, -5, -5, -17, -20,
+	56, -17, 57, -19, -18, 44, -3, -20, 17, 56,
+	57, -18, 45, 45, 56, 56, 17, 17,
 }
 var SQDef = []int{
 
-	0, -2, 0, 0, 0, 0, 0, 0, 20, 21,
-	23, 0, 9, 51, 0, 0, 0, 0, 0, 0,
-	57, 0, 0, 2, 0, 22, 0, 0, 0, 0,
-	0, 5, 0, 0, 7, 42, 0, 0, 56, 0,
-	0, 0, 0, 0, 0, 0, 1, 3, 0, 0,
-	28, 31, 32, 33, 50, 36, 36, 10, 4, 14,
-	15, 16, 6, 0, 0, 54, 0, 0, 0, 0,
-	47, 0, 0, 0, 12, 0, 58, 59, 0, 0,
-	0, 0, 29, 0, 30, 40, 0, 0, 40, 0,
-	0, 0, 52, 53, 55, 43, 44, 45, 46, 48,
-	0, 11, 0, 0, 60, 0, 0, 36, 34, 26,
-	0, 37, 38, 27, 17, 18, 19, 49, 13, 8,
-	61, 62, 0, 40, 35, 41, 0, 0, 0, 36,
-	25, 39, 63, 64, 40, 24,
+	0, -2, 1, 0, 0, 0, 0, 0, 2, 38,
+	0, 26, 27, 29, 30, 0, 15, 82, 0, 0,
+	0, 0, 0, 0, 0, 88, 0, 0, 38, 40,
+	38, 0, 0, 0, 28, 0, 0, 0, 0, 0,
+	9, 0, 0, 11, 0, 68, 0, 0, 87, 0,
+	0, 0, 0, 0, 0, 0, 0, 40, 38, 44,
+	0, 40, 0, 0, 7, 0, 0, 51, 54, 55,
+	56, 57, 58, 0, 81, 49, 49, 16, 8, 20,
+	21, 22, 10, 0, 0, 0, 0, 85, 0, 0,
+	0, 0, 0, 0, 0, 0, 78, 0, 0, 0,
+	18, 0, 89, 90, 0, 0, 92, 0, 44, 40,
+	0, 0, 0, 44, 39, 49, 0, 0, 52, 0,
+	53, 0, 62, 0, 62, 0, 0, 0, 0, 0,
+	83, 84, 86, 69, 70, 71, 72, 73, 74, 75,
+	76, 77, 79, 0, 17, 0, 38, 91, 0, 93,
+	0, 44, 4, 45, 41, 0, 48, 0, 49, 60,
+	59, 66, 0, 0, 0, 66, 23, 24, 25, 0,
+	49, 80, 19, 0, 94, 95, 3, 0, 0, 0,
+	42, 43, 6, 0, 62, 61, 33, 0, 63, 64,
+	50, 34, 0, 0, 14, 0, 0, 5, 46, 47,
+	49, 66, 67, 0, 49, 0, 96, 97, 62, 35,
+	65, 0, 13, 66, 32, 0, 0, 35, 0, 0,
+	12, 31, 0, 0, 0, 0, 36, 37,
 }
 var SQTok1 = []int{
 
@@ -437,7 +605,9 @@ var SQTok2 = []int{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
 	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
-	32, 33, 34, 35, 36, 37, 38, 39,
+	32, 33, 34, 35, 36, 37, 38, 39, 40, 41,
+	42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+	52, 53, 54, 55, 56, 57, 58, 59,
 }
 var SQTok3 = []int{
 	0,
@@ -668,237 +838,381 @@ SQdefault:
 	// dummy call; replaced with literal code
 	switch SQnt {
 
-	case 1:
-		//line query.y:63
+	case 2:
+		//line query.y:77
 		{
-			SQlex.(*SQLex).query.Contents = SQS[SQpt-2].list
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
+			SQlex.(*SQLex).query.explain = true
+		}
+	case 3:
+		//line query.y:83
+		{
+			SQlex.(*SQLex).query.Contents = SQS[SQpt-5].list
+			SQlex.(*SQLex).query.where = SQS[SQpt-4].pred
 			SQlex.(*SQLex).query.qtype = SELECT_TYPE
 		}
-	case 2:
-		//line query.y:69
+	case 4:
+		//line query.y:89
 		{
-			SQlex.(*SQLex).query.Contents = SQS[SQpt-1].list
+			SQlex.(*SQLex).query.Contents = SQS[SQpt-4].list
 			SQlex.(*SQLex).query.qtype = SELECT_TYPE
 		}
-	case 3:
-		//line query.y:74
+	case 5:
+		//line query.y:94
+		{
+			SQlex.(*SQLex).query.Contents = SQS[SQpt-6].list
+			SQlex.(*SQLex).query.where = SQS[SQpt-5].pred
+			SQlex.(*SQLex).query.asof = SQS[SQpt-4].time
+			SQlex.(*SQLex).query.qtype = SELECT_TYPE
+		}
+	case 6:
+		//line query.y:101
 		{
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
+			SQlex.(*SQLex).query.Contents = SQS[SQpt-5].list
+			SQlex.(*SQLex).query.asof = SQS[SQpt-4].time
+			SQlex.(*SQLex).query.qtype = SELECT_TYPE
+		}
+	case 7:
+		//line query.y:107
+		{
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
 			SQlex.(*SQLex).query.data = SQS[SQpt-2].data
 			SQlex.(*SQLex).query.qtype = DATA_TYPE
 		}
-	case 4:
-		//line query.y:80
+	case 8:
+		//line query.y:113
 		{
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
 			SQlex.(*SQLex).query.set = SQS[SQpt-2].dict
 			SQlex.(*SQLex).query.qtype = SET_TYPE
 		}
-	case 5:
-		//line query.y:86
+	case 9:
+		//line query.y:119
 		{
 			SQlex.(*SQLex).query.set = SQS[SQpt-1].dict
 			SQlex.(*SQLex).query.qtype = SET_TYPE
 		}
-	case 6:
-		//line query.y:91
+	case 10:
+		//line query.y:124
 		{
 			SQlex.(*SQLex).query.Contents = SQS[SQpt-2].list
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
 			SQlex.(*SQLex).query.qtype = DELETE_TYPE
 		}
-	case 7:
-		//line query.y:97
+	case 11:
+		//line query.y:130
 		{
 			SQlex.(*SQLex).query.Contents = []string{}
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
 			SQlex.(*SQLex).query.qtype = DELETE_TYPE
 		}
-	case 8:
-		//line query.y:103
+	case 12:
+		//line query.y:136
 		{
-			SQlex.(*SQLex).query.where = SQS[SQpt-1].dict
-			SQlex.(*SQLex).query.data = SQS[SQpt-2].data
-			SQlex.(*SQLex).query.operators = SQS[SQpt-4].oplist
+			SQlex.(*SQLex).query.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-6].tref(SQS[SQpt-2].loc), end: SQS[SQpt-4].tref(SQS[SQpt-2].loc)}
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
+			SQlex.(*SQLex).query.qtype = DELETE_TYPE
+		}
+	case 13:
+		//line query.y:142
+		{
+			SQlex.(*SQLex).query.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-5].tref(SQS[SQpt-2].loc), end: SQS[SQpt-3].tref(SQS[SQpt-2].loc)}
+			SQlex.(*SQLex).query.where = SQS[SQpt-1].pred
+			SQlex.(*SQLex).query.qtype = DELETE_TYPE
+		}
+	case 14:
+		//line query.y:148
+		{
+			SQlex.(*SQLex).query.where = SQS[SQpt-2].pred
+			SQlex.(*SQLex).query.data = SQS[SQpt-3].data
+			SQlex.(*SQLex).query.operators = SQS[SQpt-5].oplist
 			SQlex.(*SQLex).query.qtype = APPLY_TYPE
 		}
-	case 9:
-		//line query.y:112
+	case 15:
+		//line query.y:157
 		{
 			SQVAL.list = List{SQS[SQpt-0].str}
 		}
-	case 10:
-		//line query.y:116
+	case 16:
+		//line query.y:161
 		{
 			SQVAL.list = append(List{SQS[SQpt-2].str}, SQS[SQpt-0].list...)
 		}
-	case 11:
-		//line query.y:122
+	case 17:
+		//line query.y:167
 		{
 			SQVAL.list = SQS[SQpt-1].list
 		}
-	case 12:
-		//line query.y:127
+	case 18:
+		//line query.y:172
 		{
 			SQVAL.list = List{SQS[SQpt-0].str}
 		}
-	case 13:
-		//line query.y:131
+	case 19:
+		//line query.y:176
 		{
 			SQVAL.list = append(List{SQS[SQpt-2].str}, SQS[SQpt-0].list...)
 		}
-	case 14:
-		//line query.y:137
+	case 20:
+		//line query.y:182
 		{
 			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
 		}
-	case 15:
-		//line query.y:141
+	case 21:
+		//line query.y:186
 		{
-			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
+			SQVAL.dict = Dict{SQS[SQpt-2].str: parseNumber(SQS[SQpt-0].str)}
 		}
-	case 16:
-		//line query.y:145
+	case 22:
+		//line query.y:190
 		{
 			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].list}
 		}
-	case 17:
-		//line query.y:149
+	case 23:
+		//line query.y:194
 		{
 			SQS[SQpt-0].dict[SQS[SQpt-4].str] = SQS[SQpt-2].str
 			SQVAL.dict = SQS[SQpt-0].dict
 		}
-	case 18:
-		//line query.y:154
+	case 24:
+		//line query.y:199
 		{
-			SQS[SQpt-0].dict[SQS[SQpt-4].str] = SQS[SQpt-2].str
+			SQS[SQpt-0].dict[SQS[SQpt-4].str] = parseNumber(SQS[SQpt-2].str)
 			SQVAL.dict = SQS[SQpt-0].dict
 		}
-	case 19:
-		//line query.y:159
+	case 25:
+		//line query.y:204
 		{
 			SQS[SQpt-0].dict[SQS[SQpt-4].str] = SQS[SQpt-2].list
 			SQVAL.dict = SQS[SQpt-0].dict
 		}
-	case 20:
-		//line query.y:166
+	case 26:
+		//line query.y:211
 		{
 			SQlex.(*SQLex).query.Contents = SQS[SQpt-0].list
 			SQVAL.list = SQS[SQpt-0].list
 		}
-	case 21:
-		//line query.y:171
+	case 27:
+		//line query.y:216
 		{
 			SQVAL.list = List{}
 		}
-	case 22:
-		//line query.y:175
+	case 28:
+		//line query.y:220
 		{
 			SQlex.(*SQLex).query.distinct = true
 			SQVAL.list = List{SQS[SQpt-0].str}
 		}
-	case 23:
-		//line query.y:180
+	case 29:
+		//line query.y:225
 		{
 			SQlex.(*SQLex).query.distinct = true
 			SQVAL.list = List{}
 		}
-	case 24:
-		//line query.y:187
+	case 30:
+		//line query.y:230
 		{
-			SQVAL.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-5].time, end: SQS[SQpt-3].time, limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
+			SQlex.(*SQLex).query.count = true
+			SQVAL.list = List{}
 		}
-	case 25:
-		//line query.y:191
+	case 31:
+		//line query.y:237
 		{
-			SQVAL.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-4].time, end: SQS[SQpt-2].time, limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
+			SQVAL.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-7].tref(SQS[SQpt-3].loc), end: SQS[SQpt-5].tref(SQS[SQpt-3].loc), limit: SQS[SQpt-2].limit, timeconv: SQS[SQpt-1].timeconv, fill: SQS[SQpt-0].fill}
 		}
-	case 26:
-		//line query.y:195
+	case 32:
+		//line query.y:241
 		{
-			SQVAL.data = &dataquery{dtype: BEFORE_TYPE, start: SQS[SQpt-2].time, limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
+			SQVAL.data = &dataquery{dtype: IN_TYPE, start: SQS[SQpt-6].tref(SQS[SQpt-3].loc), end: SQS[SQpt-4].tref(SQS[SQpt-3].loc), limit: SQS[SQpt-2].limit, timeconv: SQS[SQpt-1].timeconv, fill: SQS[SQpt-0].fill}
 		}
-	case 27:
-		//line query.y:199
+	case 33:
+		//line query.y:245
 		{
-			SQVAL.data = &dataquery{dtype: AFTER_TYPE, start: SQS[SQpt-2].time, limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
+			SQVAL.data = &dataquery{dtype: BEFORE_TYPE, start: SQS[SQpt-3].tref(SQS[SQpt-2].loc), limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
 		}
-	case 28:
-		//line query.y:205
+	case 34:
+		//line query.y:249
 		{
-			SQVAL.time = SQS[SQpt-0].time
+			SQVAL.data = &dataquery{dtype: AFTER_TYPE, start: SQS[SQpt-3].tref(SQS[SQpt-2].loc), limit: SQS[SQpt-1].limit, timeconv: SQS[SQpt-0].timeconv}
 		}
-	case 29:
-		//line query.y:209
+	case 35:
+		//line query.y:255
 		{
-			SQVAL.time = SQS[SQpt-1].time.Add(SQS[SQpt-0].timediff)
+			SQVAL.fill = nil
 		}
-	case 30:
-		//line query.y:215
+	case 36:
+		//line query.y:259
+		{
+			if SQS[SQpt-3].str != FILL_PREVIOUS && SQS[SQpt-3].str != FILL_LINEAR && SQS[SQpt-3].str != FILL_NULL {
+				SQlex.(*SQLex).Error(fmt.Sprintf("Invalid fill \"%v\". Must be previous, linear, null or a number", SQS[SQpt-3].str))
+			}
+			SQVAL.fill = &dataFill{method: SQS[SQpt-3].str, every: SQlex.(*SQLex).fillInterval(SQS[SQpt-1].str, SQS[SQpt-0].str)}
+		}
+	case 37:
+		//line query.y:266
+		{
+			value, err := strconv.ParseFloat(SQS[SQpt-3].str, 64)
+			if err != nil {
+				SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", SQS[SQpt-3].str, err.Error()))
+			}
+			SQVAL.fill = &dataFill{method: FILL_CONSTANT, value: value, every: SQlex.(*SQLex).fillInterval(SQS[SQpt-1].str, SQS[SQpt-0].str)}
+		}
+	case 39:
+		//line query.y:277
+		{
+			SQlex.(*SQLex).query.groupBy = SQS[SQpt-0].str
+		}
+	case 41:
+		//line query.y:284
+		{
+			SQlex.(*SQLex).query.page.OrderBy = SQS[SQpt-0].str
+		}
+	case 42:
+		//line query.y:288
+		{
+			SQlex.(*SQLex).query.page.OrderBy = SQS[SQpt-1].str
+		}
+	case 43:
+		//line query.y:292
+		{
+			SQlex.(*SQLex).query.page.OrderBy = SQS[SQpt-1].str
+			SQlex.(*SQLex).query.page.Descending = true
+		}
+	case 45:
+		//line query.y:300
+		{
+			SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber(SQS[SQpt-0].str, 1)
+		}
+	case 46:
+		//line query.y:304
+		{
+			SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber(SQS[SQpt-2].str, 1)
+			SQlex.(*SQLex).query.page.Offset = SQlex.(*SQLex).pageNumber(SQS[SQpt-0].str, 0)
+		}
+	case 47:
+		//line query.y:309
+		{
+			SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber(SQS[SQpt-2].str, 1)
+			SQlex.(*SQLex).query.cursor = SQS[SQpt-0].str
+		}
+	case 48:
+		//line query.y:316
+		{
+			SQVAL.time = SQS[SQpt-1].tref(SQS[SQpt-0].loc)
+		}
+	case 49:
+		//line query.y:322
+		{
+			SQVAL.loc = _time.UTC
+		}
+	case 50:
+		//line query.y:326
+		{
+			loc, err := _time.LoadLocation(SQS[SQpt-0].str)
+			if err != nil {
+				SQlex.(*SQLex).Error(fmt.Sprintf("Unknown time zone \"%v\" (%v)", SQS[SQpt-0].str, err.Error()))
+				loc = _time.UTC
+			}
+			SQVAL.loc = loc
+		}
+	case 51:
+		//line query.y:337
+		{
+			SQVAL.tref = SQS[SQpt-0].tref
+		}
+	case 52:
+		//line query.y:341
+		{
+			abs, offset := SQS[SQpt-1].tref, SQS[SQpt-0].offset
+			SQVAL.tref = func(loc *_time.Location) _time.Time {
+				return offset.addTo(abs(loc).In(loc))
+			}
+		}
+	case 53:
+		//line query.y:350
 		{
 			foundtime, err := parseAbsTime(SQS[SQpt-1].str, SQS[SQpt-0].str)
 			if err != nil {
 				SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse time \"%v %v\" (%v)", SQS[SQpt-1].str, SQS[SQpt-0].str, err.Error()))
 			}
-			SQVAL.time = foundtime
+			SQVAL.tref = fixedTime(foundtime)
 		}
-	case 31:
-		//line query.y:223
+	case 54:
+		//line query.y:358
 		{
 			num, err := strconv.ParseInt(SQS[SQpt-0].str, 10, 64)
 			if err != nil {
 				SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", SQS[SQpt-0].str, err.Error()))
 			}
-			SQVAL.time = _time.Unix(num, 0)
+			SQVAL.tref = fixedTime(_time.Unix(num, 0))
 		}
-	case 32:
-		//line query.y:231
+	case 55:
+		//line query.y:366
 		{
-			found := false
-			for _, format := range supported_formats {
-				t, err := _time.Parse(format, SQS[SQpt-0].str)
-				if err != nil {
-					continue
-				}
-				SQVAL.time = t
-				found = true
-				break
-			}
+			format, found := findTimeFormat(SQS[SQpt-0].str)
 			if !found {
 				SQlex.(*SQLex).Error(fmt.Sprintf("No time format matching \"%v\" found", SQS[SQpt-0].str))
 			}
+			value := SQS[SQpt-0].str
+			SQVAL.tref = func(loc *_time.Location) _time.Time {
+				t, _ := _time.ParseInLocation(format, value, loc)
+				return t
+			}
 		}
-	case 33:
-		//line query.y:247
+	case 56:
+		//line query.y:378
 		{
-			SQVAL.time = _time.Now()
+			SQVAL.tref = fixedTime(_time.Now())
 		}
-	case 34:
-		//line query.y:253
+	case 57:
+		//line query.y:382
+		{
+			SQVAL.tref = func(loc *_time.Location) _time.Time {
+				return startOf(_time.Now().In(loc), "day")
+			}
+		}
+	case 58:
+		//line query.y:388
+		{
+			SQVAL.tref = func(loc *_time.Location) _time.Time {
+				return startOf(_time.Now().In(loc), "day").AddDate(0, 0, -1)
+			}
+		}
+	case 59:
+		//line query.y:394
+		{
+			unit := SQS[SQpt-0].str
+			if !isCalendarUnit(unit) {
+				SQlex.(*SQLex).Error(fmt.Sprintf("Invalid calendar unit \"%v\". Must be day, week, month or year", unit))
+			}
+			SQVAL.tref = func(loc *_time.Location) _time.Time {
+				return startOf(_time.Now().In(loc), unit)
+			}
+		}
+	case 60:
+		//line query.y:406
 		{
 			var err error
-			SQVAL.timediff, err = parseReltime(SQS[SQpt-1].str, SQS[SQpt-0].str)
+			SQVAL.offset, err = parseTimeOffset(SQS[SQpt-1].str, SQS[SQpt-0].str)
 			if err != nil {
 				SQlex.(*SQLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", SQS[SQpt-1].str, SQS[SQpt-0].str, err.Error()))
 			}
 		}
-	case 35:
-		//line query.y:261
+	case 61:
+		//line query.y:414
 		{
-			newDuration, err := parseReltime(SQS[SQpt-2].str, SQS[SQpt-1].str)
+			newOffset, err := parseTimeOffset(SQS[SQpt-2].str, SQS[SQpt-1].str)
 			if err != nil {
 				SQlex.(*SQLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", SQS[SQpt-2].str, SQS[SQpt-1].str, err.Error()))
 			}
-			SQVAL.timediff = addDurations(newDuration, SQS[SQpt-0].timediff)
+			SQVAL.offset = addTimeOffsets(newOffset, SQS[SQpt-0].offset)
 		}
-	case 36:
-		//line query.y:271
+	case 62:
+		//line query.y:424
 		{
 			SQVAL.limit = datalimit{limit: -1, streamlimit: -1}
 		}
-	case 37:
-		//line query.y:275
+	case 63:
+		//line query.y:428
 		{
 			num, err := strconv.ParseInt(SQS[SQpt-0].str, 10, 64)
 			if err != nil {
@@ -906,8 +1220,8 @@ SQdefault:
 			}
 			SQVAL.limit = datalimit{limit: num, streamlimit: -1}
 		}
-	case 38:
-		//line query.y:283
+	case 64:
+		//line query.y:436
 		{
 			num, err := strconv.ParseInt(SQS[SQpt-0].str, 10, 64)
 			if err != nil {
@@ -915,8 +1229,8 @@ SQdefault:
 			}
 			SQVAL.limit = datalimit{limit: -1, streamlimit: num}
 		}
-	case 39:
-		//line query.y:291
+	case 65:
+		//line query.y:444
 		{
 			limit_num, err := strconv.ParseInt(SQS[SQpt-2].str, 10, 64)
 			if err != nil {
@@ -928,13 +1242,13 @@ SQdefault:
 			}
 			SQVAL.limit = datalimit{limit: limit_num, streamlimit: slimit_num}
 		}
-	case 40:
-		//line query.y:305
+	case 66:
+		//line query.y:458
 		{
 			SQVAL.timeconv = UOT_MS
 		}
-	case 41:
-		//line query.y:309
+	case 67:
+		//line query.y:462
 		{
 			uot, err := parseUOT(SQS[SQpt-0].str)
 			if err != nil {
@@ -942,126 +1256,157 @@ SQdefault:
 			}
 			SQVAL.timeconv = uot
 		}
-	case 42:
-		//line query.y:321
+	case 68:
+		//line query.y:474
 		{
-			SQVAL.dict = SQS[SQpt-0].dict
+			SQVAL.pred = SQS[SQpt-0].pred
 		}
-	case 43:
-		//line query.y:328
+	case 69:
+		//line query.y:481
 		{
-			SQVAL.dict = Dict{SQS[SQpt-2].str: Dict{"$regex": SQS[SQpt-0].str}}
+			SQVAL.pred = Like{Key: SQS[SQpt-2].str, Pattern: SQS[SQpt-0].str}
 		}
-	case 44:
-		//line query.y:332
+	case 70:
+		//line query.y:485
 		{
-			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
+			SQVAL.pred = Eq{Key: SQS[SQpt-2].str, Value: SQS[SQpt-0].str}
 		}
-	case 45:
-		//line query.y:336
+	case 71:
+		//line query.y:489
 		{
-			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
+			SQVAL.pred = Eq{Key: SQS[SQpt-2].str, Value: parseNumber(SQS[SQpt-0].str)}
 		}
-	case 46:
-		//line query.y:340
+	case 72:
+		//line query.y:493
 		{
-			SQVAL.dict = Dict{SQS[SQpt-2].str: Dict{"$neq": SQS[SQpt-0].str}}
+			SQVAL.pred = Not{Eq{Key: SQS[SQpt-2].str, Value: SQS[SQpt-0].str}}
 		}
-	case 47:
-		//line query.y:344
+	case 73:
+		//line query.y:497
 		{
-			SQVAL.dict = Dict{SQS[SQpt-0].str: Dict{"$exists": true}}
+			SQVAL.pred = Not{Eq{Key: SQS[SQpt-2].str, Value: parseNumber(SQS[SQpt-0].str)}}
 		}
-	case 48:
-		//line query.y:348
+	case 74:
+		//line query.y:501
 		{
-			SQVAL.dict = Dict{SQS[SQpt-0].str: Dict{"$in": SQS[SQpt-2].list}}
+			SQVAL.pred = newCompare(SQS[SQpt-2].str, "<", SQS[SQpt-0].str)
 		}
-	case 49:
-		//line query.y:352
+	case 75:
+		//line query.y:505
 		{
-			SQVAL.dict = Dict{SQS[SQpt-1].str: Dict{"$not": Dict{"$in": SQS[SQpt-3].list}}}
+			SQVAL.pred = newCompare(SQS[SQpt-2].str, "<=", SQS[SQpt-0].str)
 		}
-	case 50:
-		//line query.y:358
+	case 76:
+		//line query.y:509
+		{
+			SQVAL.pred = newCompare(SQS[SQpt-2].str, ">", SQS[SQpt-0].str)
+		}
+	case 77:
+		//line query.y:513
+		{
+			SQVAL.pred = newCompare(SQS[SQpt-2].str, ">=", SQS[SQpt-0].str)
+		}
+	case 78:
+		//line query.y:517
+		{
+			SQVAL.pred = Has{Key: SQS[SQpt-0].str}
+		}
+	case 79:
+		//line query.y:521
+		{
+			SQVAL.pred = In{Key: SQS[SQpt-0].str, Values: SQS[SQpt-2].list}
+		}
+	case 80:
+		//line query.y:525
+		{
+			SQVAL.pred = Not{In{Key: SQS[SQpt-0].str, Values: SQS[SQpt-3].list}}
+		}
+	case 81:
+		//line query.y:531
 		{
 			SQVAL.str = SQS[SQpt-0].str[1 : len(SQS[SQpt-0].str)-1]
 		}
-	case 51:
-		//line query.y:364
+	case 82:
+		//line query.y:537
 		{
 
 			SQlex.(*SQLex)._keys[SQS[SQpt-0].str] = struct{}{}
 			SQVAL.str = cleantagstring(SQS[SQpt-0].str)
 		}
-	case 52:
-		//line query.y:372
+	case 83:
+		//line query.y:545
 		{
-			SQVAL.dict = Dict{"$and": []Dict{SQS[SQpt-2].dict, SQS[SQpt-0].dict}}
+			SQVAL.pred = And{SQS[SQpt-2].pred, SQS[SQpt-0].pred}
 		}
-	case 53:
-		//line query.y:376
+	case 84:
+		//line query.y:549
 		{
-			SQVAL.dict = Dict{"$or": []Dict{SQS[SQpt-2].dict, SQS[SQpt-0].dict}}
+			SQVAL.pred = Or{SQS[SQpt-2].pred, SQS[SQpt-0].pred}
 		}
-	case 54:
-		//line query.y:380
+	case 85:
+		//line query.y:553
 		{
-			tmp := make(Dict)
-			for k, v := range SQS[SQpt-0].dict {
-				tmp[k] = Dict{"$ne": v}
-			}
-			SQVAL.dict = tmp
+			SQVAL.pred = Not{SQS[SQpt-0].pred}
 		}
-	case 55:
-		//line query.y:388
+	case 86:
+		//line query.y:557
 		{
-			SQVAL.dict = SQS[SQpt-1].dict
+			SQVAL.pred = SQS[SQpt-1].pred
 		}
-	case 56:
-		//line query.y:392
+	case 87:
+		//line query.y:561
 		{
-			SQVAL.dict = SQS[SQpt-0].dict
+			SQVAL.pred = SQS[SQpt-0].pred
 		}
-	case 57:
-		//line query.y:398
+	case 88:
+		//line query.y:567
 		{
 			SQVAL.oplist = []*OpNode{SQS[SQpt-0].op}
 		}
-	case 58:
-		//line query.y:402
+	case 89:
+		//line query.y:571
 		{
 			SQVAL.oplist = append(SQS[SQpt-0].oplist, SQS[SQpt-2].op)
 		}
-	case 59:
-		//line query.y:408
+	case 90:
+		//line query.y:577
 		{
 			SQVAL.op = &OpNode{Operator: SQS[SQpt-2].str}
 		}
-	case 60:
-		//line query.y:412
+	case 91:
+		//line query.y:581
 		{
 			SQVAL.op = &OpNode{Operator: SQS[SQpt-3].str, Arguments: SQS[SQpt-1].dict}
 		}
-	case 61:
-		//line query.y:418
+	case 92:
+		//line query.y:585
+		{
+			SQVAL.op = &OpNode{Operator: SQS[SQpt-2].str}
+		}
+	case 93:
+		//line query.y:589
+		{
+			SQVAL.op = &OpNode{Operator: SQS[SQpt-3].str, Arguments: SQS[SQpt-1].dict}
+		}
+	case 94:
+		//line query.y:595
 		{
 			fmt.Printf("op args %v %v\n", SQS[SQpt-2].str, SQS[SQpt-0].str)
 			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
 		}
-	case 62:
-		//line query.y:423
+	case 95:
+		//line query.y:600
 		{
 			SQVAL.dict = Dict{SQS[SQpt-2].str: SQS[SQpt-0].str}
 		}
-	case 63:
-		//line query.y:427
+	case 96:
+		//line query.y:604
 		{
 			SQS[SQpt-0].dict[SQS[SQpt-4].str] = SQS[SQpt-2].str
 			SQVAL.dict = SQS[SQpt-0].dict
 		}
-	case 64:
-		//line query.y:432
+	case 97:
+		//line query.y:609
 		{
 			SQS[SQpt-0].dict[SQS[SQpt-4].str] = SQS[SQpt-2].str
 			SQVAL.dict = SQS[SQpt-0].dict
@@ -20,6 +20,7 @@ Notes here
 %union{
 	str string
 	dict Dict
+	pred Predicate
     oplist []*OpNode
     op *OpNode
 	data *dataquery
@@ -27,15 +28,23 @@ Notes here
     timeconv UnitOfTime
 	list List
 	time _time.Time
-    timediff _time.Duration
+	tref timeRef
+	offset timeOffset
+	loc *_time.Location
+	fill *dataFill
 }
 
-%token <str> SELECT DISTINCT DELETE SET APPLY
+%token <str> SELECT DISTINCT DELETE SET APPLY EXPLAIN
 %token <str> WHERE
 %token <str> DATA BEFORE AFTER LIMIT STREAMLIMIT NOW
 %token <str> LVALUE QSTRING OPERATOR
 %token <str> EQ NEQ COMMA ALL LEFTPIPE
-%token <str> LIKE AS
+%token <str> LTE GT GTE
+%token <str> LIKE AS OF
+%token <str> AT TIMEZONE TODAY YESTERDAY START
+%token <str> ORDER BY ASC DESC OFFSET CURSOR
+%token <str> GROUP STREAMCOUNT
+%token <str> FILL EVERY
 %token <str> AND OR HAS NOT IN TO
 %token <str> LPAREN RPAREN LBRACK RBRACK
 %token NUMBER
@@ -43,13 +52,17 @@ Notes here
 %token NEWLINE
 %token TIMEUNIT
 
-%type <dict> whereList whereTerm whereClause setList opArgs
+%type <pred> whereList whereTerm whereClause
+%type <dict> setList opArgs
 %type <list> selector tagList valueList valueListBrack
 %type <oplist> operatorList
 %type <op> operator
 %type <data> dataClause
-%type <time> timeref abstime
-%type <timediff> reltime
+%type <time> asOf
+%type <tref> timeref abstime
+%type <offset> reltime
+%type <loc> timezone
+%type <fill> fill
 %type <limit> limit
 %type <timeconv> timeconv
 %type <str> NUMBER qstring lvalue TIMEUNIT
@@ -59,15 +72,35 @@ Notes here
 
 %%
 
-query		: SELECT selector whereClause SEMICOLON
+statement	: query
+			| EXPLAIN query
+			{
+				SQlex.(*SQLex).query.explain = true
+			}
+			;
+
+query		: SELECT selector whereClause groupBy orderBy page SEMICOLON
+			{
+				SQlex.(*SQLex).query.Contents = $2
+				SQlex.(*SQLex).query.where = $3
+				SQlex.(*SQLex).query.qtype = SELECT_TYPE
+			}
+			| SELECT selector groupBy orderBy page SEMICOLON
+			{
+				SQlex.(*SQLex).query.Contents = $2
+				SQlex.(*SQLex).query.qtype = SELECT_TYPE
+			}
+			| SELECT selector whereClause asOf groupBy orderBy page SEMICOLON
 			{
 				SQlex.(*SQLex).query.Contents = $2
 				SQlex.(*SQLex).query.where = $3
+				SQlex.(*SQLex).query.asof = $4
 				SQlex.(*SQLex).query.qtype = SELECT_TYPE
 			}
-			| SELECT selector SEMICOLON
+			| SELECT selector asOf groupBy orderBy page SEMICOLON
 			{
 				SQlex.(*SQLex).query.Contents = $2
+				SQlex.(*SQLex).query.asof = $3
 				SQlex.(*SQLex).query.qtype = SELECT_TYPE
 			}
 			| SELECT dataClause whereClause SEMICOLON
@@ -99,7 +132,19 @@ query		: SELECT selector whereClause SEMICOLON
 				SQlex.(*SQLex).query.where = $2
 				SQlex.(*SQLex).query.qtype = DELETE_TYPE
 			}
-            | APPLY operatorList TO dataClause whereClause SEMICOLON
+			| DELETE DATA IN LPAREN timeref COMMA timeref RPAREN timezone whereClause SEMICOLON
+			{
+				SQlex.(*SQLex).query.data = &dataquery{dtype: IN_TYPE, start: $5($9), end: $7($9)}
+				SQlex.(*SQLex).query.where = $10
+				SQlex.(*SQLex).query.qtype = DELETE_TYPE
+			}
+			| DELETE DATA IN timeref COMMA timeref timezone whereClause SEMICOLON
+			{
+				SQlex.(*SQLex).query.data = &dataquery{dtype: IN_TYPE, start: $4($7), end: $6($7)}
+				SQlex.(*SQLex).query.where = $8
+				SQlex.(*SQLex).query.qtype = DELETE_TYPE
+			}
+            | APPLY operatorList TO dataClause whereClause groupBy SEMICOLON
             {
 				SQlex.(*SQLex).query.where = $5
 				SQlex.(*SQLex).query.data = $4
@@ -139,7 +184,7 @@ setList     : lvalue EQ qstring
             }
             | lvalue EQ NUMBER
             {
-                $$ = Dict{$1: $3}
+                $$ = Dict{$1: parseNumber($3)}
             }
             | lvalue EQ valueListBrack
             {
@@ -152,7 +197,7 @@ setList     : lvalue EQ qstring
             }
             | lvalue EQ NUMBER COMMA setList
             {
-                $5[$1] = $3
+                $5[$1] = parseNumber($3)
                 $$ = $5
             }
             | lvalue EQ valueListBrack COMMA setList
@@ -181,33 +226,123 @@ selector	: tagList
 				SQlex.(*SQLex).query.distinct = true
 				$$ = List{}
 			}
+			| STREAMCOUNT
+			{
+				SQlex.(*SQLex).query.count = true
+				$$ = List{}
+			}
 			;
 
-dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN limit timeconv
+dataClause : DATA IN LPAREN timeref COMMA timeref RPAREN timezone limit timeconv fill
 			{
-				$$ = &dataquery{dtype: IN_TYPE, start: $4, end: $6, limit: $8, timeconv: $9}
+				$$ = &dataquery{dtype: IN_TYPE, start: $4($8), end: $6($8), limit: $9, timeconv: $10, fill: $11}
 			}
-		   | DATA IN timeref COMMA timeref limit timeconv
+		   | DATA IN timeref COMMA timeref timezone limit timeconv fill
 			{
-				$$ = &dataquery{dtype: IN_TYPE, start: $3, end: $5, limit: $6, timeconv: $7}
+				$$ = &dataquery{dtype: IN_TYPE, start: $3($6), end: $5($6), limit: $7, timeconv: $8, fill: $9}
 			}
-		   | DATA BEFORE timeref limit timeconv
+		   | DATA BEFORE timeref timezone limit timeconv
 			{
-				$$ = &dataquery{dtype: BEFORE_TYPE, start: $3, limit: $4, timeconv: $5}
+				$$ = &dataquery{dtype: BEFORE_TYPE, start: $3($4), limit: $5, timeconv: $6}
 			}
-		   | DATA AFTER timeref limit timeconv
+		   | DATA AFTER timeref timezone limit timeconv
 			{
-				$$ = &dataquery{dtype: AFTER_TYPE, start: $3, limit: $4, timeconv: $5}
+				$$ = &dataquery{dtype: AFTER_TYPE, start: $3($4), limit: $5, timeconv: $6}
 			}
 		   ;
 
+fill		: /* empty */
+			{
+				$$ = nil
+			}
+			| FILL LVALUE EVERY NUMBER LVALUE
+			{
+				if $2 != FILL_PREVIOUS && $2 != FILL_LINEAR && $2 != FILL_NULL {
+					SQlex.(*SQLex).Error(fmt.Sprintf("Invalid fill \"%v\". Must be previous, linear, null or a number", $2))
+				}
+				$$ = &dataFill{method: $2, every: SQlex.(*SQLex).fillInterval($4, $5)}
+			}
+			| FILL NUMBER EVERY NUMBER LVALUE
+			{
+				value, err := strconv.ParseFloat($2, 64)
+				if err != nil {
+					SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse number \"%v\" (%v)", $2, err.Error()))
+				}
+				$$ = &dataFill{method: FILL_CONSTANT, value: value, every: SQlex.(*SQLex).fillInterval($4, $5)}
+			}
+			;
+
+groupBy		: /* empty */
+			| GROUP BY lvalue
+			{
+				SQlex.(*SQLex).query.groupBy = $3
+			}
+			;
+
+orderBy		: /* empty */
+			| ORDER BY lvalue
+			{
+				SQlex.(*SQLex).query.page.OrderBy = $3
+			}
+			| ORDER BY lvalue ASC
+			{
+				SQlex.(*SQLex).query.page.OrderBy = $3
+			}
+			| ORDER BY lvalue DESC
+			{
+				SQlex.(*SQLex).query.page.OrderBy = $3
+				SQlex.(*SQLex).query.page.Descending = true
+			}
+			;
+
+page		: /* empty */
+			| LIMIT NUMBER
+			{
+				SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber($2, 1)
+			}
+			| LIMIT NUMBER OFFSET NUMBER
+			{
+				SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber($2, 1)
+				SQlex.(*SQLex).query.page.Offset = SQlex.(*SQLex).pageNumber($4, 0)
+			}
+			| LIMIT NUMBER CURSOR qstring
+			{
+				SQlex.(*SQLex).query.page.Limit = SQlex.(*SQLex).pageNumber($2, 1)
+				SQlex.(*SQLex).query.cursor = $4
+			}
+			;
+
+asOf		: AS OF timeref timezone
+			{
+				$$ = $3($4)
+			}
+			;
+
+timezone	: /* empty */
+			{
+				$$ = _time.UTC
+			}
+			| AT TIMEZONE qstring
+			{
+				loc, err := _time.LoadLocation($3)
+				if err != nil {
+					SQlex.(*SQLex).Error(fmt.Sprintf("Unknown time zone \"%v\" (%v)", $3, err.Error()))
+					loc = _time.UTC
+				}
+				$$ = loc
+			}
+			;
+
 timeref		: abstime
 			{
 				$$ = $1
 			}
 			| abstime reltime
 			{
-                $$ = $1.Add($2)
+				abs, offset := $1, $2
+				$$ = func(loc *_time.Location) _time.Time {
+					return offset.addTo(abs(loc).In(loc))
+				}
 			}
 			;
 
@@ -217,7 +352,7 @@ abstime		: NUMBER LVALUE
                 if err != nil {
 				    SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
-                $$ = foundtime
+                $$ = fixedTime(foundtime)
             }
             | NUMBER
             {
@@ -225,45 +360,63 @@ abstime		: NUMBER LVALUE
                 if err != nil {
 				    SQlex.(*SQLex).Error(fmt.Sprintf("Could not parse integer \"%v\" (%v)", $1, err.Error()))
                 }
-                $$ = _time.Unix(num, 0)
+                $$ = fixedTime(_time.Unix(num, 0))
             }
 			| qstring
             {
-                found := false
-                for _, format := range supported_formats {
-                    t, err := _time.Parse(format, $1)
-                    if err != nil {
-                        continue
-                    }
-                    $$ = t
-                    found = true
-                    break
-                }
+                format, found := findTimeFormat($1)
                 if !found {
 				    SQlex.(*SQLex).Error(fmt.Sprintf("No time format matching \"%v\" found", $1))
                 }
+                value := $1
+                $$ = func(loc *_time.Location) _time.Time {
+                    t, _ := _time.ParseInLocation(format, value, loc)
+                    return t
+                }
             }
 			| NOW
             {
-                $$ = _time.Now()
+                $$ = fixedTime(_time.Now())
+            }
+			| TODAY
+            {
+                $$ = func(loc *_time.Location) _time.Time {
+                    return startOf(_time.Now().In(loc), "day")
+                }
+            }
+			| YESTERDAY
+            {
+                $$ = func(loc *_time.Location) _time.Time {
+                    return startOf(_time.Now().In(loc), "day").AddDate(0, 0, -1)
+                }
+            }
+			| START OF LVALUE
+            {
+                unit := $3
+                if !isCalendarUnit(unit) {
+				    SQlex.(*SQLex).Error(fmt.Sprintf("Invalid calendar unit \"%v\". Must be day, week, month or year", unit))
+                }
+                $$ = func(loc *_time.Location) _time.Time {
+                    return startOf(_time.Now().In(loc), unit)
+                }
             }
 			;
 
 reltime		: NUMBER lvalue
             {
                 var err error
-                $$, err = parseReltime($1, $2)
+                $$, err = parseTimeOffset($1, $2)
                 if err != nil {
 				    SQlex.(*SQLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
             }
 			| NUMBER lvalue reltime
             {
-                newDuration, err := parseReltime($1, $2)
+                newOffset, err := parseTimeOffset($1, $2)
                 if err != nil {
 				    SQlex.(*SQLex).Error(fmt.Sprintf("Error parsing relative time \"%v %v\" (%v)", $1, $2, err.Error()))
                 }
-                $$ = addDurations(newDuration, $3)
+                $$ = addTimeOffsets(newOffset, $3)
             }
 			;
 
@@ -326,31 +479,51 @@ whereClause : WHERE whereList
 
 whereTerm : lvalue LIKE qstring
 			{
-				$$ = Dict{$1: Dict{"$regex": $3}}
+				$$ = Like{Key: $1, Pattern: $3}
 			}
 		  | lvalue EQ qstring
 			{
-				$$ = Dict{$1: $3}
+				$$ = Eq{Key: $1, Value: $3}
 			}
           | lvalue EQ NUMBER
             {
-				$$ = Dict{$1: $3}
+				$$ = Eq{Key: $1, Value: parseNumber($3)}
             }
 		  | lvalue NEQ qstring
 			{
-				$$ = Dict{$1: Dict{"$neq": $3}}
+				$$ = Not{Eq{Key: $1, Value: $3}}
 			}
+          | lvalue NEQ NUMBER
+            {
+				$$ = Not{Eq{Key: $1, Value: parseNumber($3)}}
+            }
+          | lvalue LEFTPIPE NUMBER /* < is also the pipe of apply queries */
+            {
+				$$ = newCompare($1, "<", $3)
+            }
+          | lvalue LTE NUMBER
+            {
+				$$ = newCompare($1, "<=", $3)
+            }
+          | lvalue GT NUMBER
+            {
+				$$ = newCompare($1, ">", $3)
+            }
+          | lvalue GTE NUMBER
+            {
+				$$ = newCompare($1, ">=", $3)
+            }
 		  | HAS lvalue
 			{
-				$$ = Dict{$2: Dict{"$exists": true}}
+				$$ = Has{Key: $2}
 			}
           | valueListBrack IN lvalue
             {
-                $$ = Dict{$3: Dict{"$in": $1}}
+                $$ = In{Key: $3, Values: $1}
             }
           | valueListBrack NOT IN lvalue
             {
-                $$ = Dict{$3: Dict{"$not": Dict{"$in": $1}}}
+                $$ = Not{In{Key: $4, Values: $1}}
             }
 		  ;
 
@@ -370,19 +543,15 @@ lvalue    : LVALUE
 
 whereList : whereList AND whereList
 			{
-				$$ = Dict{"$and": []Dict{$1, $3}}
+				$$ = And{$1, $3}
 			}
 		  | whereList OR whereList
 			{
-				$$ = Dict{"$or": []Dict{$1, $3}}
+				$$ = Or{$1, $3}
 			}
 		  | NOT whereList
 			{
-                tmp := make(Dict)
-                for k,v := range $2 {
-                    tmp[k] = Dict{"$ne": v}
-                }
-				$$ = tmp
+				$$ = Not{$2}
 			}
 		  | LPAREN whereList RPAREN
 			{
@@ -412,6 +581,14 @@ operator    : LVALUE LPAREN RPAREN
             {
                 $$ = &OpNode{Operator: $1, Arguments: $3}
             }
+            | STREAMCOUNT LPAREN RPAREN
+            {
+                $$ = &OpNode{Operator: $1}
+            }
+            | STREAMCOUNT LPAREN opArgs RPAREN
+            {
+                $$ = &OpNode{Operator: $1, Arguments: $3}
+            }
             ;
 
 opArgs  : LVALUE EQ NUMBER
@@ -443,7 +620,11 @@ var supported_formats = []string{"1/2/2006",
                                  "1-2-2006 03:04:05 PM MST",
                                  "1/2/2006 15:04:05 MST",
                                  "1-2-2006 15:04:05 MST",
-                                 "2006-1-2 15:04:05 MST"}
+                                 "2006-1-2 15:04:05 MST",
+                                 "2006-1-2 15:04:05",
+                                 "2006-1-2",
+                                 _time.RFC3339,
+                                 "2006-01-02T15:04:05"}
 type Dict map[string]interface{}
 type List []string
 type OpNode struct {
@@ -469,6 +650,8 @@ func (qt queryType) String() string {
 		ret = "set"
 	case DATA_TYPE:
 		ret = "data"
+	case APPLY_TYPE:
+		ret = "apply"
 	}
 	return ret
 }
@@ -481,18 +664,30 @@ type query struct {
     // key-value pairs to add
     set         Dict
 	// where clause for query
-	where	  Dict
+	where	  Predicate
 	// are we querying distinct values?
 	distinct  bool
 	// list of tags to target for deletion, selection
 	Contents  []string
+	// select the metadata as it was at this time, if set
+	asof      _time.Time
+	// order and limit of the documents returned by a select
+	page      Page
+	// continues the select from where an earlier page ended
+	cursor    string
+	// are we counting the streams instead of selecting their tags?
+	count     bool
+	// dotted key of the tag whose values group the results
+	groupBy   string
+	// describe how the query would run instead of running it
+	explain   bool
     // formed operator tree
     operators []*OpNode
 }
 
 func (q *query) Print() {
 	fmt.Printf("Type: %v\n", q.qtype.String())
-	if q.qtype == DATA_TYPE {
+	if q.data != nil {
 		fmt.Printf("Data Query Type: %v\n", q.data.dtype.String())
 		fmt.Printf("Start: %v\n", q.data.start)
 		fmt.Printf("End: %v\n", q.data.end)
@@ -502,6 +697,21 @@ func (q *query) Print() {
 	fmt.Printf("Contents: %v\n", q.Contents)
 	fmt.Printf("Distinct? %v\n", q.distinct)
 	fmt.Printf("where: %v\n", q.where)
+	if !q.asof.IsZero() {
+		fmt.Printf("As of: %v\n", q.asof)
+	}
+	if q.page.OrderBy != "" {
+		fmt.Printf("Order by: %v (descending? %v)\n", q.page.OrderBy, q.page.Descending)
+	}
+	if q.page.Limit > 0 {
+		fmt.Printf("Limit: %v offset %v cursor %v\n", q.page.Limit, q.page.Offset, q.cursor)
+	}
+	if q.count {
+		fmt.Printf("Count? %v\n", q.count)
+	}
+	if q.groupBy != "" {
+		fmt.Printf("Group by: %v\n", q.groupBy)
+	}
 }
 
 func (q *query) ContentsBson() bson.M {
@@ -512,10 +722,6 @@ func (q *query) ContentsBson() bson.M {
     return ret
 }
 
-func (q *query) WhereBson() bson.M {
-    return bson.M(q.where)
-}
-
 func (q *query) SetBson() bson.M {
     return bson.M(q.set)
 }
@@ -546,6 +752,8 @@ type dataquery struct {
 	end			_time.Time
 	limit		datalimit
     timeconv  UnitOfTime
+	// nil unless the readings are filled in
+	fill		*dataFill
 }
 
 type datalimit struct {
@@ -566,12 +774,25 @@ type SQLex struct {
     keys    []string
 }
 
+// Words that are lexed as LVALUE and then turned into their token, so that
+// tags starting with them (like atrium or start_time) are still tags. "to" is
+// here so that it does not take the start of "today"
+var reservedWords = map[string]int{
+	"to":        TO,
+	"at":        AT,
+	"timezone":  TIMEZONE,
+	"today":     TODAY,
+	"yesterday": YESTERDAY,
+	"start":     START,
+}
+
 func NewSQLex(s string) *SQLex {
 	scanner := toki.NewScanner(
 		[]toki.Def{
 			{Token: WHERE, Pattern: "where"},
 			{Token: SELECT, Pattern: "select"},
             {Token: APPLY, Pattern: "apply"},
+			{Token: EXPLAIN, Pattern: "explain"},
 			{Token: DELETE, Pattern: "delete"},
 			{Token: DISTINCT, Pattern: "distinct"},
 			{Token: LIMIT, Pattern: "limit"},
@@ -583,16 +804,29 @@ func NewSQLex(s string) *SQLex {
 			{Token: AFTER, Pattern: "after"},
 			{Token: COMMA, Pattern: ","},
 			{Token: AND, Pattern: "and"},
+			{Token: ASC, Pattern: "asc"},
 			{Token: AS, Pattern: "as"},
-			{Token: TO, Pattern: "to"},
+			{Token: OFFSET, Pattern: "offset"},
+			{Token: OF, Pattern: "of"},
+			{Token: BY, Pattern: "by"},
+			{Token: DESC, Pattern: "desc"},
+			{Token: CURSOR, Pattern: "cursor"},
+			{Token: STREAMCOUNT, Pattern: "count"},
+			{Token: GROUP, Pattern: "group"},
+			{Token: FILL, Pattern: "fill"},
+			{Token: EVERY, Pattern: "every"},
 			{Token: DATA, Pattern: "data"},
+			{Token: ORDER, Pattern: "order"},
 			{Token: OR, Pattern: "or"},
 			{Token: IN, Pattern: "in"},
 			{Token: HAS, Pattern: "has"},
 			{Token: NOT, Pattern: "not"},
 			{Token: NEQ, Pattern: "!="},
 			{Token: EQ, Pattern: "="},
+			{Token: LTE, Pattern: "<="},
+			{Token: GTE, Pattern: ">="},
 			{Token: LEFTPIPE, Pattern: "<"},
+			{Token: GT, Pattern: ">"},
 			{Token: LPAREN, Pattern: "\\("},
 			{Token: RPAREN, Pattern: "\\)"},
 			{Token: LBRACK, Pattern: "\\["},
@@ -617,6 +851,9 @@ func (sq *SQLex) Lex(lval *SQSymType) int {
 	}
 	lval.str = string(r.Value)
     sq.tokens = append(sq.tokens, lval.str)
+	if token, found := reservedWords[lval.str]; found && int(r.Token) == LVALUE {
+		return token
+	}
 	return int(r.Token)
 }
 
@@ -624,6 +861,26 @@ func (sq *SQLex) Error(s string) {
     sq.error = fmt.Errorf(s)
 }
 
+// Parses @num, the number of a limit or offset, which must be at least @min
+func (sq *SQLex) pageNumber(num string, min int) int {
+	n, err := strconv.Atoi(num)
+	if err != nil || n < min {
+		sq.Error(fmt.Sprintf("Expected a whole number of at least %v, not \"%v\"", min, num))
+	}
+	return n
+}
+
+// Parses the interval "@num @units" of a fill, which must be positive
+func (sq *SQLex) fillInterval(num, units string) _time.Duration {
+	every, err := parseReltime(num, units)
+	if err != nil {
+		sq.Error(fmt.Sprintf("Error parsing fill interval \"%v %v\" (%v)", num, units, err.Error()))
+	} else if every <= 0 {
+		sq.Error(fmt.Sprintf("Fill interval \"%v %v\" must be positive", num, units))
+	}
+	return every
+}
+
 func readline(fi *bufio.Reader) (string, bool) {
 	fmt.Printf("smap> ")
 	s, err := fi.ReadString('\n')
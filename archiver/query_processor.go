@@ -1,21 +1,18 @@
 package archiver
 
 import (
-	"fmt"
 	"strings"
 )
 
 type QueryProcessor struct {
 	a      *Archiver
 	graphs map[string]*Node
-	done   chan struct{}
 }
 
 func NewQueryProcessor(a *Archiver) (qp *QueryProcessor) {
 	qp = &QueryProcessor{
 		a:      a,
 		graphs: make(map[string]*Node),
-		done:   make(chan struct{}),
 	}
 	return
 }
@@ -25,21 +22,21 @@ func (qp *QueryProcessor) Parse(querystring string) *SQLex {
 		querystring = querystring + ";"
 	}
 	l := NewSQLex(querystring)
-	fmt.Printf("Query: %v\n", querystring)
+	log.Debug("Query: %v", querystring)
 	SQParse(l)
-	l.query.Print()
 	l.keys = make([]string, len(l._keys))
 	i := 0
 	for key, _ := range l._keys {
 		l.keys[i] = cleantagstring(key)
 		i += 1
 	}
-	fmt.Printf("operator list %v\n", l.query.operators)
-	fmt.Printf("select keys %v\n", l.query.Contents)
+	log.Debug("operator list %v", l.query.operators)
+	log.Debug("select keys %v", l.query.Contents)
 	return l
 }
 
-func (qp *QueryProcessor) GetNodeFromOp(op *OpNode, query *query) *Node {
+// Creates the node of the operator @op, which stops when @done is closed
+func (qp *QueryProcessor) GetNodeFromOp(op *OpNode, query *query, done <-chan struct{}) *Node {
 	var (
 		operator OperationType
 		found    bool
@@ -52,10 +49,11 @@ func (qp *QueryProcessor) GetNodeFromOp(op *OpNode, query *query) *Node {
 	// Populate extra information in nodes that need it
 	switch operator {
 	case WINDOW:
-		node = NodeLookup[operator](qp.done, op.Arguments, query.data)
+		node = NodeLookup[operator](done, op.Arguments, query.data, qp.a)
 	default:
-		node = NodeLookup[operator](qp.done, op.Arguments)
+		node = NodeLookup[operator](done, op.Arguments)
 	}
+	node.Tags["operator"] = op.Operator
 
 	return node
 }
@@ -75,8 +73,10 @@ func (qp *QueryProcessor) CheckOutToIn(out, in *Node) bool {
 		return false
 	}
 
-	// check structure matches
-	if (outStructure.(StructureType) & inStructure.(StructureType)) == 0 {
+	// check structure matches. Groups of timeseries can go to a node that
+	// takes timeseries, which then runs on each group
+	lifted := outStructure.(StructureType)&GROUPED != 0 && inStructure.(StructureType)&TIMESERIES != 0
+	if (outStructure.(StructureType)&inStructure.(StructureType)) == 0 && !lifted {
 		log.Error("Out structure does not match in: %v %v\n", outStructure, inStructure)
 		return false
 	}
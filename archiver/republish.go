@@ -2,7 +2,6 @@ package archiver
 
 import (
 	"fmt"
-	"gopkg.in/mgo.v2/bson"
 	"strings"
 	"sync"
 )
@@ -18,7 +17,7 @@ type Query struct {
 	// list of desired tags
 	target []string
 	// parsed where clause
-	where bson.M
+	where Predicate
 	// a unique representation of this query used to compare two different query objects
 	hash QueryHash
 	// Track state transitions for the UUIDs that match this query
@@ -392,7 +391,7 @@ func (r *Republisher) HandleQuery(querystring string) (*Query, error) {
 	q := &Query{}
 	// make this a syntactically valid query so we can parse
 	lex := r.a.qp.Parse("select * where " + querystring)
-	q.where = lex.query.WhereBson()
+	q.where = lex.query.where
 	q.keys = lex.keys
 	q.hash = QueryHash(strings.Join(lex.tokens, ""))
 	q.m_uuids = make(map[string]UUIDSTATE)
@@ -3,7 +3,6 @@ package archiver
 import (
 	"encoding/json"
 	"fmt"
-	"gopkg.in/mgo.v2/bson"
 	"strings"
 )
 
@@ -91,7 +90,7 @@ func (r *Republisher) reevaluateSelect(q *Query) (result interface{}, err error)
 		matchedUUIDs[idx] = uuid
 		idx += 1
 	}
-	findClause := bson.M{"uuid": bson.M{"$in": matchedUUIDs}}
+	findClause := In{Key: "uuid", Values: matchedUUIDs}
 	selectClause := q.lex.query.ContentsBson()
 	if q.distinct {
 		distinctKey := ""
@@ -151,7 +150,7 @@ func (r *Republisher) HandleQuery2(query string) (*Query, error) {
 		q = new(Query)
 		q.hash = myhash
 		q.m_uuids = make(map[string]UUIDSTATE)
-		q.where = lex.query.WhereBson()
+		q.where = lex.query.where
 		q.keys = lex.keys
 		q.target = lex.query.Contents
 		q.querytype = lex.query.qtype
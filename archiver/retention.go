@@ -0,0 +1,219 @@
+package archiver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// the number of rollup windows fetched from the timeseries database at a time
+const retentionBatchWindows = 256
+
+// A RetentionPolicy limits how long raw data is kept for the streams that
+// match a where clause, e.g. "keep raw data 90 days, then keep 15-minute
+// means forever". Readings older than keepRaw are replaced by one reading per
+// rollup window (aligned to the epoch) holding the aggregate of the window,
+// computed with one of the functions in operatorAggregators.go. Without a
+// rollup window, old readings are just removed.
+//
+// Rolling up is idempotent: a window that already holds a single reading at
+// its start is left alone, so the policy can be applied over and over (and
+// after a restart) without changing data it has already rolled up. The policy
+// remembers how far it has rolled up each stream, so later runs only look at
+// the windows that have aged past keepRaw since.
+type RetentionPolicy struct {
+	name     string
+	where    Predicate
+	keepRaw  time.Duration
+	rollup   time.Duration
+	function string
+	aggFunc  func([][]interface{}) float64
+	// per stream, the time (nanoseconds) everything before which is rolled up
+	rolledUp     map[string]uint64
+	rolledUpLock sync.Mutex
+}
+
+// Creates a retention policy from its configuration. @where is a where
+// clause in the query language, @keepRaw and @rollup are durations like 90d
+// or 15min. An empty @rollup means old data is removed rather than rolled up,
+// and @function (mean, min or max) defaults to mean.
+func NewRetentionPolicy(name, where, keepRaw, rollup, function string) (*RetentionPolicy, error) {
+	rp := &RetentionPolicy{name: name, function: function, rolledUp: make(map[string]uint64)}
+	lex := NewSQLex("select * where " + where + ";")
+	SQParse(lex)
+	if lex.error != nil {
+		return nil, fmt.Errorf("Error (%v) in where clause \"%v\" of retention policy %v", lex.error, where, name)
+	}
+	rp.where = lex.query.where
+
+	var err error
+	if rp.keepRaw, err = parseIntoDuration(keepRaw); err != nil {
+		return nil, fmt.Errorf("Invalid KeepRaw %v for retention policy %v (%v)", keepRaw, name, err)
+	}
+	if rp.keepRaw <= 0 {
+		return nil, fmt.Errorf("KeepRaw for retention policy %v must be positive", name)
+	}
+	if rollup == "" {
+		return rp, nil
+	}
+	if rp.rollup, err = parseIntoDuration(rollup); err != nil {
+		return nil, fmt.Errorf("Invalid Rollup %v for retention policy %v (%v)", rollup, name, err)
+	}
+	if rp.rollup <= 0 {
+		return nil, fmt.Errorf("Rollup for retention policy %v must be positive", name)
+	}
+	if rp.function == "" {
+		rp.function = "mean"
+	}
+	if rp.aggFunc = opFuncChooser[rp.function]; rp.aggFunc == nil {
+		return nil, fmt.Errorf("Unknown function %v for retention policy %v", function, name)
+	}
+	return rp, nil
+}
+
+func (rp *RetentionPolicy) String() string {
+	if rp.rollup == 0 {
+		return fmt.Sprintf("%v: keep %v where %v", rp.name, rp.keepRaw, rp.where)
+	}
+	return fmt.Sprintf("%v: keep %v, then %v %v where %v", rp.name, rp.keepRaw, rp.rollup, rp.function, rp.where)
+}
+
+// Returns the time (nanoseconds) up to which @uuid has been rolled up
+func (rp *RetentionPolicy) watermark(uuid string) uint64 {
+	rp.rolledUpLock.Lock()
+	defer rp.rolledUpLock.Unlock()
+	return rp.rolledUp[uuid]
+}
+
+// Records that @uuid has been rolled up to @to (nanoseconds)
+func (rp *RetentionPolicy) setWatermark(uuid string, to uint64) {
+	rp.rolledUpLock.Lock()
+	defer rp.rolledUpLock.Unlock()
+	if to > rp.rolledUp[uuid] {
+		rp.rolledUp[uuid] = to
+	}
+}
+
+// Applies all of the archiver's retention policies. Run periodically by the
+// archiver when any are configured
+func (a *Archiver) applyRetention() {
+	for _, rp := range a.retention {
+		if err := a.ApplyRetentionPolicy(rp, time.Now()); err != nil {
+			log.Error("Error applying retention policy %v (%v)", rp.name, err)
+		}
+	}
+}
+
+// Rolls up (or removes) the data older than the policy allows as of @now for
+// all streams that match the policy's where clause
+func (a *Archiver) ApplyRetentionPolicy(rp *RetentionPolicy, now time.Time) error {
+	cutoff := uint64(now.Add(-rp.keepRaw).UnixNano())
+	if rp.rollup > 0 {
+		// only roll up whole windows
+		cutoff -= cutoff % uint64(rp.rollup)
+	}
+	uuids, err := a.store.GetUUIDs(rp.where)
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		if a.store.GetStreamType(uuid) == OBJECT_STREAM {
+			// objects cannot be aggregated, so they are only ever removed
+			if rp.rollup == 0 {
+				err = a.objstore.DeleteObjects(uuid, 0, cutoff, UOT_NS)
+			}
+		} else if rp.rollup == 0 {
+			err = a.tsdb.DeleteData([]string{uuid}, 0, cutoff, UOT_NS)
+		} else {
+			err = a.rollupStream(rp, uuid, cutoff)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the readings of @uuid before @cutoff (nanoseconds, aligned to the
+// rollup window) with one aggregate reading per window. Works through the
+// stream a batch of windows at a time from where the last run left off,
+// skipping over gaps in the data.
+func (a *Archiver) rollupStream(rp *RetentionPolicy, uuid string, cutoff uint64) error {
+	window := uint64(rp.rollup)
+	uot := a.store.GetUnitOfTime(uuid)
+	start := rp.watermark(uuid)
+	for {
+		next, err := a.tsdb.Next([]string{uuid}, start, 1, UOT_NS)
+		if err != nil {
+			return err
+		}
+		if len(next) == 0 || len(next[0].Readings) == 0 {
+			rp.setWatermark(uuid, cutoff)
+			return nil
+		}
+		start = convertTime(next[0].Readings[0].Time, uot, UOT_NS)
+		start -= start % window
+		if start >= cutoff {
+			rp.setWatermark(uuid, cutoff)
+			return nil
+		}
+		end := start + retentionBatchWindows*window
+		if end > cutoff {
+			end = cutoff
+		}
+		if err = a.rollupBatch(rp, uuid, uot, start, end); err != nil {
+			return err
+		}
+		rp.setWatermark(uuid, end)
+		start = end
+	}
+}
+
+// Rolls up the windows in [start, end) of @uuid. The raw readings are removed
+// before the rolled up ones are written, since they share timestamps
+func (a *Archiver) rollupBatch(rp *RetentionPolicy, uuid string, uot UnitOfTime, start, end uint64) error {
+	window := uint64(rp.rollup)
+	res, err := a.tsdb.GetData([]string{uuid}, start, end, UOT_NS)
+	if err != nil || len(res) == 0 {
+		return err
+	}
+	var (
+		rollups     []*SmapNumberReading
+		changed     bool
+		current     [][]interface{}
+		windowStart uint64
+	)
+	flush := func() {
+		if len(current) == 0 {
+			return
+		}
+		// a single reading at the start of the window is already rolled up
+		if len(current) != 1 || current[0][0].(uint64) != windowStart {
+			changed = true
+		}
+		rollups = append(rollups, &SmapNumberReading{Time: convertTime(windowStart, UOT_NS, uot), Value: rp.aggFunc(current)})
+		current = current[:0]
+	}
+	for _, rdg := range res[0].Readings {
+		time_ns := convertTime(rdg.Time, uot, UOT_NS)
+		if ws := time_ns - time_ns%window; ws != windowStart || len(current) == 0 {
+			flush()
+			windowStart = ws
+		}
+		current = append(current, []interface{}{time_ns, rdg.Value})
+	}
+	flush()
+	if !changed {
+		return nil
+	}
+	if err = a.tsdb.DeleteData([]string{uuid}, start, end, UOT_NS); err != nil {
+		return err
+	}
+	sb := &StreamBuf{uuid: uuid, unitOfTime: uot, readings: rollups, idx: len(rollups)}
+	if !a.tsdb.Add(sb) {
+		log.Error("Lost rolled up data for %v in [%v, %v) after removing the raw data", uuid, start, end)
+		return fmt.Errorf("Could not write rolled up data for %v", uuid)
+	}
+	log.Info("Rolled up %v windows of %v in [%v, %v) (%v)", len(rollups), uuid, start, end, rp.name)
+	return nil
+}
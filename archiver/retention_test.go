@@ -0,0 +1,101 @@
+package archiver
+
+import (
+	"testing"
+	"time"
+)
+
+// archiver over an embedded store and a MemoryDB holding readings for aaa
+// (unit of time s) at the given times, with value = time
+func newTestRetentionArchiver(times ...uint64) (*Archiver, *MemoryDB) {
+	mem := newTestMemoryDB(UOT_S, "aaa", times...)
+	return &Archiver{store: newTestEmbeddedStore(""), tsdb: mem}, mem
+}
+
+func TestRetentionPolicyRollup(t *testing.T) {
+	a, mem := newTestRetentionArchiver(0, 100, 200, 700, 900, 2000, 2100)
+	rp, err := NewRetentionPolicy("test", `uuid = "aaa"`, "1000s", "10min", "mean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// everything before 3100 - 1000 = 2100, aligned down to 1800, is rolled up
+	// into the windows at 0 and 600
+	now := time.Unix(3100, 0)
+	for i := 0; i < 2; i++ {
+		if err := a.ApplyRetentionPolicy(rp, now); err != nil {
+			t.Fatal(err)
+		}
+		res, _ := mem.GetData([]string{"aaa"}, 0, 10000, UOT_S)
+		if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{0, 600, 2000, 2100}) {
+			t.Fatal("Got ", times, " should be [0 600 2000 2100]")
+		}
+		for j, value := range []float64{100, 800, 2000, 2100} {
+			if res[0].Readings[j].Value != value {
+				t.Error("Got ", res[0].Readings[j].Value, " should be ", value)
+			}
+		}
+	}
+}
+
+// records the reference times Next is called with
+type nextRecorder struct {
+	TSDB
+	starts []uint64
+}
+
+func (nr *nextRecorder) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	nr.starts = append(nr.starts, start)
+	return nr.TSDB.Next(uuids, start, limit, uot)
+}
+
+func TestRetentionPolicyWatermark(t *testing.T) {
+	a, mem := newTestRetentionArchiver(0, 100, 700, 2000)
+	recorder := &nextRecorder{TSDB: mem}
+	a.tsdb = recorder
+	rp, err := NewRetentionPolicy("test", `uuid = "aaa"`, "1000s", "10min", "mean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ApplyRetentionPolicy(rp, time.Unix(3100, 0)); err != nil {
+		t.Fatal(err)
+	}
+	// the next run starts where the first one stopped (1800s), not at the epoch
+	recorder.starts = nil
+	if err := a.ApplyRetentionPolicy(rp, time.Unix(3700, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.starts) == 0 || recorder.starts[0] != 1800*1e9 {
+		t.Error("Got ", recorder.starts, " should start at ", uint64(1800*1e9))
+	}
+	res, _ := mem.GetData([]string{"aaa"}, 0, 10000, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{0, 600, 1800}) {
+		t.Error("Got ", times, " should be [0 600 1800]")
+	}
+}
+
+func TestRetentionPolicyRemove(t *testing.T) {
+	a, mem := newTestRetentionArchiver(100, 200, 300)
+	rp, err := NewRetentionPolicy("test", `Metadata/Type = "Sensor"`, "1d", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ApplyRetentionPolicy(rp, time.Unix(250+86400, 0)); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := mem.GetData([]string{"aaa"}, 0, 10000, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{300}) {
+		t.Error("Got ", times, " should be [300]")
+	}
+}
+
+func TestNewRetentionPolicyErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{`uuid = `, "1d", "", ""},
+		{`uuid = "a"`, "forever", "", ""},
+		{`uuid = "a"`, "1d", "15min", "median"},
+	} {
+		if _, err := NewRetentionPolicy("test", args[0], args[1], args[2], args[3]); err == nil {
+			t.Error("Policy ", args, " should not be valid")
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package archiver
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A TagSchema constrains the values of a tag, like Metadata/Location/Floor
+// (must be an integer) or Properties/UnitofTime (must be one of s, ms, us,
+// ns), or of all the tags in a namespace, like Metadata/Location/* (must be
+// strings). A closed namespace only allows the tags under it that have a
+// schema of their own, which catches misspelled tags like
+// Properties/UnitOfTime.
+//
+// The tags of incoming messages and set queries are checked against the
+// schemas before they are written to the metadata store. Violations of a
+// rejecting schema refuse the whole message or query; violations of a flagging
+// schema are logged and counted, and the tags are saved anyway.
+
+const (
+	SCHEMA_REJECT = "reject"
+	SCHEMA_FLAG   = "flag"
+)
+
+var schemaTypes = map[string]func(interface{}) bool{
+	"":        func(v interface{}) bool { return true },
+	"string":  isString,
+	"integer": isInteger,
+	"number":  isNumber,
+	"boolean": isBoolean,
+}
+
+type TagSchema struct {
+	name string
+	// path of the tag with slashes, or of the namespace without the /*
+	tag       string
+	namespace bool
+	kind      string
+	isKind    func(interface{}) bool
+	values    []string
+	closed    bool
+	action    string
+}
+
+// Creates a schema from its configuration. @tag is a tag path as in queries,
+// or a namespace ending in /*. @kind is one of string, integer, number or
+// boolean, or empty for any type. If @values is not empty, the tag must have
+// one of them. @closed only applies to namespaces. @action is reject (the
+// default) or flag.
+func NewTagSchema(name, tag, kind string, values []string, closed bool, action string) (*TagSchema, error) {
+	ts := &TagSchema{name: name, tag: tag, kind: kind, values: values, closed: closed, action: action}
+	if strings.HasSuffix(tag, "/*") {
+		ts.tag = strings.TrimSuffix(tag, "/*")
+		ts.namespace = true
+	} else if closed {
+		return nil, fmt.Errorf("Only namespaces (ending in /*) can be closed in schema %v", name)
+	}
+	if ts.tag == "" {
+		return nil, fmt.Errorf("Schema %v needs a Tag", name)
+	}
+	var found bool
+	if ts.isKind, found = schemaTypes[kind]; !found {
+		return nil, fmt.Errorf("Unknown type %v for schema %v (must be string, integer, number or boolean)", kind, name)
+	}
+	if ts.action == "" {
+		ts.action = SCHEMA_REJECT
+	}
+	if ts.action != SCHEMA_REJECT && ts.action != SCHEMA_FLAG {
+		return nil, fmt.Errorf("Unknown action %v for schema %v (must be reject or flag)", action, name)
+	}
+	return ts, nil
+}
+
+func (ts *TagSchema) String() string {
+	tag := ts.tag
+	if ts.namespace {
+		tag += "/*"
+	}
+	return fmt.Sprintf("%v: %v %v %v", ts.name, ts.action, tag, ts.describe())
+}
+
+// what the schema expects of a tag
+func (ts *TagSchema) describe() string {
+	var expect []string
+	if ts.kind != "" {
+		expect = append(expect, "of type "+ts.kind)
+	}
+	if len(ts.values) > 0 {
+		expect = append(expect, "one of ["+strings.Join(ts.values, ", ")+"]")
+	}
+	if ts.closed {
+		expect = append(expect, "a known tag")
+	}
+	if len(expect) == 0 {
+		return "anything"
+	}
+	return strings.Join(expect, " and ")
+}
+
+// Returns true if the schema applies to the tag @path
+func (ts *TagSchema) covers(path string) bool {
+	if ts.namespace {
+		return strings.HasPrefix(path, ts.tag+"/")
+	}
+	return path == ts.tag
+}
+
+// Returns true if one of @schemas besides this closed namespace names the tag
+// @path: a schema of the tag itself, or of a namespace deeper than this one.
+// Schemas of enclosing or equal namespaces don't make a tag known.
+func (ts *TagSchema) knows(schemas []*TagSchema, path string) bool {
+	for _, other := range schemas {
+		if other == ts || !other.covers(path) {
+			continue
+		}
+		if !other.namespace || strings.HasPrefix(other.tag, ts.tag+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if @value (or each of its elements, for a list) is allowed. Set
+// queries write every value as a string, so with @fromSet a string that parses
+// as the integer or number the schema expects is allowed too
+func (ts *TagSchema) allows(value interface{}, fromSet bool) bool {
+	if list, ok := asList(value); ok {
+		for _, elem := range list {
+			if !ts.allows(elem, fromSet) {
+				return false
+			}
+		}
+		return true
+	}
+	if !ts.isKind(value) && !(fromSet && ts.parses(value)) {
+		return false
+	}
+	if len(ts.values) == 0 {
+		return true
+	}
+	for _, allowed := range ts.values {
+		if fmt.Sprintf("%v", value) == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// A tag of a message or set query that does not follow a schema
+type SchemaViolation struct {
+	// the uuid or path of the message, or the where clause of the query
+	Source string
+	Tag    string
+	Value  interface{}
+	Schema *TagSchema
+}
+
+func (sv *SchemaViolation) Error() string {
+	return fmt.Sprintf("%v of %v is %v, should be %v (schema %v)", sv.Tag, sv.Source, sv.Value, sv.Schema.describe(), sv.Schema.name)
+}
+
+// The violations of rejecting schemas that refused a message or query
+type SchemaViolations []*SchemaViolation
+
+func (svs SchemaViolations) Error() string {
+	msgs := make([]string, len(svs))
+	for i, sv := range svs {
+		msgs[i] = sv.Error()
+	}
+	return fmt.Sprintf("Tags do not follow the schema (%v)", strings.Join(msgs, "; "))
+}
+
+// Returns true if @value is a string holding a number of the type of the schema
+func (ts *TagSchema) parses(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	var err error
+	switch ts.kind {
+	case "integer":
+		_, err = strconv.ParseInt(s, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(s, 64)
+	default:
+		return false
+	}
+	return err == nil
+}
+
+// Checks the tags in @tags (keyed by their paths with slashes) against
+// @schemas. @fromSet is true for the tags of a set query (see allows). Returns
+// the violations of rejecting schemas and of flagging ones, in order of tag
+func checkSchemas(schemas []*TagSchema, source string, tags bson.M, fromSet bool) (rejected, flagged SchemaViolations) {
+	paths := make([]string, 0, len(tags))
+	for path := range tags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		value := tags[path]
+		for _, ts := range schemas {
+			if !ts.covers(path) || (ts.allows(value, fromSet) && (!ts.closed || ts.knows(schemas, path))) {
+				continue
+			}
+			sv := &SchemaViolation{Source: source, Tag: path, Value: value, Schema: ts}
+			if ts.action == SCHEMA_FLAG {
+				flagged = append(flagged, sv)
+			} else {
+				rejected = append(rejected, sv)
+			}
+		}
+	}
+	return
+}
+
+// Returns the tags in @doc keyed by their paths with slashes, whether they
+// are nested documents or were flattened with dots (as JSON messages and set
+// queries are)
+func tagPaths(doc bson.M) bson.M {
+	ret := bson.M{}
+	for k, v := range flattenDocument(doc) {
+		ret[strings.Replace(k, ".", "/", -1)] = v
+	}
+	return ret
+}
+
+// Checks the metadata, properties and actuator of each of @readings against
+// the archiver's schemas. Flagged violations are logged, and the rejected
+// ones are returned as a SchemaViolations
+func (a *Archiver) checkMessageSchemas(readings map[string]*SmapMessage) error {
+	if len(a.schemas) == 0 {
+		return nil
+	}
+	var rejected SchemaViolations
+	for path, msg := range readings {
+		doc := bson.M{}
+		if msg.Metadata != nil {
+			doc["Metadata"] = msg.Metadata
+		}
+		if msg.Properties != nil {
+			doc["Properties"] = msg.Properties
+		}
+		if msg.Actuator != nil {
+			doc["Actuator"] = msg.Actuator
+		}
+		source := path
+		if msg.UUID != "" {
+			source = msg.UUID
+		}
+		r, f := checkSchemas(a.schemas, source, tagPaths(doc), false)
+		a.flagSchemaViolations(f)
+		rejected = append(rejected, r...)
+	}
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
+}
+
+// Like checkMessageSchemas, for the tags of a set query
+func (a *Archiver) checkUpdateSchemas(updates bson.M, where Predicate) error {
+	if len(a.schemas) == 0 {
+		return nil
+	}
+	rejected, flagged := checkSchemas(a.schemas, fmt.Sprintf("%v", where), tagPaths(updates), true)
+	a.flagSchemaViolations(flagged)
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
+}
+
+func (a *Archiver) flagSchemaViolations(flagged SchemaViolations) {
+	for _, sv := range flagged {
+		log.Warning("Schema violation: %v", sv)
+		a.flaggedcounter.Mark()
+	}
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+func isInteger(v interface{}) bool {
+	f, ok := asFloat(v)
+	return ok && f == math.Trunc(f)
+}
+
+func isNumber(v interface{}) bool {
+	_, ok := asFloat(v)
+	return ok
+}
+
+func isBoolean(v interface{}) bool {
+	_, ok := v.(bool)
+	return ok
+}
@@ -0,0 +1,127 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func newTestSchemas(t *testing.T) []*TagSchema {
+	var schemas []*TagSchema
+	for _, s := range []struct {
+		name, tag, kind string
+		values          []string
+		closed          bool
+		action          string
+	}{
+		{"floor", "Metadata/Location/Floor", "integer", nil, false, ""},
+		{"unitoftime", "Properties/UnitofTime", "", []string{"s", "ms", "us", "ns"}, false, ""},
+		{"unitofmeasure", "Properties/UnitofMeasure", "string", nil, false, SCHEMA_FLAG},
+		{"properties", "Properties/*", "", nil, true, ""},
+	} {
+		ts, err := NewTagSchema(s.name, s.tag, s.kind, s.values, s.closed, s.action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schemas = append(schemas, ts)
+	}
+	return schemas
+}
+
+func TestNewTagSchema(t *testing.T) {
+	if _, err := NewTagSchema("bad", "Metadata/Floor", "integer", nil, true, ""); err == nil {
+		t.Error("Only namespaces can be closed")
+	}
+	if _, err := NewTagSchema("bad", "Metadata/Floor", "int", nil, false, ""); err == nil {
+		t.Error("int is not a type")
+	}
+	if _, err := NewTagSchema("bad", "Metadata/Floor", "", nil, false, "drop"); err == nil {
+		t.Error("drop is not an action")
+	}
+}
+
+func TestCheckSchemas(t *testing.T) {
+	schemas := newTestSchemas(t)
+	tags := tagPaths(bson.M{
+		"Metadata":   bson.M{"Location.Floor": 4, "Location": bson.M{"Room": "410"}},
+		"Properties": bson.M{"UnitofTime": "s", "UnitofMeasure": "W"},
+	})
+	if rejected, flagged := checkSchemas(schemas, "aaa", tags, false); len(rejected) != 0 || len(flagged) != 0 {
+		t.Error("Got ", rejected, flagged, " should follow the schemas")
+	}
+
+	tags = tagPaths(bson.M{
+		"Metadata":   bson.M{"Location": bson.M{"Floor": "fourth"}},
+		"Properties": bson.M{"UnitofTime": "sec", "UnitOfTime": "s", "UnitofMeasure": 3},
+	})
+	rejected, flagged := checkSchemas(schemas, "aaa", tags, false)
+	var rejectedTags []string
+	for _, sv := range rejected {
+		rejectedTags = append(rejectedTags, sv.Tag)
+	}
+	if !isStringSliceEqual(rejectedTags, []string{"Metadata/Location/Floor", "Properties/UnitOfTime", "Properties/UnitofTime"}) {
+		t.Error("Got ", rejectedTags, " should be the floor and both units of time")
+	}
+	if len(flagged) != 1 || flagged[0].Tag != "Properties/UnitofMeasure" {
+		t.Error("Got ", flagged, " should flag the unit of measure")
+	}
+
+	// set queries write numbers as strings, and lists as List
+	tags = tagPaths(bson.M{"Metadata.Location.Floor": "4", "Properties.UnitofTime": List{"s", "ms"}})
+	if rejected, _ := checkSchemas(schemas, "aaa", tags, true); len(rejected) != 0 {
+		t.Error("Got ", rejected, " should follow the schemas")
+	}
+	// but messages have real numbers
+	if rejected, _ := checkSchemas(schemas, "aaa", tagPaths(bson.M{"Metadata.Location.Floor": "4"}), false); len(rejected) != 1 {
+		t.Error("Got ", rejected, " a string floor in a message should be rejected")
+	}
+
+	// an open enclosing namespace does not make the tags of a closed one known
+	metadata, err := NewTagSchema("metadata", "Metadata/*", "", nil, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := NewTagSchema("location", "Metadata/Location/*", "", nil, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas = append(schemas, metadata, location)
+	rejected, _ = checkSchemas(schemas, "aaa", tagPaths(bson.M{"Metadata.Location.Flor": 4}), false)
+	if len(rejected) != 1 || rejected[0].Tag != "Metadata/Location/Flor" || rejected[0].Schema != location {
+		t.Error("Got ", rejected, " should reject the misspelled floor")
+	}
+	if rejected, _ := checkSchemas(schemas, "aaa", tagPaths(bson.M{"Metadata.Location.Floor": 4}), false); len(rejected) != 0 {
+		t.Error("Got ", rejected, " the floor has a schema of its own")
+	}
+}
+
+func TestArchiverSchemas(t *testing.T) {
+	es := newTestEmbeddedStore("")
+	a := &Archiver{store: es, schemas: newTestSchemas(t), flaggedcounter: newCounter()}
+
+	err := a.AddData(map[string]*SmapMessage{
+		"/building/temp": &SmapMessage{Path: "/building/temp", UUID: "aaa", Properties: bson.M{"UnitofTime": "seconds"}},
+	}, "")
+	if _, ok := err.(SchemaViolations); !ok {
+		t.Error("Got ", err, " should be refused")
+	}
+	if a.store.GetUnitOfTime("aaa") != UOT_S {
+		t.Error("Unit of time of aaa should not have changed")
+	}
+
+	err = a.checkMessageSchemas(map[string]*SmapMessage{
+		"/building/temp": &SmapMessage{Path: "/building/temp", UUID: "aaa", Properties: bson.M{"UnitofMeasure": 3}},
+	})
+	if err != nil || a.FlaggedTags() != 1 {
+		t.Error("Got ", err, " and ", a.FlaggedTags(), " flagged tags, should be accepted and flagged")
+	}
+
+	if _, err = a.SetTags(bson.M{"Metadata.Location.Floor": "fourth"}, parseWhere(t, `uuid = "bbb"`), ""); err == nil {
+		t.Error("Set of a non-integer floor should be refused")
+	}
+	if floor, _ := getPath(es.metadata["bbb"], "Metadata.Location.Floor"); floor != nil {
+		t.Error("Got ", floor, " should not have been set")
+	}
+	if n, err := a.SetTags(bson.M{"Metadata.Location.Floor": "5"}, parseWhere(t, `uuid = "bbb"`), ""); err != nil || n != 1 {
+		t.Error("Got ", n, " updated and ", err, ", should set the floor")
+	}
+}
@@ -0,0 +1,921 @@
+package archiver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+)
+
+// SQLStore implements MetadataStore and APIKeyManager on top of a SQL
+// database. Each timeseries is a row holding its whole document (the same
+// shape MongoStore uses: Path, uuid, _api, Metadata, Properties, Actuator) in
+// a JSONB column, and the where-clauses generated by the query grammar are
+// translated into SQL predicates over that column by the dialect.
+//
+// PostgreSQL is the intended database. SQLite (with the JSON1 functions and a
+// REGEXP function registered by the driver) is supported so the store can be
+// exercised without a server
+type SQLStore struct {
+	db          *sql.DB
+	dialect     *sqlDialect
+	enforceKeys bool
+}
+
+// sqlDialect holds the SQL fragments that differ between databases. Queries
+// are written with $1-style placeholders and rebound for the database.
+type sqlDialect struct {
+	// type of the column holding documents
+	jsonType string
+	// rewrites $n placeholders for this database
+	rebind func(query string) string
+	// encodes a dotted path as an argument usable by the fragments below
+	path func(keys []string) string
+	// relation of the values at the path placeholder: a single row for a
+	// scalar, or a row per element for an array. Aliased as e(value)
+	elements string
+	// true if the path placeholder exists in the document
+	exists string
+	// true if e.value equals the value placeholder
+	equals string
+	// true if e.value is a number that compares to the number placeholder
+	// (the second argument) with the operator (the first)
+	compare string
+	// true if e.value matches the regex placeholder
+	regex string
+	// encodes a literal for comparison with e.value
+	encode func(v interface{}) (interface{}, error)
+	// expressions over e.value that order values like compareSortValues: the
+	// rank of the type (as in sortRank), then the value as a number (or a
+	// boolean as 0 or 1), then the value as text
+	sortRank   string
+	sortNumber string
+	sortText   string
+	// LIMIT argument that returns all rows
+	unlimited interface{}
+}
+
+var postgresDialect = &sqlDialect{
+	jsonType: "JSONB",
+	rebind:   func(query string) string { return query },
+	path: func(keys []string) string {
+		return `{"` + strings.Join(keys, `","`) + `"}`
+	},
+	elements: `jsonb_array_elements(CASE jsonb_typeof(doc #> %[1]s::text[]) WHEN 'array' THEN doc #> %[1]s::text[] ELSE jsonb_build_array(doc #> %[1]s::text[]) END) AS e(value)`,
+	exists:   `doc #> %s::text[] IS NOT NULL`,
+	equals:   `e.value = %s::jsonb`,
+	// jsonb orders numbers before strings, so the type has to be checked
+	compare: `jsonb_typeof(e.value) = 'number' AND e.value %s %s::jsonb`,
+	regex:   `e.value #>> '{}' ~ %s`,
+	encode: func(v interface{}) (interface{}, error) {
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	},
+	sortRank:   `CASE jsonb_typeof(e.value) WHEN 'null' THEN 0 WHEN 'number' THEN 1 WHEN 'string' THEN 2 WHEN 'object' THEN 3 WHEN 'boolean' THEN 4 ELSE 5 END`,
+	sortNumber: `CASE jsonb_typeof(e.value) WHEN 'number' THEN (e.value #>> '{}')::numeric WHEN 'boolean' THEN (e.value #>> '{}')::boolean::int END`,
+	// Go compares strings bytewise
+	sortText:  `(e.value #>> '{}') COLLATE "C"`,
+	unlimited: nil,
+}
+
+var sqlitePlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+var sqliteDialect = &sqlDialect{
+	jsonType: "TEXT",
+	rebind: func(query string) string {
+		return sqlitePlaceholder.ReplaceAllString(query, "?$1")
+	},
+	path: func(keys []string) string {
+		return `$."` + strings.Join(keys, `"."`) + `"`
+	},
+	// json_each walks the members of an object, which is not what we want
+	elements: `(SELECT value, type FROM json_each(doc, %[1]s) WHERE json_type(doc, %[1]s) != 'object') AS e`,
+	exists:   `json_type(doc, %s) IS NOT NULL`,
+	equals:   `e.value = %s`,
+	// booleans are stored as the integers 0 and 1
+	compare: `e.type IN ('integer', 'real') AND e.value %s %s`,
+	regex:   `e.value REGEXP %s`,
+	encode: func(v interface{}) (interface{}, error) {
+		switch v.(type) {
+		case string, bool, int, int32, int64, float32, float64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("Cannot compare against %v", v)
+	},
+	// documents are not elements here, so they sort like missing values
+	sortRank:   `CASE e.type WHEN 'null' THEN 0 WHEN 'integer' THEN 1 WHEN 'real' THEN 1 WHEN 'text' THEN 2 WHEN 'true' THEN 4 WHEN 'false' THEN 4 ELSE 5 END`,
+	sortNumber: `CASE WHEN e.type IN ('integer', 'real', 'true', 'false') THEN e.value END`,
+	sortText:   `CASE e.type WHEN 'text' THEN e.value END`,
+	unlimited:  -1,
+}
+
+// database/sql driver name -> dialect
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": postgresDialect,
+	"sqlite3":  sqliteDialect,
+}
+
+// SQLite does not ship a REGEXP function, so the sqlite3 driver is opened
+// through one that registers it
+const SQLITE_REGEXP_DRIVER = "sqlite3_regexp"
+
+func init() {
+	sql.Register(SQLITE_REGEXP_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", func(pattern, s string) (bool, error) {
+				return regexp.MatchString(pattern, s)
+			}, true)
+		},
+	})
+}
+
+func NewSQLStore(driver, datasource string) *SQLStore {
+	dialect, found := sqlDialects[driver]
+	if !found {
+		log.Critical("No SQL dialect for driver %v", driver)
+		return nil
+	}
+	log.Notice("Connecting to %v metadata store...", driver)
+	sqlDriver := driver
+	if driver == "sqlite3" {
+		sqlDriver = SQLITE_REGEXP_DRIVER
+	}
+	db, err := sql.Open(sqlDriver, datasource)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		log.Critical("Could not connect to %v: %v", driver, err)
+		return nil
+	}
+	log.Notice("...connected!")
+	ss := &SQLStore{db: db, dialect: dialect, enforceKeys: true}
+	for _, table := range []string{
+		"CREATE TABLE IF NOT EXISTS metadata (uuid TEXT PRIMARY KEY, doc " + dialect.jsonType + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS pathmetadata (path TEXT PRIMARY KEY, doc " + dialect.jsonType + " NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS apikeys (key TEXT PRIMARY KEY, name TEXT NOT NULL, email TEXT NOT NULL, public BOOLEAN NOT NULL, UNIQUE (name, email))",
+		"CREATE TABLE IF NOT EXISTS streams (uuid TEXT PRIMARY KEY, streamid INTEGER NOT NULL UNIQUE)",
+		"CREATE TABLE IF NOT EXISTS metadata_history (uuid TEXT NOT NULL, time BIGINT NOT NULL, action TEXT NOT NULL, apikey TEXT NOT NULL, doc " + dialect.jsonType + " NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS metadata_history_uuid_time ON metadata_history (uuid, time)",
+	} {
+		if _, err = db.Exec(table); err != nil {
+			log.Critical("Could not create table (%v)", err)
+			return nil
+		}
+	}
+	return ss
+}
+
+/* where-clause translation */
+
+// Translates a where-clause into a SQL predicate over the doc column,
+// appending the values it references to @args. Follows the semantics of
+// matchPredicate
+func (d *sqlDialect) compileWhere(where Predicate, args *[]interface{}) (string, error) {
+	switch p := where.(type) {
+	case nil:
+		return "1=1", nil
+	case And:
+		return d.compileList(p, " AND ", args)
+	case Or:
+		return d.compileList(p, " OR ", args)
+	case Not:
+		clause, err := d.compileWhere(p.Predicate, args)
+		return "NOT (" + clause + ")", err
+	case Eq:
+		pathArg := d.pathArg(p.Key, args)
+		return d.compileEquals(pathArg, p.Value, args)
+	case Like:
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			return "", err
+		}
+		pathArg := d.pathArg(p.Key, args)
+		return d.anyValue(pathArg, fmt.Sprintf(d.regex, d.arg(args, p.Pattern))), nil
+	case Compare:
+		// the operator goes into the query, so it must be one we know
+		if _, found := compareOperators[p.Op]; !found {
+			return "", fmt.Errorf("Unknown comparison %v", p.Op)
+		}
+		pathArg := d.pathArg(p.Key, args)
+		encoded, err := d.encode(p.Value)
+		if err != nil {
+			return "", err
+		}
+		return d.anyValue(pathArg, fmt.Sprintf(d.compare, p.Op, d.arg(args, encoded))), nil
+	case Has:
+		return "(" + fmt.Sprintf(d.exists, d.pathArg(p.Key, args)) + ")", nil
+	case In:
+		if len(p.Values) == 0 {
+			return "1=0", nil
+		}
+		pathArg := d.pathArg(p.Key, args)
+		options := make([]string, len(p.Values))
+		for i, value := range p.Values {
+			var err error
+			if options[i], err = d.compileEquals(pathArg, value, args); err != nil {
+				return "", err
+			}
+		}
+		return "(" + strings.Join(options, " OR ") + ")", nil
+	}
+	return "", fmt.Errorf("Unsupported predicate %v", where)
+}
+
+func (d *sqlDialect) compileList(preds []Predicate, join string, args *[]interface{}) (string, error) {
+	if len(preds) == 0 {
+		return "", fmt.Errorf("Expected list of predicates")
+	}
+	compiled := make([]string, len(preds))
+	for i, pred := range preds {
+		var err error
+		if compiled[i], err = d.compileWhere(pred, args); err != nil {
+			return "", err
+		}
+	}
+	return "(" + strings.Join(compiled, join) + ")", nil
+}
+
+func (d *sqlDialect) arg(args *[]interface{}, value interface{}) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
+
+// registers the dotted path @key as an argument and returns its placeholder
+func (d *sqlDialect) pathArg(key string, args *[]interface{}) string {
+	return d.arg(args, d.path(strings.Split(key, ".")))
+}
+
+// true if any of the values at the path in placeholder @pathArg satisfy
+// @predicate on e.value
+func (d *sqlDialect) anyValue(pathArg, predicate string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s)", fmt.Sprintf(d.elements, pathArg), predicate)
+}
+
+func (d *sqlDialect) compileEquals(pathArg string, value interface{}, args *[]interface{}) (string, error) {
+	encoded, err := d.encode(value)
+	if err != nil {
+		return "", err
+	}
+	return d.anyValue(pathArg, fmt.Sprintf(d.equals, d.arg(args, encoded))), nil
+}
+
+// Returns the ORDER BY, LIMIT and OFFSET clauses of @page. Documents are
+// ordered the way pageDocuments orders them: by the values at the order key,
+// where a list sorts by its smallest element (its largest if descending) and
+// missing values sort first, with ties broken by uuid
+func (d *sqlDialect) compilePage(page Page, args *[]interface{}) string {
+	dir := ""
+	if page.Descending {
+		dir = " DESC"
+	}
+	var order []string
+	if page.OrderBy == "" {
+		order = []string{"uuid" + dir}
+	} else {
+		// each term picks the same first element of the list
+		pathArg := d.pathArg(page.OrderBy, args)
+		keys := []string{d.sortRank + dir, d.sortNumber + dir, d.sortText + dir}
+		for i, key := range []string{d.sortRank, d.sortNumber, d.sortText} {
+			term := fmt.Sprintf("(SELECT %s FROM %s ORDER BY %s LIMIT 1)", key, fmt.Sprintf(d.elements, pathArg), strings.Join(keys, ", "))
+			if i == 0 {
+				term = "COALESCE(" + term + ", 0)"
+			}
+			order = append(order, term+dir)
+		}
+		order = append(order, "uuid")
+	}
+	var limit interface{} = d.unlimited
+	if page.Limit > 0 {
+		limit = page.Limit
+	}
+	return fmt.Sprintf(" ORDER BY %s LIMIT %s OFFSET %s", strings.Join(order, ", "), d.arg(args, limit), d.arg(args, page.Offset))
+}
+
+/* document storage */
+
+// decodes a stored document. Integers are kept as integers rather than
+// float64 so documents round trip the way they do through Mongo
+func decodeDocument(data []byte) (bson.M, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return decodeNumbers(doc).(bson.M), nil
+}
+
+func decodeNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		ret := make(bson.M, len(x))
+		for k, vv := range x {
+			ret[k] = decodeNumbers(vv)
+		}
+		return ret
+	case []interface{}:
+		for i, vv := range x {
+			x[i] = decodeNumbers(vv)
+		}
+		return x
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	}
+	return v
+}
+
+// anything that can run a query: the database or a transaction
+type sqlQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// returns the documents in @table whose doc matches @where, ordered by key
+func (ss *SQLStore) find(q sqlQueryer, table, key string, where Predicate) ([]bson.M, error) {
+	var args []interface{}
+	predicate, err := ss.dialect.compileWhere(where, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT doc FROM %s WHERE %s ORDER BY %s", table, predicate, key)
+	return ss.queryDocuments(q, query, args)
+}
+
+// returns the metadata documents matching @where in the window of @page
+func (ss *SQLStore) findPage(where Predicate, page Page) ([]bson.M, error) {
+	var args []interface{}
+	predicate, err := ss.dialect.compileWhere(where, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT doc FROM metadata WHERE " + predicate + ss.dialect.compilePage(page, &args)
+	return ss.queryDocuments(ss.db, query, args)
+}
+
+// runs @query, which selects a doc column, and decodes the documents
+func (ss *SQLStore) queryDocuments(q sqlQueryer, query string, args []interface{}) ([]bson.M, error) {
+	var ret []bson.M
+	rows, err := q.Query(ss.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		doc, err := decodeDocument(data)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, doc)
+	}
+	return ret, rows.Err()
+}
+
+// returns the document in @table identified by @value in column @key
+func (ss *SQLStore) findOne(q sqlQueryer, table, key, value string) (bson.M, error) {
+	var data []byte
+	query := fmt.Sprintf("SELECT doc FROM %s WHERE %s = $1", table, key)
+	rows, err := q.Query(ss.dialect.rebind(query), value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, mgo.ErrNotFound
+	}
+	if err = rows.Scan(&data); err != nil {
+		return nil, err
+	}
+	return decodeDocument(data)
+}
+
+// inserts or replaces the document in @table identified by @value
+func (ss *SQLStore) save(q sqlQueryer, table, key, value string, doc bson.M) error {
+	bytes, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %[1]s (%[2]s, doc) VALUES ($1, $2) ON CONFLICT (%[2]s) DO UPDATE SET doc = EXCLUDED.doc", table, key)
+	_, err = q.Exec(ss.dialect.rebind(query), value, string(bytes))
+	return err
+}
+
+// runs @f in a transaction, committing if it returns nil
+func (ss *SQLStore) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := ss.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/* MetadataStore interface implementation*/
+
+func (ss *SQLStore) EnforceKeys(enforce bool) {
+	ss.enforceKeys = enforce
+}
+
+func (ss *SQLStore) Find(where Predicate, selectClause bson.M) (interface{}, error) {
+	var result []interface{}
+	docs, err := ss.find(ss.db, "metadata", "uuid", where)
+	for _, doc := range docs {
+		result = append(result, projectDocument(doc, selectClause))
+	}
+	return result, err
+}
+
+func (ss *SQLStore) FindDistinct(where Predicate, distinctKey string) (interface{}, error) {
+	docs, err := ss.find(ss.db, "metadata", "uuid", where)
+	if err != nil {
+		return nil, err
+	}
+	return distinctValues(docs, distinctKey), nil
+}
+
+func (ss *SQLStore) CheckKey(apikey string, messages map[string]*SmapMessage) (bool, error) {
+	for _, msg := range messages {
+		if msg.UUID == "" {
+			continue
+		} // no API key for path metadata
+		ok, err := ss.CanWrite(apikey, msg.UUID)
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Same rules as MongoStore.CanWrite: the first valid key to write to a UUID
+// owns it
+func (ss *SQLStore) CanWrite(apikey, uuid string) (bool, error) {
+	if !ss.enforceKeys {
+		return true, nil
+	}
+	doc, err := ss.findOne(ss.db, "metadata", "uuid", uuid)
+	if err == nil {
+		if doc["_api"] != apikey {
+			return false, errors.New("API key " + apikey + " is invalid for UUID " + uuid)
+		}
+		return true, nil
+	} else if err != mgo.ErrNotFound {
+		return false, err
+	}
+	exists, err := ss.ApiKeyExists(apikey)
+	if !exists || err != nil {
+		return false, err
+	}
+	if uuid == "" {
+		return false, err
+	}
+	if err = ss.save(ss.db, "metadata", "uuid", uuid, bson.M{"uuid": uuid, "_api": apikey}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (ss *SQLStore) SavePathMetadata(messages map[string]*SmapMessage) error {
+	return ss.transaction(func(tx *sql.Tx) error {
+		for path, msg := range messages {
+			// check if we have anything to do
+			if msg.Path == "" || (msg.Metadata == nil && msg.Properties == nil && msg.Actuator == nil) {
+				continue
+			}
+			doc, err := ss.findOne(tx, "pathmetadata", "path", path)
+			if err == mgo.ErrNotFound {
+				doc = bson.M{"Path": path}
+			} else if err != nil {
+				return err
+			}
+			if mergeSmapMessage(doc, msg) {
+				if err = ss.save(tx, "pathmetadata", "path", path, doc); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Inherits the metadata of each of the prefixes of the timeseries path before
+// applying the timeseries-specific metadata, like MongoStore
+func (ss *SQLStore) SaveTimeseriesMetadata(messages map[string]*SmapMessage) error {
+	return ss.transaction(func(tx *sql.Tx) error {
+		for path, msg := range messages {
+			if msg.UUID == "" { // not a timeseries path
+				continue
+			}
+			toWrite := bson.M{"Path": path, "uuid": msg.UUID}
+			for _, prefix := range getPrefixes(path) {
+				prefixDoc, err := ss.findOne(tx, "pathmetadata", "path", prefix)
+				if err == mgo.ErrNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				for k, v := range projectDocument(prefixDoc, bson.M{"Path": 0}) {
+					toWrite[k] = v
+				}
+			}
+			mergeSmapMessage(toWrite, msg)
+			if len(toWrite) <= 2 {
+				continue
+			}
+			if err := ss.update(tx, msg.UUID, toWrite); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sets each of the (dotted) keys in @updates on the document for @uuid,
+// creating it if necessary
+func (ss *SQLStore) update(tx *sql.Tx, uuid string, updates bson.M) error {
+	doc, err := ss.findOne(tx, "metadata", "uuid", uuid)
+	if err == mgo.ErrNotFound {
+		doc = bson.M{}
+	} else if err != nil {
+		return err
+	}
+	changed := err == mgo.ErrNotFound
+	for k, v := range updates {
+		changed = setPath(doc, k, v) || changed
+	}
+	if !changed {
+		return nil
+	}
+	return ss.save(tx, "metadata", "uuid", uuid, doc)
+}
+
+func (ss *SQLStore) SaveTags(messages *map[string]*SmapMessage) error {
+	tsm := TieredSmapMessage(*messages)
+	tsm.CollapseToTimeseries()
+	return ss.transaction(func(tx *sql.Tx) error {
+		for _, bsonMsg := range tsm.ToBson() {
+			if err := ss.update(tx, bsonMsg["uuid"].(string), bsonMsg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLStore) GetTags(target bson.M, is_distinct bool, distinct_key string, where Predicate, page Page) ([]interface{}, error) {
+	var res = []interface{}{}
+	if is_distinct {
+		docs, err := ss.find(ss.db, "metadata", "uuid", where)
+		if err != nil {
+			return res, err
+		}
+		return distinctValues(docs, distinct_key), nil
+	}
+	docs, err := ss.findPage(where, page)
+	if err != nil {
+		return res, err
+	}
+	sel := bson.M{"_api": 0}
+	if len(target) > 0 {
+		sel = target
+		// same as MongoStore: only exclude _api if the target is not
+		// including anything
+		doExclude := true
+		for _, include := range target {
+			if include == 1 {
+				doExclude = false
+				break
+			}
+		}
+		if doExclude {
+			sel["_api"] = 0
+		}
+	}
+	for _, doc := range docs {
+		res = append(res, projectDocument(doc, sel))
+	}
+	return res, nil
+}
+
+// checks @apikey against all documents matching @where, then calls @apply
+// with each of them inside a transaction
+func (ss *SQLStore) updateWritable(apikey string, where Predicate, apply func(tx *sql.Tx, doc bson.M) error) (int, error) {
+	var count int
+	err := ss.transaction(func(tx *sql.Tx) error {
+		docs, err := ss.find(tx, "metadata", "uuid", where)
+		if err != nil {
+			return err
+		}
+		if ss.enforceKeys {
+			if exists, err := ss.ApiKeyExists(apikey); !exists || err != nil {
+				return err
+			}
+			for _, doc := range docs {
+				if doc["_api"] != apikey {
+					return errors.New("API key " + apikey + " is invalid for UUID " + fmt.Sprintf("%v", doc["uuid"]))
+				}
+			}
+		}
+		for _, doc := range docs {
+			if err = apply(tx, doc); err != nil {
+				return err
+			}
+		}
+		count = len(docs)
+		return nil
+	})
+	return count, err
+}
+
+func (ss *SQLStore) UpdateTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	updated, err := ss.updateWritable(apikey, where, func(tx *sql.Tx, doc bson.M) error {
+		for k, v := range updates {
+			setPath(doc, k, v)
+		}
+		return ss.save(tx, "metadata", "uuid", doc["uuid"].(string), doc)
+	})
+	if err != nil {
+		return res, err
+	}
+	log.Info("Updated %v records", updated)
+	return bson.M{"Updated": updated}, nil
+}
+
+func (ss *SQLStore) RemoveDocs(apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	removed, err := ss.updateWritable(apikey, where, func(tx *sql.Tx, doc bson.M) error {
+		_, err := tx.Exec(ss.dialect.rebind("DELETE FROM metadata WHERE uuid = $1"), doc["uuid"])
+		return err
+	})
+	if err != nil {
+		return res, err
+	}
+	log.Info("Removed %v records", removed)
+	return bson.M{"Removed": removed}, nil
+}
+
+func (ss *SQLStore) RemoveTags(updates bson.M, apikey string, where Predicate) (bson.M, error) {
+	var res bson.M
+	updated, err := ss.updateWritable(apikey, where, func(tx *sql.Tx, doc bson.M) error {
+		for k := range updates {
+			unsetPath(doc, k)
+		}
+		return ss.save(tx, "metadata", "uuid", doc["uuid"].(string), doc)
+	})
+	if err != nil {
+		return res, err
+	}
+	log.Info("Updated %v records", updated)
+	return bson.M{"Updated": updated}, nil
+}
+
+func (ss *SQLStore) UUIDTags(uuid string) (bson.M, error) {
+	doc, err := ss.findOne(ss.db, "metadata", "uuid", uuid)
+	if err != nil {
+		return bson.M{}, err
+	}
+	return projectDocument(doc, bson.M{"_api": 0}), nil
+}
+
+// Returns the query that finds the streams matching @where, and its arguments
+func (ss *SQLStore) ExplainWhere(where Predicate) (interface{}, error) {
+	var args []interface{}
+	predicate, err := ss.dialect.compileWhere(where, &args)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("SELECT doc FROM metadata WHERE %s ORDER BY uuid", predicate)
+	return bson.M{"Query": ss.dialect.rebind(query), "Args": args}, nil
+}
+
+func (ss *SQLStore) GetUUIDs(where Predicate) ([]string, error) {
+	var res = []string{}
+	docs, err := ss.find(ss.db, "metadata", "uuid", where)
+	if err != nil {
+		return res, err
+	}
+	for _, doc := range docs {
+		res = append(res, doc["uuid"].(string))
+	}
+	return res, nil
+}
+
+// defaults to ms, like MongoStore
+func (ss *SQLStore) GetUnitOfTime(uuid string) UnitOfTime {
+	if doc, err := ss.findOne(ss.db, "metadata", "uuid", uuid); err == nil {
+		if units, found := getPath(doc, "Properties.UnitofTime"); found {
+			if s, ok := units.(string); ok {
+				if uot, err := parseUOT(s); err == nil {
+					return uot
+				}
+			}
+		}
+	}
+	return UOT_MS
+}
+
+func (ss *SQLStore) GetStreamType(uuid string) StreamType {
+	if doc, err := ss.findOne(ss.db, "metadata", "uuid", uuid); err == nil {
+		if st, found := getPath(doc, "Properties.StreamType"); found && st == "object" {
+			return OBJECT_STREAM
+		}
+	}
+	return NUMERIC_STREAM
+}
+
+func (ss *SQLStore) GetStreamId(uuid string) uint32 {
+	var streamid uint32
+	err := ss.transaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow(ss.dialect.rebind("SELECT streamid FROM streams WHERE uuid = $1"), uuid).Scan(&streamid)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		// not found, so create
+		if err = tx.QueryRow("SELECT COALESCE(MAX(streamid), 0) + 1 FROM streams").Scan(&streamid); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ss.dialect.rebind("INSERT INTO streams (uuid, streamid) VALUES ($1, $2)"), uuid, streamid)
+		log.Notice("Creating StreamId %v for uuid %v", streamid, uuid)
+		return err
+	})
+	if err != nil {
+		log.Error("Error inserting streamid %v", err)
+		return 0
+	}
+	return streamid
+}
+
+/* MetadataHistory interface implementation */
+
+// the owner, changes and document of each change are kept together in the
+// doc column
+func (ss *SQLStore) AddMetadataChanges(changes []*MetadataChange) error {
+	return ss.transaction(func(tx *sql.Tx) error {
+		for _, change := range changes {
+			bytes, err := json.Marshal(bson.M{"owner": change.Owner, "changes": change.Changes, "document": change.Document})
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ss.dialect.rebind("INSERT INTO metadata_history (uuid, time, action, apikey, doc) VALUES ($1, $2, $3, $4, $5)"),
+				change.UUID, change.Time, change.Action, change.ApiKey, string(bytes))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ss *SQLStore) GetMetadataHistory(uuid string) ([]*MetadataChange, error) {
+	return ss.findChanges("SELECT uuid, time, action, apikey, doc FROM metadata_history WHERE uuid = $1 ORDER BY time", uuid)
+}
+
+func (ss *SQLStore) GetMetadataAsOf(when int64) ([]*MetadataChange, error) {
+	changes, err := ss.findChanges(`SELECT h.uuid, h.time, h.action, h.apikey, h.doc FROM metadata_history h
+		WHERE h.time = (SELECT MAX(time) FROM metadata_history WHERE uuid = h.uuid AND time <= $1) ORDER BY h.uuid`, when)
+	if err != nil {
+		return nil, err
+	}
+	// only keep one of the changes to a stream made at the same time
+	var ret []*MetadataChange
+	for _, change := range changes {
+		if len(ret) > 0 && ret[len(ret)-1].UUID == change.UUID {
+			ret[len(ret)-1] = change
+		} else {
+			ret = append(ret, change)
+		}
+	}
+	return ret, nil
+}
+
+func (ss *SQLStore) findChanges(query string, args ...interface{}) ([]*MetadataChange, error) {
+	var ret []*MetadataChange
+	rows, err := ss.db.Query(ss.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			change = &MetadataChange{}
+			data   []byte
+		)
+		if err = rows.Scan(&change.UUID, &change.Time, &change.Action, &change.ApiKey, &data); err != nil {
+			return nil, err
+		}
+		doc, err := decodeDocument(data)
+		if err != nil {
+			return nil, err
+		}
+		change.Owner, _ = asMap(doc["owner"])
+		change.Changes, _ = asMap(doc["changes"])
+		change.Document, _ = asMap(doc["document"])
+		ret = append(ret, change)
+	}
+	return ret, rows.Err()
+}
+
+/** Implementing the APIKeyManager interface **/
+
+func (ss *SQLStore) ApiKeyExists(apikey string) (bool, error) {
+	var count int
+	err := ss.db.QueryRow(ss.dialect.rebind("SELECT COUNT(*) FROM apikeys WHERE key = $1"), apikey).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 1 {
+		return false, errors.New("More than 1 API key with value " + apikey)
+	}
+	if count < 1 {
+		return false, errors.New("No API key with value " + apikey)
+	}
+	return true, nil
+}
+
+func (ss *SQLStore) NewKey(name, email string, public bool) (string, error) {
+	apikey, err := generateAPIKey()
+	if err != nil {
+		return apikey, err
+	}
+	_, err = ss.db.Exec(ss.dialect.rebind("INSERT INTO apikeys (key, name, email, public) VALUES ($1, $2, $3, $4)"), apikey, name, email, public)
+	if err != nil {
+		return apikey, errors.New(fmt.Sprintf("could not save new apikey for %v %v (%v)", name, email, err))
+	}
+	return apikey, nil
+}
+
+func (ss *SQLStore) GetKey(name, email string) (string, error) {
+	var apikey string
+	err := ss.db.QueryRow(ss.dialect.rebind("SELECT key FROM apikeys WHERE name = $1 AND email = $2"), name, email).Scan(&apikey)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not retrieve apikey for %v %v (%v)", name, email, err))
+	}
+	return apikey, nil
+}
+
+func (ss *SQLStore) ListKeys(email string) ([]map[string]interface{}, error) {
+	var res []map[string]interface{}
+	rows, err := ss.db.Query(ss.dialect.rebind("SELECT key, name, email, public FROM apikeys WHERE email = $1 ORDER BY name"), email)
+	if err != nil {
+		return res, errors.New(fmt.Sprintf("Could not get apikeys for %v (%v)", email, err))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			key, name, email string
+			public           bool
+		)
+		if err = rows.Scan(&key, &name, &email, &public); err != nil {
+			return res, errors.New(fmt.Sprintf("Could not get apikeys for %v (%v)", email, err))
+		}
+		res = append(res, map[string]interface{}{"key": key, "name": name, "email": email, "public": public})
+	}
+	return res, rows.Err()
+}
+
+func (ss *SQLStore) DeleteKeyByName(name, email string) (string, error) {
+	result, err := ss.db.Exec(ss.dialect.rebind("DELETE FROM apikeys WHERE name = $1 AND email = $2"), name, email)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not delete keys for %v %v (%v)", name, email, err))
+	}
+	removed, _ := result.RowsAffected()
+	return fmt.Sprintf("Removed %v records", removed), nil
+}
+
+func (ss *SQLStore) DeleteKeyByValue(key string) (string, error) {
+	result, err := ss.db.Exec(ss.dialect.rebind("DELETE FROM apikeys WHERE key = $1"), key)
+	if err == nil {
+		if removed, _ := result.RowsAffected(); removed == 0 {
+			err = mgo.ErrNotFound
+		}
+	}
+	return fmt.Sprintf("Removed key"), err
+}
+
+func (ss *SQLStore) Owner(key string) (map[string]interface{}, error) {
+	var name, email string
+	err := ss.db.QueryRow(ss.dialect.rebind("SELECT name, email FROM apikeys WHERE key = $1"), key).Scan(&name, &email)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not find owners for key %v (%v)", key, err))
+	}
+	return map[string]interface{}{"name": name, "email": email}, nil
+}
@@ -0,0 +1,130 @@
+package archiver
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestSQLStore(t *testing.T) (*SQLStore, func()) {
+	dir, err := ioutil.TempDir("", "sqlstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := NewSQLStore("sqlite3", filepath.Join(dir, "metadata.db"))
+	if ss == nil {
+		os.RemoveAll(dir)
+		t.Fatal("Could not open SQL store")
+	}
+	populateTestStore(ss)
+	return ss, func() {
+		ss.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSQLStoreWhere(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	testWhere(t, ss)
+}
+
+func TestSQLStoreTags(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	testTags(t, ss)
+}
+
+func TestSQLStorePathInheritance(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	msgs := map[string]*SmapMessage{
+		"/":      &SmapMessage{Path: "/", Metadata: bson.M{"Site": "cory"}},
+		"/floor": &SmapMessage{Path: "/floor", Metadata: bson.M{"Floor": "4", "Site": "soda"}},
+		"/floor/meter": &SmapMessage{Path: "/floor/meter", UUID: "ddd",
+			Metadata: bson.M{"Type": "Meter"}},
+	}
+	if err := ss.SavePathMetadata(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.SaveTimeseriesMetadata(msgs); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ss.UUIDTags("ddd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// longer prefixes override shorter ones
+	for path, value := range map[string]string{"Metadata.Site": "soda", "Metadata.Floor": "4", "Metadata.Type": "Meter", "Path": "/floor/meter"} {
+		if found, _ := getPath(doc, path); found != value {
+			t.Error("Got ", found, " for ", path, " should be ", value)
+		}
+	}
+}
+
+func TestSQLStoreCompileWhere(t *testing.T) {
+	var args []interface{}
+	predicate, err := postgresDialect.compileWhere(parseWhere(t, `Metadata/Type = "Sensor" and not has Metadata/Floor`), &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(predicate, "e.value = $2::jsonb") || !strings.Contains(predicate, "NOT ((doc #> $3::text[] IS NOT NULL))") {
+		t.Error("Unexpected predicate ", predicate)
+	}
+	if len(args) != 3 || args[0] != `{"Metadata","Type"}` || args[1] != `"Sensor"` {
+		t.Error("Got args ", args, ` should be [{"Metadata","Type"} "Sensor" {"Metadata","Floor"}]`)
+	}
+
+	args = nil
+	predicate, err = sqliteDialect.compileWhere(parseWhere(t, `Metadata/Floor >= 3`), &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(predicate, "e.value >= $2") || len(args) != 2 || args[1] != 3.0 {
+		t.Error("Unexpected predicate ", predicate, " with args ", args)
+	}
+	if _, err = sqliteDialect.compileWhere(Compare{Key: "Metadata.Floor", Op: "; DROP TABLE metadata", Value: 3}, &args); err == nil {
+		t.Error("Expected error for unknown comparison")
+	}
+}
+
+func TestSQLStoreKeys(t *testing.T) {
+	ss, cleanup := newTestSQLStore(t)
+	defer cleanup()
+	ss.EnforceKeys(true)
+	key, err := ss.NewKey("test", "test@example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.NewKey("test", "test@example.com", false); err == nil {
+		t.Error("Should not be able to create a second key with the same name")
+	}
+	if found, err := ss.GetKey("test", "test@example.com"); found != key || err != nil {
+		t.Error("Got ", found, " should be ", key, " (", err, ")")
+	}
+	if ok, err := ss.CanWrite(key, "ddd"); !ok || err != nil {
+		t.Error("Key should be able to claim new uuid: ", err)
+	}
+	if ok, _ := ss.CanWrite("badkey", "ddd"); ok {
+		t.Error("Other keys should not be able to write to ddd")
+	}
+	if _, err := ss.UpdateTags(bson.M{"Metadata.Type": "Meter"}, key, Eq{Key: "uuid", Value: "aaa"}); err == nil {
+		t.Error("Key should not be able to update a document it does not own")
+	}
+	if res, err := ss.UpdateTags(bson.M{"Metadata.Type": "Meter"}, key, Eq{Key: "uuid", Value: "ddd"}); err != nil || res["Updated"] != 1 {
+		t.Error("Got ", res, " (", err, ") should have updated ddd")
+	}
+	if sid := ss.GetStreamId("ddd"); sid != 1 || ss.GetStreamId("eee") != 2 || ss.GetStreamId("ddd") != 1 {
+		t.Error("Stream ids should be allocated in order")
+	}
+	if keys, _ := ss.ListKeys("test@example.com"); len(keys) != 1 || keys[0]["public"] != true {
+		t.Error("Got ", keys, " should have one public key")
+	}
+	ss.DeleteKeyByValue(key)
+	if _, err := ss.Owner(key); err == nil {
+		t.Error("Key should have been deleted")
+	}
+}
@@ -0,0 +1,60 @@
+package archiver
+
+import (
+	"errors"
+)
+
+// Returned by TSDB.GetStatistics when the database cannot compute windowed
+// statistics for the given arguments. Callers should fall back to fetching the
+// readings with GetData and summarizing them with windowStatistics
+var ErrStatisticsUnsupported = errors.New("Timeseries database does not support windowed statistics for this query")
+
+// Folds @stat into the summary @into
+func (into *StatisticalNumberReading) merge(stat *StatisticalNumberReading) {
+	if stat.Count == 0 {
+		return
+	}
+	if into.Count == 0 || stat.Min < into.Min {
+		into.Min = stat.Min
+	}
+	if into.Count == 0 || stat.Max > into.Max {
+		into.Max = stat.Max
+	}
+	total := into.Count + stat.Count
+	into.Mean = into.Mean*(float64(into.Count)/float64(total)) + stat.Mean*(float64(stat.Count)/float64(total))
+	into.Count = total
+}
+
+// Groups @stats (summaries of smaller windows, sorted by time) into windows of
+// @window starting at @start. Anything outside of [start, end) is dropped, as
+// are windows without any readings. All times are in the same unit, and each
+// window is timestamped with its start.
+func mergeStatistics(stats []*StatisticalNumberReading, start, end, window uint64) []*StatisticalNumberReading {
+	var ret []*StatisticalNumberReading
+	if window == 0 {
+		return ret
+	}
+	var current *StatisticalNumberReading
+	for _, stat := range stats {
+		if stat.Time < start || stat.Time >= end {
+			continue
+		}
+		windowStart := start + (stat.Time-start)/window*window
+		if current == nil || current.Time != windowStart {
+			current = &StatisticalNumberReading{Time: windowStart}
+			ret = append(ret, current)
+		}
+		current.merge(stat)
+	}
+	return ret
+}
+
+// Summarizes @readings (sorted by time) into windows of @window starting at
+// @start. See mergeStatistics
+func windowStatistics(readings []*SmapNumberReading, start, end, window uint64) []*StatisticalNumberReading {
+	stats := make([]*StatisticalNumberReading, len(readings))
+	for i, rdg := range readings {
+		stats[i] = &StatisticalNumberReading{Time: rdg.Time, Count: 1, Min: rdg.Value, Mean: rdg.Value, Max: rdg.Value}
+	}
+	return mergeStatistics(stats, start, end, window)
+}
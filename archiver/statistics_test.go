@@ -0,0 +1,183 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestWindowStatistics(t *testing.T) {
+	readings := []*SmapNumberReading{
+		{Time: 5, Value: 1}, // before start
+		{Time: 10, Value: 2},
+		{Time: 12, Value: 4},
+		{Time: 19, Value: 6},
+		{Time: 31, Value: 3}, // the window at 20 has no readings
+		{Time: 40, Value: 5}, // at end
+	}
+	stats := windowStatistics(readings, 10, 40, 10)
+	if len(stats) != 2 {
+		t.Fatal("Got ", len(stats), " windows should be 2")
+	}
+	if s := stats[0]; s.Time != 10 || s.Count != 3 || s.Min != 2 || s.Mean != 4 || s.Max != 6 {
+		t.Error("Got ", *s, " should be {10 3 2 4 6}")
+	}
+	if s := stats[1]; s.Time != 30 || s.Count != 1 || s.Min != 3 || s.Mean != 3 || s.Max != 3 {
+		t.Error("Got ", *s, " should be {30 1 3 3 3}")
+	}
+}
+
+func TestMergeStatistics(t *testing.T) {
+	stats := []*StatisticalNumberReading{
+		{Time: 0, Count: 1, Min: 1, Mean: 1, Max: 1},
+		{Time: 4, Count: 3, Min: 0, Mean: 5, Max: 9},
+		{Time: 8, Count: 0},
+		{Time: 12, Count: 2, Min: 2, Mean: 2, Max: 2},
+	}
+	merged := mergeStatistics(stats, 0, 16, 8)
+	if len(merged) != 2 {
+		t.Fatal("Got ", len(merged), " windows should be 2")
+	}
+	if s := merged[0]; s.Time != 0 || s.Count != 4 || s.Min != 0 || s.Mean != 4 || s.Max != 9 {
+		t.Error("Got ", *s, " should be {0 4 0 4 9}")
+	}
+	if s := merged[1]; s.Time != 8 || s.Count != 2 || s.Mean != 2 {
+		t.Error("Got ", *s, " should be {8 2 2 2 2}")
+	}
+}
+
+func TestQuasarPointWidth(t *testing.T) {
+	for _, test := range []struct {
+		window uint64
+		pw     uint8
+	}{
+		{0, 0},
+		{1 << 10, 0},
+		{1 << 11, 1},
+		{3 << 20, 12},
+		// 5 minutes, an hour and a day
+		{300e9, 29},
+		{3600e9, 32},
+		{86400e9, 37},
+	} {
+		pw := quasarPointWidth(test.window)
+		if pw != test.pw || (test.window > 0 && test.window>>pw > quasarMaxSubWindows) {
+			t.Error("Got ", pw, " for ", test.window, " should be ", test.pw)
+		}
+	}
+}
+
+// the readings of @readings in [start, end)
+func readingsBetween(readings []*SmapNumberReading, start, end uint64) []*SmapNumberReading {
+	from := sort.Search(len(readings), func(i int) bool { return readings[i].Time >= start })
+	to := sort.Search(len(readings), func(i int) bool { return readings[i].Time >= end })
+	return readings[from:to]
+}
+
+func TestQuasarAssembleStatistics(t *testing.T) {
+	// a reading every 7 minutes or so for a year, windowed by 15 minutes
+	// starting at now -1y, which is not aligned to anything
+	now := uint64(time.Now().UnixNano())
+	start, end, window := now-uint64(365*24*time.Hour), now, uint64(15*time.Minute)
+	random := rand.New(rand.NewSource(1))
+	var readings []*SmapNumberReading
+	for t := start - uint64(time.Hour); t < end+uint64(time.Hour); t += uint64(7*time.Minute) + uint64(random.Int63n(int64(time.Minute))) {
+		readings = append(readings, &SmapNumberReading{Time: t, Value: float64(random.Intn(1000))})
+	}
+
+	pw := quasarPointWidth(window)
+	alignedStart, alignedEnd := quasarAlignedRange(start, end, pw)
+	// what Quasar returns for the aligned range
+	records := windowStatistics(readingsBetween(readings, alignedStart, alignedEnd), alignedStart, alignedEnd, 1<<pw)
+	fetched, calls, queried := 0, 0, 0
+	stats, err := quasarAssembleStatistics(records, pw, start, end, window, func(ranges []quasarRange) ([][]*SmapNumberReading, error) {
+		calls += 1
+		queried += len(ranges)
+		if len(ranges) > quasarRawBatchRanges {
+			t.Error("Got ", len(ranges), " ranges at once, should be at most ", quasarRawBatchRanges)
+		}
+		ret := make([][]*SmapNumberReading, len(ranges))
+		for i, r := range ranges {
+			ret[i] = readingsBetween(readings, r.start, r.end)
+			fetched += len(ret[i])
+		}
+		return ret, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := windowStatistics(readingsBetween(readings, start, end), start, end, window)
+	if len(stats) != len(expected) {
+		t.Fatal("Got ", len(stats), " windows should be ", len(expected))
+	}
+	for i, s := range stats {
+		e := expected[i]
+		if s.Time != e.Time || s.Count != e.Count || s.Min != e.Min || s.Max != e.Max || math.Abs(s.Mean-e.Mean) > 1e-6 {
+			t.Error("Got ", *s, " should be ", *e)
+			break
+		}
+	}
+	if fetched*quasarMaxSubWindows/4 > len(readings) {
+		t.Error("Fetched ", fetched, " of ", len(readings), " readings, should only fetch the edges of the windows")
+	}
+	if expectedCalls := (queried + quasarRawBatchRanges - 1) / quasarRawBatchRanges; calls != expectedCalls {
+		t.Error("Fetched the raw readings in ", calls, " calls, should be ", expectedCalls)
+	}
+
+	// too short a range for any of Quasar's windows
+	short, _ := quasarAssembleStatistics(nil, pw, start, start+10, window, func(ranges []quasarRange) ([][]*SmapNumberReading, error) {
+		return [][]*SmapNumberReading{{{Time: ranges[0].start, Value: 3}}}, nil
+	})
+	if len(short) != 1 || short[0].Count != 1 || short[0].Mean != 3 {
+		t.Error("Got ", short, " should be the raw reading")
+	}
+}
+
+func TestMemoryDBGetStatistics(t *testing.T) {
+	mem := newTestMemoryDB(UOT_S, "a", 1, 2, 3, 11, 25)
+	res, err := mem.GetStatistics([]string{"a"}, 0, 20, 10, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].UUID != "a" || len(res[0].Readings) != 2 {
+		t.Fatal("Got ", res, " should have 2 windows for a")
+	}
+	if s := res[0].Readings[0]; s.Time != 0 || s.Count != 3 || s.Mean != 2 {
+		t.Error("Got ", *s, " should be {0 3 1 2 3}")
+	}
+	if s := res[0].Readings[1]; s.Time != 10 || s.Count != 1 || s.Mean != 11 {
+		t.Error("Got ", *s, " should be {10 1 11 11 11}")
+	}
+}
+
+func TestFileDBGetStatistics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	// more readings than fit in one segment
+	if !addToFileDB(fdb, "a", 1, 2, 3, 4, 5, 6, 7) {
+		t.Fatal("Could not add readings")
+	}
+	res, err := fdb.GetStatistics([]string{"a"}, 0, 8, 4, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0].Readings) != 2 {
+		t.Fatal("Got ", res, " should have 2 windows")
+	}
+	if s := res[0].Readings[0]; s.Time != 0 || s.Count != 3 || s.Min != 1 || s.Max != 3 {
+		t.Error("Got ", *s, " should be {0 3 1 2 3}")
+	}
+	if s := res[0].Readings[1]; s.Time != 4 || s.Count != 4 || s.Mean != 5.5 {
+		t.Error("Got ", *s, " should be {4 4 4 5.5 7}")
+	}
+}
@@ -19,12 +19,53 @@ func (c *counter) Mark() {
 	atomic.AddUint64(&c.Count, 1)
 }
 
+// Atomically adds @n to the count and returns the new count
+func (c *counter) Add(n uint64) uint64 {
+	return atomic.AddUint64(&c.Count, n)
+}
+
+// Atomically subtracts @n from the count
+func (c *counter) Sub(n uint64) {
+	atomic.AddUint64(&c.Count, ^(n - 1))
+}
+
+// Returns the current count without resetting it
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.Count)
+}
+
 func (c *counter) Reset() uint64 {
 	var returncount = atomic.LoadUint64(&c.Count)
 	atomic.StoreUint64(&c.Count, 0)
 	return returncount
 }
 
+// Returns the number of readings that have been accepted but not yet written
+// to the timeseries database
+func (a *Archiver) PendingWrites() uint64 {
+	return a.pendingwritescounter.Value()
+}
+
+// Returns the number of live, idle and failed connections to the timeseries
+// database
+func (a *Archiver) ConnectionStats() ConnectionStats {
+	return a.tsdb.LiveConnections()
+}
+
+// Returns the number of tags that did not follow a flagging schema but were
+// saved anyway
+func (a *Archiver) FlaggedTags() uint64 {
+	return a.flaggedcounter.Value()
+}
+
+// Returns the stats of the metadata store's caches, if it has any
+func (a *Archiver) CacheStats() []CacheStats {
+	if cr, ok := a.store.(CacheReporter); ok {
+		return cr.CacheStats()
+	}
+	return []CacheStats{}
+}
+
 /**
  * Prints status of the archiver:
  ** number of connected clients
@@ -32,12 +73,15 @@ func (c *counter) Reset() uint64 {
  ** connection status to database
  ** connection status to Mongo
  ** amount of incoming traffic since last call
+ ** number of readings waiting to be written to the database
  ** amount of api requests since last call
+ ** hits, misses and evictions of the metadata caches
 **/
 func (a *Archiver) status() {
-	log.Info("Repub clients:%d--Recv Adds:%d--Pend Write:%d--Live Conn:%d",
+	log.Info("Repub clients:%d--Recv Adds:%d--Pend Write:%d--Conns:%v--Caches:%v",
 		len(a.republisher.clients),
 		a.incomingcounter.Reset(),
-		a.pendingwritescounter.Reset(),
-		a.tsdb.LiveConnections())
+		a.pendingwritescounter.Value(),
+		a.tsdb.LiveConnections(),
+		a.CacheStats())
 }
@@ -3,6 +3,7 @@ package archiver
 import (
 	"fmt"
 	"math"
+	"sort"
 )
 
 /** Min Node **/
@@ -18,14 +19,17 @@ func NewMinNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	log.Error("new MIN node")
 	n = NewNode(msn, done)
 	n.Tags["out:datatype"] = SCALAR
-	n.Tags["out:structure"] = LIST
+	n.Tags["out:structure"] = LIST | GROUPED
 	n.Tags["in:datatype"] = SCALAR
-	n.Tags["in:structure"] = TIMESERIES
+	n.Tags["in:structure"] = TIMESERIES | GROUPED
 	return n
 }
 
 // arg0: list of SmapNumbersResponse to compute MIN of. Must be scalars
 func (msn *MinNode) Run(input interface{}) (interface{}, error) {
+	if groups, ok := input.([]TimeseriesGroup); ok {
+		return aggregateGroups(groups, "min"), nil
+	}
 	var (
 		err error
 		ok  bool
@@ -74,14 +78,17 @@ func NewMaxNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 
 	n = NewNode(msn, done)
 	n.Tags["out:datatype"] = SCALAR
-	n.Tags["out:structure"] = LIST
+	n.Tags["out:structure"] = LIST | GROUPED
 	n.Tags["in:datatype"] = SCALAR
-	n.Tags["in:structure"] = TIMESERIES
+	n.Tags["in:structure"] = TIMESERIES | GROUPED
 	return n
 }
 
 // arg0: list of SmapNumbersResponse to compute MIN of. Must be scalars
 func (msn *MaxNode) Run(input interface{}) (interface{}, error) {
+	if groups, ok := input.([]TimeseriesGroup); ok {
+		return aggregateGroups(groups, "max"), nil
+	}
 	var (
 		err error
 		ok  bool
@@ -121,13 +128,16 @@ func NewMeanNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	mn := &MeanNode{}
 	n = NewNode(mn, done)
 	n.Tags["out:datatype"] = SCALAR
-	n.Tags["out:structure"] = LIST
+	n.Tags["out:structure"] = LIST | GROUPED
 	n.Tags["in:datatype"] = SCALAR
-	n.Tags["in:structure"] = TIMESERIES
+	n.Tags["in:structure"] = TIMESERIES | GROUPED
 	return
 }
 
 func (mn *MeanNode) Run(input interface{}) (interface{}, error) {
+	if groups, ok := input.([]TimeseriesGroup); ok {
+		return aggregateGroups(groups, "mean"), nil
+	}
 	data, ok := input.([]SmapNumbersResponse)
 	var result = make([]*SmapItem, len(data))
 	if !ok {
@@ -162,13 +172,16 @@ func NewCountNode(done <-chan struct{}, args ...interface{}) (n *Node) {
 	cn := &CountNode{}
 	n = NewNode(cn, done)
 	n.Tags["out:datatype"] = SCALAR
-	n.Tags["out:structure"] = LIST
+	n.Tags["out:structure"] = LIST | GROUPED
 	n.Tags["in:datatype"] = SCALAR
-	n.Tags["in:structure"] = TIMESERIES
+	n.Tags["in:structure"] = TIMESERIES | GROUPED
 	return
 }
 
 func (cn *CountNode) Run(input interface{}) (interface{}, error) {
+	if groups, ok := input.([]TimeseriesGroup); ok {
+		return aggregateGroups(groups, "count"), nil
+	}
 	list, ok := input.([]SmapNumbersResponse)
 	if !ok {
 		return -1, fmt.Errorf("Input was not []SmapNumbersResponse")
@@ -179,3 +192,32 @@ func (cn *CountNode) Run(input interface{}) (interface{}, error) {
 	}
 	return result, nil
 }
+
+// Combines the streams of each group into one series whose reading at each
+// timestamp is the @stat (see opFuncChooser) of the readings of the streams
+// in the group at that time
+func aggregateGroups(groups []TimeseriesGroup, stat string) []TimeseriesGroup {
+	aggregate := opFuncChooser[stat]
+	var result = make([]TimeseriesGroup, len(groups))
+	for idx, group := range groups {
+		var (
+			times  []uint64
+			byTime = make(map[uint64][][]interface{})
+		)
+		for _, stream := range group.Streams {
+			for _, reading := range stream.Readings {
+				if _, found := byTime[reading.Time]; !found {
+					times = append(times, reading.Time)
+				}
+				byTime[reading.Time] = append(byTime[reading.Time], []interface{}{reading.Time, reading.Value})
+			}
+		}
+		sort.Sort(uint64s(times))
+		series := SmapNumbersResponse{Readings: make([]*SmapNumberReading, len(times))}
+		for i, time := range times {
+			series.Readings[i] = &SmapNumberReading{Time: time, Value: aggregate(byTime[time])}
+		}
+		result[idx] = TimeseriesGroup{Value: group.Value, Streams: []SmapNumbersResponse{series}}
+	}
+	return result
+}
@@ -60,6 +60,78 @@ func parseAbsTime(num, units string) (time.Time, error) {
 	return d, err
 }
 
+// A time in a query. Calendar anchors like today, and dates without an
+// offset, are in the time zone of the query, which is only given after them
+// (at timezone "America/Los_Angeles"), so they are resolved once it is known
+type timeRef func(loc *time.Location) time.Time
+
+// a time that is the same in every time zone
+func fixedTime(t time.Time) timeRef {
+	return func(*time.Location) time.Time {
+		return t
+	}
+}
+
+// A relative time in a query. Days are calendar days, so that a day across a
+// change to or from daylight saving time is 23 or 25 hours long and midnight
+// stays midnight
+type timeOffset struct {
+	days     int
+	duration time.Duration
+}
+
+// Returns @t moved by the offset, counting days in the location of @t
+func (to timeOffset) addTo(t time.Time) time.Time {
+	return t.AddDate(0, 0, to.days).Add(to.duration)
+}
+
+func parseTimeOffset(num, units string) (timeOffset, error) {
+	switch units {
+	case "d", "day", "days":
+		days, err := strconv.Atoi(num)
+		return timeOffset{days: days}, err
+	}
+	d, err := parseReltime(num, units)
+	return timeOffset{duration: d}, err
+}
+
+func addTimeOffsets(o1, o2 timeOffset) timeOffset {
+	return timeOffset{days: o1.days + o2.days, duration: addDurations(o1.duration, o2.duration)}
+}
+
+func isCalendarUnit(unit string) bool {
+	switch unit {
+	case "day", "week", "month", "year":
+		return true
+	}
+	return false
+}
+
+// Returns the start of the day, week (which starts on Monday), month or year
+// that @t is in, in the location of @t
+func startOf(t time.Time, unit string) time.Time {
+	year, month, day := t.Date()
+	switch unit {
+	case "week":
+		day -= (int(t.Weekday()) + 6) % 7
+	case "month":
+		day = 1
+	case "year":
+		month, day = time.January, 1
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// Returns the first of supported_formats that parses @value
+func findTimeFormat(value string) (string, bool) {
+	for _, format := range supported_formats {
+		if _, err := time.Parse(format, value); err == nil {
+			return format, true
+		}
+	}
+	return "", false
+}
+
 /**
 Takes 2 durations and returns the result of them added together
 */
@@ -114,8 +186,10 @@ func parseTimeUnit(units string) (time.Duration, error) {
 		return time.Millisecond, nil
 	case "ns", "nsec", "nanosecond", "nanoseconds":
 		return time.Nanosecond, nil
+	case "d", "day", "days":
+		return 24 * time.Hour, nil
 	default:
-		return time.Second, fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns", units)
+		return time.Second, fmt.Errorf("Invalid unit %v. Must be h,m,s,us,ms,ns,d", units)
 	}
 }
 
@@ -1,7 +1,9 @@
 package archiver
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 )
@@ -99,3 +101,103 @@ func TestParseDuration(t *testing.T) {
 		t.Error("-5m gave", duration, "but should be", shouldbe)
 	}
 }
+
+func mustParseTime(t *testing.T, value string) time.Time {
+	ret, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ret
+}
+
+func TestParseTimeRefs(t *testing.T) {
+	for _, test := range []struct {
+		query      string
+		start, end string
+	}{
+		// without a time zone, times are in UTC as before
+		{`select data in ("2026-03-08", "2026-03-09") where has uuid;`, "2026-03-08T00:00:00Z", "2026-03-09T00:00:00Z"},
+		// the day daylight saving time starts is 23 hours long
+		{`select data in ("2026-03-08", "2026-03-09") at timezone "America/Los_Angeles" where has uuid;`, "2026-03-08T08:00:00Z", "2026-03-09T07:00:00Z"},
+		{`select data in ("2026-03-08T00:00:00-05:00", "2026-03-08 12:00:00") at timezone "America/Los_Angeles" where has uuid;`, "2026-03-08T05:00:00Z", "2026-03-08T19:00:00Z"},
+		{`select data in ("2026-03-08T01:30:00Z", 1772933400) where has uuid;`, "2026-03-08T01:30:00Z", "2026-03-08T01:30:00Z"},
+		// days are calendar days, so midnight stays midnight, but hours are hours
+		{`select data in ("2026-03-09" -1d, "2026-03-09" -1d 12h) at timezone "America/Los_Angeles" where has uuid;`, "2026-03-08T08:00:00Z", "2026-03-08T20:00:00Z"},
+		{`delete data in ("2026-11-01", "2026-11-02") at timezone "America/Los_Angeles" where has uuid;`, "2026-11-01T07:00:00Z", "2026-11-02T08:00:00Z"},
+	} {
+		q := parseQuery(t, test.query)
+		if start := mustParseTime(t, test.start); !q.data.start.Equal(start) {
+			t.Error(test.query, ": got start ", q.data.start, " should be ", start)
+		}
+		if end := mustParseTime(t, test.end); !q.data.end.Equal(end) {
+			t.Error(test.query, ": got end ", q.data.end, " should be ", end)
+		}
+	}
+
+	q := parseQuery(t, `select * where has uuid as of "2026-01-01" at timezone "Asia/Tokyo";`)
+	if asof := mustParseTime(t, "2025-12-31T15:00:00Z"); !q.asof.Equal(asof) {
+		t.Error("Got ", q.asof, " should be ", asof)
+	}
+
+	for _, bad := range []string{
+		`select data in ("2026-03-08", now) at timezone "Mars/Olympus_Mons" where has uuid;`,
+		`select data in (start of fortnight, now) where has uuid;`,
+	} {
+		l := NewSQLex(bad)
+		SQParse(l)
+		if l.error == nil {
+			t.Error(bad, " should not parse")
+		}
+	}
+}
+
+func TestCalendarAnchors(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		anchor string
+		check  func(time.Time) bool
+	}{
+		{"today", func(ts time.Time) bool { return ts.YearDay() == time.Now().In(la).YearDay() }},
+		{"yesterday", func(ts time.Time) bool { return ts.AddDate(0, 0, 1).YearDay() == time.Now().In(la).YearDay() }},
+		{"start of day", func(ts time.Time) bool { return ts.YearDay() == time.Now().In(la).YearDay() }},
+		{"start of week", func(ts time.Time) bool { return ts.Weekday() == time.Monday }},
+		{"start of month", func(ts time.Time) bool { return ts.Day() == 1 }},
+		{"start of year", func(ts time.Time) bool { return ts.YearDay() == 1 }},
+	} {
+		q := parseQuery(t, `select data before `+test.anchor+` at timezone "America/Los_Angeles" where has uuid;`)
+		start := q.data.start.In(la)
+		if start.Hour() != 0 || start.Minute() != 0 || !test.check(start) || start.After(time.Now()) {
+			t.Error(test.anchor, ": got ", start)
+		}
+	}
+}
+
+func TestTimeKeywordsInTags(t *testing.T) {
+	for _, tag := range []string{"atrium", "start_time", "timezone_name", "today_max", "yesterdays", "total"} {
+		q := parseQuery(t, `select * where `+tag+` = "x";`)
+		if where := fmt.Sprintf("%v", q.where); !strings.Contains(where, tag) {
+			t.Error("Got ", where, " should be about ", tag)
+		}
+	}
+}
+
+func TestStartOf(t *testing.T) {
+	ts := mustParseTime(t, "2026-03-11T15:04:05Z") // a Wednesday
+	for unit, start := range map[string]string{
+		"day":   "2026-03-11T00:00:00Z",
+		"week":  "2026-03-09T00:00:00Z",
+		"month": "2026-03-01T00:00:00Z",
+		"year":  "2026-01-01T00:00:00Z",
+	} {
+		if got := startOf(ts, unit); !got.Equal(mustParseTime(t, start)) {
+			t.Error("Start of ", unit, " is ", got, " should be ", start)
+		}
+	}
+	// Sundays are the end of the week
+	if got := startOf(mustParseTime(t, "2026-03-15T10:00:00Z"), "week"); !got.Equal(mustParseTime(t, "2026-03-09T00:00:00Z")) {
+		t.Error("Got ", got, " should be Monday 2026-03-09")
+	}
+}
@@ -0,0 +1,665 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileDB is a single-node, file-backed implementation of the TSDB interface
+// for deployments that do not want to operate Quasar.
+//
+// Each stream gets its own directory under the root path. Readings are
+// appended to numbered segment files (00000001.seg, 00000002.seg, ...) as
+// fixed-size records of (time in nanoseconds, value, crc32). Once a segment
+// holds segmentSize readings it is sealed and its time range is recorded in
+// the stream's index file, so reads only have to open the segments that
+// overlap the requested range. The index is rewritten atomically, and only
+// the last (active) segment is ever appended to, so recovering from a crash
+// means truncating a torn record off the end of the active segment.
+type FileDB struct {
+	root        string
+	segmentSize int
+	store       MetadataStore
+	streams     map[string]*fileStream
+	sync.Mutex
+}
+
+const (
+	fileRecordSize       = 20 // int64 time, float64 value, uint32 crc
+	fileIndexEntrySize   = 32 // uint64 seq, mintime, maxtime, count
+	fileIndexName        = "index"
+	DEFAULT_SEGMENT_SIZE = 65536 // num readings
+)
+
+// time range covered by a segment file
+type segmentInfo struct {
+	seq     uint64
+	minTime uint64
+	maxTime uint64
+	count   uint64
+}
+
+func (si *segmentInfo) add(time uint64) {
+	if si.count == 0 || time < si.minTime {
+		si.minTime = time
+	}
+	if si.count == 0 || time > si.maxTime {
+		si.maxTime = time
+	}
+	si.count += 1
+}
+
+// true if the segment could hold readings in [start, end]
+func (si segmentInfo) overlaps(start, end uint64) bool {
+	return si.count > 0 && si.minTime <= end && si.maxTime >= start
+}
+
+type fileStream struct {
+	dir      string
+	segments []segmentInfo
+	active   segmentInfo
+	sync.RWMutex
+}
+
+func NewFileDB(root string, segmentSize int) *FileDB {
+	log.Notice("Using file-backed timeseries database at %v", root)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		log.Critical("Could not create timeseries directory %v (%v)", root, err)
+		return nil
+	}
+	if segmentSize <= 0 {
+		segmentSize = DEFAULT_SEGMENT_SIZE
+	}
+	return &FileDB{root: root, segmentSize: segmentSize, streams: make(map[string]*fileStream)}
+}
+
+func (fdb *FileDB) GetConnection() (net.Conn, error) {
+	return nil, nil
+}
+
+func (fdb *FileDB) AddStore(s MetadataStore) {
+	fdb.store = s
+}
+
+func (fdb *FileDB) LiveConnections() ConnectionStats {
+	return ConnectionStats{}
+}
+
+// Returns the stream for the given uuid, loading its index and recovering
+// its active segment from disk the first time it is used. Unless @create is
+// set, a stream with nothing on disk is nil and is not remembered, so that
+// reading streams that were never written does not create anything.
+func (fdb *FileDB) getStream(uuid string, create bool) (*fileStream, error) {
+	if uuid == "" || uuid == "." || uuid == ".." || strings.ContainsAny(uuid, "/\\") {
+		return nil, fmt.Errorf("Invalid uuid for file storage: %v", uuid)
+	}
+	fdb.Lock()
+	defer fdb.Unlock()
+	if fs, found := fdb.streams[uuid]; found {
+		return fs, nil
+	}
+	fs := &fileStream{dir: filepath.Join(fdb.root, uuid)}
+	if create {
+		if err := os.MkdirAll(fs.dir, 0755); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(fs.dir); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := fs.load(); err != nil {
+		return nil, err
+	}
+	fdb.streams[uuid] = fs
+	return fs, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%08d.seg", seq)
+}
+
+func encodeRecord(buf []byte, time uint64, value float64) {
+	binary.BigEndian.PutUint64(buf[0:8], time)
+	binary.BigEndian.PutUint64(buf[8:16], math.Float64bits(value))
+	binary.BigEndian.PutUint32(buf[16:20], crc32.ChecksumIEEE(buf[0:16]))
+}
+
+// Decodes as many valid records as it can from @buf, calling @f on each. Returns
+// the number of bytes that held valid records
+func decodeRecords(buf []byte, f func(time uint64, value float64)) int {
+	offset := 0
+	for offset+fileRecordSize <= len(buf) {
+		rec := buf[offset : offset+fileRecordSize]
+		if binary.BigEndian.Uint32(rec[16:20]) != crc32.ChecksumIEEE(rec[0:16]) {
+			break
+		}
+		f(binary.BigEndian.Uint64(rec[0:8]), math.Float64frombits(binary.BigEndian.Uint64(rec[8:16])))
+		offset += fileRecordSize
+	}
+	return offset
+}
+
+// Reads the index of sealed segments and recovers the active segment
+func (fs *fileStream) load() error {
+	index, err := ioutil.ReadFile(filepath.Join(fs.dir, fileIndexName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for offset := 0; offset+fileIndexEntrySize <= len(index); offset += fileIndexEntrySize {
+		entry := index[offset : offset+fileIndexEntrySize]
+		fs.segments = append(fs.segments, segmentInfo{
+			seq:     binary.BigEndian.Uint64(entry[0:8]),
+			minTime: binary.BigEndian.Uint64(entry[8:16]),
+			maxTime: binary.BigEndian.Uint64(entry[16:24]),
+			count:   binary.BigEndian.Uint64(entry[24:32]),
+		})
+	}
+	fs.active = segmentInfo{seq: 1}
+	if len(fs.segments) > 0 {
+		fs.active.seq = fs.segments[len(fs.segments)-1].seq + 1
+	}
+	return fs.recoverActive()
+}
+
+// Scans the active segment to rebuild its time range. Anything after the last
+// valid record (e.g. a write torn by a crash) is truncated away.
+func (fs *fileStream) recoverActive() error {
+	filename := filepath.Join(fs.dir, segmentName(fs.active.seq))
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	valid := decodeRecords(contents, func(time uint64, value float64) {
+		fs.active.add(time)
+	})
+	if valid < len(contents) {
+		log.Warning("Truncating %v bytes of partial writes from %v", len(contents)-valid, filename)
+		return os.Truncate(filename, int64(valid))
+	}
+	return nil
+}
+
+// Atomically rewrites the index to include all sealed segments
+func (fs *fileStream) writeIndex() error {
+	var buf bytes.Buffer
+	entry := make([]byte, fileIndexEntrySize)
+	for _, si := range fs.segments {
+		binary.BigEndian.PutUint64(entry[0:8], si.seq)
+		binary.BigEndian.PutUint64(entry[8:16], si.minTime)
+		binary.BigEndian.PutUint64(entry[16:24], si.maxTime)
+		binary.BigEndian.PutUint64(entry[24:32], si.count)
+		buf.Write(entry)
+	}
+	tmp := filepath.Join(fs.dir, fileIndexName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = buf.WriteTo(f); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(fs.dir, fileIndexName))
+}
+
+// Appends the readings (in nanoseconds) to the active segment, sealing it
+// and starting a new one whenever it fills up
+func (fs *fileStream) append(readings []*SmapNumberReading, segmentSize int) error {
+	fs.Lock()
+	defer fs.Unlock()
+	for len(readings) > 0 {
+		room := segmentSize - int(fs.active.count)
+		if room <= 0 {
+			fs.segments = append(fs.segments, fs.active)
+			if err := fs.writeIndex(); err != nil {
+				fs.segments = fs.segments[:len(fs.segments)-1]
+				return err
+			}
+			fs.active = segmentInfo{seq: fs.active.seq + 1}
+			continue
+		}
+		if room > len(readings) {
+			room = len(readings)
+		}
+		batch := readings[:room]
+		readings = readings[room:]
+
+		buf := make([]byte, fileRecordSize*len(batch))
+		for i, rdg := range batch {
+			encodeRecord(buf[i*fileRecordSize:], rdg.Time, rdg.Value)
+		}
+		f, err := os.OpenFile(filepath.Join(fs.dir, segmentName(fs.active.seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(buf); err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			// drop whatever part of the batch made it to disk
+			fs.active = segmentInfo{seq: fs.active.seq}
+			if recoverErr := fs.recoverActive(); recoverErr != nil {
+				log.Error("Could not recover segment after failed write (%v)", recoverErr)
+			}
+			return err
+		}
+		for _, rdg := range batch {
+			fs.active.add(rdg.Time)
+		}
+	}
+	return nil
+}
+
+// the sealed segments followed by the active one, in the order they were written
+func (fs *fileStream) allSegments() []segmentInfo {
+	segments := make([]segmentInfo, len(fs.segments), len(fs.segments)+1)
+	copy(segments, fs.segments)
+	return append(segments, fs.active)
+}
+
+// Returns the readings of segment @si in [start, end], in the order they
+// were written
+func (fs *fileStream) readSegment(si segmentInfo, start, end uint64) ([]*SmapNumberReading, error) {
+	var readings []*SmapNumberReading
+	contents, err := ioutil.ReadFile(filepath.Join(fs.dir, segmentName(si.seq)))
+	if err != nil {
+		return readings, err
+	}
+	decodeRecords(contents, func(time uint64, value float64) {
+		if time >= start && time <= end {
+			readings = append(readings, &SmapNumberReading{Time: time, Value: value})
+		}
+	})
+	return readings, nil
+}
+
+// Puts the readings of segments, given in the order the segments were
+// written, in time order. If the same timestamp was written more than once,
+// the latest write wins.
+func mergeSegments(perSegment [][]*SmapNumberReading) []*SmapNumberReading {
+	var readings []*SmapNumberReading
+	for _, segment := range perSegment {
+		readings = append(readings, segment...)
+	}
+	sort.Stable(readingsByTime(readings))
+	deduped := readings[:0]
+	for i, rdg := range readings {
+		if i+1 < len(readings) && readings[i+1].Time == rdg.Time {
+			continue
+		}
+		deduped = append(deduped, rdg)
+	}
+	return deduped
+}
+
+// Returns all readings in the segments overlapping [start, end], in time
+// order.
+func (fs *fileStream) read(start, end uint64) ([]*SmapNumberReading, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	var perSegment [][]*SmapNumberReading
+	for _, si := range fs.allSegments() {
+		if !si.overlaps(start, end) {
+			continue
+		}
+		readings, err := fs.readSegment(si, start, end)
+		if err != nil {
+			return mergeSegments(perSegment), err
+		}
+		perSegment = append(perSegment, readings)
+	}
+	return mergeSegments(perSegment), nil
+}
+
+// Returns the last @limit readings at or before @end, in time order. The
+// segments are read starting with the one with the latest readings, and the
+// rest are skipped once they only hold readings older than the @limit found.
+func (fs *fileStream) readLast(end uint64, limit int) ([]*SmapNumberReading, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	if limit <= 0 {
+		return nil, nil
+	}
+	var candidates []segmentInfo
+	for _, si := range fs.allSegments() {
+		if si.overlaps(0, end) {
+			candidates = append(candidates, si)
+		}
+	}
+	sort.Sort(segmentsByLatest{candidates, end})
+	readings, err := fs.readUntil(candidates, 0, end, func(si segmentInfo, readings []*SmapNumberReading) bool {
+		return len(readings) >= limit && si.latest(end) < readings[len(readings)-limit].Time
+	})
+	if len(readings) > limit {
+		readings = readings[len(readings)-limit:]
+	}
+	return readings, err
+}
+
+// Returns the first @limit readings at or after @start, in time order, reading
+// the segments starting with the one with the earliest readings like readLast
+func (fs *fileStream) readFirst(start uint64, limit int) ([]*SmapNumberReading, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	if limit <= 0 {
+		return nil, nil
+	}
+	var candidates []segmentInfo
+	for _, si := range fs.allSegments() {
+		if si.overlaps(start, math.MaxUint64) {
+			candidates = append(candidates, si)
+		}
+	}
+	sort.Sort(segmentsByEarliest{candidates, start})
+	readings, err := fs.readUntil(candidates, start, math.MaxUint64, func(si segmentInfo, readings []*SmapNumberReading) bool {
+		return len(readings) >= limit && si.earliest(start) > readings[limit-1].Time
+	})
+	if len(readings) > limit {
+		readings = readings[:limit]
+	}
+	return readings, err
+}
+
+// Reads the readings in [start, end] of the @candidates segments in turn until
+// @enough says the next segment cannot change the result, and returns them in
+// time order
+func (fs *fileStream) readUntil(candidates []segmentInfo, start, end uint64, enough func(segmentInfo, []*SmapNumberReading) bool) ([]*SmapNumberReading, error) {
+	var (
+		read     = make(map[uint64][]*SmapNumberReading)
+		readings []*SmapNumberReading
+	)
+	for _, si := range candidates {
+		if enough(si, readings) {
+			break
+		}
+		segment, err := fs.readSegment(si, start, end)
+		if err != nil {
+			return nil, err
+		}
+		read[si.seq] = segment
+		// the latest write of a timestamp wins, so merge in the order of writing
+		var perSegment [][]*SmapNumberReading
+		for _, written := range fs.allSegments() {
+			if segment, found := read[written.seq]; found {
+				perSegment = append(perSegment, segment)
+			}
+		}
+		readings = mergeSegments(perSegment)
+	}
+	return readings, nil
+}
+
+// the time of the latest reading of the segment at or before @end
+func (si segmentInfo) latest(end uint64) uint64 {
+	if si.maxTime > end {
+		return end
+	}
+	return si.maxTime
+}
+
+// sorts segments by their latest reading at or before end, latest first
+type segmentsByLatest struct {
+	segments []segmentInfo
+	end      uint64
+}
+
+func (s segmentsByLatest) Len() int      { return len(s.segments) }
+func (s segmentsByLatest) Swap(i, j int) { s.segments[i], s.segments[j] = s.segments[j], s.segments[i] }
+func (s segmentsByLatest) Less(i, j int) bool {
+	return s.segments[i].latest(s.end) > s.segments[j].latest(s.end)
+}
+
+// the time of the earliest reading of the segment at or after @start
+func (si segmentInfo) earliest(start uint64) uint64 {
+	if si.minTime < start {
+		return start
+	}
+	return si.minTime
+}
+
+// sorts segments by their earliest reading at or after start, earliest first
+type segmentsByEarliest struct {
+	segments []segmentInfo
+	start    uint64
+}
+
+func (s segmentsByEarliest) Len() int { return len(s.segments) }
+func (s segmentsByEarliest) Swap(i, j int) {
+	s.segments[i], s.segments[j] = s.segments[j], s.segments[i]
+}
+func (s segmentsByEarliest) Less(i, j int) bool {
+	return s.segments[i].earliest(s.start) < s.segments[j].earliest(s.start)
+}
+
+// Removes the readings in [start, end) (nanoseconds, start < end). Each
+// segment that holds any of them is rewritten without them and atomically
+// replaced, and the index is rewritten afterwards, so a crash can at worst
+// leave the index with a time range that is wider than the segment's. A
+// sealed segment that ends up empty stays in the index with a count of 0 so
+// that the numbering of the active segment does not change.
+func (fs *fileStream) remove(start, end uint64) error {
+	fs.Lock()
+	defer fs.Unlock()
+	sealedChanged := false
+	for i, si := range fs.segments {
+		if !si.overlaps(start, end-1) {
+			continue
+		}
+		kept, err := fs.rewriteSegment(si.seq, start, end)
+		if err != nil {
+			return err
+		}
+		fs.segments[i] = kept
+		sealedChanged = true
+	}
+	if sealedChanged {
+		if err := fs.writeIndex(); err != nil {
+			return err
+		}
+	}
+	if fs.active.overlaps(start, end-1) {
+		kept, err := fs.rewriteSegment(fs.active.seq, start, end)
+		if err != nil {
+			return err
+		}
+		fs.active = kept
+	}
+	return nil
+}
+
+// Rewrites segment @seq without the readings in [start, end). Returns the
+// time range of what is left
+func (fs *fileStream) rewriteSegment(seq, start, end uint64) (segmentInfo, error) {
+	kept := segmentInfo{seq: seq}
+	filename := filepath.Join(fs.dir, segmentName(seq))
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return kept, err
+	}
+	buf := make([]byte, 0, len(contents))
+	rec := make([]byte, fileRecordSize)
+	decodeRecords(contents, func(time uint64, value float64) {
+		if time >= start && time < end {
+			return
+		}
+		encodeRecord(rec, time, value)
+		buf = append(buf, rec...)
+		kept.add(time)
+	})
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return kept, err
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return kept, err
+	}
+	return kept, os.Rename(tmp, filename)
+}
+
+type readingsByTime []*SmapNumberReading
+
+func (r readingsByTime) Len() int           { return len(r) }
+func (r readingsByTime) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r readingsByTime) Less(i, j int) bool { return r[i].Time < r[j].Time }
+
+func (fdb *FileDB) Add(sb *StreamBuf) bool {
+	if sb.idx == 0 {
+		return false
+	}
+	fs, err := fdb.getStream(sb.uuid, true)
+	if err != nil {
+		log.Error("Error opening stream %v (%v)", sb.uuid, err)
+		return false
+	}
+	readings := make([]*SmapNumberReading, sb.idx)
+	for i, val := range sb.readings[:sb.idx] {
+		readings[i] = &SmapNumberReading{Time: convertTime(val.Time, sb.unitOfTime, UOT_NS), Value: val.Value}
+	}
+	if err = fs.append(readings, fdb.segmentSize); err != nil {
+		log.Error("Error writing to stream %v (%v)", sb.uuid, err)
+		return false
+	}
+	return true
+}
+
+// Fetches readings in [start, end] (nanoseconds) for each uuid, then lets @pick
+// choose the slice to return before the times are converted to the stream's
+// unit of time
+func (fdb *FileDB) query(uuids []string, start, end uint64, pick func([]*SmapNumberReading) []*SmapNumberReading) ([]SmapNumbersResponse, error) {
+	return fdb.fetch(uuids, func(fs *fileStream) ([]*SmapNumberReading, error) {
+		readings, err := fs.read(start, end)
+		return pick(readings), err
+	})
+}
+
+// Fetches the readings of each uuid with @read and converts their times from
+// nanoseconds to the stream's unit of time. Streams that were never written
+// have no readings
+func (fdb *FileDB) fetch(uuids []string, read func(*fileStream) ([]*SmapNumberReading, error)) ([]SmapNumbersResponse, error) {
+	var ret = make([]SmapNumbersResponse, len(uuids))
+	for i, uu := range uuids {
+		ret[i] = SmapNumbersResponse{UUID: uu}
+		fs, err := fdb.getStream(uu, false)
+		if err != nil {
+			return ret, err
+		} else if fs == nil {
+			continue
+		}
+		readings, err := read(fs)
+		if err != nil {
+			return ret, err
+		}
+		stream_uot := fdb.store.GetUnitOfTime(uu)
+		for _, rdg := range readings {
+			rdg.Time = convertTime(rdg.Time, UOT_NS, stream_uot)
+		}
+		ret[i] = SmapNumbersResponse{UUID: uu, Readings: readings}
+	}
+	return ret, nil
+}
+
+// Like Quasar's nearest value query, a negative limit returns the single
+// nearest reading. Otherwise returns up to @limit readings, in time order.
+func (fdb *FileDB) Prev(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, UOT_NS)
+	if limit < 0 {
+		limit = 1
+	}
+	return fdb.fetch(uuids, func(fs *fileStream) ([]*SmapNumberReading, error) {
+		return fs.readLast(start, int(limit))
+	})
+}
+
+func (fdb *FileDB) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, UOT_NS)
+	if limit < 0 {
+		limit = 1
+	}
+	return fdb.fetch(uuids, func(fs *fileStream) ([]*SmapNumberReading, error) {
+		return fs.readFirst(start, int(limit))
+	})
+}
+
+// Returns all readings in [start, end)
+func (fdb *FileDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	return fdb.query(uuids, start, end, func(readings []*SmapNumberReading) []*SmapNumberReading {
+		if len(readings) > 0 && readings[len(readings)-1].Time == end {
+			return readings[:len(readings)-1]
+		}
+		return readings
+	})
+}
+
+// Summarizes the readings in [start, end) into windows of @window
+func (fdb *FileDB) GetStatistics(uuids []string, start uint64, end uint64, window uint64, uot UnitOfTime) ([]StatisticalNumbersResponse, error) {
+	var ret = make([]StatisticalNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	window = convertTime(window, uot, UOT_NS)
+	for i, uu := range uuids {
+		ret[i] = StatisticalNumbersResponse{UUID: uu}
+		fs, err := fdb.getStream(uu, false)
+		if err != nil {
+			return ret, err
+		} else if fs == nil {
+			continue
+		}
+		readings, err := fs.read(start, end)
+		if err != nil {
+			return ret, err
+		}
+		stats := windowStatistics(readings, start, end, window)
+		stream_uot := fdb.store.GetUnitOfTime(uu)
+		for _, stat := range stats {
+			stat.Time = convertTime(stat.Time, UOT_NS, stream_uot)
+		}
+		ret[i] = StatisticalNumbersResponse{UUID: uu, Readings: stats}
+	}
+	return ret, nil
+}
+
+// Removes all readings in [start, end)
+func (fdb *FileDB) DeleteData(uuids []string, start uint64, end uint64, uot UnitOfTime) error {
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	if end <= start {
+		return nil
+	}
+	for _, uu := range uuids {
+		fs, err := fdb.getStream(uu, false)
+		if err != nil {
+			return err
+		} else if fs == nil {
+			continue
+		}
+		if err = fs.remove(start, end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
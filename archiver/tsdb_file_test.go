@@ -0,0 +1,217 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestFileDB(t *testing.T, dir string) *FileDB {
+	fdb := NewFileDB(dir, 3)
+	if fdb == nil {
+		t.Fatal("Could not create FileDB in ", dir)
+	}
+	fdb.AddStore(uotStore{uot: UOT_S})
+	return fdb
+}
+
+func addToFileDB(fdb *FileDB, uuid string, times ...uint64) bool {
+	return fdb.Add(newTestStreamBuf(uuid, UOT_S, times...))
+}
+
+func TestFileDBSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	if !addToFileDB(fdb, "a", 7, 1, 2, 5, 3) || !addToFileDB(fdb, "a", 4, 6, 2) {
+		t.Fatal("Could not add readings")
+	}
+	// segment size is 3, so 8 readings fill 2 sealed segments + the active one
+	if _, err := os.Stat(filepath.Join(dir, "a", segmentName(3))); err != nil {
+		t.Error("Expected third segment to exist: ", err)
+	}
+
+	res, err := fdb.GetData([]string{"a"}, 2, 6, UOT_S)
+	if err != nil {
+		t.Error(err)
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2, 3, 4, 5}) {
+		t.Error("Got ", times, " should be [2 3 4 5]")
+	}
+
+	// reopening reads the sealed segments back through the index
+	fdb = newTestFileDB(t, dir)
+	res, _ = fdb.Prev([]string{"a"}, 6, 2, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{5, 6}) {
+		t.Error("Got ", times, " should be [5 6]")
+	}
+	res, _ = fdb.Next([]string{"a"}, 7, -1, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{7}) {
+		t.Error("Got ", times, " should be [7]")
+	}
+}
+
+func TestFileDBRecoverActiveSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	addToFileDB(fdb, "a", 1, 2, 3, 4)
+
+	// simulate a write torn by a crash
+	segment := filepath.Join(dir, "a", segmentName(2))
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5, 6, 7})
+	f.Close()
+
+	fdb = newTestFileDB(t, dir)
+	if !addToFileDB(fdb, "a", 5) {
+		t.Fatal("Could not add readings after recovery")
+	}
+	res, _ := fdb.GetData([]string{"a"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 2, 3, 4, 5}) {
+		t.Error("Got ", times, " should be [1 2 3 4 5]")
+	}
+	if info, _ := os.Stat(segment); info.Size() != 2*fileRecordSize {
+		t.Error("Segment is ", info.Size(), " bytes, should be ", 2*fileRecordSize)
+	}
+}
+
+func TestFileDBDeleteData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	// two sealed segments of 3 readings and an active one
+	if !addToFileDB(fdb, "a", 1, 2, 3, 4, 5, 6, 7, 8) {
+		t.Fatal("Could not add readings")
+	}
+	// empties the second segment and cuts into the first and the active one
+	if err := fdb.DeleteData([]string{"a"}, 3, 8, UOT_S); err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{1, 2, 8}
+	res, _ := fdb.GetData([]string{"a"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, expected) {
+		t.Error("Got ", times, " should be ", expected)
+	}
+	// new readings still go to the active segment
+	addToFileDB(fdb, "a", 9)
+	expected = append(expected, 9)
+
+	fdb = newTestFileDB(t, dir)
+	res, _ = fdb.GetData([]string{"a"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, expected) {
+		t.Error("Got ", times, " after reopening should be ", expected)
+	}
+}
+
+func TestFileDBPrevReadsFromTheEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	// segments [1 2 3] [4 5 6] [7 8 9], then 2 is rewritten in the active one
+	if !addToFileDB(fdb, "a", 1, 2, 3, 4, 5, 6, 7, 8, 9, 2) {
+		t.Fatal("Could not add readings")
+	}
+	res, _ := fdb.Prev([]string{"a"}, 4, 3, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2, 3, 4}) {
+		t.Error("Got ", times, " should be [2 3 4]")
+	}
+	// the first segment is not needed for the last 2 readings before 7
+	if err := os.Remove(filepath.Join(dir, "a", segmentName(1))); err != nil {
+		t.Fatal(err)
+	}
+	fdb = newTestFileDB(t, dir)
+	res, err = fdb.Prev([]string{"a"}, 7, 2, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{6, 7}) {
+		t.Error("Got ", times, " should be [6 7]")
+	}
+	// but it is for the last 2 readings before 4
+	if _, err = fdb.Prev([]string{"a"}, 4, 2, UOT_S); err == nil {
+		t.Error("Prev should have read the deleted segment")
+	}
+}
+
+func TestFileDBNextReadsFromTheStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	// segments [1 2 3] [4 5 6] [7 8 9], then 5 is rewritten in the active one
+	if !addToFileDB(fdb, "a", 1, 2, 3, 4, 5, 6, 7, 8, 9, 5) {
+		t.Fatal("Could not add readings")
+	}
+	res, _ := fdb.Next([]string{"a"}, 2, 3, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2, 3, 4}) {
+		t.Error("Got ", times, " should be [2 3 4]")
+	}
+	// the last sealed segment is not needed for the first 2 readings after 4
+	if err := os.Remove(filepath.Join(dir, "a", segmentName(3))); err != nil {
+		t.Fatal(err)
+	}
+	fdb = newTestFileDB(t, dir)
+	res, err = fdb.Next([]string{"a"}, 4, 2, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{4, 5}) {
+		t.Error("Got ", times, " should be [4 5]")
+	}
+	// but it is for the first 4 readings after 4
+	if _, err = fdb.Next([]string{"a"}, 4, 4, UOT_S); err == nil {
+		t.Error("Next should have read the deleted segment")
+	}
+}
+
+func TestFileDBReadsDoNotCreateStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fdb := newTestFileDB(t, dir)
+	if res, err := fdb.GetData([]string{"nothing"}, 0, 10, UOT_S); err != nil || len(res) != 1 || len(res[0].Readings) != 0 || res[0].UUID != "nothing" {
+		t.Error("Got ", res, err, " should be an empty response")
+	}
+	fdb.Prev([]string{"nothing"}, 10, 1, UOT_S)
+	fdb.GetStatistics([]string{"nothing"}, 0, 10, 5, UOT_S)
+	fdb.DeleteData([]string{"nothing"}, 0, 10, UOT_S)
+	if _, err := os.Stat(filepath.Join(dir, "nothing")); !os.IsNotExist(err) {
+		t.Error("Reading a stream should not create its directory")
+	}
+	if len(fdb.streams) != 0 {
+		t.Error("Got ", fdb.streams, " reading should not remember streams")
+	}
+	if !addToFileDB(fdb, "nothing", 1) {
+		t.Fatal("Could not add readings")
+	}
+	if res, _ := fdb.GetData([]string{"nothing"}, 0, 10, UOT_S); len(res[0].Readings) != 1 {
+		t.Error("Got ", res, " should have the reading")
+	}
+}
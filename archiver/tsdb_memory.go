@@ -0,0 +1,175 @@
+package archiver
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// MemoryDB is an in-process implementation of the TSDB interface. Readings
+// are kept in a sorted slice per UUID with timestamps in nanoseconds, which
+// is the same convention QuasarDB uses when talking to Quasar. Nothing is
+// persisted: this is meant for unit tests, demos and laptops where running
+// Quasar is overkill.
+type MemoryDB struct {
+	store   MetadataStore
+	streams map[string][]*SmapNumberReading
+	sync.RWMutex
+}
+
+func NewMemoryDB() *MemoryDB {
+	log.Notice("Using in-memory timeseries database")
+	return &MemoryDB{streams: make(map[string][]*SmapNumberReading)}
+}
+
+func (mem *MemoryDB) GetConnection() (net.Conn, error) {
+	return nil, nil
+}
+
+func (mem *MemoryDB) AddStore(s MetadataStore) {
+	mem.store = s
+}
+
+func (mem *MemoryDB) LiveConnections() ConnectionStats {
+	return ConnectionStats{}
+}
+
+// Inserts the buffered readings into the stream in time order. A reading
+// with the same timestamp as an existing one replaces it.
+func (mem *MemoryDB) Add(sb *StreamBuf) bool {
+	if sb.idx == 0 {
+		return false
+	}
+	mem.Lock()
+	defer mem.Unlock()
+	stream := mem.streams[sb.uuid]
+	for _, val := range sb.readings[:sb.idx] {
+		rdg := &SmapNumberReading{Time: convertTime(val.Time, sb.unitOfTime, UOT_NS), Value: val.Value}
+		i := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= rdg.Time })
+		if i < len(stream) && stream[i].Time == rdg.Time {
+			stream[i] = rdg
+			continue
+		}
+		stream = append(stream, nil)
+		copy(stream[i+1:], stream[i:])
+		stream[i] = rdg
+	}
+	mem.streams[sb.uuid] = stream
+	return true
+}
+
+// copies readings out of the store, converting from nanoseconds to the unit
+// of time of the stream
+func (mem *MemoryDB) toResponse(uuid string, readings []*SmapNumberReading) SmapNumbersResponse {
+	stream_uot := mem.store.GetUnitOfTime(uuid)
+	sr := SmapNumbersResponse{UUID: uuid, Readings: make([]*SmapNumberReading, len(readings))}
+	for i, rdg := range readings {
+		sr.Readings[i] = &SmapNumberReading{Time: convertTime(rdg.Time, UOT_NS, stream_uot), Value: rdg.Value}
+	}
+	return sr
+}
+
+// Like Quasar's nearest value query, a negative limit returns the single
+// nearest reading. Otherwise returns up to @limit readings, in time order.
+func (mem *MemoryDB) Prev(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	var ret = make([]SmapNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	if limit < 0 {
+		limit = 1
+	}
+	mem.RLock()
+	defer mem.RUnlock()
+	for i, uu := range uuids {
+		stream := mem.streams[uu]
+		// index of the first reading after start
+		end := sort.Search(len(stream), func(i int) bool { return stream[i].Time > start })
+		begin := end - int(limit)
+		if begin < 0 {
+			begin = 0
+		}
+		ret[i] = mem.toResponse(uu, stream[begin:end])
+	}
+	return ret, nil
+}
+
+func (mem *MemoryDB) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	var ret = make([]SmapNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	if limit < 0 {
+		limit = 1
+	}
+	mem.RLock()
+	defer mem.RUnlock()
+	for i, uu := range uuids {
+		stream := mem.streams[uu]
+		begin := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= start })
+		end := begin + int(limit)
+		if end > len(stream) {
+			end = len(stream)
+		}
+		ret[i] = mem.toResponse(uu, stream[begin:end])
+	}
+	return ret, nil
+}
+
+// Returns all readings in [start, end)
+func (mem *MemoryDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	var ret = make([]SmapNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	mem.RLock()
+	defer mem.RUnlock()
+	for i, uu := range uuids {
+		stream := mem.streams[uu]
+		begin := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= start })
+		finish := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= end })
+		if finish < begin {
+			finish = begin
+		}
+		ret[i] = mem.toResponse(uu, stream[begin:finish])
+	}
+	return ret, nil
+}
+
+// Summarizes the readings in [start, end) into windows of @window
+func (mem *MemoryDB) GetStatistics(uuids []string, start uint64, end uint64, window uint64, uot UnitOfTime) ([]StatisticalNumbersResponse, error) {
+	var ret = make([]StatisticalNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	window = convertTime(window, uot, UOT_NS)
+	mem.RLock()
+	defer mem.RUnlock()
+	for i, uu := range uuids {
+		stream := mem.streams[uu]
+		begin := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= start })
+		finish := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= end })
+		if finish < begin {
+			finish = begin
+		}
+		stats := windowStatistics(stream[begin:finish], start, end, window)
+		stream_uot := mem.store.GetUnitOfTime(uu)
+		for _, stat := range stats {
+			stat.Time = convertTime(stat.Time, UOT_NS, stream_uot)
+		}
+		ret[i] = StatisticalNumbersResponse{UUID: uu, Readings: stats}
+	}
+	return ret, nil
+}
+
+// Removes all readings in [start, end)
+func (mem *MemoryDB) DeleteData(uuids []string, start uint64, end uint64, uot UnitOfTime) error {
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	mem.Lock()
+	defer mem.Unlock()
+	for _, uu := range uuids {
+		stream := mem.streams[uu]
+		begin := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= start })
+		finish := sort.Search(len(stream), func(i int) bool { return stream[i].Time >= end })
+		if finish <= begin {
+			continue
+		}
+		mem.streams[uu] = append(stream[:begin], stream[finish:]...)
+	}
+	return nil
+}
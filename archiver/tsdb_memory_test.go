@@ -0,0 +1,119 @@
+package archiver
+
+import (
+	"testing"
+)
+
+// metadata store that only knows about units of time
+type uotStore struct {
+	MetadataStore
+	uot UnitOfTime
+}
+
+func (s uotStore) GetUnitOfTime(uuid string) UnitOfTime {
+	return s.uot
+}
+
+// a buffer of readings for @uuid at each of @times, with value = time
+func newTestStreamBuf(uuid string, uot UnitOfTime, times ...uint64) *StreamBuf {
+	sb := &StreamBuf{uuid: uuid, unitOfTime: uot}
+	for _, t := range times {
+		sb.readings = append(sb.readings, &SmapNumberReading{Time: t, Value: float64(t)})
+	}
+	sb.idx = len(sb.readings)
+	return sb
+}
+
+// a MemoryDB holding readings for @uuid at each of @times, with value = time
+func newTestMemoryDB(uot UnitOfTime, uuid string, times ...uint64) *MemoryDB {
+	mem := NewMemoryDB()
+	mem.AddStore(uotStore{uot: uot})
+	mem.Add(newTestStreamBuf(uuid, uot, times...))
+	return mem
+}
+
+func readingTimes(sr SmapNumbersResponse) []uint64 {
+	ret := make([]uint64, len(sr.Readings))
+	for i, rdg := range sr.Readings {
+		ret[i] = rdg.Time
+	}
+	return ret
+}
+
+func isUint64SliceEqual(x, y []uint64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for idx := range x {
+		if x[idx] != y[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryDBAddSorted(t *testing.T) {
+	mem := newTestMemoryDB(UOT_S, "a", 5, 1, 3)
+	// the later reading for a duplicate timestamp wins
+	sb := newTestStreamBuf("a", UOT_S, 3)
+	sb.readings[0].Value = 30
+	mem.Add(sb)
+	res, err := mem.GetData([]string{"a"}, 0, 10, UOT_S)
+	if err != nil {
+		t.Error(err)
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 3, 5}) {
+		t.Error("Got ", times, " should be [1 3 5]")
+	}
+	if res[0].Readings[1].Value != 30 {
+		t.Error("Got ", res[0].Readings[1].Value, " should be 30")
+	}
+}
+
+func TestMemoryDBGetData(t *testing.T) {
+	mem := newTestMemoryDB(UOT_MS, "a", 1000, 2000, 3000, 4000)
+
+	// end is exclusive
+	res, _ := mem.GetData([]string{"a"}, 2, 4, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2000, 3000}) {
+		t.Error("Got ", times, " should be [2000 3000]")
+	}
+
+	// unknown streams come back empty
+	res, _ = mem.GetData([]string{"a", "b"}, 0, 10, UOT_S)
+	if len(res) != 2 || res[1].UUID != "b" || len(res[1].Readings) != 0 {
+		t.Error("Got ", res, " should have empty response for b")
+	}
+}
+
+func TestMemoryDBPrevNext(t *testing.T) {
+	mem := newTestMemoryDB(UOT_S, "a", 1, 2, 3, 4)
+
+	res, _ := mem.Prev([]string{"a"}, 3, -1, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{3}) {
+		t.Error("Got ", times, " should be [3]")
+	}
+	res, _ = mem.Prev([]string{"a"}, 3500, 2, UOT_MS)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2, 3}) {
+		t.Error("Got ", times, " should be [2 3]")
+	}
+	res, _ = mem.Next([]string{"a"}, 2, -1, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2}) {
+		t.Error("Got ", times, " should be [2]")
+	}
+	res, _ = mem.Next([]string{"a"}, 2, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2, 3, 4}) {
+		t.Error("Got ", times, " should be [2 3 4]")
+	}
+}
+
+func TestMemoryDBDeleteData(t *testing.T) {
+	mem := newTestMemoryDB(UOT_S, "a", 1, 2, 3, 4, 5)
+	if err := mem.DeleteData([]string{"a"}, 2000, 4000, UOT_MS); err != nil {
+		t.Fatal(err)
+	}
+	res, _ := mem.GetData([]string{"a"}, 0, 10, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 4, 5}) {
+		t.Error("Got ", times, " should be [1 4 5]")
+	}
+}
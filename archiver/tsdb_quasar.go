@@ -9,6 +9,7 @@ import (
 	uuidlib "github.com/pborman/uuid"
 	"net"
 	"sync"
+	"time"
 )
 
 type QuasarDB struct {
@@ -25,7 +26,7 @@ type QuasarReading struct {
 	ins *qsr.CmdInsertValues
 }
 
-func NewQuasarDB(address *net.TCPAddr, maxConnections int) *QuasarDB {
+func NewQuasarDB(address *net.TCPAddr, maxConnections int, keepAlive time.Duration) *QuasarDB {
 	log.Notice("Connecting to Quasar at %v...", address.String())
 	quasar := &QuasarDB{addr: address,
 		packetpool: sync.Pool{
@@ -49,18 +50,18 @@ func NewQuasarDB(address *net.TCPAddr, maxConnections int) *QuasarDB {
 		},
 	}
 
-	quasar.connpool = NewConnectionPool(quasar.getConnection, maxConnections)
+	quasar.connpool = NewConnectionPool(quasar.getConnection, maxConnections, keepAlive)
 	return quasar
 }
 
-func (quasar *QuasarDB) getConnection() *TSDBConn {
+func (quasar *QuasarDB) getConnection() (*TSDBConn, error) {
 	conn, err := net.DialTCP("tcp", nil, quasar.addr)
 	if err != nil {
 		log.Error("Error getting connection to Quasar (%v)", err)
-		return nil
+		return nil, err
 	}
 	conn.SetKeepAlive(true)
-	return &TSDBConn{conn, false}
+	return NewTSDBConn(conn), nil
 }
 
 func (quasar *QuasarDB) GetConnection() (net.Conn, error) {
@@ -71,15 +72,19 @@ func (quasar *QuasarDB) AddStore(s MetadataStore) {
 	quasar.store = s
 }
 
-func (quasar *QuasarDB) LiveConnections() int {
-	return 0
+func (quasar *QuasarDB) LiveConnections() ConnectionStats {
+	return quasar.connpool.Stats()
 }
 
 func (quasar *QuasarDB) Add(sb *StreamBuf) bool {
 	if len(sb.readings) == 0 {
 		return false
 	}
-	conn := quasar.connpool.Get()
+	conn, err := quasar.connpool.Get()
+	if err != nil {
+		log.Error("Error writing to quasar %v", err)
+		return false
+	}
 	defer quasar.connpool.Put(conn)
 	uuid := uuidlib.Parse(sb.uuid)
 	qr := quasar.packetpool.Get().(QuasarReading)
@@ -98,9 +103,14 @@ func (quasar *QuasarDB) Add(sb *StreamBuf) bool {
 	}
 	qr.ins.SetValues(rl)
 	qr.req.SetInsertValues(*qr.ins)
-	qr.seg.WriteTo(conn)
-	_, err := quasar.receive(conn, -1)
-	if err != nil {
+	if _, err = qr.seg.WriteTo(conn); err != nil {
+		conn.Close()
+		log.Error("Error writing to quasar %v", err)
+		return false
+	}
+	// a rejected write is reported as not added, so that it stays in the
+	// write-ahead log
+	if err = quasar.receiveStatus(conn); err != nil {
 		log.Error("Error writing to quasar %v", err)
 		return false
 	}
@@ -121,7 +131,7 @@ func (quasar *QuasarDB) receive(conn *TSDBConn, limit int32) (SmapNumbersRespons
 	switch resp.Which() {
 	case qsr.RESPONSE_VOID:
 		if resp.StatusCode() != qsr.STATUSCODE_OK {
-			log.Error("Received error status code when writing: %v", resp.StatusCode())
+			return sr, errors.New("Error from Quasar: " + resp.StatusCode().String())
 		}
 	case qsr.RESPONSE_RECORDS:
 		if resp.StatusCode() != 0 {
@@ -145,7 +155,10 @@ func (quasar *QuasarDB) receive(conn *TSDBConn, limit int32) (SmapNumbersRespons
 
 func (quasar *QuasarDB) queryNearestValue(uuids []string, start uint64, limit int32, backwards bool) ([]SmapNumbersResponse, error) {
 	var ret = make([]SmapNumbersResponse, len(uuids))
-	conn := quasar.connpool.Get()
+	conn, err := quasar.connpool.Get()
+	if err != nil {
+		return ret, err
+	}
 	defer quasar.connpool.Put(conn)
 	for i, uu := range uuids {
 		stream_uot := quasar.store.GetUnitOfTime(uu)
@@ -159,6 +172,7 @@ func (quasar *QuasarDB) queryNearestValue(uuids []string, start uint64, limit in
 		req.SetQueryNearestValue(qnv)
 		_, err := seg.WriteTo(conn) // here, ignoring # bytes written
 		if err != nil {
+			conn.Close()
 			return ret, err
 		}
 		sr, err := quasar.receive(conn, limit)
@@ -184,31 +198,68 @@ func (quasar *QuasarDB) Next(uuids []string, start uint64, limit int32, uot Unit
 	return quasar.queryNearestValue(uuids, start, limit, false)
 }
 
+// Fetches the raw readings in [start, end) (nanoseconds) for a single stream
+func (quasar *QuasarDB) sendQueryStandardValues(conn *TSDBConn, uu string, start, end uint64) error {
+	seg := capn.NewBuffer(nil)
+	req := qsr.NewRootRequest(seg)
+	qnv := qsr.NewCmdQueryStandardValues(seg)
+	uuid := uuidlib.Parse(uu)
+	qnv.SetUuid([]byte(uuid))
+	qnv.SetStartTime(int64(start))
+	qnv.SetEndTime(int64(end))
+	req.SetQueryStandardValues(qnv)
+	_, err := seg.WriteTo(conn) // here, ignoring # bytes written
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func (quasar *QuasarDB) queryStandardValues(conn *TSDBConn, uu string, start, end uint64) (SmapNumbersResponse, error) {
+	if err := quasar.sendQueryStandardValues(conn, uu, start, end); err != nil {
+		return SmapNumbersResponse{}, err
+	}
+	sr, err := quasar.receive(conn, -1)
+	sr.UUID = uu
+	return sr, err
+}
+
+// Reads the readings of @uu in each of @ranges. All of the queries are sent
+// before any of the responses are read, so they take a single round trip.
+func (quasar *QuasarDB) queryStandardValueRanges(conn *TSDBConn, uu string, ranges []quasarRange) ([][]*SmapNumberReading, error) {
+	for _, r := range ranges {
+		if err := quasar.sendQueryStandardValues(conn, uu, r.start, r.end); err != nil {
+			return nil, err
+		}
+	}
+	ret := make([][]*SmapNumberReading, len(ranges))
+	for i := range ranges {
+		sr, err := quasar.receive(conn, -1)
+		if err != nil {
+			// the rest of the responses are still waiting to be read
+			conn.Close()
+			return nil, err
+		}
+		ret[i] = sr.Readings
+	}
+	return ret, nil
+}
+
 func (quasar *QuasarDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime) ([]SmapNumbersResponse, error) {
 	var ret = make([]SmapNumbersResponse, len(uuids))
 	start = convertTime(start, uot, UOT_NS)
 	end = convertTime(end, uot, UOT_NS)
-	conn := quasar.connpool.Get()
+	conn, err := quasar.connpool.Get()
+	if err != nil {
+		return ret, err
+	}
 	defer quasar.connpool.Put(conn)
 	for i, uu := range uuids {
 		stream_uot := quasar.store.GetUnitOfTime(uu)
-		seg := capn.NewBuffer(nil)
-		req := qsr.NewRootRequest(seg)
-		qnv := qsr.NewCmdQueryStandardValues(seg)
-		uuid := uuidlib.Parse(uu)
-		qnv.SetUuid([]byte(uuid))
-		qnv.SetStartTime(int64(start))
-		qnv.SetEndTime(int64(end))
-		req.SetQueryStandardValues(qnv)
-		_, err := seg.WriteTo(conn) // here, ignoring # bytes written
+		sr, err := quasar.queryStandardValues(conn, uu, start, end)
 		if err != nil {
 			return ret, err
 		}
-		sr, err := quasar.receive(conn, -1)
-		if err != nil {
-			return ret, err
-		}
-		sr.UUID = uu
 		for _, reading := range sr.Readings {
 			reading.Time = convertTime(reading.Time, UOT_NS, stream_uot)
 		}
@@ -216,3 +267,237 @@ func (quasar *QuasarDB) GetData(uuids []string, start uint64, end uint64, uot Un
 	}
 	return ret, nil
 }
+
+// the most statistical records Quasar returns to make up one window
+const quasarMaxSubWindows = 1024
+
+// Quasar computes statistics over windows of 2^pointwidth nanoseconds that
+// are aligned to multiples of 2^pointwidth. Returns the smallest point width
+// that makes up a window of @window nanoseconds out of at most
+// quasarMaxSubWindows of them, so that the parts of the window that do not
+// line up with them (see quasarAssembleStatistics) are small.
+func quasarPointWidth(window uint64) uint8 {
+	var pw uint8
+	for pw < 62 && window>>pw > quasarMaxSubWindows {
+		pw += 1
+	}
+	return pw
+}
+
+// the most raw ranges quasarAssembleStatistics fetches at a time
+const quasarRawBatchRanges = 64
+
+// A range [start, end) of nanoseconds
+type quasarRange struct {
+	start, end uint64
+}
+
+// Assembles the statistics of windows of @window over [start, end) (all in
+// nanoseconds) from @records, Quasar's statistics over windows of 2^pw that
+// are aligned to multiples of 2^pw, and readings fetched with @raw. The
+// records must cover [alignedStart, alignedEnd) of quasarAlignedRange. A
+// record that a window boundary cuts through, and the parts of the range
+// before and after the aligned one, are replaced by the raw readings in them,
+// which only adds up to about 2 / quasarMaxSubWindows of the readings. @raw
+// returns the readings in each of up to quasarRawBatchRanges ranges at once,
+// and ranges that touch are fetched as one.
+func quasarAssembleStatistics(records []*StatisticalNumberReading, pw uint8, start, end, window uint64,
+	raw func(ranges []quasarRange) ([][]*SmapNumberReading, error)) ([]*StatisticalNumberReading, error) {
+	var (
+		width    = uint64(1) << pw
+		kept     []*StatisticalNumberReading
+		ranges   []quasarRange
+		addRange = func(from, to uint64) {
+			if from >= to {
+				return
+			}
+			if n := len(ranges); n > 0 && ranges[n-1].end == from {
+				ranges[n-1].end = to
+				return
+			}
+			ranges = append(ranges, quasarRange{from, to})
+		}
+	)
+	alignedStart, alignedEnd := quasarAlignedRange(start, end, pw)
+	if alignedStart >= alignedEnd {
+		addRange(start, end)
+	} else {
+		addRange(start, alignedStart)
+		for _, record := range records {
+			if record.Time < alignedStart || record.Time >= alignedEnd {
+				continue
+			}
+			// the first window boundary after the start of the record
+			boundary := start + (record.Time-start+window-1)/window*window
+			if boundary > record.Time && boundary < record.Time+width {
+				addRange(record.Time, record.Time+width)
+				continue
+			}
+			kept = append(kept, record)
+		}
+		addRange(alignedEnd, end)
+	}
+
+	var fetched [][]*SmapNumberReading
+	for i := 0; i < len(ranges); i += quasarRawBatchRanges {
+		batch := ranges[i:]
+		if len(batch) > quasarRawBatchRanges {
+			batch = batch[:quasarRawBatchRanges]
+		}
+		readings, err := raw(batch)
+		if err != nil {
+			return nil, err
+		}
+		fetched = append(fetched, readings...)
+	}
+
+	// interleave the raw readings with the records kept, in order of time
+	var (
+		stats []*StatisticalNumberReading
+		next  int
+	)
+	addRaw := func(until uint64) {
+		for ; next < len(ranges) && ranges[next].start < until; next++ {
+			for _, rdg := range fetched[next] {
+				stats = append(stats, &StatisticalNumberReading{Time: rdg.Time, Count: 1, Min: rdg.Value, Mean: rdg.Value, Max: rdg.Value})
+			}
+		}
+	}
+	for _, record := range kept {
+		addRaw(record.Time)
+		stats = append(stats, record)
+	}
+	addRaw(end)
+	return mergeStatistics(stats, start, end, window), nil
+}
+
+// The part of [start, end) that is made of whole windows of 2^pw aligned to
+// multiples of 2^pw. Empty (alignedStart >= alignedEnd) if there is none
+func quasarAlignedRange(start, end uint64, pw uint8) (alignedStart, alignedEnd uint64) {
+	width := uint64(1) << pw
+	alignedStart = (start + width - 1) / width * width
+	alignedEnd = end / width * width
+	return
+}
+
+func (quasar *QuasarDB) receiveStatistics(conn *TSDBConn) ([]*StatisticalNumberReading, error) {
+	var stats []*StatisticalNumberReading
+	seg, err := capn.ReadFromStream(conn, nil)
+	if err != nil {
+		conn.Close()
+		log.Error("Error receiving data from Quasar %v", err)
+		return stats, err
+	}
+	resp := qsr.ReadRootResponse(seg)
+	if resp.StatusCode() != qsr.STATUSCODE_OK {
+		return stats, errors.New("Error when reading from Quasar:" + resp.StatusCode().String())
+	}
+	if resp.Which() != qsr.RESPONSE_STATISTICALRECORDS {
+		return stats, fmt.Errorf("Got unexpected Quasar response (%v)", resp.Which())
+	}
+	for _, rec := range resp.StatisticalRecords().Values().ToArray() {
+		stats = append(stats, &StatisticalNumberReading{Time: uint64(rec.Time()), Count: rec.Count(),
+			Min: rec.Min(), Mean: rec.Mean(), Max: rec.Max()})
+	}
+	return stats, nil
+}
+
+// Uses Quasar's statistical query for the parts of the windows that line up
+// with the ones Quasar computes, and the raw readings for the rest (see
+// quasarAssembleStatistics). Returns ErrStatisticsUnsupported for an empty
+// window.
+func (quasar *QuasarDB) GetStatistics(uuids []string, start uint64, end uint64, window uint64, uot UnitOfTime) ([]StatisticalNumbersResponse, error) {
+	var ret = make([]StatisticalNumbersResponse, len(uuids))
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	window = convertTime(window, uot, UOT_NS)
+	if window == 0 || end < start {
+		return ret, ErrStatisticsUnsupported
+	}
+	pw := quasarPointWidth(window)
+	alignedStart, alignedEnd := quasarAlignedRange(start, end, pw)
+	conn, err := quasar.connpool.Get()
+	if err != nil {
+		return ret, err
+	}
+	defer quasar.connpool.Put(conn)
+	for i, uu := range uuids {
+		stream_uot := quasar.store.GetUnitOfTime(uu)
+		var records []*StatisticalNumberReading
+		if alignedStart < alignedEnd {
+			seg := capn.NewBuffer(nil)
+			req := qsr.NewRootRequest(seg)
+			qsv := qsr.NewCmdQueryStatisticalValues(seg)
+			uuid := uuidlib.Parse(uu)
+			qsv.SetUuid([]byte(uuid))
+			qsv.SetStartTime(int64(alignedStart))
+			qsv.SetEndTime(int64(alignedEnd))
+			qsv.SetPointWidth(pw)
+			req.SetQueryStatisticalValues(qsv)
+			_, err := seg.WriteTo(conn) // here, ignoring # bytes written
+			if err != nil {
+				conn.Close()
+				return ret, err
+			}
+			if records, err = quasar.receiveStatistics(conn); err != nil {
+				return ret, err
+			}
+		}
+		stats, err := quasarAssembleStatistics(records, pw, start, end, window, func(ranges []quasarRange) ([][]*SmapNumberReading, error) {
+			return quasar.queryStandardValueRanges(conn, uu, ranges)
+		})
+		if err != nil {
+			return ret, err
+		}
+		for _, stat := range stats {
+			stat.Time = convertTime(stat.Time, UOT_NS, stream_uot)
+		}
+		ret[i] = StatisticalNumbersResponse{UUID: uu, Readings: stats}
+	}
+	return ret, nil
+}
+
+// Reads the response to a command that returns no records, turning an error
+// status into an error
+func (quasar *QuasarDB) receiveStatus(conn *TSDBConn) error {
+	seg, err := capn.ReadFromStream(conn, nil)
+	if err != nil {
+		conn.Close()
+		log.Error("Error receiving data from Quasar %v", err)
+		return err
+	}
+	resp := qsr.ReadRootResponse(seg)
+	if resp.StatusCode() != qsr.STATUSCODE_OK {
+		return errors.New("Error from Quasar: " + resp.StatusCode().String())
+	}
+	return nil
+}
+
+// Removes all readings in [start, end)
+func (quasar *QuasarDB) DeleteData(uuids []string, start uint64, end uint64, uot UnitOfTime) error {
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	conn, err := quasar.connpool.Get()
+	if err != nil {
+		return err
+	}
+	defer quasar.connpool.Put(conn)
+	for _, uu := range uuids {
+		seg := capn.NewBuffer(nil)
+		req := qsr.NewRootRequest(seg)
+		del := qsr.NewCmdDeleteValues(seg)
+		uuid := uuidlib.Parse(uu)
+		del.SetUuid([]byte(uuid))
+		del.SetStartTime(int64(start))
+		del.SetEndTime(int64(end))
+		req.SetDeleteValues(del)
+		if _, err := seg.WriteTo(conn); err != nil {
+			conn.Close()
+			return err
+		}
+		if err := quasar.receiveStatus(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
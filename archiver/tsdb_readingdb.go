@@ -0,0 +1,242 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	rdb "github.com/gtfierro/giles/internal/readingdbproto"
+	"io"
+	"net"
+	"time"
+)
+
+// ReadingDB stores timestamps in seconds, and identifies streams by a 32-bit
+// stream id rather than a UUID. The uuid -> streamid mapping is kept by the
+// metadata store (see StreamIdStore)
+const READINGDB_UOT = UOT_S
+
+// ReadingDB frames each protobuf message with an 8 byte header: the
+// MessageType followed by the length of the encoded body, both as big-endian
+// uint32
+const readingdbHeaderSize = 8
+
+// maximum number of points returned by a single nearest-value query
+const readingdbMaxNearest = 10000
+
+type ReadingDB struct {
+	addr     *net.TCPAddr
+	store    MetadataStore
+	streamid StreamIdStore
+	connpool *ConnectionPool
+}
+
+func NewReadingDB(address *net.TCPAddr, maxConnections int, keepAlive time.Duration) *ReadingDB {
+	log.Notice("Connecting to ReadingDB at %v...", address.String())
+	readingdb := &ReadingDB{addr: address}
+	readingdb.connpool = NewConnectionPool(readingdb.getConnection, maxConnections, keepAlive)
+	return readingdb
+}
+
+func (readingdb *ReadingDB) getConnection() (*TSDBConn, error) {
+	conn, err := net.DialTCP("tcp", nil, readingdb.addr)
+	if err != nil {
+		log.Error("Error getting connection to ReadingDB (%v)", err)
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	return NewTSDBConn(conn), nil
+}
+
+func (readingdb *ReadingDB) GetConnection() (net.Conn, error) {
+	return nil, nil
+}
+
+// ReadingDB needs a store that can also map UUIDs to stream ids (MongoStore
+// does). Any other store is refused here so the problem shows up at startup
+func (readingdb *ReadingDB) AddStore(s MetadataStore) {
+	readingdb.store = s
+	if sids, ok := s.(StreamIdStore); ok {
+		readingdb.streamid = sids
+	} else {
+		log.Fatal("ReadingDB requires a metadata store that can allocate stream ids")
+	}
+}
+
+func (readingdb *ReadingDB) LiveConnections() ConnectionStats {
+	return readingdb.connpool.Stats()
+}
+
+// writes the header and encoded message to the connection
+func (readingdb *ReadingDB) send(conn io.Writer, mtype rdb.MessageType, msg proto.Message) error {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, readingdbHeaderSize+len(body))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(mtype))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(body)))
+	copy(buf[readingdbHeaderSize:], body)
+	_, err = conn.Write(buf)
+	return err
+}
+
+// reads a RESPONSE message off of the connection and translates its readings
+// into nanoseconds
+func (readingdb *ReadingDB) receive(conn *TSDBConn) (SmapNumbersResponse, error) {
+	var sr = SmapNumbersResponse{Readings: []*SmapNumberReading{}}
+	header := make([]byte, readingdbHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return sr, err
+	}
+	mtype := rdb.MessageType(binary.BigEndian.Uint32(header[0:4]))
+	body := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		conn.Close()
+		return sr, err
+	}
+	if mtype != rdb.MessageType_RESPONSE {
+		return sr, fmt.Errorf("Expected RESPONSE from ReadingDB but got %v", mtype)
+	}
+	resp := new(rdb.Response)
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return sr, err
+	}
+	if resp.GetError() != rdb.Response_OK {
+		return sr, errors.New("Error when reading from ReadingDB: " + resp.GetError().String())
+	}
+	for _, rdg := range resp.GetData().GetData() {
+		sr.Readings = append(sr.Readings, &SmapNumberReading{Time: convertTime(rdg.GetTimestamp(), READINGDB_UOT, UOT_NS), Value: rdg.GetValue()})
+	}
+	return sr, nil
+}
+
+func (readingdb *ReadingDB) Add(sb *StreamBuf) bool {
+	if sb.idx == 0 {
+		return false
+	}
+	conn, err := readingdb.connpool.Get()
+	if err != nil {
+		log.Error("Error writing to ReadingDB %v", err)
+		return false
+	}
+	defer readingdb.connpool.Put(conn)
+	rs := &rdb.ReadingSet{
+		Streamid:  proto.Uint32(readingdb.streamid.GetStreamId(sb.uuid)),
+		Substream: proto.Uint32(0),
+		Data:      make([]*rdb.Reading, sb.idx),
+	}
+	for i, val := range sb.readings[:sb.idx] {
+		rs.Data[i] = &rdb.Reading{
+			Timestamp: proto.Uint64(convertTime(val.Time, sb.unitOfTime, READINGDB_UOT)),
+			Value:     proto.Float64(val.Value),
+		}
+	}
+	if err := readingdb.send(conn, rdb.MessageType_READINGSET, rs); err != nil {
+		log.Error("Error writing to ReadingDB %v", err)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// sends @msg for each of the uuids (built by @request) and collects the
+// responses, converting the times to the unit of time of each stream
+func (readingdb *ReadingDB) query(uuids []string, mtype rdb.MessageType, request func(streamid uint32) proto.Message) ([]SmapNumbersResponse, error) {
+	var ret = make([]SmapNumbersResponse, len(uuids))
+	conn, err := readingdb.connpool.Get()
+	if err != nil {
+		return ret, err
+	}
+	defer readingdb.connpool.Put(conn)
+	for i, uu := range uuids {
+		stream_uot := readingdb.store.GetUnitOfTime(uu)
+		if err := readingdb.send(conn, mtype, request(readingdb.streamid.GetStreamId(uu))); err != nil {
+			conn.Close()
+			return ret, err
+		}
+		sr, err := readingdb.receive(conn)
+		if err != nil {
+			return ret, err
+		}
+		sr.UUID = uu
+		for _, reading := range sr.Readings {
+			reading.Time = convertTime(reading.Time, UOT_NS, stream_uot)
+		}
+		ret[i] = sr
+	}
+	return ret, nil
+}
+
+func (readingdb *ReadingDB) queryNearestValue(uuids []string, start uint64, limit int32, direction rdb.Nearest_Direction) ([]SmapNumbersResponse, error) {
+	if limit < 0 {
+		limit = 1
+	} else if limit > readingdbMaxNearest {
+		limit = readingdbMaxNearest
+	}
+	return readingdb.query(uuids, rdb.MessageType_NEAREST, func(streamid uint32) proto.Message {
+		return &rdb.Nearest{
+			Streamid:  proto.Uint32(streamid),
+			Substream: proto.Uint32(0),
+			Reference: proto.Uint64(convertTime(start, UOT_NS, READINGDB_UOT)),
+			Direction: direction.Enum(),
+			N:         proto.Uint32(uint32(limit)),
+		}
+	})
+}
+
+func (readingdb *ReadingDB) Prev(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, UOT_NS)
+	return readingdb.queryNearestValue(uuids, start, limit, rdb.Nearest_PREV)
+}
+
+func (readingdb *ReadingDB) Next(uuids []string, start uint64, limit int32, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, UOT_NS)
+	return readingdb.queryNearestValue(uuids, start, limit, rdb.Nearest_NEXT)
+}
+
+func (readingdb *ReadingDB) GetData(uuids []string, start uint64, end uint64, uot UnitOfTime) ([]SmapNumbersResponse, error) {
+	start = convertTime(start, uot, READINGDB_UOT)
+	end = convertTime(end, uot, READINGDB_UOT)
+	return readingdb.query(uuids, rdb.MessageType_QUERY, func(streamid uint32) proto.Message {
+		return &rdb.Query{
+			Streamid:  proto.Uint32(streamid),
+			Substream: proto.Uint32(0),
+			Starttime: proto.Uint64(start),
+			Endtime:   proto.Uint64(end),
+		}
+	})
+}
+
+// ReadingDB has no aggregate queries, so windows are computed from the raw data
+func (readingdb *ReadingDB) GetStatistics(uuids []string, start uint64, end uint64, window uint64, uot UnitOfTime) ([]StatisticalNumbersResponse, error) {
+	return nil, ErrStatisticsUnsupported
+}
+
+// ReadingDB deletes whole seconds, inclusive of both ends, so the range is
+// narrowed to the seconds that lie entirely within [start, end)
+func (readingdb *ReadingDB) DeleteData(uuids []string, start uint64, end uint64, uot UnitOfTime) error {
+	start = convertTime(start, uot, UOT_NS)
+	end = convertTime(end, uot, UOT_NS)
+	if end <= start {
+		return nil
+	}
+	starttime := convertTime(start, UOT_NS, READINGDB_UOT)
+	if convertTime(starttime, READINGDB_UOT, UOT_NS) < start {
+		starttime += 1
+	}
+	endtime := convertTime(end-1, UOT_NS, READINGDB_UOT)
+	if starttime > endtime {
+		return nil
+	}
+	_, err := readingdb.query(uuids, rdb.MessageType_DELETE, func(streamid uint32) proto.Message {
+		return &rdb.Delete{
+			Streamid:  proto.Uint32(streamid),
+			Substream: proto.Uint32(0),
+			Starttime: proto.Uint64(starttime),
+			Endtime:   proto.Uint64(endtime),
+		}
+	})
+	return err
+}
@@ -0,0 +1,156 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	rdb "github.com/gtfierro/giles/internal/readingdbproto"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// metadata store that hands out stream ids in order of first use
+type streamIdStore struct {
+	uotStore
+	ids map[string]uint32
+	sync.Mutex
+}
+
+func (s *streamIdStore) GetStreamId(uuid string) uint32 {
+	s.Lock()
+	defer s.Unlock()
+	if id, found := s.ids[uuid]; found {
+		return id
+	}
+	s.ids[uuid] = uint32(len(s.ids) + 1)
+	return s.ids[uuid]
+}
+
+// fakeReadingDB speaks enough of the ReadingDB protocol to store readings and
+// answer QUERY and NEAREST requests
+type fakeReadingDB struct {
+	listener net.Listener
+	streams  map[uint32][]*rdb.Reading
+	sync.Mutex
+}
+
+func newFakeReadingDB(t *testing.T) *fakeReadingDB {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeReadingDB{listener: l, streams: make(map[uint32][]*rdb.Reading)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fake.handle(conn)
+		}
+	}()
+	return fake
+}
+
+func (fake *fakeReadingDB) handle(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, readingdbHeaderSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		var data []*rdb.Reading
+		switch rdb.MessageType(binary.BigEndian.Uint32(header[0:4])) {
+		case rdb.MessageType_READINGSET:
+			rs := new(rdb.ReadingSet)
+			proto.Unmarshal(body, rs)
+			fake.Lock()
+			stream := append(fake.streams[rs.GetStreamid()], rs.Data...)
+			sort.Sort(rdbReadings(stream))
+			fake.streams[rs.GetStreamid()] = stream
+			fake.Unlock()
+			continue
+		case rdb.MessageType_QUERY:
+			q := new(rdb.Query)
+			proto.Unmarshal(body, q)
+			fake.Lock()
+			for _, rdg := range fake.streams[q.GetStreamid()] {
+				if rdg.GetTimestamp() >= q.GetStarttime() && rdg.GetTimestamp() <= q.GetEndtime() {
+					data = append(data, rdg)
+				}
+			}
+			fake.Unlock()
+		case rdb.MessageType_NEAREST:
+			n := new(rdb.Nearest)
+			proto.Unmarshal(body, n)
+			fake.Lock()
+			stream := fake.streams[n.GetStreamid()]
+			if n.GetDirection() == rdb.Nearest_NEXT {
+				for _, rdg := range stream {
+					if rdg.GetTimestamp() >= n.GetReference() && uint32(len(data)) < n.GetN() {
+						data = append(data, rdg)
+					}
+				}
+			} else {
+				for i := len(stream) - 1; i >= 0; i-- {
+					if stream[i].GetTimestamp() <= n.GetReference() && uint32(len(data)) < n.GetN() {
+						data = append([]*rdb.Reading{stream[i]}, data...)
+					}
+				}
+			}
+			fake.Unlock()
+		}
+		resp := &rdb.Response{
+			Error: rdb.Response_OK.Enum(),
+			Data:  &rdb.ReadingSet{Streamid: proto.Uint32(0), Substream: proto.Uint32(0), Data: data},
+		}
+		if err := new(ReadingDB).send(conn, rdb.MessageType_RESPONSE, resp); err != nil {
+			return
+		}
+	}
+}
+
+type rdbReadings []*rdb.Reading
+
+func (r rdbReadings) Len() int           { return len(r) }
+func (r rdbReadings) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r rdbReadings) Less(i, j int) bool { return r[i].GetTimestamp() < r[j].GetTimestamp() }
+
+func TestReadingDBRoundTrip(t *testing.T) {
+	fake := newFakeReadingDB(t)
+	defer fake.listener.Close()
+
+	readingdb := NewReadingDB(fake.listener.Addr().(*net.TCPAddr), 2, 0)
+	readingdb.AddStore(&streamIdStore{uotStore: uotStore{uot: UOT_MS}, ids: make(map[string]uint32)})
+
+	if !readingdb.Add(newTestStreamBuf("a", UOT_MS, 3000, 1000, 4000, 2000)) {
+		t.Fatal("Could not add readings")
+	}
+
+	// times are returned in the unit of time of the stream
+	res, err := readingdb.GetData([]string{"a", "b"}, 2, 3, UOT_S)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2000, 3000}) {
+		t.Error("Got ", times, " should be [2000 3000]")
+	}
+	if res[1].UUID != "b" || len(res[1].Readings) != 0 {
+		t.Error("Got ", res[1], " should be empty response for b")
+	}
+
+	res, _ = readingdb.Prev([]string{"a"}, 3500, 2, UOT_MS)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2000, 3000}) {
+		t.Error("Got ", times, " should be [2000 3000]")
+	}
+	res, _ = readingdb.Next([]string{"a"}, 2, -1, UOT_S)
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{2000}) {
+		t.Error("Got ", times, " should be [2000]")
+	}
+}
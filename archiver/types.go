@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,9 +26,14 @@ type SmapNumberReading struct {
 	Value float64
 }
 
+// Encodes as [time, value]. A NaN value, which is how `fill null` leaves out a
+// reading, is null
 func (s *SmapNumberReading) MarshalJSON() ([]byte, error) {
-	floatString := strconv.FormatFloat(s.Value, 'f', -1, 64)
 	timeString := strconv.FormatUint(s.Time, 10)
+	if math.IsNaN(s.Value) {
+		return json.Marshal([]interface{}{json.Number(timeString), nil})
+	}
+	floatString := strconv.FormatFloat(s.Value, 'f', -1, 64)
 	return json.Marshal([]json.Number{json.Number(timeString), json.Number(floatString)})
 }
 
@@ -67,14 +73,54 @@ func (s *SmapObjectReading) GetValue() interface{} {
 	return s.Value
 }
 
+// Status of a stream in the response to a data query, so that a stream with
+// no data in the range (STATUS_NODATA) can be told apart from one whose data
+// could not be fetched (STATUS_ERROR, with the reason in Error)
+const (
+	STATUS_OK     = "ok"
+	STATUS_NODATA = "nodata"
+	STATUS_ERROR  = "error"
+)
+
 type SmapNumbersResponse struct {
 	Readings []*SmapNumberReading
 	UUID     string `json:"uuid"`
+	Status   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// Summary of the readings in the window starting at Time
+type StatisticalNumberReading struct {
+	// uint64 timestamp of the start of the window
+	Time uint64
+	// number of readings in the window
+	Count uint64
+	Min   float64
+	Mean  float64
+	Max   float64
+}
+
+// Encodes as [time, min, mean, max, count]
+func (s *StatisticalNumberReading) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]json.Number{
+		json.Number(strconv.FormatUint(s.Time, 10)),
+		json.Number(strconv.FormatFloat(s.Min, 'f', -1, 64)),
+		json.Number(strconv.FormatFloat(s.Mean, 'f', -1, 64)),
+		json.Number(strconv.FormatFloat(s.Max, 'f', -1, 64)),
+		json.Number(strconv.FormatUint(s.Count, 10)),
+	})
+}
+
+type StatisticalNumbersResponse struct {
+	Readings []*StatisticalNumberReading
+	UUID     string `json:"uuid"`
 }
 
 type SmapObjectResponse struct {
 	Readings []*SmapObjectReading
 	UUID     string `json:"uuid"`
+	Status   string `json:",omitempty"`
+	Error    string `json:",omitempty"`
 }
 
 type SmapItem struct {
@@ -434,13 +480,31 @@ func transformSmapNumResp(srs []SmapNumbersResponse) []map[string]interface{} {
 		m["uuid"] = sr.UUID
 		m["Readings"] = make([][]interface{}, len(sr.Readings))
 		for idx, rdg := range sr.Readings {
-			m["Readings"].([][]interface{})[idx] = []interface{}{rdg.Time, rdg.Value}
+			if math.IsNaN(rdg.Value) {
+				m["Readings"].([][]interface{})[idx] = []interface{}{rdg.Time, nil}
+			} else {
+				m["Readings"].([][]interface{})[idx] = []interface{}{rdg.Time, rdg.Value}
+			}
+		}
+		if sr.Status != "" {
+			m["Status"] = sr.Status
+		}
+		if sr.Error != "" {
+			m["Error"] = sr.Error
 		}
 		result[idx] = m
 	}
 	return result
 }
 
+func transformTimeseriesGroups(groups []TimeseriesGroup) []map[string]interface{} {
+	result := make([]map[string]interface{}, len(groups))
+	for idx, group := range groups {
+		result[idx] = map[string]interface{}{"Value": group.Value, "Streams": transformSmapNumResp(group.Streams)}
+	}
+	return result
+}
+
 func transformSmapItem(srs []*SmapItem) []map[string]interface{} {
 	result := make([]map[string]interface{}, len(srs))
 	for idx, sr := range srs {
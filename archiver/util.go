@@ -1,9 +1,12 @@
 package archiver
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2/bson"
+	"os"
 	"strings"
 	"time"
 )
@@ -105,3 +108,21 @@ func flatten(m bson.M) bson.M {
 	}
 	return ret
 }
+
+// Generates a new random API key from 64 bytes of /dev/urandom
+func generateAPIKey() (string, error) {
+	urandom, err := os.Open("/dev/urandom")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not open /dev/urandom (%v)", err))
+	}
+	defer urandom.Close()
+	randbytes := make([]byte, 64)
+	n, err := urandom.Read(randbytes)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not read /dev/urandom (%v)", err))
+	}
+	if n != 64 {
+		return "", errors.New(fmt.Sprintf("Could not read 64 bytes from /dev/urandom %v", n))
+	}
+	return base64.URLEncoding.EncodeToString(randbytes), nil
+}
@@ -0,0 +1,266 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WriteAheadLog records the readings accepted by the TransactionCoalescer
+// before AddData returns, so that readings still waiting in a StreamBuf (or
+// whose write to the timeseries database failed) are not lost if Giles
+// stops. Readings are replayed into the timeseries database on startup.
+//
+// The log is a directory of numbered segment files (00000001.wal, ...) of
+// records of (length, crc32, body), where the body holds the uuid, unit of
+// time and readings of one SmapMessage. Records are only appended to the
+// newest segment; once it grows past segmentSize bytes a new one is started.
+// Each segment counts the records that have not been committed to the
+// timeseries database yet, and is removed when it is no longer being
+// appended to and that count drops to 0.
+type WriteAheadLog struct {
+	dir         string
+	segmentSize int64
+	sync        bool
+	// the segment being appended to
+	active     *os.File
+	activeSeq  uint64
+	activeSize int64
+	// uncommitted records per segment
+	pending map[uint64]int
+	sync.Mutex
+}
+
+const (
+	walHeaderSize            = 8 // uint32 length, uint32 crc
+	walReadingSize           = 16
+	DEFAULT_WAL_SEGMENT_SIZE = 64 * 1024 * 1024 // bytes
+)
+
+// a record read back from the log
+type walRecord struct {
+	uuid     string
+	uot      UnitOfTime
+	readings []*SmapNumberReading
+}
+
+// Opens the write-ahead log in @dir. Existing segments are left alone until
+// they have been replayed (see TransactionCoalescer.replay). If @sync is true,
+// every record is flushed to disk before it is acknowledged, which also
+// protects against the machine (not just Giles) going down.
+func NewWriteAheadLog(dir string, segmentSize int64, sync bool) *WriteAheadLog {
+	log.Notice("Using write-ahead log at %v", dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Critical("Could not create write-ahead log directory %v (%v)", dir, err)
+		return nil
+	}
+	if segmentSize <= 0 {
+		segmentSize = DEFAULT_WAL_SEGMENT_SIZE
+	}
+	return &WriteAheadLog{dir: dir, segmentSize: segmentSize, sync: sync, pending: make(map[uint64]int)}
+}
+
+func walSegmentName(seq uint64) string {
+	return fmt.Sprintf("%08d.wal", seq)
+}
+
+// Returns the sequence numbers of the segments on disk, in order
+func (wal *WriteAheadLog) segments() ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(wal.dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, name := range names {
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(filepath.Base(name), ".wal"), "%d", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Sort(uint64s(seqs))
+	return seqs, nil
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+
+func encodeWALRecord(msg *SmapMessage, uot UnitOfTime) ([]byte, error) {
+	if len(msg.UUID) > math.MaxUint16 {
+		return nil, errors.New("UUID too long for write-ahead log")
+	}
+	bodySize := 1 + 2 + len(msg.UUID) + 4 + walReadingSize*len(msg.Readings)
+	buf := make([]byte, walHeaderSize+bodySize)
+	body := buf[walHeaderSize:]
+	body[0] = byte(uot)
+	binary.BigEndian.PutUint16(body[1:3], uint16(len(msg.UUID)))
+	offset := 3 + copy(body[3:], msg.UUID)
+	binary.BigEndian.PutUint32(body[offset:], uint32(len(msg.Readings)))
+	offset += 4
+	for _, rdg := range msg.Readings {
+		value, ok := rdg.GetValue().(float64)
+		if !ok {
+			return nil, fmt.Errorf("Reading for %v is not a number: %v", msg.UUID, rdg.GetValue())
+		}
+		binary.BigEndian.PutUint64(body[offset:], rdg.GetTime())
+		binary.BigEndian.PutUint64(body[offset+8:], math.Float64bits(value))
+		offset += walReadingSize
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(bodySize))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	return buf, nil
+}
+
+// Decodes the record at the start of @buf. Returns the number of bytes it
+// takes up, or 0 if there is no complete, valid record there
+func decodeWALRecord(buf []byte) (walRecord, int) {
+	var rec walRecord
+	if len(buf) < walHeaderSize {
+		return rec, 0
+	}
+	size := int(binary.BigEndian.Uint32(buf[0:4]))
+	if size < 7 || len(buf) < walHeaderSize+size {
+		return rec, 0
+	}
+	body := buf[walHeaderSize : walHeaderSize+size]
+	if binary.BigEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(body) {
+		return rec, 0
+	}
+	rec.uot = UnitOfTime(body[0])
+	uuidLen := int(binary.BigEndian.Uint16(body[1:3]))
+	if 3+uuidLen+4 > size {
+		return rec, 0
+	}
+	rec.uuid = string(body[3 : 3+uuidLen])
+	offset := 3 + uuidLen
+	count := int(binary.BigEndian.Uint32(body[offset:]))
+	offset += 4
+	if offset+count*walReadingSize != size {
+		return rec, 0
+	}
+	rec.readings = make([]*SmapNumberReading, count)
+	for i := range rec.readings {
+		rec.readings[i] = &SmapNumberReading{
+			Time:  binary.BigEndian.Uint64(body[offset:]),
+			Value: math.Float64frombits(binary.BigEndian.Uint64(body[offset+8:])),
+		}
+		offset += walReadingSize
+	}
+	return rec, walHeaderSize + size
+}
+
+// Reads all records in the segments @seqs, in the order they were written.
+// Reading a segment stops at the first torn or corrupt record
+func (wal *WriteAheadLog) read(seqs []uint64) ([]walRecord, error) {
+	var records []walRecord
+	for _, seq := range seqs {
+		filename := filepath.Join(wal.dir, walSegmentName(seq))
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return records, err
+		}
+		offset := 0
+		for offset < len(contents) {
+			rec, n := decodeWALRecord(contents[offset:])
+			if n == 0 {
+				log.Warning("Ignoring %v bytes of partial writes in %v", len(contents)-offset, filename)
+				break
+			}
+			records = append(records, rec)
+			offset += n
+		}
+	}
+	return records, nil
+}
+
+// Removes the segments @seqs, which must not be in use
+func (wal *WriteAheadLog) remove(seqs []uint64) {
+	for _, seq := range seqs {
+		if err := os.Remove(filepath.Join(wal.dir, walSegmentName(seq))); err != nil {
+			log.Error("Could not remove write-ahead log segment %v (%v)", seq, err)
+		}
+	}
+}
+
+// Starts a new segment after all of the existing ones. Must hold the lock
+func (wal *WriteAheadLog) rotate() error {
+	if wal.active != nil {
+		wal.active.Close()
+		wal.active = nil
+		if wal.pending[wal.activeSeq] == 0 {
+			delete(wal.pending, wal.activeSeq)
+			wal.remove([]uint64{wal.activeSeq})
+		}
+	}
+	seqs, err := wal.segments()
+	if err != nil {
+		return err
+	}
+	seq := wal.activeSeq + 1
+	if len(seqs) > 0 && seqs[len(seqs)-1] >= seq {
+		seq = seqs[len(seqs)-1] + 1
+	}
+	f, err := os.OpenFile(filepath.Join(wal.dir, walSegmentName(seq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.active = f
+	wal.activeSeq = seq
+	wal.activeSize = 0
+	return nil
+}
+
+// Appends the readings in @msg to the log. Returns the segment the record
+// was written to, which has to be passed to commit once the readings are in
+// the timeseries database
+func (wal *WriteAheadLog) append(msg *SmapMessage, uot UnitOfTime) (uint64, error) {
+	buf, err := encodeWALRecord(msg, uot)
+	if err != nil {
+		return 0, err
+	}
+	wal.Lock()
+	defer wal.Unlock()
+	if wal.active == nil || wal.activeSize >= wal.segmentSize {
+		if err = wal.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := wal.active.Write(buf)
+	wal.activeSize += int64(n)
+	if err == nil && wal.sync {
+		err = wal.active.Sync()
+	}
+	if err != nil {
+		// don't leave a torn record in the middle of the segment
+		wal.active.Close()
+		wal.active = nil
+		return 0, err
+	}
+	wal.pending[wal.activeSeq] += 1
+	return wal.activeSeq, nil
+}
+
+// Marks one record in each of the segments @seqs as committed, removing the
+// segments that have nothing left to replay
+func (wal *WriteAheadLog) commit(seqs []uint64) {
+	wal.Lock()
+	defer wal.Unlock()
+	for _, seq := range seqs {
+		wal.pending[seq] -= 1
+		if wal.pending[seq] > 0 || (wal.active != nil && seq == wal.activeSeq) {
+			continue
+		}
+		delete(wal.pending, seq)
+		wal.remove([]uint64{seq})
+	}
+}
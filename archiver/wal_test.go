@@ -0,0 +1,137 @@
+package archiver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestWAL(t *testing.T, segmentSize int64) (*WriteAheadLog, string) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWriteAheadLog(dir, segmentSize, false), dir
+}
+
+func walMessage(uuid string, times ...uint64) *SmapMessage {
+	msg := &SmapMessage{UUID: uuid}
+	for _, t := range times {
+		msg.Readings = append(msg.Readings, &SmapNumberReading{Time: t, Value: float64(t) / 2})
+	}
+	return msg
+}
+
+func TestWALAppendRead(t *testing.T) {
+	wal, dir := newTestWAL(t, 0)
+	defer os.RemoveAll(dir)
+
+	if _, err := wal.append(walMessage("aaa", 1, 2, 3), UOT_S); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.append(walMessage("bbb", 4), UOT_MS); err != nil {
+		t.Fatal(err)
+	}
+	seqs, _ := wal.segments()
+	records, err := wal.read(seqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatal("Got ", len(records), " records should be 2")
+	}
+	if rec := records[0]; rec.uuid != "aaa" || rec.uot != UOT_S || len(rec.readings) != 3 || rec.readings[2].Value != 1.5 {
+		t.Error("Got ", rec, " should be aaa with 3 readings in seconds")
+	}
+	if rec := records[1]; rec.uuid != "bbb" || rec.uot != UOT_MS || rec.readings[0].Time != 4 {
+		t.Error("Got ", rec, " should be bbb with 1 reading in milliseconds")
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	wal, dir := newTestWAL(t, 0)
+	defer os.RemoveAll(dir)
+
+	seq, _ := wal.append(walMessage("aaa", 1), UOT_S)
+	wal.append(walMessage("aaa", 2), UOT_S)
+	// cut the last record short, as if Giles stopped while writing it
+	filename := filepath.Join(dir, walSegmentName(seq))
+	info, _ := os.Stat(filename)
+	if err := os.Truncate(filename, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	records, err := wal.read([]uint64{seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].readings[0].Time != 1 {
+		t.Error("Got ", records, " should be only the first record")
+	}
+}
+
+func TestWALCommitRemovesSegments(t *testing.T) {
+	// every record goes in its own segment
+	wal, dir := newTestWAL(t, 1)
+	defer os.RemoveAll(dir)
+
+	first, _ := wal.append(walMessage("aaa", 1), UOT_S)
+	second, _ := wal.append(walMessage("aaa", 2), UOT_S)
+	if first == second {
+		t.Fatal("Got segment ", second, " should be after ", first)
+	}
+	// the active segment stays around until the next rotation
+	wal.commit([]uint64{first, second})
+	seqs, _ := wal.segments()
+	if !isUint64SliceEqual(seqs, []uint64{second}) {
+		t.Error("Got ", seqs, " should be ", []uint64{second})
+	}
+	third, _ := wal.append(walMessage("aaa", 3), UOT_S)
+	seqs, _ = wal.segments()
+	if !isUint64SliceEqual(seqs, []uint64{third}) {
+		t.Error("Got ", seqs, " should be ", []uint64{third})
+	}
+}
+
+// timeseries database that cannot be written to
+type failingTSDB struct {
+	TSDB
+}
+
+func (f failingTSDB) Add(sb *StreamBuf) bool {
+	return false
+}
+
+func TestTransactionCoalescerReplay(t *testing.T) {
+	wal, dir := newTestWAL(t, 0)
+	defer os.RemoveAll(dir)
+	wal.append(walMessage("aaa", 1, 2), UOT_S)
+	wal.append(walMessage("aaa", 3), UOT_S)
+	wal.append(walMessage("bbb", 4), UOT_S)
+
+	// readings stay in the log as long as they cannot be written
+	var store MetadataStore = uotStore{uot: UOT_S}
+	var tsdb TSDB = failingTSDB{}
+	NewTransactionCoalescer(&tsdb, &store, NewWriteAheadLog(dir, 0, false), 0)
+	if seqs, _ := wal.segments(); len(seqs) != 1 {
+		t.Fatal("Got ", seqs, " should still have 1 segment")
+	}
+
+	mem := NewMemoryDB()
+	mem.AddStore(store)
+	tsdb = mem
+	NewTransactionCoalescer(&tsdb, &store, NewWriteAheadLog(dir, 0, false), 0)
+	res, _ := mem.GetData([]string{"aaa", "bbb"}, 0, 10, UOT_S)
+	if len(res) != 2 {
+		t.Fatal("Got ", res, " should have 2 streams")
+	}
+	if times := readingTimes(res[0]); !isUint64SliceEqual(times, []uint64{1, 2, 3}) {
+		t.Error("Got ", times, " should be [1 2 3]")
+	}
+	if times := readingTimes(res[1]); !isUint64SliceEqual(times, []uint64{4}) {
+		t.Error("Got ", times, " should be [4]")
+	}
+	if seqs, _ := wal.segments(); len(seqs) != 0 {
+		t.Error("Got ", seqs, " should have removed the replayed segments")
+	}
+}
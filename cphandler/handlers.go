@@ -29,7 +29,7 @@ func Handle(a *archiver.Archiver, port int) {
 	defer conn.Close()
 	for {
 		buf := make([]byte, 4096)
-		n, err := conn.Read(buf)
+		n, from, err := conn.ReadFromUDP(buf)
 		buffer := bytes.NewBuffer(buf[:n])
 		segment, err := capn.ReadFromStream(buffer, nil)
 		if err != nil {
@@ -39,7 +39,9 @@ func Handle(a *archiver.Archiver, port int) {
 		switch req.Which() {
 
 		case REQUEST_WRITEDATA:
-			AddReadings(a, req)
+			if status := AddReadings(a, req); status != STATUSCODE_OK {
+				sendStatus(conn, from, status)
+			}
 
 		case REQUEST_QUERY:
 			DoQuery(a, req)
@@ -51,9 +53,33 @@ func Handle(a *archiver.Archiver, port int) {
 	}
 }
 
-func AddReadings(a *archiver.Archiver, req Request) {
+func AddReadings(a *archiver.Archiver, req Request) StatusCode {
 	smapmsgs := CapnpToStruct(req.WriteData().Messages().ToArray())
-	a.AddData(smapmsgs, req.Apikey())
+	err := a.AddData(smapmsgs, req.Apikey())
+	switch {
+	case err == archiver.ErrOverloaded:
+		return STATUSCODE_OVERLOADED
+	case err != nil:
+		log.Error("Error adding readings: %v", err)
+		return STATUSCODE_INTERNALERROR
+	}
+	return STATUSCODE_OK
+}
+
+// Sends a Response with @status back to the client at @addr. Writes that
+// succeed are not acknowledged
+func sendStatus(conn *net.UDPConn, addr *net.UDPAddr, status StatusCode) {
+	seg := capn.NewBuffer(nil)
+	res := NewRootResponse(seg)
+	res.SetStatus(status)
+	var buf bytes.Buffer
+	if _, err := seg.WriteTo(&buf); err != nil {
+		log.Error("Error encoding response: %v", err)
+		return
+	}
+	if _, err := conn.WriteToUDP(buf.Bytes(), addr); err != nil {
+		log.Error("Error sending response to %v: %v", addr, err)
+	}
 }
 
 func DoQuery(a *archiver.Archiver, req Request) {
@@ -129,6 +129,7 @@ type StatusCode uint16
 const (
 	STATUSCODE_OK            StatusCode = 0
 	STATUSCODE_INTERNALERROR StatusCode = 1
+	STATUSCODE_OVERLOADED    StatusCode = 2
 )
 
 func (c StatusCode) String() string {
@@ -137,6 +138,8 @@ func (c StatusCode) String() string {
 		return "ok"
 	case STATUSCODE_INTERNALERROR:
 		return "internalError"
+	case STATUSCODE_OVERLOADED:
+		return "overloaded"
 	default:
 		return ""
 	}
@@ -148,6 +151,8 @@ func StatusCodeFromString(c string) StatusCode {
 		return STATUSCODE_OK
 	case "internalError":
 		return STATUSCODE_INTERNALERROR
+	case "overloaded":
+		return STATUSCODE_OVERLOADED
 	default:
 		return 0
 	}
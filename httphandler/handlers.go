@@ -39,6 +39,8 @@ func Handle(a *archiver.Archiver, port int) {
 	r.POST("/api/query", curryhandler(a, QueryHandler))
 	r.POST("/api/test", curryhandler(a, Query2Handler))
 	r.GET("/api/tags/uuid/:uuid", curryhandler(a, TagsHandler))
+	r.GET("/api/history/uuid/:uuid", curryhandler(a, HistoryHandler))
+	r.GET("/api/status", curryhandler(a, StatusHandler))
 
 	r.POST("/api/streamingquery", curryhandler(a, StreamingQueryHandler))
 
@@ -104,7 +106,16 @@ func AddReadingHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.R
 		return
 	}
 	err = a.AddData(messages, apikey)
-	if err != nil {
+	if err == archiver.ErrOverloaded {
+		rw.Header().Set("Retry-After", "1")
+		rw.WriteHeader(503)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if _, ok := err.(archiver.SchemaViolations); ok {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
@@ -112,6 +123,24 @@ func AddReadingHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.R
 	rw.WriteHeader(200)
 }
 
+// Returns the number of readings that have been accepted but are still
+// waiting to be written to the timeseries database, the state of the
+// connections to it, the number of tags saved despite a flagging schema, and
+// the counters of the metadata store's caches, as
+//    {"PendingWrites": 1234, "Connections": {"Live": 10, "Idle": 8, "Failed": 0}, "FlaggedTags": 0,
+//     "Caches": [{"Name": "unitoftime", "Size": 1000, "Capacity": 1000, "Hits": 5120, "Misses": 12, "Evictions": 2, "Expirations": 0}, ...]}
+func StatusHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(map[string]interface{}{
+		"PendingWrites": a.PendingWrites(),
+		"Connections":   a.ConnectionStats(),
+		"FlaggedTags":   a.FlaggedTags(),
+		"Caches":        a.CacheStats(),
+	})
+}
+
 // Receives POST request which contains metadata query. Subscribes the
 // requester to readings from streams which match that metadata query
 func RepublishHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -282,6 +311,30 @@ func TagsHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request
 	rw.Write(res)
 }
 
+/**
+ * Returns the changes made to the metadata of a uuid, oldest first
+**/
+func HistoryHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	uuid := ps.ByName("uuid")
+	rw.Header().Set("Content-Type", "application/json")
+	changes, err := a.MetadataHistory(uuid)
+	if err != nil {
+		log.Error("Error fetching metadata history: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	res, err := json.Marshal(changes)
+	if err != nil {
+		log.Error("Error converting to json: %v", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(200)
+	rw.Write(res)
+}
+
 func unescape(s string) string {
 	return strings.Replace(s, "%3D", "=", -1)
 }
@@ -37,6 +37,7 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"time"
 )
 
 const (
@@ -95,7 +96,9 @@ func HandleUDP(a *archiver.Archiver, port int) {
 
 func handleUDPConn(a *archiver.Archiver, buf []byte) {
 	_, decoded := msgpack.Decode(&buf, 0)
-	AddReadings(a, decoded.(map[string]interface{}))
+	if err := AddReadings(a, decoded.(map[string]interface{})); err != nil {
+		log.Warning("Dropping readings: %v", err)
+	}
 }
 
 // How do we efficiently handle lots of packets on a single connection?
@@ -139,7 +142,7 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 				offset = leftover
 			}
 			_, decoded := msgpack.Decode(&dec, 0)
-			AddReadings(a, decoded.(map[string]interface{}))
+			addReadingsWithBackoff(a, decoded.(map[string]interface{}))
 			old = old[:cap(old)]
 			readalready = 0
 			leftover = 0
@@ -165,7 +168,7 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 				packetlength -= 3
 				if offset+packetlength <= BUFFER_SIZE { // still have room
 					newoffset, decoded := msgpack.Decode(&buf, offset)
-					AddReadings(a, decoded.(map[string]interface{}))
+					addReadingsWithBackoff(a, decoded.(map[string]interface{}))
 					offset = newoffset
 				} else { // not enough!
 					copy(old, buf[offset:])
@@ -178,8 +181,28 @@ func handleConn(a *archiver.Archiver, conn net.Conn) {
 	}
 }
 
+// Adds the readings, retrying for as long as the archiver is overloaded. The
+// connection is not read from while we wait, so TCP flow control slows the
+// client down to what the archiver can keep up with
+func addReadingsWithBackoff(a *archiver.Archiver, md map[string]interface{}) {
+	wait := 10 * time.Millisecond
+	for {
+		err := AddReadings(a, md)
+		if err != archiver.ErrOverloaded {
+			if err != nil {
+				log.Error("Error adding readings: %v", err)
+			}
+			return
+		}
+		time.Sleep(wait)
+		if wait < time.Second {
+			wait *= 2
+		}
+	}
+}
+
 //TODO: check for malformed
-func AddReadings(a *archiver.Archiver, md map[string]interface{}) {
+func AddReadings(a *archiver.Archiver, md map[string]interface{}) error {
 	ret := map[string]*archiver.SmapMessage{}
 	sm := &archiver.SmapMessage{Path: md["Path"].(string),
 		UUID:     md["uuid"].(string),
@@ -199,5 +222,5 @@ func AddReadings(a *archiver.Archiver, md map[string]interface{}) {
 		}
 	}
 	ret[sm.Path] = sm
-	a.AddData(ret, md["key"].(string))
+	return a.AddData(ret, md["key"].(string))
 }
@@ -40,6 +40,8 @@ func Handle(a *archiver.Archiver, port int) {
 	r.GET("/republish/data", curryhandler(a, RepublishHandler))
 	r.GET("/republish/uuids", curryhandler(a, UUIDRepublishHandler))
 	r.GET("/republish/query", curryhandler(a, QueryRepublishHandler))
+	r.GET("/api/query", curryhandler(a, WsQueryHandler))
+	r.GET("/api/query/:key", curryhandler(a, WsQueryHandler))
 
 	go m.start()
 
@@ -150,14 +152,38 @@ func WsTagsHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Reque
 	log.Debug("got uuid %v", uuid, ws)
 }
 
+// Evaluates each message received on the WebSocket as a query and sends back
+// the results as JSON, the same as the HTTP /api/query interface. Data query
+// results carry a Status (and Error) for each stream. If the query fails, the
+// server sends back {"error": "..."} and keeps the connection open. Queries
+// that change metadata (set, delete) need the API key in the URL
+// (/api/query/<key>).
 func WsQueryHandler(a *archiver.Archiver, rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	ws, err := upgrader.Upgrade(rw, req, nil)
 	if err != nil {
 		log.Error("Error: %v", err)
 		return
 	}
-	msgtype, msg, err := ws.ReadMessage()
-	log.Debug("msgtype: %v, msg: %v, err: %v", msgtype, msg, err)
+	defer ws.Close()
+	apikey := unescape(ps.ByName("key"))
+	for {
+		msgtype, msg, err := ws.ReadMessage()
+		if err != nil {
+			log.Debug("Closing query websocket: %v", err)
+			return
+		}
+		log.Debug("msgtype: %v, msg: %v", msgtype, msg)
+		res, err := a.HandleQuery(string(msg), apikey)
+		if err != nil {
+			err = ws.WriteJSON(map[string]string{"error": err.Error()})
+		} else {
+			err = ws.WriteJSON(res)
+		}
+		if err != nil {
+			log.Error("Error sending query results: %v", err)
+			return
+		}
+	}
 }
 
 func unescape(s string) string {